@@ -0,0 +1,345 @@
+// Package client provides a client for the HTTP API of the server.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// State represents the state of a key at a point in time.
+type State uint8
+
+const (
+	Inactive State = 0
+	Active   State = 1
+	Unknown  State = 2
+)
+
+// validKey matches the keys that can be sent to the server, which validates them
+// using its configurable key pattern.
+var validKey = regexp.MustCompile(`^[^\s#*()]+$`)
+
+// An Error is an error response of the server. Reason holds the machine-readable
+// error code of the response (e.g. "key_not_found" or "invalid_range").
+type Error struct {
+	Code    int
+	Reason  string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+// A Client sends requests to a server. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+// An Option configures a Client.
+type Option func(*Client)
+
+// WithToken sets the bearer token sent with requests.
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithHTTPClient sets the HTTP client used to send requests, a client with a 30
+// seconds timeout being used by default.
+func WithHTTPClient(h *http.Client) Option {
+	return func(c *Client) { c.httpClient = h }
+}
+
+// New returns a client sending requests to the server at baseURL (e.g.
+// "http://127.0.0.1:8080").
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("base url is not valid")
+	}
+	c := &Client{baseURL: strings.TrimSuffix(baseURL, "/"), httpClient: &http.Client{Timeout: 30 * time.Second}}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// A Statement sets the state of a key at a point in time. If Time is zero, the
+// current time of the server is used. If Duration is set, the state is set from
+// Time for Duration, rounded up to a whole number of values; Time must be set.
+type Statement struct {
+	Key      string
+	State    State
+	Time     time.Time
+	Duration time.Duration
+}
+
+// An InsertResult reports the number of statements executed by the server, the
+// number of statements skipped because they duplicate recorded values and the
+// statements it rejected.
+type InsertResult struct {
+	Processed  int
+	Duplicates int
+	Total      int
+	Rejected   []Rejection
+}
+
+// A Rejection describes a statement rejected by the server, Line being the line
+// number of the statement in the request.
+type Rejection struct {
+	Line    int    `json:"line"`
+	Content string `json:"content"`
+	Reason  string `json:"reason"`
+}
+
+// A Row is an aggregated group of values, Mean being the ratio of active values
+// among the Count known values of the group, or nil if there are none.
+type Row struct {
+	Time  time.Time `json:"time"`
+	Count int64     `json:"count"`
+	Mean  *float64  `json:"mean"`
+}
+
+// Insert sets the state of key at ts, or at the current time of the server if ts
+// is zero.
+func (c *Client) Insert(ctx context.Context, key string, state State, ts time.Time) error {
+	result, err := c.InsertBatch(ctx, []Statement{{Key: key, State: state, Time: ts}})
+	if err != nil {
+		return err
+	}
+	if result.Processed+result.Duplicates != result.Total {
+		return errors.New("statement was not executed")
+	}
+	return nil
+}
+
+// InsertBatch sends statements in a single request. Statements rejected by the
+// server (e.g. values older than the last value of a key) are not reported as
+// an error, the result holding the number of statements executed. Statements
+// whose value has already been recorded, e.g. when a request is sent again after
+// a timeout, are counted as duplicates rather than rejected.
+func (c *Client) InsertBatch(ctx context.Context, statements []Statement) (InsertResult, error) {
+	body, err := encodeStatements(statements)
+	if err != nil {
+		return InsertResult{}, err
+	}
+	return c.insert(ctx, body)
+}
+
+// insert sends statements encoded using the line protocol.
+func (c *Client) insert(ctx context.Context, body []byte) (InsertResult, error) {
+	var result InsertResult
+	query := url.Values{"verbose": {"1"}, "duplicates": {"skip"}}
+	resp, err := c.do(ctx, http.MethodPost, "/insert/", query, body)
+	if err != nil {
+		return result, err
+	}
+	if _, err := fmt.Sscanf(resp.Message, "processed %d/%d", &result.Processed, &result.Total); err != nil {
+		return result, fmt.Errorf("error decoding response: %s", err)
+	}
+	if i := strings.Index(resp.Message, ", "); i != -1 {
+		if _, err := fmt.Sscanf(resp.Message[i+2:], "%d duplicate(s)", &result.Duplicates); err != nil {
+			return result, fmt.Errorf("error decoding response: %s", err)
+		}
+	}
+	if len(resp.Data) > 0 {
+		if err := json.Unmarshal(resp.Data, &result.Rejected); err != nil {
+			return result, fmt.Errorf("error decoding response: %s", err)
+		}
+	}
+	return result, nil
+}
+
+func (s Statement) validate() error {
+	if !validKey.MatchString(s.Key) {
+		return fmt.Errorf("key %q is not valid", s.Key)
+	}
+	if s.State > Unknown {
+		return fmt.Errorf("state %d is not valid", s.State)
+	}
+	if s.Duration != 0 && (s.Time.IsZero() || s.Duration < time.Second) {
+		return fmt.Errorf("duration of key %q is not valid", s.Key)
+	}
+	return nil
+}
+
+// encodeStatements encodes statements using the line protocol of the server.
+func encodeStatements(statements []Statement) ([]byte, error) {
+	var buf bytes.Buffer
+	for i, v := range statements {
+		if err := v.validate(); err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(v.Key)
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.Itoa(int(v.State)))
+		if !v.Time.IsZero() {
+			buf.WriteByte(' ')
+			buf.WriteString(strconv.FormatInt(v.Time.Unix(), 10))
+		}
+		if v.Duration != 0 {
+			buf.WriteByte(' ')
+			buf.WriteString(strconv.FormatInt(int64((v.Duration+time.Second-1)/time.Second), 10))
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// A QueryOption configures a query.
+type QueryOption func(url.Values)
+
+// ExcludeMaintenance ignores values recorded during maintenance windows of keys.
+func ExcludeMaintenance() QueryOption {
+	return func(v url.Values) { v.Set("maintenance", "exclude") }
+}
+
+// Query returns the values of key between start and end grouped using the interval
+// selected by the server.
+func (c *Client) Query(ctx context.Context, key string, start, end time.Time, opts ...QueryOption) ([]Row, error) {
+	var rows []row
+	if err := c.query(ctx, key, start, end, opts, &rows); err != nil {
+		return nil, err
+	}
+	return convertRows(rows), nil
+}
+
+// QuerySubtree returns the values of the keys matching pattern, a subtree pattern
+// such as "eu.web.*", between start and end.
+func (c *Client) QuerySubtree(ctx context.Context, pattern string, start, end time.Time, opts ...QueryOption) (map[string][]Row, error) {
+	var m map[string][]row
+	if err := c.query(ctx, pattern, start, end, opts, &m); err != nil {
+		return nil, err
+	}
+	result := make(map[string][]Row, len(m))
+	for k, v := range m {
+		result[k] = convertRows(v)
+	}
+	return result, nil
+}
+
+// row represents a row of query results as returned by the server.
+type row struct {
+	Date  int64    `json:"date"`
+	Count int64    `json:"count"`
+	Mean  *float64 `json:"mean"`
+}
+
+func convertRows(rows []row) []Row {
+	result := make([]Row, len(rows))
+	for i, v := range rows {
+		result[i] = Row{Time: time.Unix(v.Date, 0), Count: v.Count, Mean: v.Mean}
+	}
+	return result
+}
+
+func (c *Client) query(ctx context.Context, key string, start, end time.Time, opts []QueryOption, v any) error {
+	query := url.Values{}
+	query.Set("key", key)
+	query.Set("start", strconv.FormatInt(start.Unix(), 10))
+	query.Set("end", strconv.FormatInt(end.Unix(), 10))
+	for _, opt := range opts {
+		opt(query)
+	}
+	resp, err := c.do(ctx, http.MethodGet, "/query/", query, nil)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(resp.Data, v); err != nil {
+		return fmt.Errorf("error decoding response: %s", err)
+	}
+	return nil
+}
+
+// Keys returns the sorted keys matching pattern, a key or a subtree pattern, all
+// keys being returned if pattern is empty.
+func (c *Client) Keys(ctx context.Context, pattern string) ([]string, error) {
+	query := url.Values{}
+	if pattern != "" {
+		query.Set("key", pattern)
+	}
+	resp, err := c.do(ctx, http.MethodGet, "/keys/", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	if err := json.Unmarshal(resp.Data, &keys); err != nil {
+		return nil, fmt.Errorf("error decoding response: %s", err)
+	}
+	return keys, nil
+}
+
+// Delete deletes the keys matching pattern, a key or a subtree pattern, returning
+// the number of keys deleted.
+func (c *Client) Delete(ctx context.Context, pattern string) (int, error) {
+	if pattern == "" {
+		return 0, errors.New("missing key")
+	}
+	query := url.Values{}
+	query.Set("key", pattern)
+	resp, err := c.do(ctx, http.MethodDelete, "/keys/", query, nil)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	if _, err := fmt.Sscanf(resp.Message, "%d", &n); err != nil {
+		return 0, fmt.Errorf("error decoding response: %s", err)
+	}
+	return n, nil
+}
+
+// response represents a response of the server.
+type response struct {
+	Code    int             `json:"code"`
+	Status  string          `json:"status"`
+	Message string          `json:"message"`
+	Error   string          `json:"error"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// do sends a request to the server, returning the decoded response. It returns an
+// *Error if the server does not answer with a 200 status code.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body []byte) (response, error) {
+	var x response
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return x, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return x, err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&x); err != nil {
+		return x, fmt.Errorf("error decoding response (status %s)", resp.Status)
+	}
+	if x.Code != http.StatusOK {
+		return x, &Error{Code: x.Code, Reason: x.Error, Message: x.Message}
+	}
+	return x, nil
+}
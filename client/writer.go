@@ -0,0 +1,343 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrBufferFull is returned by Writer.Write when the buffer of the writer is full.
+	ErrBufferFull = errors.New("buffer is full")
+	// ErrClosed is returned when using a closed Writer.
+	ErrClosed = errors.New("writer is closed")
+)
+
+// WriterOptions configures a Writer. Zero values select the defaults.
+type WriterOptions struct {
+	// BatchSize is the number of buffered statements triggering a flush and the
+	// maximum number of statements sent per request (default 1000).
+	BatchSize int
+	// FlushInterval is the interval between periodic flushes (default 10s).
+	FlushInterval time.Duration
+	// MaxBuffer is the maximum number of buffered statements (default 100000).
+	MaxBuffer int
+	// MaxRetries is the number of times a batch is resent after a failure
+	// (default 5, -1 to disable retries).
+	MaxRetries int
+	// RetryInterval is the delay before the first retry, doubling on each retry
+	// up to MaxRetryInterval (defaults 1s and 1m).
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+	// SpoolDir, if set, is the directory where batches that cannot be sent are
+	// written, to be sent once the server can be reached again, including after a
+	// restart of the process.
+	SpoolDir string
+	// OnError, if set, is called with the errors of the writer, e.g. batches that
+	// are dropped. It is called from the goroutine of the writer.
+	OnError func(error)
+}
+
+// A Writer buffers statements and sends them in batches in the background, when
+// the buffer reaches the batch size and at regular intervals, retrying failed
+// batches with exponential backoff. Batches are sent in order, so that values of
+// a key are inserted in chronological order. It is safe for concurrent use.
+type Writer struct {
+	c       *Client
+	opts    WriterOptions
+	mu      sync.Mutex
+	buf     []Statement
+	closed  bool
+	err     error // error of the last flush, returned by Close
+	wake    chan struct{}
+	flushes chan chan error
+	stop    chan struct{}
+	stopped chan struct{}
+	ctx     context.Context // canceled when closing times out
+	cancel  context.CancelFunc
+}
+
+// NewWriter returns a writer sending statements using c. The writer must be closed
+// to send the remaining statements and release its resources.
+func (c *Client) NewWriter(opts WriterOptions) (*Writer, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 10 * time.Second
+	}
+	if opts.MaxBuffer <= 0 {
+		opts.MaxBuffer = 100000
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = 5
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = time.Second
+	}
+	if opts.MaxRetryInterval <= 0 {
+		opts.MaxRetryInterval = time.Minute
+	}
+	if opts.SpoolDir != "" {
+		if err := os.MkdirAll(opts.SpoolDir, 0750); err != nil {
+			return nil, err
+		}
+	}
+	w := &Writer{
+		c:       c,
+		opts:    opts,
+		wake:    make(chan struct{}, 1),
+		flushes: make(chan chan error),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	go w.run()
+	return w, nil
+}
+
+// Write adds statements to the buffer of the writer. Statements without time are
+// set to the current time, as they may be sent later. It returns ErrBufferFull,
+// without adding any statement, if the buffer cannot hold statements.
+func (w *Writer) Write(statements ...Statement) error {
+	now := time.Now()
+	for i := range statements {
+		if err := statements[i].validate(); err != nil {
+			return err
+		}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	if len(w.buf)+len(statements) > w.opts.MaxBuffer {
+		return ErrBufferFull
+	}
+	for _, v := range statements {
+		if v.Time.IsZero() {
+			v.Time = now
+		}
+		w.buf = append(w.buf, v)
+	}
+	if len(w.buf) >= w.opts.BatchSize {
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Flush sends the buffered statements, returning the last error encountered.
+func (w *Writer) Flush(ctx context.Context) error {
+	reply := make(chan error, 1)
+	select {
+	case w.flushes <- reply:
+	case <-w.stopped:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-reply:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close sends the buffered statements and stops the writer. If ctx is done before
+// statements are sent, pending requests are canceled and the remaining statements
+// are spooled if a spool directory is set, dropped otherwise.
+func (w *Writer) Close(ctx context.Context) error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return ErrClosed
+	}
+	w.closed = true
+	w.mu.Unlock()
+	close(w.stop)
+	select {
+	case <-w.stopped:
+	case <-ctx.Done():
+		w.cancel()
+		<-w.stopped
+		return ctx.Err()
+	}
+	w.cancel()
+	return w.err
+}
+
+func (w *Writer) run() {
+	defer close(w.stopped)
+	ticker := time.NewTicker(w.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.flush()
+		case <-w.wake:
+			w.flush()
+		case reply := <-w.flushes:
+			reply <- w.flush()
+		case <-w.stop:
+			w.err = w.flush()
+			return
+		}
+	}
+}
+
+// flush sends the spooled batches, then the buffered statements by batches,
+// returning the last error encountered. Batches are spooled as long as spooled
+// batches remain, so that batches are sent in order.
+func (w *Writer) flush() error {
+	var last error
+	report := func(err error) {
+		last = err
+		if w.opts.OnError != nil {
+			w.opts.OnError(err)
+		}
+	}
+	spooled, err := w.drainSpool()
+	if err != nil {
+		report(err)
+	}
+	for {
+		w.mu.Lock()
+		n := len(w.buf)
+		if n > w.opts.BatchSize {
+			n = w.opts.BatchSize
+		}
+		batch := make([]Statement, n)
+		copy(batch, w.buf)
+		w.buf = w.buf[n:]
+		w.mu.Unlock()
+		if n == 0 {
+			return last
+		}
+
+		if spooled == 0 {
+			err := w.send(batch)
+			if err == nil {
+				continue
+			}
+			if !retryable(err) || w.opts.SpoolDir == "" {
+				report(fmt.Errorf("dropping %d statement(s): %w", len(batch), err))
+				continue
+			}
+			report(fmt.Errorf("spooling %d statement(s): %w", len(batch), err))
+		}
+		if err := w.spool(batch); err != nil {
+			report(fmt.Errorf("dropping %d statement(s): %w", len(batch), err))
+			continue
+		}
+		spooled++
+	}
+}
+
+// send sends batch, retrying with exponential backoff on retryable errors.
+func (w *Writer) send(batch []Statement) error {
+	body, err := encodeStatements(batch)
+	if err != nil {
+		return err
+	}
+	delay := w.opts.RetryInterval
+	for attempt := 0; ; attempt++ {
+		_, err := w.c.insert(w.ctx, body)
+		if err == nil || !retryable(err) || attempt >= w.opts.MaxRetries || w.ctx.Err() != nil {
+			return err
+		}
+		select {
+		case <-time.After(delay):
+		case <-w.ctx.Done():
+			return err
+		}
+		if delay *= 2; delay > w.opts.MaxRetryInterval {
+			delay = w.opts.MaxRetryInterval
+		}
+	}
+}
+
+// retryable reports whether a request failing with err may succeed if resent.
+// Statements rejected by the server are not reported as errors, so that batches
+// are never partially resent.
+func retryable(err error) bool {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code == http.StatusTooManyRequests || e.Code >= 500
+	}
+	return true
+}
+
+// spool writes batch to a new file of the spool directory, files being named
+// after the time they are created so that they are sent in order.
+func (w *Writer) spool(batch []Statement) error {
+	if w.opts.SpoolDir == "" {
+		return errors.New("spooling is disabled")
+	}
+	body, err := encodeStatements(batch)
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(w.opts.SpoolDir, fmt.Sprintf("%020d.spool", time.Now().UnixNano()))
+	if err := os.WriteFile(name+".tmp", body, 0640); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// spoolFiles returns the sorted names of the files of the spool directory.
+func (w *Writer) spoolFiles() ([]string, error) {
+	if w.opts.SpoolDir == "" {
+		return nil, nil
+	}
+	files, err := filepath.Glob(filepath.Join(w.opts.SpoolDir, "*.spool"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// drainSpool sends the spooled batches in order, stopping at the first batch that
+// cannot be sent, and returns the number of batches remaining. Batches rejected
+// by the server are dropped.
+func (w *Writer) drainSpool() (int, error) {
+	files, err := w.spoolFiles()
+	if err != nil {
+		return 0, err
+	}
+	for i, f := range files {
+		body, err := os.ReadFile(f)
+		if err != nil {
+			return len(files) - i, err
+		}
+		if _, err := w.c.insert(w.ctx, body); err != nil && retryable(err) {
+			return len(files) - i, fmt.Errorf("sending spooled statements: %w", err)
+		} else if err != nil {
+			err = fmt.Errorf("dropping spooled statements of %s: %w", filepath.Base(f), err)
+			if w.opts.OnError != nil {
+				w.opts.OnError(err)
+			}
+		}
+		if err := os.Remove(f); err != nil {
+			return len(files) - i, err
+		}
+	}
+	return 0, nil
+}
+
+// Buffered returns the number of buffered statements.
+func (w *Writer) Buffered() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.buf)
+}
@@ -0,0 +1,222 @@
+// Command bench generates synthetic insert and query traffic against a server,
+// reporting throughput and latency percentiles.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recorder collects the latencies and errors of requests of a kind.
+type recorder struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	errors    int
+}
+
+func (r *recorder) record(d time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.errors++
+		return
+	}
+	r.latencies = append(r.latencies, d)
+}
+
+// report writes the number of requests, errors, throughput and latency percentiles
+// of the requests recorded during elapsed.
+func (r *recorder) report(w io.Writer, name string, elapsed time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := len(r.latencies)
+	fmt.Fprintf(w, "%s: %d request(s), %d error(s), %.1f req/s\n", name, n+r.errors, r.errors, float64(n)/elapsed.Seconds())
+	if n == 0 {
+		return
+	}
+	sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+	fmt.Fprintf(w, "  p50 %s  p90 %s  p99 %s  max %s\n",
+		percentile(r.latencies, 50), percentile(r.latencies, 90), percentile(r.latencies, 99), percentile(r.latencies, 100))
+}
+
+// percentile returns the p-th percentile of sorted using the nearest-rank method.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := (len(sorted)*p + 99) / 100
+	if i < 1 {
+		i = 1
+	}
+	return sorted[i-1].Round(time.Microsecond)
+}
+
+type bench struct {
+	server string
+	token  string
+	keys   []string
+	batch  int
+	up     float64
+	window time.Duration
+	client *http.Client
+}
+
+func main() {
+	var b bench
+	var numberOfKeys, workers int
+	var insertRate, queryRate float64
+	var duration time.Duration
+	var prefix string
+	flag.StringVar(&b.server, "s", "http://127.0.0.1:8080", "Server base URL")
+	flag.StringVar(&b.token, "t", "", "Bearer token")
+	flag.IntVar(&numberOfKeys, "k", 1000, "Number of synthetic keys")
+	flag.StringVar(&prefix, "prefix", "bench.", "Prefix of synthetic keys")
+	flag.IntVar(&b.batch, "b", 100, "Number of statements per insert request")
+	flag.Float64Var(&b.up, "up", 0.99, "Probability of inserting an active value")
+	flag.Float64Var(&insertRate, "ir", 10, "Insert requests per second (0 to disable)")
+	flag.Float64Var(&queryRate, "qr", 5, "Query requests per second (0 to disable)")
+	flag.DurationVar(&b.window, "w", time.Hour, "Time range of queries, ending at the current time")
+	flag.DurationVar(&duration, "d", 30*time.Second, "Duration of the benchmark")
+	flag.IntVar(&workers, "c", 16, "Maximum number of concurrent requests")
+	flag.Parse()
+
+	if numberOfKeys < 1 || b.batch < 1 || workers < 1 || insertRate < 0 || queryRate < 0 {
+		log.Fatal("invalid arguments")
+	}
+
+	b.client = &http.Client{Timeout: 30 * time.Second}
+	b.keys = make([]string, numberOfKeys)
+	for i := range b.keys {
+		b.keys[i] = fmt.Sprintf("%s%06d", prefix, i)
+	}
+
+	var inserts, queries recorder
+	jobs := make(chan func())
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				job()
+			}
+		}()
+	}
+
+	log.Printf("running benchmark for %s (%d key(s), %.1f insert(s)/s of %d statement(s), %.1f query/s)", duration, numberOfKeys, insertRate, b.batch, queryRate)
+	start := time.Now()
+	var pacers sync.WaitGroup
+	pace(&pacers, jobs, insertRate, start.Add(duration), func() { b.timed(&inserts, b.insert) })
+	pace(&pacers, jobs, queryRate, start.Add(duration), func() { b.timed(&queries, b.query) })
+	pacers.Wait()
+	close(jobs)
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	inserts.report(os.Stdout, "insert", elapsed)
+	queries.report(os.Stdout, "query", elapsed)
+}
+
+// pace submits job to jobs rate times per second until deadline. Jobs are dropped
+// when all workers are busy, so that a slow server does not shift the schedule.
+func pace(wg *sync.WaitGroup, jobs chan<- func(), rate float64, deadline time.Time, job func()) {
+	if rate == 0 {
+		return
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		var dropped int
+		for {
+			select {
+			case <-timer.C:
+				if dropped > 0 {
+					log.Printf("%d request(s) not sent, all workers being busy", dropped)
+				}
+				return
+			case <-ticker.C:
+				select {
+				case jobs <- job:
+				default:
+					dropped++
+				}
+			}
+		}
+	}()
+}
+
+func (b *bench) timed(r *recorder, f func() error) {
+	t := time.Now()
+	err := f()
+	r.record(time.Since(t), err)
+}
+
+// insert sends a batch of statements on random keys at the current time.
+func (b *bench) insert() error {
+	var buf bytes.Buffer
+	for i := 0; i < b.batch; i++ {
+		if i > 0 {
+			buf.WriteByte('\n')
+		}
+		state := 0
+		if rand.Float64() < b.up {
+			state = 1
+		}
+		fmt.Fprintf(&buf, "%s %d", b.keys[rand.Intn(len(b.keys))], state)
+	}
+	return b.do(http.MethodPost, "/insert/", &buf)
+}
+
+// query queries a random key over the query window.
+func (b *bench) query() error {
+	now := time.Now()
+	q := url.Values{}
+	q.Set("key", b.keys[rand.Intn(len(b.keys))])
+	q.Set("start", strconv.FormatInt(now.Add(-b.window).Unix(), 10))
+	q.Set("end", strconv.FormatInt(now.Unix(), 10))
+	return b.do(http.MethodGet, "/query/?"+q.Encode(), nil)
+}
+
+// do sends a request to the server, returning an error unless the server answers
+// with a 200 status code. Queries on keys without values yet are not errors.
+func (b *bench) do(method, path string, body io.Reader) error {
+	req, err := http.NewRequest(method, strings.TrimSuffix(b.server, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	if b.token != "" {
+		req.Header.Set("Authorization", "Bearer "+b.token)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var x struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&x); err != nil {
+		return err
+	}
+	if x.Code != http.StatusOK && x.Error != "key_not_found" {
+		return errors.New(x.Message)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"run-length-example/client"
+)
+
+// states maps the names accepted by insert to states.
+var states = map[string]client.State{
+	"0": client.Inactive, "inactive": client.Inactive, "down": client.Inactive,
+	"1": client.Active, "active": client.Active, "up": client.Active,
+	"2": client.Unknown, "unknown": client.Unknown,
+}
+
+// runInsert inserts key / state pairs given as arguments or, using -f, read from
+// a file holding one "key state [time]" statement per line.
+func runInsert(args []string) error {
+	fs, o := newFlagSet("insert", "[key state]...")
+	at := fs.String("at", "", "Time of the values given as arguments (default current time)")
+	file := fs.String("f", "", `File of "key state [time]" lines to insert ("-" for standard input)`)
+	fs.Parse(args)
+
+	if (fs.NArg() == 0 && *file == "") || fs.NArg()%2 != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	now := time.Now()
+	var statements []client.Statement
+	add := func(key, state, t string) error {
+		v, ok := states[strings.ToLower(state)]
+		if !ok {
+			return fmt.Errorf("state %q is not valid", state)
+		}
+		x := client.Statement{Key: key, State: v}
+		if t != "" {
+			ts, err := parseTime(t, now)
+			if err != nil {
+				return err
+			}
+			x.Time = ts
+		}
+		statements = append(statements, x)
+		return nil
+	}
+
+	for i := 0; i < fs.NArg(); i += 2 {
+		if err := add(fs.Arg(i), fs.Arg(i+1), *at); err != nil {
+			return err
+		}
+	}
+
+	if *file != "" {
+		var r io.Reader = os.Stdin
+		if *file != "-" {
+			f, err := os.Open(*file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		scanner := bufio.NewScanner(r)
+		var line int
+		for scanner.Scan() {
+			line++
+			fields := strings.SplitN(strings.TrimSpace(scanner.Text()), " ", 3)
+			if len(fields) == 1 && fields[0] == "" {
+				continue
+			}
+			if len(fields) < 2 {
+				return fmt.Errorf("line %d: expected key state [time]", line)
+			}
+			var t string
+			if len(fields) == 3 {
+				t = strings.TrimSpace(fields[2])
+			}
+			if err := add(fields[0], fields[1], t); err != nil {
+				return fmt.Errorf("line %d: %s", line, err)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	c, err := o.client()
+	if err != nil {
+		return err
+	}
+	result, err := c.InsertBatch(context.Background(), statements)
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return writeJSON(result)
+	}
+	fmt.Printf("processed %d/%d statement(s), %d duplicate(s)\n", result.Processed, result.Total, result.Duplicates)
+	for _, v := range result.Rejected {
+		fmt.Printf("line %d: %s: %s\n", v.Line, v.Reason, v.Content)
+	}
+	if result.Processed+result.Duplicates != result.Total {
+		os.Exit(1)
+	}
+	return nil
+}
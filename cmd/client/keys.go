@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// runKeys lists the keys matching a key or subtree pattern, all keys by default.
+func runKeys(args []string) error {
+	fs, o := newFlagSet("keys", "[pattern]")
+	fs.Parse(args)
+
+	if fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	c, err := o.client()
+	if err != nil {
+		return err
+	}
+	keys, err := c.Keys(context.Background(), fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return writeJSON(keys)
+	}
+	for _, k := range keys {
+		fmt.Println(k)
+	}
+	return nil
+}
+
+// runDelete deletes the keys matching a key or subtree pattern.
+func runDelete(args []string) error {
+	fs, o := newFlagSet("delete", "pattern")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	c, err := o.client()
+	if err != nil {
+		return err
+	}
+	n, err := c.Delete(context.Background(), fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return writeJSON(n)
+	}
+	fmt.Printf("%d key(s) deleted\n", n)
+	return nil
+}
+
+// isSubtree reports whether pattern addresses a subtree of keys, i.e. "*" or a key
+// prefix ending with a hierarchy separator followed by "*" (e.g. "eu.web.*").
+func isSubtree(pattern string) bool {
+	if pattern == "*" {
+		return true
+	}
+	return strings.HasSuffix(pattern, ".*") || strings.HasSuffix(pattern, "/*")
+}
+
+// writeJSON writes v as indented JSON to the standard output.
+func writeJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,77 @@
+// Command client talks to the HTTP API of the server.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"run-length-example/client"
+)
+
+// commands maps subcommand names to their implementation, each receiving the
+// arguments following the name.
+var commands = map[string]func(args []string) error{
+	"insert": runInsert,
+	"query":  runQuery,
+	"keys":   runKeys,
+	"delete": runDelete,
+}
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		usage()
+	}
+	run, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+	if err := run(os.Args[2:]); err != nil {
+		log.Fatalf("%s: %s", os.Args[1], err)
+	}
+}
+
+func usage() {
+	var names []string
+	for k := range commands {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [arguments]\n\nCommands: %s\n", os.Args[0], strings.Join(names, ", "))
+	os.Exit(2)
+}
+
+// options holds the flags shared by commands.
+type options struct {
+	server string
+	token  string
+	json   bool
+}
+
+// newFlagSet returns a flag set for the command name registering the shared flags,
+// which default to the RL_SERVER and RL_TOKEN environment variables if set.
+func newFlagSet(name, arguments string) (*flag.FlagSet, *options) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	o := &options{}
+	server := os.Getenv("RL_SERVER")
+	if server == "" {
+		server = "http://127.0.0.1:8080"
+	}
+	fs.StringVar(&o.server, "s", server, "Server base URL (RL_SERVER)")
+	fs.StringVar(&o.token, "t", os.Getenv("RL_TOKEN"), "Bearer token (RL_TOKEN)")
+	fs.BoolVar(&o.json, "json", false, "Write JSON output instead of a table")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [flags] %s\n", os.Args[0], name, arguments)
+		fs.PrintDefaults()
+	}
+	return fs, o
+}
+
+// client returns a client for the server set by the shared flags.
+func (o *options) client() (*client.Client, error) {
+	return client.New(o.server, client.WithToken(o.token))
+}
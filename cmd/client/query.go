@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"run-length-example/client"
+)
+
+// runQuery queries a key or subtree over a time range.
+func runQuery(args []string) error {
+	fs, o := newFlagSet("query", "key")
+	start := fs.String("start", "-24h", "Start of the range")
+	end := fs.String("end", "now", "End of the range")
+	exclude := fs.Bool("exclude-maintenance", false, "Ignore values recorded during maintenance windows")
+	utc := fs.Bool("utc", false, "Write dates in UTC instead of local time")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	now := time.Now()
+	x, err := parseTime(*start, now)
+	if err != nil {
+		return err
+	}
+	y, err := parseTime(*end, now)
+	if err != nil {
+		return err
+	}
+
+	c, err := o.client()
+	if err != nil {
+		return err
+	}
+	var opts []client.QueryOption
+	if *exclude {
+		opts = append(opts, client.ExcludeMaintenance())
+	}
+	results := make(map[string][]client.Row)
+	if isSubtree(fs.Arg(0)) {
+		results, err = c.QuerySubtree(context.Background(), fs.Arg(0), x, y, opts...)
+	} else {
+		results[fs.Arg(0)], err = c.Query(context.Background(), fs.Arg(0), x, y, opts...)
+	}
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return writeJSON(results)
+	}
+
+	keys := make([]string, 0, len(results))
+	for k := range results {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	loc := time.Local
+	if *utc {
+		loc = time.UTC
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tDATE\tCOUNT\tMEAN")
+	for _, k := range keys {
+		for _, v := range results[k] {
+			mean := "-"
+			if v.Mean != nil {
+				mean = strconv.FormatFloat(*v.Mean, 'f', 2, 64)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", k, v.Time.In(loc).Format("2006-01-02 15:04:05"), v.Count, mean)
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeLayouts lists the layouts accepted by parseTime, in local time unless the
+// layout includes a time zone.
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// parseTime parses s as "now", a Unix time, a time relative to now (e.g. "-2h",
+// "-7d") or a date using one of timeLayouts.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if s == "now" {
+		return now, nil
+	}
+	if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(v, 0), nil
+	}
+	if strings.HasPrefix(s, "-") || strings.HasPrefix(s, "+") {
+		if days, ok := strings.CutSuffix(s, "d"); ok {
+			if v, err := strconv.Atoi(days); err == nil {
+				return now.AddDate(0, 0, v), nil
+			}
+		} else if d, err := time.ParseDuration(s); err == nil {
+			return now.Add(d), nil
+		}
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("error parsing time %q", s)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+const (
+	// internalKeySeparator separates a key from the suffix of the internal keys
+	// holding its gauge, counter or rollup bit sequences.
+	internalKeySeparator = "#"
+	rollupKeyInfix       = "#r"
+)
+
+// A retentionOverride defines the retention policy in days of the keys starting
+// with prefix.
+type retentionOverride struct {
+	prefix string
+	days   int
+}
+
+// retentionOverrides implements the flag.Value interface, parsing values formatted
+// as prefix=days.
+type retentionOverrides []retentionOverride
+
+func (r *retentionOverrides) String() string {
+	s := make([]string, len(*r))
+	for i, v := range *r {
+		s[i] = fmt.Sprintf("%s=%d", v.prefix, v.days)
+	}
+	return strings.Join(s, ",")
+}
+
+func (r *retentionOverrides) Set(value string) error {
+	p := strings.LastIndexByte(value, '=')
+	if p < 1 {
+		return errors.New("expected prefix=days")
+	}
+	days, err := strconv.Atoi(value[p+1:])
+	if err != nil {
+		return errors.New("expected prefix=days")
+	}
+	*r = append(*r, retentionOverride{prefix: value[:p], days: days})
+	return nil
+}
+
+// lookup returns the retention policy of key, using the longest matching prefix
+// or fallback if no override matches.
+func (r retentionOverrides) lookup(key string, fallback int) int {
+	days, n := fallback, -1
+	for _, v := range r {
+		if strings.HasPrefix(key, v.prefix) && len(v.prefix) > n {
+			days, n = v.days, len(v.prefix)
+		}
+	}
+	return days
+}
+
+// runCompact rewrites a dump file, dropping values older than the retention policy
+// of each key and sequences holding no known values.
+func runCompact(args []string) error {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	dumpFile := fs.String("f", "./store.dump", "Full path to dump file")
+	output := fs.String("o", "", "Full path to output dump file (default dump file)")
+	days := fs.Int("r", 0, "Retention policy in days (0 or less to disable)")
+	var overrides retentionOverrides
+	fs.Var(&overrides, "R", "Retention policy override in days for keys starting with a prefix, formatted as prefix=days (repeatable)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s compact [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *output == "" {
+		*output = *dumpFile
+	}
+
+	info, err := os.Stat(*dumpFile)
+	if err != nil {
+		return err
+	}
+	store, err := readDump(*dumpFile)
+	if err != nil {
+		return err
+	}
+
+	keys := store.Keys()
+	dropped := compact(store, keys, *days, overrides, time.Now())
+
+	buf, err := store.Dump()
+	if err != nil {
+		return err
+	}
+	if err := writeFile(*output, buf); err != nil {
+		return err
+	}
+	log.Printf("compacted %s into %s: %d/%d key(s) kept, %d -> %d bytes", *dumpFile, *output, len(keys)-dropped, len(keys), info.Size(), len(buf))
+	return nil
+}
+
+// compact drops the values of keys older than their retention policy at now, days
+// being the default policy, and deletes the sequences holding no known values,
+// returning the number of sequences deleted. Rollup sequences are not trimmed, as
+// they hold values downsampled by the server before values are dropped.
+func compact(store *sequence.Store, keys []string, days int, overrides retentionOverrides, now time.Time) int {
+	var dropped int
+	for _, k := range keys {
+		x, _ := store.Get(k)
+		name := k
+		if i := strings.Index(k, internalKeySeparator); i != -1 {
+			name = k[:i]
+		}
+		if d := overrides.lookup(name, days); d > 0 && !strings.Contains(k, rollupKeyInfix) {
+			x.TrimLeft(now.Add(-time.Duration(d) * 86400 * time.Second).Truncate(time.Duration(x.Frequency()) * time.Second))
+		}
+		if !hasKnownValues(x) {
+			store.Delete(k)
+			dropped++
+			continue
+		}
+		store.Add(k, x)
+	}
+	return dropped
+}
+
+func hasKnownValues(x *sequence.Sequence) bool {
+	for _, v := range x.All() {
+		if v != sequence.StateUnknown {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFile writes data to a temporary file renamed to f, so that f is left
+// unchanged if writing fails.
+func writeFile(f string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(f), filepath.Base(f)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0660); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f)
+}
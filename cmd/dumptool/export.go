@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// exportSeries represents the values of a key in JSON exports, either raw values
+// or the count and sum of valid and active values of each group.
+type exportSeries struct {
+	Timestamp int64   `json:"timestamp"`
+	Frequency int64   `json:"frequency"`
+	Values    []uint8 `json:"values,omitempty"`
+	Count     []int64 `json:"count,omitempty"`
+	Sum       []int64 `json:"sum,omitempty"`
+}
+
+// runExport extracts keys from a dump file into CSV or JSON, writing raw values or,
+// if an interval is given, values aggregated using the interval.
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	dumpFile := fs.String("f", "./store.dump", "Full path to dump file")
+	output := fs.String("o", "", "Full path to output file (default standard output)")
+	format := fs.String("format", "csv", "Output format (csv or json)")
+	start := fs.Int64("start", 0, "Start of the range as Unix time (default start of each sequence)")
+	end := fs.Int64("end", 0, "End of the range as Unix time (default end of each sequence)")
+	interval := fs.Int("interval", 0, "Grouping interval in seconds (0 to export raw values)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s export [flags] key...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *format != "csv" && *format != "json" {
+		return errors.New("format is not supported")
+	}
+	if *interval < 0 {
+		return errors.New("interval is not valid")
+	}
+
+	store, err := readDump(*dumpFile)
+	if err != nil {
+		return err
+	}
+	keys, err := matchKeys(store, fs.Args())
+	if err != nil {
+		return err
+	}
+
+	series := make([]exportSeries, len(keys))
+	for i, k := range keys {
+		x, _ := store.Get(k)
+		if series[i], err = export(x, *start, *end, *interval); err != nil {
+			return fmt.Errorf("error exporting key %s: %s", k, err)
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	if *format == "json" {
+		err = writeJSON(bw, keys, series)
+	} else {
+		err = writeCSV(bw, keys, series, *interval > 0)
+	}
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// export returns the values of x within the closed interval defined by start and
+// end, grouped using interval seconds if interval is greater than 0. A start or end
+// equal to 0 defaults to the start or end of x, the default start being aligned on
+// interval.
+func export(x *sequence.Sequence, start, end int64, interval int) (exportSeries, error) {
+	frequency := int64(x.Frequency())
+	if start == 0 {
+		start = x.Timestamp()
+		if interval > 0 {
+			start -= start % int64(interval)
+		}
+	}
+	if end == 0 {
+		end = x.Timestamp() + int64(len(x.All()))*frequency - 1
+	}
+	if start > end {
+		return exportSeries{}, errors.New("range is not valid")
+	}
+	if interval > 0 {
+		if int64(interval)%frequency != 0 {
+			return exportSeries{}, fmt.Errorf("interval must be a multiple of %d", frequency)
+		}
+		qs, err := x.Query(time.Unix(start, 0), time.Unix(end, 0), time.Duration(interval)*time.Second)
+		if err != nil {
+			return exportSeries{}, err
+		}
+		return exportSeries{Timestamp: qs.Timestamp, Frequency: qs.Frequency, Count: qs.Count, Sum: qs.Sum}, nil
+	}
+	values, ts, err := x.Values(time.Unix(start, 0), time.Unix(end, 0))
+	if err != nil {
+		// the range and the sequence don't overlap
+		return exportSeries{Timestamp: start, Frequency: frequency, Values: []uint8{}}, nil
+	}
+	return exportSeries{Timestamp: ts, Frequency: frequency, Values: values}, nil
+}
+
+func writeJSON(w io.Writer, keys []string, series []exportSeries) error {
+	m := make(map[string]exportSeries, len(keys))
+	for i, k := range keys {
+		m[k] = series[i]
+	}
+	enc := json.NewEncoder(w)
+	return enc.Encode(m)
+}
+
+// writeCSV writes one row per value or group, raw values being written as key,
+// timestamp, value and groups as key, timestamp, count, sum.
+func writeCSV(w io.Writer, keys []string, series []exportSeries, aggregated bool) error {
+	cw := csv.NewWriter(w)
+	header := []string{"key", "timestamp", "value"}
+	if aggregated {
+		header = []string{"key", "timestamp", "count", "sum"}
+	}
+	cw.Write(header)
+	for i, k := range keys {
+		x := series[i]
+		if aggregated {
+			for j := range x.Count {
+				t := x.Timestamp + int64(j)*x.Frequency
+				cw.Write([]string{k, strconv.FormatInt(t, 10), strconv.FormatInt(x.Count[j], 10), strconv.FormatInt(x.Sum[j], 10)})
+			}
+			continue
+		}
+		for j, v := range x.Values {
+			t := x.Timestamp + int64(j)*x.Frequency
+			cw.Write([]string{k, strconv.FormatInt(t, 10), strconv.Itoa(int(v))})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
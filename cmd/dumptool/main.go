@@ -0,0 +1,102 @@
+// Command dumptool works on dump files written by the server, without needing a
+// running server.
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// commands maps subcommand names to their implementation, each receiving the
+// arguments following the name.
+var commands = map[string]func(args []string) error{
+	"compact": runCompact,
+	"export":  runExport,
+	"merge":   runMerge,
+	"repair":  runRepair,
+	"verify":  runVerify,
+}
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		usage()
+	}
+	run, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+	if err := run(os.Args[2:]); err != nil {
+		log.Fatalf("%s: %s", os.Args[1], err)
+	}
+}
+
+func usage() {
+	var names []string
+	for k := range commands {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [arguments]\n\nCommands: %s\n", os.Args[0], strings.Join(names, ", "))
+	os.Exit(2)
+}
+
+// readDump loads the dump file f into a new store.
+func readDump(f string) (store *sequence.Store, err error) {
+	data, err := os.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed dump %s: %v", f, r)
+		}
+	}()
+	store = sequence.NewStore()
+	if err := store.Load(data); err != nil {
+		return nil, fmt.Errorf("error loading dump %s: %s", f, err)
+	}
+	return store, nil
+}
+
+// isSubtree reports whether pattern addresses a subtree of keys, i.e. "*" or a key
+// prefix ending with a hierarchy separator followed by "*" (e.g. "eu.web.*").
+func isSubtree(pattern string) bool {
+	if pattern == "*" {
+		return true
+	}
+	return strings.HasSuffix(pattern, ".*") || strings.HasSuffix(pattern, "/*")
+}
+
+// matchKeys returns the sorted keys of store matching patterns, either keys or
+// subtrees. It returns an error if a key does not exist.
+func matchKeys(store *sequence.Store, patterns []string) ([]string, error) {
+	all := store.Keys()
+	seen := make(map[string]bool)
+	var keys []string
+	for _, p := range patterns {
+		if !isSubtree(p) {
+			if _, ok := store.Get(p); !ok {
+				return nil, fmt.Errorf("key %s does not exist", p)
+			}
+			if !seen[p] {
+				seen[p] = true
+				keys = append(keys, p)
+			}
+			continue
+		}
+		for _, k := range all {
+			if strings.HasPrefix(k, p[:len(p)-1]) && !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
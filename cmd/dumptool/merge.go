@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// runMerge merges dump files into a single dump file. Files are merged in the
+// order they are given, the known values of a file taking precedence over the
+// values of the previous files.
+func runMerge(args []string) error {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	output := fs.String("o", "", "Full path to output dump file")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s merge -o file dump...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 2 || *output == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	merged := sequence.NewStore()
+	for _, f := range fs.Args() {
+		store, err := readDump(f)
+		if err != nil {
+			return err
+		}
+		for _, k := range store.Keys() {
+			y, _ := store.Get(k)
+			if x, ok := merged.Get(k); ok {
+				if x.Frequency() != y.Frequency() {
+					log.Printf("frequencies of key %s differ, using values of %s", k, f)
+				}
+				y = mergeSequences(y, x)
+			}
+			merged.Add(k, y)
+		}
+	}
+
+	buf, err := merged.Dump()
+	if err != nil {
+		return err
+	}
+	if err := writeFile(*output, buf); err != nil {
+		return err
+	}
+	log.Printf("merged %d key(s) from %d file(s) into %s", len(merged.Keys()), fs.NArg(), *output)
+	return nil
+}
+
+// mergeSequences returns a sequence spanning x and y, using the values of x and
+// falling back to the values of y where x is unknown. If frequencies differ, x is
+// returned unchanged.
+func mergeSequences(x, y *sequence.Sequence) *sequence.Sequence {
+	if x.Frequency() != y.Frequency() {
+		return x
+	}
+	frequency := int64(x.Frequency())
+	xv, yv := x.All(), y.All()
+	start, end := x.Timestamp(), x.Timestamp()+int64(len(xv))*frequency
+	if t := y.Timestamp(); t < start {
+		start = t
+	}
+	if t := y.Timestamp() + int64(len(yv))*frequency; t > end {
+		end = t
+	}
+	values := make([]uint8, (end-start)/frequency)
+	for i := range values {
+		values[i] = sequence.StateUnknown
+	}
+	copy(values[(y.Timestamp()-start)/frequency:], yv)
+	offset := (x.Timestamp() - start) / frequency
+	for i, v := range xv {
+		if v != sequence.StateUnknown {
+			values[offset+int64(i)] = v
+		}
+	}
+	z := sequence.NewWithValues(time.Unix(start, 0), x.Frequency(), values)
+	if n := x.Length(); n > 0 {
+		z.SetLength(n)
+	}
+	return z
+}
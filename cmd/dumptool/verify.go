@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+const (
+	// layout of the header of sequences represented as bytes
+	sizeHeader     = 18
+	indexFrequency = 8
+	indexLength    = 10
+	indexCounter   = 14
+
+	maxKeyLength = 1024
+)
+
+// validKey matches keys of the server, including internal keys. As the key pattern
+// of the server is configurable, any key made of printable characters is accepted.
+var validKey = regexp.MustCompile(`^[^\x00-\x20\x7f]+$`)
+
+// A dumpRecord is a key / sequence pair read from a dump file.
+type dumpRecord struct {
+	offset int
+	key    string
+	seq    *sequence.Sequence
+}
+
+// A dumpProblem describes a corrupted part of a dump file.
+type dumpProblem struct {
+	offset int
+	key    string
+	err    error
+}
+
+func (p dumpProblem) String() string {
+	if p.key == "" {
+		return fmt.Sprintf("offset %d: %s", p.offset, p.err)
+	}
+	return fmt.Sprintf("offset %d: key %s: %s", p.offset, p.key, p.err)
+}
+
+// runVerify checks the structure of a dump file, reporting corrupted parts. It
+// exits with status 1 if the dump file is corrupted.
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	dumpFile := fs.String("f", "./store.dump", "Full path to dump file")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s verify [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	data, err := os.ReadFile(*dumpFile)
+	if err != nil {
+		return err
+	}
+	records, problems := scanDump(data)
+	for _, v := range problems {
+		fmt.Println(v)
+	}
+	fmt.Printf("%d key(s) readable, %d problem(s) found\n", len(records), len(problems))
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+	return nil
+}
+
+// runRepair writes the sequences that can be salvaged from a dump file into a new
+// dump file.
+func runRepair(args []string) error {
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	dumpFile := fs.String("f", "./store.dump", "Full path to dump file")
+	output := fs.String("o", "", "Full path to output dump file")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s repair -o file [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *output == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	data, err := os.ReadFile(*dumpFile)
+	if err != nil {
+		return err
+	}
+	records, problems := scanDump(data)
+	for _, v := range problems {
+		log.Println(v)
+	}
+
+	store := sequence.NewStore()
+	for _, v := range records {
+		store.Add(v.key, v.seq)
+	}
+	buf, err := store.Dump()
+	if err != nil {
+		return err
+	}
+	if err := writeFile(*output, buf); err != nil {
+		return err
+	}
+	log.Printf("salvaged %d key(s) from %s into %s (%d problem(s) found)", len(store.Keys()), *dumpFile, *output, len(problems))
+	return nil
+}
+
+// scanDump reads the key / sequence pairs of data, checking the structure of each
+// sequence. Sequences holding corrupted values are salvaged up to their first
+// corrupted value. When a pair cannot be delimited, reading resumes at the next
+// offset holding a valid pair. Keys appearing multiple times are reported, the
+// last occurrence being kept as when loading the dump.
+func scanDump(data []byte) ([]dumpRecord, []dumpProblem) {
+	var records []dumpRecord
+	var problems []dumpProblem
+	seen := make(map[string]int)
+	for i := 0; i < len(data); {
+		key, raw, next, err := readRecord(data, i)
+		if err != nil {
+			problems = append(problems, dumpProblem{offset: i, err: err})
+			if i = resync(data, i+1); i < len(data) {
+				problems = append(problems, dumpProblem{offset: i, err: errors.New("resuming at next valid key")})
+			}
+			continue
+		}
+		seq, err := checkSequence(raw)
+		if err != nil {
+			problems = append(problems, dumpProblem{offset: i, key: key, err: err})
+		}
+		if seq != nil {
+			if j, ok := seen[key]; ok {
+				problems = append(problems, dumpProblem{offset: i, key: key, err: errors.New("duplicate key")})
+				records[j].seq, records[j].offset = seq, i
+			} else {
+				seen[key] = len(records)
+				records = append(records, dumpRecord{offset: i, key: key, seq: seq})
+			}
+		}
+		i = next
+	}
+	return records, problems
+}
+
+// readRecord reads the key / sequence pair starting at offset i of data, returning
+// the key, the sequence represented as bytes and the offset of the next pair.
+func readRecord(data []byte, i int) (string, []byte, int, error) {
+	key, i, err := readField(data, i)
+	if err != nil {
+		return "", nil, 0, fmt.Errorf("key: %s", err)
+	}
+	if len(key) > maxKeyLength || !validKey.Match(key) {
+		return "", nil, 0, errors.New("key is not valid")
+	}
+	raw, i, err := readField(data, i)
+	if err != nil {
+		return "", nil, 0, fmt.Errorf("key %s: sequence: %s", key, err)
+	}
+	return string(key), raw, i, nil
+}
+
+// readField reads the length-prefixed field starting at offset i of data,
+// returning the field and the offset following it.
+func readField(data []byte, i int) ([]byte, int, error) {
+	v, n := binary.Varint(data[i:])
+	if n <= 0 {
+		return nil, 0, errors.New("length is not valid")
+	}
+	i += n
+	if v < 0 || v > int64(len(data)-i) {
+		return nil, 0, errors.New("length is out of bounds")
+	}
+	return data[i : i+int(v)], i + int(v), nil
+}
+
+// resync returns the first offset from i holding a valid key / sequence pair, or
+// the length of data if there is none.
+func resync(data []byte, i int) int {
+	for ; i < len(data); i++ {
+		if _, raw, _, err := readRecord(data, i); err == nil {
+			if _, err := checkSequence(raw); err == nil {
+				return i
+			}
+		}
+	}
+	return len(data)
+}
+
+// checkSequence checks the structure of the sequence represented by raw, returning
+// the sequence and an error describing the first problem found, if any. Values
+// preceding a corrupted value are salvaged, the returned sequence being nil if the
+// sequence cannot be salvaged.
+func checkSequence(raw []byte) (*sequence.Sequence, error) {
+	if len(raw) < sizeHeader {
+		return nil, errors.New("sequence is truncated")
+	}
+	if binary.LittleEndian.Uint16(raw[indexFrequency:]) == 0 {
+		return nil, errors.New("frequency is not valid")
+	}
+	length := binary.LittleEndian.Uint32(raw[indexLength:])
+	if length == 0 {
+		length = sequence.MaxSequenceLength
+	}
+	count := binary.LittleEndian.Uint32(raw[indexCounter:])
+
+	// each run of values is encoded as a varint, the two lowest bits of the first
+	// byte holding the value
+	var problem error
+	var total uint64
+	end := sizeHeader
+	for p := sizeHeader; p < len(raw); {
+		if v := raw[p] & 0x3; v == sequence.StateNotUsed {
+			problem = fmt.Errorf("value at byte %d is not valid", p-sizeHeader)
+			break
+		}
+		n := uint64(raw[p]&0x7f) >> 2
+		shift := 5
+		q := p
+		for raw[q] >= 0x80 && q+1 < len(raw) && shift < 32 {
+			q++
+			n |= uint64(raw[q]&0x7f) << shift
+			shift += 7
+		}
+		if raw[q] >= 0x80 {
+			problem = fmt.Errorf("run at byte %d is truncated", p-sizeHeader)
+			break
+		}
+		if total+n > uint64(length) {
+			problem = fmt.Errorf("run at byte %d overflows the sequence", p-sizeHeader)
+			break
+		}
+		total += n
+		p, end = q+1, q+1
+	}
+	if problem == nil && total != uint64(count) {
+		problem = fmt.Errorf("sequence holds %d value(s), expected %d", total, count)
+	}
+	if problem == nil {
+		seq, err := sequence.FromBytes(raw)
+		return seq, err
+	}
+
+	salvaged := make([]byte, end)
+	copy(salvaged, raw[:end])
+	binary.LittleEndian.PutUint32(salvaged[indexCounter:], uint32(total))
+	seq, err := sequence.FromBytes(salvaged)
+	if err != nil {
+		return nil, problem
+	}
+	return seq, fmt.Errorf("%s (%d value(s) salvaged)", problem, total)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// touch records the current time as last activity of the keys of statements
+// successfully executed in batch.
+func (s *server) touch(statements []sequence.Statement, result sequence.BatchResult) {
+	var errs []error
+	if result.HasErrors() {
+		errs = result.ErrorVars()
+	}
+	now := time.Now()
+	s.activityMu.Lock()
+	defer s.activityMu.Unlock()
+	for i, v := range statements {
+		if errs != nil && errs[i] != nil {
+			continue
+		}
+		key := v.Key
+		if i := strings.Index(key, internalKeySeparator); i != -1 {
+			key = key[:i]
+		}
+		s.activity[key] = now
+	}
+}
+
+// expire deletes the keys that did not receive inserts for at least ttl. Keys
+// without recorded activity, e.g. loaded from a dump, are considered active.
+func (s *server) expire(ttl time.Duration) {
+	now := time.Now()
+	var expired []string
+	s.activityMu.Lock()
+	for _, k := range s.keys("*") {
+		last, ok := s.activity[k]
+		if !ok {
+			s.activity[k] = now
+			continue
+		}
+		if now.Sub(last) >= ttl {
+			expired = append(expired, k)
+		}
+	}
+	s.activityMu.Unlock()
+	for _, k := range expired {
+		s.deleteKey(k)
+	}
+	if len(expired) > 0 {
+		log.Printf("expiring %d idle key(s)", len(expired))
+		s.audit(nil, auditExpire, expired, fmt.Sprintf("%d idle key(s) deleted", len(expired)))
+	}
+}
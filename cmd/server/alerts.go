@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Alert statuses.
+const (
+	alertPending  = "pending"
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+// A rule defines an alert condition on the values of the keys matching Key (a key
+// or a subtree pattern): the value is compared to State using Operator ("==" or
+// "!=") and the alert fires once the condition holds for at least For seconds.
+// Notify lists the names of the notifiers receiving status changes.
+type rule struct {
+	Name     string   `json:"name"`
+	Key      string   `json:"key"`
+	State    uint8    `json:"state"`
+	Operator string   `json:"operator"`
+	For      int64    `json:"for"`
+	Notify   []string `json:"notify"`
+}
+
+func (r rule) validate() error {
+	switch {
+	case r.Name == "":
+		return errors.New("name is required")
+	case !validKey.MatchString(r.Key) && !isSubtree(r.Key):
+		return errors.New("key is not valid")
+	case r.State > 2:
+		return errors.New("state is not valid")
+	case r.Operator != "" && r.Operator != "==" && r.Operator != "!=":
+		return errors.New("operator is not valid")
+	case r.For < 0:
+		return errors.New("for is not valid")
+	}
+	return nil
+}
+
+// match reports whether value satisfies the condition of r.
+func (r rule) match(value uint8) bool {
+	if r.Operator == "!=" {
+		return value != r.State
+	}
+	return value == r.State
+}
+
+// An alert represents the state of a rule for a key.
+type alert struct {
+	Rule   string `json:"rule"`
+	Key    string `json:"key"`
+	Status string `json:"status"`
+	Since  int64  `json:"since"`
+	Fired  int64  `json:"fired,omitempty"`
+}
+
+// An alertEvent represents a status change of an alert.
+type alertEvent struct {
+	Rule   string `json:"rule"`
+	Key    string `json:"key"`
+	Status string `json:"status"`
+	Time   int64  `json:"time"`
+	Value  uint8  `json:"value"`
+	notify []string
+}
+
+// An alerter evaluates rules against inserted values and tracks the resulting
+// alerts. Alerts are kept in memory only.
+type alerter struct {
+	mu     sync.Mutex
+	rules  []rule
+	alerts map[[2]string]*alert
+}
+
+func newAlerter(rules []rule) *alerter {
+	return &alerter{rules: rules, alerts: make(map[[2]string]*alert)}
+}
+
+// observe evaluates the rules matching key using value, recorded at Unix time ts,
+// and returns the resulting status changes.
+func (a *alerter) observe(key string, ts int64, value uint8) []alertEvent {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var events []alertEvent
+	for _, r := range a.rules {
+		if !matchKey(key, r.Key) {
+			continue
+		}
+		id := [2]string{r.Name, key}
+		x, ok := a.alerts[id]
+		if !r.match(value) {
+			if ok {
+				if x.Status == alertFiring {
+					events = append(events, alertEvent{Rule: r.Name, Key: key, Status: alertResolved, Time: ts, Value: value, notify: r.Notify})
+				}
+				delete(a.alerts, id)
+			}
+			continue
+		}
+		if !ok {
+			x = &alert{Rule: r.Name, Key: key, Status: alertPending, Since: ts}
+			a.alerts[id] = x
+		}
+		if x.Status == alertPending && ts-x.Since >= r.For {
+			x.Status, x.Fired = alertFiring, ts
+			events = append(events, alertEvent{Rule: r.Name, Key: key, Status: alertFiring, Time: ts, Value: value, notify: r.Notify})
+		}
+	}
+	return events
+}
+
+// setRules replaces the rules of a, dropping the alerts of rules that no longer
+// exist or whose definition changed.
+func (a *alerter) setRules(rules []rule) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	kept := make(map[string]bool)
+	for _, v := range rules {
+		for _, w := range a.rules {
+			if v.Name == w.Name && v.Key == w.Key && v.State == w.State && v.Operator == w.Operator && v.For == w.For {
+				kept[v.Name] = true
+			}
+		}
+	}
+	for id := range a.alerts {
+		if !kept[id[0]] {
+			delete(a.alerts, id)
+		}
+	}
+	a.rules = rules
+}
+
+// forget drops the alerts of key.
+func (a *alerter) forget(key string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for id := range a.alerts {
+		if id[1] == key {
+			delete(a.alerts, id)
+		}
+	}
+}
+
+// list returns the pending and firing alerts sorted by rule and key.
+func (a *alerter) list() []alert {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	alerts := make([]alert, 0, len(a.alerts))
+	for _, v := range a.alerts {
+		alerts = append(alerts, *v)
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		if alerts[i].Rule != alerts[j].Rule {
+			return alerts[i].Rule < alerts[j].Rule
+		}
+		return alerts[i].Key < alerts[j].Key
+	})
+	return alerts
+}
+
+func (s *server) handlerAlerts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	alerts := s.alerts.list()
+	data, err := json.Marshal(alerts)
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+		logf(r, "error serializing alerts: %s", err)
+		return
+	}
+	writeResponse(w, http.StatusOK, statusOK, fmt.Sprintf("%d alert(s) returned", len(alerts)), data)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+var validKey = regexp.MustCompile(`^` + keyPattern + `$`)
+
+func (s *server) handlerAnnotations(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.handlerAnnotationsList(w, r)
+	case http.MethodPost:
+		s.handlerAnnotationsAdd(w, r)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+func (s *server) handlerAnnotationsList(w http.ResponseWriter, r *http.Request) {
+	start, end := int64(0), int64(math.MaxInt64)
+	if v := r.FormValue("start"); v != "" {
+		x, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			writeResponse(w, http.StatusBadRequest, statusError, "error parsing start date", nil)
+			return
+		}
+		start = x
+	}
+	if v := r.FormValue("end"); v != "" {
+		x, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			writeResponse(w, http.StatusBadRequest, statusError, "error parsing end date", nil)
+			return
+		}
+		end = x
+	}
+
+	annotations := s.meta.annotations(r.FormValue("key"), start, end)
+	data, err := json.Marshal(annotations)
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+		logf(r, "error serializing annotations: %s", err)
+		return
+	}
+	writeResponse(w, http.StatusOK, statusOK, fmt.Sprintf("%d annotation(s) returned", len(annotations)), data)
+}
+
+func (s *server) handlerAnnotationsAdd(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, statusError, "error reading request body", nil)
+		logf(r, "error reading request body: %s", err)
+		return
+	}
+
+	var annotations []annotation
+	if err := json.Unmarshal(body, &annotations); err != nil {
+		writeResponse(w, http.StatusBadRequest, statusError, "error parsing request body", nil)
+		return
+	}
+
+	for i, v := range annotations {
+		if v.Key != "" && !validKey.MatchString(v.Key) {
+			writeResponse(w, http.StatusBadRequest, statusError, fmt.Sprintf("annotation %d: key is not valid", i+1), nil)
+			return
+		}
+		// global annotations (without key) are not allowed by tokens restricted to key
+		// prefixes
+		if reason := checkTokenKey(r, []byte(v.Key)); reason != "" {
+			writeError(w, http.StatusForbidden, errorForbidden, fmt.Sprintf("annotation %d: %s", i+1, reason))
+			return
+		}
+		if v.Time <= 0 || v.Text == "" {
+			writeResponse(w, http.StatusBadRequest, statusError, fmt.Sprintf("annotation %d: time and text are required", i+1), nil)
+			return
+		}
+		if v.Kind == "" {
+			annotations[i].Kind = "note"
+		}
+	}
+
+	s.meta.addAnnotations(annotations...)
+
+	writeResponse(w, http.StatusOK, statusOK, fmt.Sprintf("%d annotation(s) added", len(annotations)), nil)
+}
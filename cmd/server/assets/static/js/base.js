@@ -90,7 +90,7 @@ function refresh(data) {
 
 function eventHandlerQuery() {
   const key = document.getElementById("key").value;
-  if (key.match(/^[a-zA-Z0-9_]+$/) === null) {
+  if (key.match(/^[\w./]+$/) === null) {
     refresh({"content-request": "Please enter a valid key..."});
     return;
   }
@@ -133,7 +133,7 @@ function eventHandlerQuery() {
 
 function eventHandlerInsert(e) {
   const key = document.getElementById("key").value;
-  if (key.match(/^[a-zA-Z0-9_]+$/) === null) {
+  if (key.match(/^[\w./]+$/) === null) {
     refresh({"content-request": "Please enter a valid key..."});
     return;
   }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// Operations recorded by the audit log.
+const (
+	auditInsert        = "insert"
+	auditGaugeInsert   = "gauge_insert"
+	auditCounterInsert = "counter_insert"
+	auditCreate        = "create"
+	auditOverwrite     = "overwrite"
+	auditIntervals     = "intervals"
+	auditDelete        = "delete"
+	auditDeleteRange   = "delete_range"
+	auditUndelete      = "undelete"
+	auditPurge         = "purge"
+	auditExpire        = "expire"
+	auditEvict         = "evict"
+	auditTrim          = "trim"
+	auditRestore       = "restore"
+	auditImport        = "import"
+)
+
+// An auditEntry records a mutating operation. Remote and identity are empty for
+// operations run by the server (e.g. retention).
+type auditEntry struct {
+	Time      int64    `json:"time"`
+	Tenant    string   `json:"tenant"`
+	Operation string   `json:"operation"`
+	Remote    string   `json:"remote,omitempty"`
+	Identity  string   `json:"identity,omitempty"`
+	RequestID string   `json:"request_id,omitempty"`
+	Keys      []string `json:"keys"`
+	Message   string   `json:"message,omitempty"`
+}
+
+// An auditLog appends entries to a file as JSON lines. A nil auditLog discards
+// entries.
+type auditLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// newAuditLog opens path, creating it if needed, to append entries.
+func newAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: f}, nil
+}
+
+// write appends e to the audit log.
+func (a *auditLog) write(e auditEntry) {
+	if a == nil {
+		return
+	}
+	if e.Keys == nil {
+		e.Keys = []string{}
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("error serializing audit entry: %s", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(append(data, '\n')); err != nil {
+		log.Printf("error writing audit entry: %s", err)
+	}
+}
+
+// audit records operation on keys, performed by request r or by the server if r is
+// nil, in the audit log of s.
+func (s *server) audit(r *http.Request, operation string, keys []string, message string) {
+	if s.auditLog == nil || !raftEffects(r) {
+		return
+	}
+	tenant := s.name
+	if tenant == "" {
+		tenant = defaultTenant
+	}
+	e := auditEntry{Time: time.Now().Unix(), Tenant: tenant, Operation: operation, Keys: keys, Message: message}
+	if r != nil {
+		e.Remote, e.Identity, e.RequestID = clientAddr(r), identity(r), requestIDOf(r)
+	}
+	s.auditLog.write(e)
+}
+
+// identity returns the identity of the client of r: the subject of its token if
+// issued by the OpenID Connect provider, the fingerprint of its bearer token (the
+// first 8 bytes of its SHA-256 hash), tokens themselves never being recorded, or an
+// empty string.
+func identity(r *http.Request) string {
+	if c, ok := tokenClaims(r); ok {
+		return c.identity()
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return ""
+	}
+	h := sha256.Sum256([]byte(token))
+	return "token:" + hex.EncodeToString(h[:8])
+}
+
+// seriesNames returns the sorted names of the series keys belong to.
+func seriesNames(keys []string) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, k := range keys {
+		k = seriesKey(k)
+		if !seen[k] {
+			seen[k] = true
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// appliedKeys returns the sorted names of the series of the statements of a batch
+// that were applied, errs holding the error of each statement or being nil if all
+// statements were applied.
+func appliedKeys(statements []sequence.Statement, errs []error) []string {
+	var keys []string
+	for i, v := range statements {
+		if errs == nil || errs[i] == nil {
+			keys = append(keys, v.Key)
+		}
+	}
+	return seriesNames(keys)
+}
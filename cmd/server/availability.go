@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// availability represents the percentage of time spent in each state. Availability
+// is the percentage of active values among known values.
+type availability struct {
+	Active       float64  `json:"active"`
+	Inactive     float64  `json:"inactive"`
+	Unknown      float64  `json:"unknown"`
+	Availability *float64 `json:"availability"`
+}
+
+// availabilityRow represents the availability of a group.
+type availabilityRow struct {
+	Date int64 `json:"date"`
+	availability
+}
+
+// newAvailability computes an availability using active as the number of active
+// values, known as the number of known values and total as the number of values.
+func newAvailability(active, known, total int64) availability {
+	var a availability
+	if total == 0 {
+		return a
+	}
+	a.Active = percent(active, total)
+	a.Inactive = percent(known-active, total)
+	a.Unknown = percent(total-known, total)
+	if known > 0 {
+		x := percent(active, known)
+		a.Availability = &x
+	}
+	return a
+}
+
+// percent returns x as a percentage of y rounded to 4 decimal places.
+func percent(x, y int64) float64 {
+	return math.Round(float64(x)/float64(y)*1e6) / 1e4
+}
+
+// availabilityData returns the JSON encoding of the availability computed from qs,
+// using frequency as the frequency of the underlying sequence and args as query
+// arguments. If buckets is true, the availability of each group is returned.
+func availabilityData(qs sequence.QuerySet, frequency int64, args queryArgs, buckets bool) ([]byte, error) {
+	start, end := args.start.Unix(), args.end.Unix()
+	if !buckets {
+		var active, known int64
+		for i := range qs.Count {
+			active += qs.Sum[i]
+			known += qs.Count[i]
+		}
+		return json.Marshal(newAvailability(active, known, (end-start)/frequency+1))
+	}
+	rows := make([]availabilityRow, len(qs.Count))
+	for i := range rows {
+		lo := qs.Timestamp + int64(i)*qs.Frequency
+		hi := lo + qs.Frequency - 1
+		if hi > end {
+			hi = end
+		}
+		rows[i] = availabilityRow{Date: lo, availability: newAvailability(qs.Sum[i], qs.Count[i], (hi-lo)/frequency+1)}
+	}
+	return json.Marshal(rows)
+}
+
+func (s *server) handlerQueryAvailability(w http.ResponseWriter, r *http.Request, key string) {
+	x, ok := s.get(key)
+	if !ok {
+		writeError(w, http.StatusNotFound, errorKeyNotFound, "key does not exist")
+		return
+	}
+
+	args, err := newQueryArgs(r.FormValue("start"), r.FormValue("end"), int64(x.Frequency()))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorInvalidRange, err.Error())
+		return
+	}
+	args.hours, err = queryHours(r.FormValue("hours"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorInvalidRequest, err.Error())
+		return
+	}
+
+	buckets := r.FormValue("buckets") == "1"
+	period, loc, err := queryCalendar(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorInvalidRequest, err.Error())
+		return
+	}
+	if buckets && period != "" {
+		values, ts := s.values(key, x, args, r.FormValue("maintenance") == "exclude")
+		q, err := newCalendarQuery(period, loc, values, ts, int64(x.Frequency()), args)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errorInvalidRange, err.Error())
+			return
+		}
+		data, err := json.Marshal(q.availabilityRows(int64(x.Frequency()), args))
+		if err != nil {
+			writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+			logf(r, "error serializing availability: %s", err)
+			return
+		}
+		writeResponse(w, http.StatusOK, statusOK, fmt.Sprintf("%d row(s) returned (calendar %s, %s)", len(q.count), period, loc), data)
+		return
+	}
+
+	qs, err := s.query(key, x, args, r.FormValue("maintenance") == "exclude")
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+		logf(r, "error executing query: %s", err)
+		return
+	}
+
+	data, err := availabilityData(qs, int64(x.Frequency()), args, buckets)
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+		logf(r, "error serializing availability: %s", err)
+		return
+	}
+
+	message := "availability computed over range"
+	if buckets {
+		message = fmt.Sprintf("%d row(s) returned (interval %ds)", len(qs.Count), int(args.interval.Seconds()))
+	}
+	writeResponse(w, http.StatusOK, statusOK, message, data)
+}
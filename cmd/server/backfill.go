@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// backfill applies the statements that failed because they are older than the last
+// value of their key or than the start of its sequence, as long as they are more
+// recent than the backfill window. Such values fill the unknown values of the
+// sequence, extending it backwards if needed, while known values are kept. errs
+// holds the error of each statement and is updated, the error of the statements
+// applied being set to nil.
+func (s *server) backfill(statements []sequence.Statement, errs []error) {
+	if s.backfillWindow <= 0 {
+		return
+	}
+	limit := time.Now().Add(-s.backfillWindow)
+
+	groups := make(map[string][]int)
+	var keys []string
+	for i, err := range errs {
+		if err == nil || statements[i].Timestamp.Before(limit) {
+			continue
+		}
+		if msg := err.Error(); msg != errOverwrite && msg != "out of bounds" {
+			continue
+		}
+		k := statements[i].Key
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], i)
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	var applied int
+	sequences := make(map[string][]byte)
+	s.mu.Lock()
+	for _, k := range keys {
+		x, ok := s.store.Get(k)
+		if !ok {
+			continue
+		}
+		frequency := int64(x.Frequency())
+		values := x.All()
+		start := x.Timestamp()
+		for _, i := range groups[k] {
+			if t := statements[i].Timestamp.Unix(); t < start {
+				start -= (start - t + frequency - 1) / frequency * frequency
+			}
+		}
+		end := x.Timestamp() + int64(len(values))*frequency
+		if start < x.Timestamp() && x.Length() > 0 && (end-start)/frequency > int64(x.Length()) {
+			// extending the sequence would exceed its maximum length
+			continue
+		}
+		y := make([]uint8, (end-start)/frequency)
+		for i := range y {
+			y[i] = sequence.StateUnknown
+		}
+		copy(y[(x.Timestamp()-start)/frequency:], values)
+		var n int
+		for _, i := range groups[k] {
+			p := (statements[i].Timestamp.Unix() - start) / frequency
+			if p >= int64(len(y)) || y[p] != sequence.StateUnknown {
+				continue
+			}
+			y[p] = statements[i].Value
+			errs[i] = nil
+			applied++
+			n++
+		}
+		if n == 0 {
+			continue
+		}
+		z := sequence.NewWithValues(time.Unix(start, 0), x.Frequency(), y)
+		if length := x.Length(); length > 0 {
+			z.SetLength(length)
+		}
+		s.store.Add(k, z)
+		s.cache.invalidate(k)
+		sequences[k] = z.Bytes()
+	}
+	if len(sequences) > 0 {
+		// sent while locked so that the standby receives later statements afterwards
+		s.replicator.send(replicationMessage{Sequences: sequences})
+	}
+	s.mu.Unlock()
+
+	if len(sequences) > 0 {
+		log.Printf("backfilled %d value(s) of %d key(s)", applied, len(sequences))
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// Entries of backup archives: the metadata, then the dump of each shard of the
+// store, dumps concatenated in order forming a dump file.
+const (
+	backupMeta        = "meta.json"
+	backupStoreFormat = "store-%03d.dump"
+)
+
+// handlerBackup streams a tar archive holding the metadata and the store, the dump
+// of one shard being held in memory at a time.
+func (s *server) handlerBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	meta, err := s.meta.bytes()
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+		logf(r, "error dumping metadata: %s", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", `attachment; filename="backup.tar"`)
+	now := time.Now()
+	tw := tar.NewWriter(w)
+	write := func(name string, data []byte) error {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0660, Size: int64(len(data)), ModTime: now}); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+	err = write(backupMeta, meta)
+	if err == nil {
+		i := 0
+		err = s.store.DumpShards(func(data []byte) error {
+			i++
+			return write(fmt.Sprintf(backupStoreFormat, i), data)
+		})
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		// the response is already started, closing the connection so that the
+		// archive is not mistaken for a complete one
+		logf(r, "error writing backup: %s", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func (s *server) handlerRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = "replace"
+	}
+	if mode != "replace" && mode != "merge" {
+		writeResponse(w, http.StatusBadRequest, statusError, "mode is not supported", nil)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, statusError, "error reading request body", nil)
+		logf(r, "error reading request body: %s", err)
+		return
+	}
+
+	data, meta, err := readBackup(body)
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, statusError, "backup is not valid", nil)
+		logf(r, "error reading backup: %s", err)
+		return
+	}
+	// the store is left in an undefined state if loading fails
+	dump := sequence.NewStore()
+	if err := loadDump(dump, data); err != nil {
+		writeResponse(w, http.StatusBadRequest, statusError, "dump is not valid", nil)
+		return
+	}
+	keys := dump.Keys()
+
+	s.mu.Lock()
+	if mode == "replace" {
+		s.store.Load(data)
+		if meta != nil {
+			s.meta.replace(meta)
+		}
+	} else {
+		for _, k := range keys {
+			y, _ := dump.Get(k)
+			if x, ok := s.store.Get(k); ok {
+				y = mergeSequences(x, y)
+			}
+			s.store.Add(k, y)
+		}
+		if meta != nil {
+			s.meta.merge(meta)
+		}
+	}
+	s.cache.reset()
+	s.mu.Unlock()
+
+	if m, err := s.snapshot(); err != nil {
+		logf(r, "error replicating restored store: %s", err)
+	} else {
+		s.replicator.send(m)
+	}
+
+	logf(r, "restoring %d key(s) from dump (mode %s)", len(keys), mode)
+	message := fmt.Sprintf("%d key(s) restored", len(keys))
+	s.audit(r, auditRestore, seriesNames(keys), message+" (mode "+mode+")")
+	writeResponse(w, http.StatusOK, statusOK, message, nil)
+}
+
+// readBackup returns the dump and the metadata held by data, a backup archive or a
+// dump file, e.g. written by older versions or by evictions, holding no metadata.
+func readBackup(data []byte) ([]byte, *metadata, error) {
+	// tar headers hold a magic number at offset 257, which dumps are not expected
+	// to hold
+	if len(data) < 262 || string(data[257:262]) != "ustar" {
+		return data, nil, nil
+	}
+	var dump bytes.Buffer
+	var meta *metadata
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		switch {
+		case h.Name == backupMeta:
+			b, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, nil, err
+			}
+			if meta, err = decodeMetadata(b); err != nil {
+				return nil, nil, fmt.Errorf("metadata is not valid: %s", err)
+			}
+		case strings.HasPrefix(h.Name, "store-") && strings.HasSuffix(h.Name, ".dump"):
+			if _, err := io.Copy(&dump, tr); err != nil {
+				return nil, nil, err
+			}
+		default:
+			return nil, nil, fmt.Errorf("unexpected entry %s", h.Name)
+		}
+	}
+	return dump.Bytes(), meta, nil
+}
+
+// loadDump loads data into store, recovering from panics caused by malformed dumps.
+func loadDump(store *sequence.Store, data []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed dump: %v", r)
+		}
+	}()
+	return store.Load(data)
+}
+
+// mergeSequences returns a sequence spanning x and y, using the values of x and
+// falling back to the values of y where x is unknown. If frequencies differ, x is
+// returned unchanged.
+func mergeSequences(x, y *sequence.Sequence) *sequence.Sequence {
+	if x.Frequency() != y.Frequency() {
+		return x
+	}
+	frequency := int64(x.Frequency())
+	xv, yv := x.All(), y.All()
+	start, end := x.Timestamp(), x.Timestamp()+int64(len(xv))*frequency
+	if t := y.Timestamp(); t < start {
+		start = t
+	}
+	if t := y.Timestamp() + int64(len(yv))*frequency; t > end {
+		end = t
+	}
+	values := make([]uint8, (end-start)/frequency)
+	for i := range values {
+		values[i] = sequence.StateUnknown
+	}
+	copy(values[(y.Timestamp()-start)/frequency:], yv)
+	offset := (x.Timestamp() - start) / frequency
+	for i, v := range xv {
+		if v != sequence.StateUnknown {
+			values[offset+int64(i)] = v
+		}
+	}
+	z := sequence.NewWithValues(time.Unix(start, 0), x.Frequency(), values)
+	if n := x.Length(); n > 0 {
+		z.SetLength(n)
+	}
+	return z
+}
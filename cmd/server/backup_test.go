@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBackup(t *testing.T) {
+	s := &server{store: newShardedStore(4), meta: newMetadata()}
+	now := time.Now().Truncate(time.Minute)
+	keys := []string{"eu.web", "eu.db", "us.web", "us.db"}
+	for _, k := range keys {
+		s.store.Create(now, 60, k)
+	}
+	s.meta.addMaintenanceWindow("eu.web", window{Start: 10, End: 20})
+	s.meta.setComposite("eu", "eu.web & eu.db")
+
+	w := httptest.NewRecorder()
+	s.handlerBackup(w, httptest.NewRequest("GET", "/admin/backup", nil))
+	if w.Code != 200 {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	data, meta, err := readBackup(w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if meta == nil || !reflect.DeepEqual(meta.Maintenance["eu.web"], []window{{10, 20}}) || meta.Composites["eu"] != "eu.web & eu.db" {
+		t.Fatalf("expected metadata of the server, got %+v", meta)
+	}
+	dump := newShardedStore(1)
+	if err := dump.Load(data); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := len(dump.Keys()); n != len(keys) {
+		t.Fatalf("expected %d keys, got %d", len(keys), n)
+	}
+
+	// dump files are restored as is, without metadata
+	plain, err := s.store.Dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, meta, err := readBackup(plain); err != nil || meta != nil || len(data) != len(plain) {
+		t.Fatalf("expected dump file to be returned unchanged, got %d bytes, metadata %v, error %v", len(data), meta, err)
+	}
+}
+
+func TestMetadataMerge(t *testing.T) {
+	m := newMetadata()
+	m.addMaintenanceWindow("eu.web", window{Start: 10, End: 20})
+	m.addAnnotations(annotation{Key: "eu.web", Time: 5, Kind: "deploy", Text: "v1"})
+	m.setComposite("eu", "eu.web")
+
+	x := newMetadata()
+	x.addMaintenanceWindow("eu.web", window{Start: 10, End: 20})
+	x.addMaintenanceWindow("eu.web", window{Start: 1, End: 2})
+	x.addAnnotations(annotation{Key: "eu.web", Time: 5, Kind: "deploy", Text: "v1"}, annotation{Time: 1, Kind: "note", Text: "all"})
+	x.setComposite("eu", "eu.db")
+	x.setComposite("us", "us.web")
+	x.setDashboard(dashboard{Name: "ops"})
+
+	m.merge(x)
+	if want := []window{{1, 2}, {10, 20}}; !reflect.DeepEqual(m.Maintenance["eu.web"], want) {
+		t.Errorf("expected windows %v, got %v", want, m.Maintenance["eu.web"])
+	}
+	if len(m.Annotations) != 2 || m.Annotations[0].Kind != "note" {
+		t.Errorf("expected 2 annotations sorted by time, got %v", m.Annotations)
+	}
+	if want := map[string]string{"eu": "eu.web", "us": "us.web"}; !reflect.DeepEqual(m.Composites, want) {
+		t.Errorf("expected composites %v, got %v", want, m.Composites)
+	}
+	if _, ok := m.Dashboards["ops"]; !ok {
+		t.Error("expected dashboard ops")
+	}
+}
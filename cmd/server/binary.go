@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// binaryContentType is the content type of run-length encoded sequences, as
+// returned by sequence.Sequence.Bytes.
+const binaryContentType = "application/octet-stream"
+
+func (s *server) handlerSequence(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.handlerSequenceExport(w, r)
+	case http.MethodPost:
+		s.handlerSequenceImport(w, r)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+// handlerSequenceExport returns the run-length encoded sequence of a key, restricted
+// to the values within the closed interval defined by the start and end parameters
+// if they are set, so that it can be consumed without lossy aggregation.
+func (s *server) handlerSequenceExport(w http.ResponseWriter, r *http.Request) {
+	key := r.FormValue("key")
+	if key == "" {
+		writeResponse(w, http.StatusBadRequest, statusError, "missing key", nil)
+		return
+	}
+	x, ok := s.get(key)
+	if !ok {
+		writeError(w, http.StatusNotFound, errorKeyNotFound, errKeyNotFound.Error())
+		return
+	}
+
+	if r.FormValue("start") != "" || r.FormValue("end") != "" {
+		start, err := strconv.ParseInt(r.FormValue("start"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errorInvalidRange, "error parsing start date")
+			return
+		}
+		end, err := strconv.ParseInt(r.FormValue("end"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errorInvalidRange, "error parsing end date")
+			return
+		}
+		if start > end {
+			writeError(w, http.StatusBadRequest, errorInvalidRange, "range is not valid")
+			return
+		}
+		values, ts, err := x.Values(time.Unix(start, 0), time.Unix(end, 0))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errorInvalidRange, errNoOverlap.Error())
+			return
+		}
+		x = sequence.NewWithValues(time.Unix(ts, 0), x.Frequency(), values)
+	}
+
+	data := x.Bytes()
+	w.Header().Set("Content-Type", binaryContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// decodeSequence decodes data, a sequence encoded by sequence.Sequence.Bytes,
+// recovering from panics caused by malformed sequences, and checks that its values
+// are aligned on multiples of its frequency, a divisor of the largest grouping
+// interval.
+func decodeSequence(data []byte) (x *sequence.Sequence, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			x, err = nil, fmt.Errorf("malformed sequence: %v", r)
+		}
+	}()
+	x, err = sequence.FromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	x.All()
+	frequency := int64(x.Frequency())
+	if frequency == 0 || aggregations[len(aggregations)-1]%frequency != 0 {
+		return nil, errors.New("frequency is not valid")
+	}
+	if x.Timestamp()%frequency != 0 {
+		return nil, errors.New("timestamp is not a multiple of the frequency")
+	}
+	return x, nil
+}
+
+// handlerSequenceImport creates a key using a run-length encoded sequence, or
+// merges the sequence into the sequence of an existing key, the values of the key
+// taking precedence over the values of the sequence where they are known.
+func (s *server) handlerSequenceImport(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		writeResponse(w, http.StatusBadRequest, statusError, "missing key", nil)
+		return
+	}
+	if reason := checkKey([]byte(key)); reason != "" {
+		writeResponse(w, http.StatusBadRequest, statusError, reason, nil)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, statusError, "error reading request body", nil)
+		logf(r, "error reading request body: %s", err)
+		return
+	}
+	y, err := decodeSequence(body)
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, statusError, "sequence is not valid: "+err.Error(), nil)
+		return
+	}
+	limit := s.keyLimits()
+
+	s.mu.Lock()
+	x, ok := s.store.Get(key)
+	switch {
+	case !ok:
+		if err := limit.check(key); err != nil {
+			s.mu.Unlock()
+			writeError(w, http.StatusBadRequest, errorQuotaExceeded, err.Error())
+			return
+		}
+	case x.Frequency() != y.Frequency():
+		s.mu.Unlock()
+		writeResponse(w, http.StatusBadRequest, statusError, "frequency of the sequence does not match the frequency of the key", nil)
+		return
+	default:
+		y = mergeSequences(x, y)
+	}
+	s.store.Add(key, y)
+	s.cache.invalidate(key)
+	// sent while locked so that the standby receives later statements afterwards
+	s.replicator.send(replicationMessage{Sequences: map[string][]byte{key: y.Bytes()}})
+	s.mu.Unlock()
+
+	message := fmt.Sprintf("sequence of %d value(s) imported", len(y.All()))
+	if ok {
+		message = fmt.Sprintf("sequence merged, key holding %d value(s)", len(y.All()))
+	}
+	s.audit(r, auditImport, []string{key}, message)
+	writeResponse(w, http.StatusOK, statusOK, message, nil)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// cacheEntryOverhead approximates the memory used by a cache entry on top of its
+// key and data.
+const cacheEntryOverhead = 256
+
+// A cacheKey identifies the results of a query on a key.
+type cacheKey struct {
+	key     string
+	start   string
+	end     string
+	exclude bool
+	hours   string
+}
+
+// A cacheVersion identifies the state of the values of a key, changing whenever
+// they are modified.
+type cacheVersion struct {
+	epoch uint64
+	key   uint64
+}
+
+type cacheEntry struct {
+	k       cacheKey
+	version cacheVersion
+	message string
+	data    []byte
+}
+
+func (e *cacheEntry) size() int {
+	return len(e.k.key) + len(e.k.start) + len(e.k.end) + len(e.k.hours) + len(e.message) + len(e.data) + cacheEntryOverhead
+}
+
+// A queryCache is a least recently used cache of serialized query results, bounded
+// by a memory budget in bytes. Results of a key are invalidated when its values
+// are modified. A nil cache caches nothing.
+type queryCache struct {
+	mu       sync.Mutex
+	budget   int
+	size     int
+	lru      *list.List // of *cacheEntry, most recently used first
+	entries  map[cacheKey]*list.Element
+	byKey    map[string]map[cacheKey]bool
+	epoch    uint64
+	versions map[string]uint64
+}
+
+// newQueryCache returns a cache using budget bytes, or nil if budget is 0 or less.
+func newQueryCache(budget int) *queryCache {
+	if budget <= 0 {
+		return nil
+	}
+	return &queryCache{
+		budget:   budget,
+		lru:      list.New(),
+		entries:  make(map[cacheKey]*list.Element),
+		byKey:    make(map[string]map[cacheKey]bool),
+		versions: make(map[string]uint64),
+	}
+}
+
+// version returns the current version of the values of key. It must be called
+// before reading the values used to compute results passed to put.
+func (c *queryCache) version(key string) cacheVersion {
+	if c == nil {
+		return cacheVersion{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return cacheVersion{epoch: c.epoch, key: c.versions[key]}
+}
+
+// get returns the message and data of the results identified by k.
+func (c *queryCache) get(k cacheKey) (string, []byte, bool) {
+	if c == nil {
+		return "", nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[k]
+	if !ok {
+		return "", nil, false
+	}
+	c.lru.MoveToFront(e)
+	x := e.Value.(*cacheEntry)
+	return x.message, x.data, true
+}
+
+// put adds the results identified by k, computed from the values of the key at
+// version, unless the values were modified since then. Least recently used results
+// are evicted to stay within the budget.
+func (c *queryCache) put(k cacheKey, version cacheVersion, message string, data []byte) {
+	if c == nil {
+		return
+	}
+	x := &cacheEntry{k: k, version: version, message: message, data: data}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if version != (cacheVersion{epoch: c.epoch, key: c.versions[k.key]}) || x.size() > c.budget {
+		return
+	}
+	if e, ok := c.entries[k]; ok {
+		c.remove(e)
+	}
+	c.entries[k] = c.lru.PushFront(x)
+	if c.byKey[k.key] == nil {
+		c.byKey[k.key] = make(map[cacheKey]bool)
+	}
+	c.byKey[k.key][k] = true
+	c.size += x.size()
+	for c.size > c.budget {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *queryCache) remove(e *list.Element) {
+	x := c.lru.Remove(e).(*cacheEntry)
+	delete(c.entries, x.k)
+	if m := c.byKey[x.k.key]; m != nil {
+		delete(m, x.k)
+		if len(m) == 0 {
+			delete(c.byKey, x.k.key)
+		}
+	}
+	c.size -= x.size()
+}
+
+// keySizes returns the number of bytes used by the cached results of each key.
+func (c *queryCache) keySizes() map[string]int {
+	sizes := make(map[string]int)
+	if c == nil {
+		return sizes
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.entries {
+		x := e.Value.(*cacheEntry)
+		sizes[x.k.key] += x.size()
+	}
+	return sizes
+}
+
+// invalidate drops the results of keys. It must be called after modifying their
+// values.
+func (c *queryCache) invalidate(keys ...string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range keys {
+		c.versions[k]++
+		for v := range c.byKey[k] {
+			c.remove(c.entries[v])
+		}
+	}
+}
+
+// invalidateStatements drops the results of the keys of statements.
+func (c *queryCache) invalidateStatements(statements []sequence.Statement) {
+	if c == nil {
+		return
+	}
+	keys := make([]string, len(statements))
+	for i, v := range statements {
+		keys[i] = v.Key
+	}
+	c.invalidate(keys...)
+}
+
+// reset drops all results. It must be called after modifying the values of keys
+// that are not known, e.g. when loading a store.
+func (c *queryCache) reset() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epoch++
+	c.size = 0
+	c.lru.Init()
+	c.entries = make(map[cacheKey]*list.Element)
+	c.byKey = make(map[string]map[cacheKey]bool)
+	c.versions = make(map[string]uint64)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// Calendar periods grouping values, weeks starting on Monday.
+const (
+	calendarDay  = "day"
+	calendarWeek = "week"
+)
+
+// calendarStart returns the start of the calendar period holding t, in the location
+// of t.
+func calendarStart(period string, t time.Time) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	if period == calendarWeek {
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	}
+	return day
+}
+
+// calendarBounds returns the starts of the calendar periods of loc overlapping the
+// closed interval defined by start and end, followed by the start of the next
+// period, so that period i spans [bounds[i], bounds[i+1]). Periods last 23 or 25
+// hours across daylight saving time changes.
+func calendarBounds(period string, loc *time.Location, start, end time.Time) ([]time.Time, error) {
+	var bounds []time.Time
+	t := calendarStart(period, start.In(loc))
+	for {
+		bounds = append(bounds, t)
+		if t.After(end) {
+			return bounds, nil
+		}
+		if len(bounds) > maxNumberOfPoints {
+			return nil, rangeError(fmt.Sprintf("range exceeds %d periods", maxNumberOfPoints))
+		}
+		if period == calendarWeek {
+			t = t.AddDate(0, 0, 7)
+		} else {
+			t = t.AddDate(0, 0, 1)
+		}
+	}
+}
+
+// calendarQuery represents the active and known values of each calendar period.
+type calendarQuery struct {
+	bounds []time.Time
+	sum    []int64
+	count  []int64
+}
+
+// newCalendarQuery groups values, starting at Unix time ts and spaced by frequency
+// seconds, into the calendar periods of loc overlapping the closed interval defined
+// by args.
+func newCalendarQuery(period string, loc *time.Location, values []uint8, ts, frequency int64, args queryArgs) (calendarQuery, error) {
+	bounds, err := calendarBounds(period, loc, args.start, args.end)
+	if err != nil {
+		return calendarQuery{}, err
+	}
+	q := calendarQuery{bounds: bounds, sum: make([]int64, len(bounds)-1), count: make([]int64, len(bounds)-1)}
+	var j int
+	for i, v := range values {
+		t := ts + int64(i)*frequency
+		if v == sequence.StateUnknown || t < args.start.Unix() || t > args.end.Unix() {
+			continue
+		}
+		for t >= bounds[j+1].Unix() {
+			j++
+		}
+		if v == sequence.StateActive {
+			q.sum[j]++
+		}
+		q.count[j]++
+	}
+	return q, nil
+}
+
+// total returns the number of values of period i within the closed interval defined
+// by args, values being spaced by frequency seconds.
+func (q calendarQuery) total(i int, frequency int64, args queryArgs) int64 {
+	lo, hi := q.bounds[i].Unix(), q.bounds[i+1].Unix()-1
+	if lo < args.start.Unix() {
+		lo = args.start.Unix()
+	}
+	if hi > args.end.Unix() {
+		hi = args.end.Unix()
+	}
+	if lo > hi {
+		return 0
+	}
+	return hi/frequency - ceilInt64(lo, frequency)/frequency + 1
+}
+
+// calendarRow represents the values of a calendar period starting at Unix time date,
+// as the rows of default queries.
+type calendarRow struct {
+	Date  int64    `json:"date"`
+	Count int64    `json:"count"`
+	Mean  *float64 `json:"mean"`
+}
+
+// rows returns the rows of q.
+func (q calendarQuery) rows() []calendarRow {
+	rows := make([]calendarRow, len(q.count))
+	for i := range rows {
+		rows[i] = calendarRow{Date: q.bounds[i].Unix(), Count: q.count[i]}
+		if q.count[i] > 0 {
+			x := math.Round(float64(q.sum[i])/float64(q.count[i])*100) / 100
+			rows[i].Mean = &x
+		}
+	}
+	return rows
+}
+
+// availabilityRows returns the availability of each period of q, values being
+// spaced by frequency seconds.
+func (q calendarQuery) availabilityRows(frequency int64, args queryArgs) []availabilityRow {
+	rows := make([]availabilityRow, len(q.count))
+	for i := range rows {
+		rows[i] = availabilityRow{Date: q.bounds[i].Unix(), availability: newAvailability(q.sum[i], q.count[i], q.total(i, frequency, args))}
+	}
+	return rows
+}
+
+// queryCalendar returns the calendar period and the location selected by the
+// calendar and tz parameters of r. The period is empty if calendar is not set.
+func queryCalendar(r *http.Request) (string, *time.Location, error) {
+	period := r.FormValue("calendar")
+	switch period {
+	case "":
+		return "", nil, nil
+	case calendarDay, calendarWeek:
+	default:
+		return "", nil, errors.New("calendar is not valid")
+	}
+	loc, err := queryLocation(r)
+	return period, loc, err
+}
+
+// queryLocation returns the location selected by the tz parameter of r, UTC if it
+// is not set.
+func queryLocation(r *http.Request) (*time.Location, error) {
+	tz := r.FormValue("tz")
+	if tz == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, errors.New("timezone is not valid")
+	}
+	return loc, nil
+}
+
+func (s *server) handlerQueryCalendar(w http.ResponseWriter, r *http.Request, key string, hours *schedule) {
+	period, loc, err := queryCalendar(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorInvalidRequest, err.Error())
+		return
+	}
+
+	x, ok := s.get(key)
+	if !ok {
+		writeError(w, http.StatusNotFound, errorKeyNotFound, "key does not exist")
+		return
+	}
+
+	start, end, err := parseRange(r.FormValue("start"), r.FormValue("end"), int64(x.Frequency()))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorInvalidRange, err.Error())
+		return
+	}
+	args := queryArgs{start: start, end: end, hours: hours}
+
+	values, ts := s.values(key, x, args, r.FormValue("maintenance") == "exclude")
+	q, err := newCalendarQuery(period, loc, values, ts, int64(x.Frequency()), args)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorInvalidRange, err.Error())
+		return
+	}
+
+	data, err := json.Marshal(q.rows())
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+		logf(r, "error serializing rows: %s", err)
+		return
+	}
+	writeResponse(w, http.StatusOK, statusOK, fmt.Sprintf("%d row(s) returned (calendar %s, %s)", len(q.count), period, loc), data)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// Key cardinality limits applying to the keys of each tenant, set by -max-keys and
+// -max-prefix-keys.
+var (
+	maxKeys       int
+	maxPrefixKeys prefixLimits
+)
+
+// A prefixLimit limits the number of keys starting with prefix.
+type prefixLimit struct {
+	prefix string
+	max    int
+}
+
+// prefixLimits implements the flag.Value interface, parsing values formatted as
+// prefix=keys.
+type prefixLimits []prefixLimit
+
+func (p *prefixLimits) String() string {
+	s := make([]string, len(*p))
+	for i, v := range *p {
+		s[i] = fmt.Sprintf("%s=%d", v.prefix, v.max)
+	}
+	return strings.Join(s, ",")
+}
+
+func (p *prefixLimits) Set(value string) error {
+	i := strings.LastIndexByte(value, '=')
+	if i < 1 {
+		return errors.New("expected prefix=keys")
+	}
+	max, err := strconv.Atoi(value[i+1:])
+	if err != nil || max < 1 {
+		return errors.New("expected prefix=keys, keys being a positive number")
+	}
+	*p = append(*p, prefixLimit{prefix: value[:i], max: max})
+	return nil
+}
+
+// keyRejections counts the series whose creation was rejected by each key limit.
+type keyRejections struct {
+	quota  atomic.Uint64
+	keys   atomic.Uint64
+	prefix atomic.Uint64
+	memory atomic.Uint64
+}
+
+// keyLimits tracks the series of a server against the key quota of its tenant and
+// the key cardinality limits.
+type keyLimits struct {
+	s        *server
+	quota    int
+	memory   bool
+	series   map[string]bool
+	prefixes []int // number of series starting with each prefix of maxPrefixKeys
+	rejected map[string]error
+}
+
+// keyLimits returns the key limits of s, or nil if the number of keys is
+// unlimited. Limits can be exceeded by a few keys by concurrent requests.
+func (s *server) keyLimits() *keyLimits {
+	quota := s.settings().quota.maxKeys
+	memory := s.memoryExceeded.Load()
+	if quota <= 0 && maxKeys <= 0 && len(maxPrefixKeys) == 0 && !memory {
+		return nil
+	}
+	l := &keyLimits{
+		s:        s,
+		quota:    quota,
+		memory:   memory,
+		series:   make(map[string]bool),
+		prefixes: make([]int, len(maxPrefixKeys)),
+		rejected: make(map[string]error),
+	}
+	for _, k := range s.keys("*") {
+		l.add(k)
+	}
+	return l
+}
+
+// add records series as existing.
+func (l *keyLimits) add(series string) {
+	l.series[series] = true
+	for i, v := range maxPrefixKeys {
+		if strings.HasPrefix(series, v.prefix) {
+			l.prefixes[i]++
+		}
+	}
+}
+
+// check returns nil if key, possibly an internal key, belongs to an existing series
+// or to a series that can be created, recording the series as created, and the
+// error of the exceeded limit otherwise.
+func (l *keyLimits) check(key string) error {
+	if l == nil {
+		return nil
+	}
+	key = seriesKey(key)
+	if l.series[key] {
+		return nil
+	}
+	if err, ok := l.rejected[key]; ok {
+		return err
+	}
+	var err error
+	switch n := len(l.series); {
+	case l.memory:
+		l.s.keyRejections.memory.Add(1)
+		err = errMemoryLimit
+	case l.quota > 0 && n >= l.quota:
+		l.s.keyRejections.quota.Add(1)
+		err = errKeyQuota
+	case maxKeys > 0 && n >= maxKeys:
+		l.s.keyRejections.keys.Add(1)
+		err = fmt.Errorf("key limit exceeded (%d keys)", maxKeys)
+	default:
+		for i, v := range maxPrefixKeys {
+			if strings.HasPrefix(key, v.prefix) && l.prefixes[i] >= v.max {
+				l.s.keyRejections.prefix.Add(1)
+				err = fmt.Errorf("key limit of prefix %s exceeded (%d keys)", v.prefix, v.max)
+				break
+			}
+		}
+	}
+	if err != nil {
+		l.rejected[key] = err
+		return err
+	}
+	l.add(key)
+	return nil
+}
+
+// A limitedKeys maps the indexes of the statements of a batch prevented from
+// creating their key by key limits to their error.
+type limitedKeys map[int]error
+
+// limitKeys prevents the statements creating a series beyond the key limits of s
+// from creating their key, returning their indexes.
+func (s *server) limitKeys(statements []sequence.Statement) limitedKeys {
+	l := s.keyLimits()
+	if l == nil {
+		return nil
+	}
+	var limited limitedKeys
+	for i, v := range statements {
+		if !v.CreateIfNotExists {
+			continue
+		}
+		err := l.check(v.Key)
+		if err == nil {
+			continue
+		}
+		if limited == nil {
+			limited = make(limitedKeys)
+		}
+		statements[i].CreateIfNotExists = false
+		limited[i] = err
+	}
+	return limited
+}
+
+// apply sets the error of the limited statements of a batch.
+func (l limitedKeys) apply(errs []error) {
+	for i, err := range l {
+		errs[i] = err
+	}
+}
+
+// handlerMetrics writes the number of keys of each tenant and the number of series
+// rejected by each key limit using the Prometheus text format.
+func (s *server) handlerMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	names := []string{defaultTenant}
+	servers := map[string]*server{defaultTenant: s}
+	for k, v := range s.tenants {
+		names = append(names, k)
+		servers[k] = v.server
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("# HELP rl_keys Number of keys.\n# TYPE rl_keys gauge\n")
+	for _, k := range names {
+		fmt.Fprintf(&b, "rl_keys{tenant=%q} %d\n", k, len(servers[k].keys("*")))
+	}
+	b.WriteString("# HELP rl_key_rejections_total Number of keys whose creation was rejected by a key limit.\n# TYPE rl_key_rejections_total counter\n")
+	for _, k := range names {
+		x := &servers[k].keyRejections
+		fmt.Fprintf(&b, "rl_key_rejections_total{tenant=%q,limit=\"quota\"} %d\n", k, x.quota.Load())
+		fmt.Fprintf(&b, "rl_key_rejections_total{tenant=%q,limit=\"keys\"} %d\n", k, x.keys.Load())
+		fmt.Fprintf(&b, "rl_key_rejections_total{tenant=%q,limit=\"prefix\"} %d\n", k, x.prefix.Load())
+		fmt.Fprintf(&b, "rl_key_rejections_total{tenant=%q,limit=\"memory\"} %d\n", k, x.memory.Load())
+	}
+	writeRequestMetrics(&b)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
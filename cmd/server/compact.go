@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// A compaction reports the outcome of a compaction of the store: the number of
+// sequences, their encoded size and the heap of the process before and after, and
+// the memory returned to the operating system, in bytes.
+type compaction struct {
+	Sequences   int     `json:"sequences"`
+	BytesBefore int     `json:"bytes_before"`
+	BytesAfter  int     `json:"bytes_after"`
+	HeapBefore  uint64  `json:"heap_before"`
+	HeapAfter   uint64  `json:"heap_after"`
+	Released    uint64  `json:"released"`
+	Duration    float64 `json:"duration"`
+}
+
+// compact rebuilds each sequence of the store from its values, merging adjacent runs
+// of the same state and dropping the spare capacity left by inserts and backfills,
+// then returns freed memory to the operating system. Sequences are rebuilt one at a
+// time so that inserts are only blocked briefly.
+func (s *server) compact() compaction {
+	start := time.Now()
+	var c compaction
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	c.HeapBefore = m.HeapInuse
+	released := m.HeapReleased
+
+	for _, k := range s.store.Keys() {
+		s.mu.Lock()
+		if x, ok := s.store.Get(k); ok {
+			y := sequence.NewWithValues(time.Unix(x.Timestamp(), 0), x.Frequency(), x.All())
+			if length := x.Length(); length > 0 {
+				y.SetLength(length)
+			}
+			s.store.Add(k, y)
+			c.Sequences++
+			c.BytesBefore += len(x.Bytes())
+			c.BytesAfter += len(y.Bytes())
+		}
+		s.mu.Unlock()
+	}
+
+	debug.FreeOSMemory()
+	runtime.ReadMemStats(&m)
+	c.HeapAfter = m.HeapInuse
+	if m.HeapReleased > released {
+		c.Released = m.HeapReleased - released
+	}
+	c.Duration = time.Since(start).Seconds()
+	return c
+}
+
+func (s *server) handlerCompact(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+	c := s.compact()
+	logf(r, "compacted %d sequence(s) in %.3fs: %d -> %d bytes, heap %d -> %d bytes", c.Sequences, c.Duration, c.BytesBefore, c.BytesAfter, c.HeapBefore, c.HeapAfter)
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+		logf(r, "error serializing compaction: %s", err)
+		return
+	}
+	writeResponse(w, http.StatusOK, statusOK, fmt.Sprintf("%d sequence(s) compacted", c.Sequences), data)
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// A compositeExpr represents a boolean expression over keys. Values are combined
+// using three-valued logic, unknown values propagating unless the result can be
+// determined from known values.
+type compositeExpr struct {
+	op   string // "key", "and", "or" or "not"
+	key  string
+	args []*compositeExpr
+}
+
+// eval evaluates e using value to get the value of keys.
+func (e *compositeExpr) eval(value func(key string) uint8) uint8 {
+	switch e.op {
+	case "key":
+		return value(e.key)
+	case "not":
+		switch e.args[0].eval(value) {
+		case sequence.StateActive:
+			return sequence.StateInactive
+		case sequence.StateInactive:
+			return sequence.StateActive
+		}
+		return sequence.StateUnknown
+	}
+	// an inactive (resp. active) operand determines the result of AND (resp. OR)
+	absorbing, neutral := sequence.StateInactive, sequence.StateActive
+	if e.op == "or" {
+		absorbing, neutral = sequence.StateActive, sequence.StateInactive
+	}
+	result := neutral
+	for _, v := range e.args {
+		switch v.eval(value) {
+		case absorbing:
+			return absorbing
+		case sequence.StateUnknown:
+			result = sequence.StateUnknown
+		}
+	}
+	return result
+}
+
+// keys returns the keys referenced by e.
+func (e *compositeExpr) keys() []string {
+	if e.op == "key" {
+		return []string{e.key}
+	}
+	var keys []string
+	for _, v := range e.args {
+		keys = append(keys, v.keys()...)
+	}
+	return keys
+}
+
+// parseComposite parses a boolean expression made of keys, AND, OR and NOT
+// operators (or &&, || and !) and parentheses.
+func parseComposite(s string) (*compositeExpr, error) {
+	p := compositeParser{tokens: tokenizeComposite(s)}
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.i != len(p.tokens) {
+		return nil, fmt.Errorf("unexpected token %q", p.tokens[p.i])
+	}
+	return e, nil
+}
+
+func tokenizeComposite(s string) []string {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')' || c == '!':
+			tokens = append(tokens, s[i:i+1])
+			i++
+		case strings.HasPrefix(s[i:], "&&") || strings.HasPrefix(s[i:], "||"):
+			tokens = append(tokens, s[i:i+2])
+			i += 2
+		default:
+			j := i
+			for j < len(s) && isKeyChar(s[j]) {
+				j++
+			}
+			if j == i {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+	return tokens
+}
+
+func isKeyChar(c byte) bool {
+	return c == '_' || c == '.' || c == '/' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+type compositeParser struct {
+	tokens []string
+	i      int
+}
+
+func (p *compositeParser) peek() string {
+	if p.i < len(p.tokens) {
+		return p.tokens[p.i]
+	}
+	return ""
+}
+
+func (p *compositeParser) or() (*compositeExpr, error) {
+	return p.binary("or", []string{"OR", "||"}, p.and)
+}
+
+func (p *compositeParser) and() (*compositeExpr, error) {
+	return p.binary("and", []string{"AND", "&&"}, p.not)
+}
+
+func (p *compositeParser) binary(op string, tokens []string, next func() (*compositeExpr, error)) (*compositeExpr, error) {
+	e, err := next()
+	if err != nil {
+		return nil, err
+	}
+	args := []*compositeExpr{e}
+	for {
+		t := p.peek()
+		if !strings.EqualFold(t, tokens[0]) && t != tokens[1] {
+			break
+		}
+		p.i++
+		e, err := next()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, e)
+	}
+	if len(args) == 1 {
+		return args[0], nil
+	}
+	return &compositeExpr{op: op, args: args}, nil
+}
+
+func (p *compositeParser) not() (*compositeExpr, error) {
+	t := p.peek()
+	switch {
+	case t == "":
+		return nil, errors.New("unexpected end of expression")
+	case strings.EqualFold(t, "NOT") || t == "!":
+		p.i++
+		e, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return &compositeExpr{op: "not", args: []*compositeExpr{e}}, nil
+	case t == "(":
+		p.i++
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, errors.New("missing closing parenthesis")
+		}
+		p.i++
+		return e, nil
+	case validKey.MatchString(t) && !strings.EqualFold(t, "AND") && !strings.EqualFold(t, "OR"):
+		p.i++
+		return &compositeExpr{op: "key", key: t}, nil
+	}
+	return nil, fmt.Errorf("unexpected token %q", t)
+}
+
+// get returns a copy of the sequence associated to key. If key is not in the store
+// but defines a composite key, the composite sequence is computed from the sequences
+// of the keys referenced by its expression.
+func (s *server) get(key string) (*sequence.Sequence, bool) {
+	if x, ok := s.store.Get(key); ok {
+		s.touchQuery(key)
+		return x, true
+	}
+	expression, ok := s.meta.composite(key)
+	if !ok {
+		return nil, false
+	}
+	e, err := parseComposite(expression)
+	if err != nil {
+		log.Printf("error parsing composite key %s: %s", key, err)
+		return nil, false
+	}
+	return s.evalComposite(e), true
+}
+
+// evalComposite computes the sequence defined by e, using the smallest frequency of
+// the referenced keys and spanning all their values. Missing keys are considered
+// unknown.
+func (s *server) evalComposite(e *compositeExpr) *sequence.Sequence {
+	type component struct {
+		ts, frequency int64
+		values        []uint8
+	}
+	components := make(map[string]component)
+	var start, end, frequency int64
+	for _, k := range e.keys() {
+		if _, ok := components[k]; ok {
+			continue
+		}
+		x, ok := s.store.Get(k)
+		if !ok {
+			continue
+		}
+		c := component{ts: x.Timestamp(), frequency: int64(x.Frequency()), values: x.All()}
+		components[k] = c
+		last := c.ts + int64(len(c.values))*c.frequency
+		if frequency == 0 || c.ts < start {
+			start = c.ts
+		}
+		if last > end {
+			end = last
+		}
+		if frequency == 0 || c.frequency < frequency {
+			frequency = c.frequency
+		}
+	}
+	if frequency == 0 {
+		return sequence.New(time.Now().Truncate(time.Duration(sequenceFrequency)*time.Second), sequenceFrequency)
+	}
+	start -= start % frequency
+	values := make([]uint8, (end-start+frequency-1)/frequency)
+	for i := range values {
+		t := start + int64(i)*frequency
+		values[i] = e.eval(func(key string) uint8 {
+			c, ok := components[key]
+			if !ok || t < c.ts {
+				return sequence.StateUnknown
+			}
+			j := (t - c.ts) / c.frequency
+			if j >= int64(len(c.values)) {
+				return sequence.StateUnknown
+			}
+			return c.values[j]
+		})
+	}
+	return sequence.NewWithValues(time.Unix(start, 0), uint16(frequency), values)
+}
+
+func (s *server) handlerComposites(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		data, err := json.Marshal(s.meta.composites())
+		if err != nil {
+			writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+			logf(r, "error serializing composite keys: %s", err)
+			return
+		}
+		writeResponse(w, http.StatusOK, statusOK, "composite keys returned", data)
+	case http.MethodPost:
+		s.handlerCompositesAdd(w, r)
+	case http.MethodDelete:
+		s.meta.deleteComposite(r.FormValue("key"))
+		s.cache.invalidate(r.FormValue("key"))
+		writeResponse(w, http.StatusOK, statusOK, "composite key deleted", nil)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPost, http.MethodDelete)
+	}
+}
+
+func (s *server) handlerCompositesAdd(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, statusError, "error reading request body", nil)
+		logf(r, "error reading request body: %s", err)
+		return
+	}
+
+	lines := bytes.Split(body, []byte("\n"))
+
+	var n int
+	for i, line := range lines {
+		p := bytes.IndexByte(line, '=')
+		if p == -1 {
+			logf(r, "error parsing statement %d", i+1)
+			continue
+		}
+		key := string(bytes.TrimSpace(line[:p]))
+		expression := string(bytes.TrimSpace(line[p+1:]))
+		if !validKey.MatchString(key) {
+			logf(r, "error parsing statement %d: key is not valid", i+1)
+			continue
+		}
+		if _, err := parseComposite(expression); err != nil {
+			logf(r, "error parsing statement %d: %s", i+1, err)
+			continue
+		}
+		s.meta.setComposite(key, expression)
+		s.cache.invalidate(key)
+		n++
+	}
+
+	status := statusOK
+	if n != len(lines) {
+		status = statusWarning
+	}
+
+	writeResponse(w, http.StatusOK, status, fmt.Sprintf("processed %d/%d statement(s)", n, len(lines)), nil)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// config represents the content of the configuration file. Options and settings
+// apply unless the corresponding flags are set on the command line.
+type config struct {
+	Listen             string                  `json:"listen"`
+	DumpFile           string                  `json:"dump_file"`
+	MetaFile           string                  `json:"meta_file"`
+	RollupInterval     *int                    `json:"rollup_interval"`
+	IdleExpiry         *int                    `json:"idle_expiry"`
+	Aggregations       []int64                 `json:"aggregations"`
+	DumpInterval       *int                    `json:"dump_interval"`
+	Retention          *int                    `json:"retention"`
+	RetentionOverrides map[string]int          `json:"retention_overrides"`
+	Tokens             []string                `json:"tokens"`
+	Rules              []rule                  `json:"rules"`
+	Webhooks           []webhook               `json:"webhooks"`
+	Notifiers          []notifierConfig        `json:"notifiers"`
+	Reports            []report                `json:"reports"`
+	Tenants            map[string]tenantConfig `json:"tenants"`
+}
+
+// loadConfig reads and validates the configuration file f, encoded as TOML if its
+// extension is .toml and as JSON otherwise.
+func loadConfig(f string) (*config, error) {
+	data, err := os.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(f, ".toml") {
+		m, err := parseTOML(data)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = json.Marshal(m); err != nil {
+			return nil, err
+		}
+	}
+	var c config
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	for i, v := range c.Aggregations {
+		if v < sequenceFrequency || v%sequenceFrequency != 0 || 86400%v != 0 || (i > 0 && v <= c.Aggregations[i-1]) {
+			return nil, fmt.Errorf("aggregations must be increasing divisors of 86400 and multiples of %d", sequenceFrequency)
+		}
+	}
+	for _, v := range c.Tokens {
+		if v == "" {
+			return nil, errors.New("tokens cannot be empty")
+		}
+	}
+	for name, t := range c.Tenants {
+		for _, v := range t.Tokens {
+			if v == "" {
+				return nil, fmt.Errorf("tenant %s: tokens cannot be empty", name)
+			}
+		}
+		if t.MaxKeys < 0 || t.IngestRate < 0 || t.MaxQueryRange < 0 {
+			return nil, fmt.Errorf("tenant %s: quotas cannot be negative", name)
+		}
+	}
+	notifiers := make(map[string]bool)
+	for i, v := range c.Notifiers {
+		if err := v.validate(); err != nil {
+			return nil, fmt.Errorf("notifier %d: %s", i+1, err)
+		}
+		if notifiers[v.Name] {
+			return nil, fmt.Errorf("notifier %d: name is already used", i+1)
+		}
+		notifiers[v.Name] = true
+	}
+	for i, v := range c.Rules {
+		if err := v.validate(); err != nil {
+			return nil, fmt.Errorf("rule %d: %s", i+1, err)
+		}
+		for _, name := range v.Notify {
+			if !notifiers[name] {
+				return nil, fmt.Errorf("rule %d: notifier %q does not exist", i+1, name)
+			}
+		}
+	}
+	for i, v := range c.Webhooks {
+		if err := v.validate(); err != nil {
+			return nil, fmt.Errorf("webhook %d: %s", i+1, err)
+		}
+	}
+	for i, v := range c.Reports {
+		if err := v.validate(); err != nil {
+			return nil, fmt.Errorf("report %d: %s", i+1, err)
+		}
+	}
+	return &c, nil
+}
+
+// applyFlags sets the flags that are not set on the command line, set holding the
+// names of the flags set, to the startup options defined in c.
+func (c *config) applyFlags(set map[string]bool) error {
+	values := make(map[string]string)
+	if c.Listen != "" {
+		values["l"] = c.Listen
+	}
+	if c.DumpFile != "" {
+		values["f"] = c.DumpFile
+	}
+	if c.MetaFile != "" {
+		values["m"] = c.MetaFile
+	}
+	if c.RollupInterval != nil {
+		values["u"] = strconv.Itoa(*c.RollupInterval)
+	}
+	if c.IdleExpiry != nil {
+		values["t"] = strconv.Itoa(*c.IdleExpiry)
+	}
+	for name, v := range values {
+		if set[name] {
+			continue
+		}
+		if err := flag.Set(name, v); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	if len(c.Aggregations) > 0 {
+		aggregations = c.Aggregations
+	}
+	return nil
+}
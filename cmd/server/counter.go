@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// Counters store the increase of monotonically increasing values between consecutive
+// samples, using one binary sequence per bit of the increase. The last value of each
+// counter is kept in memory only: after a restart the first sample of a counter sets
+// a new reference and no increase is recorded for it.
+const (
+	counterBits     = 32
+	counterMaxValue = 1<<counterBits - 1
+	counterKeyInfix = "#c"
+)
+
+var validCounterStatement = regexp.MustCompile(`^` + keyPattern + ` \d{1,20}(?: \d+)?$`)
+
+// counterRow represents an aggregated group of counter increases.
+type counterRow struct {
+	Date     int64    `json:"date"`
+	Count    int64    `json:"count"`
+	Increase *int64   `json:"increase"`
+	Rate     *float64 `json:"rate"`
+}
+
+func (s *server) handlerCounterInsert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	buf, err := readBody(r.Body)
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, statusError, "error reading request body", nil)
+		logf(r, "error reading request body: %s", err)
+		return
+	}
+	defer putBuffer(buf)
+	body := buf.Bytes()
+
+	defaultValueTimestamp := requestTime(r)
+	defaultSequenceTimestamp := defaultValueTimestamp.Truncate(time.Duration(sequenceFrequency) * time.Second)
+
+	lines := bytes.Split(body, []byte("\n"))
+	if tooManyStatements(w, lines) || s.limitIngest(w, r, len(lines)) {
+		return
+	}
+	rejected := newRejections(r, lines)
+
+	s.countersMu.Lock()
+	defer s.countersMu.Unlock()
+	// checked before parsing, which updates the last value of counters
+	if err := r.Context().Err(); err != nil {
+		writeContextError(w, err)
+		return
+	}
+
+	// each line recording an increase expands to one statement per bit
+	var n int
+	mapping := make([]int, 0, len(lines))
+	statements := getStatements(0, len(lines)*counterBits)
+	defer func() { putStatements(statements) }()
+
+	for i, line := range lines {
+		if reason := checkStatement(r, validCounterStatement, line); reason != "" {
+			logf(r, "error parsing statement %d: %s", i+1, reason)
+			rejected.add(i, reason)
+			continue
+		}
+		fields := bytes.Fields(line)
+		key := string(fields[0])
+		value, err := strconv.ParseUint(string(fields[1]), 10, 64)
+		if err != nil {
+			logf(r, "error parsing statement %d: value out of range", i+1)
+			rejected.add(i, "value out of range")
+			continue
+		}
+		valueTimestamp, sequenceTimestamp := defaultValueTimestamp, defaultSequenceTimestamp
+		if len(fields) > 2 {
+			x, err := strconv.Atoi(string(fields[2]))
+			if err != nil {
+				logf(r, "error parsing statement %d: timestamp out of range", i+1)
+				rejected.add(i, "timestamp out of range")
+				continue
+			}
+			var ok bool
+			if valueTimestamp, ok = s.future(time.Unix(int64(x), 0), defaultValueTimestamp); !ok {
+				logf(r, "error parsing statement %d: timestamp in the future", i+1)
+				rejected.add(i, "timestamp in the future")
+				continue
+			}
+			sequenceTimestamp = valueTimestamp.Truncate(time.Duration(sequenceFrequency) * time.Second)
+		}
+		last, ok := s.counters[key]
+		s.counters[key] = value
+		n++
+		if !ok {
+			continue
+		}
+		// a decreasing value denotes a counter reset
+		increase := value
+		if value >= last {
+			increase = value - last
+		}
+		if increase > counterMaxValue {
+			logf(r, "error executing statement %d: increase out of range", i+1)
+			rejected.add(i, "increase out of range")
+			n--
+			continue
+		}
+		for j := 0; j < counterBits; j++ {
+			statements = append(statements, sequence.Statement{
+				Key:                 planeKey(key, counterKeyInfix, j),
+				Timestamp:           valueTimestamp,
+				Value:               uint8(increase>>j) & 1,
+				Type:                sequence.StatementAdd,
+				CreateIfNotExists:   true,
+				CreateWithTimestamp: sequenceTimestamp,
+				CreateWithFrequency: sequenceFrequency,
+			})
+		}
+		mapping = append(mapping, i)
+	}
+
+	limited := s.limitKeys(statements)
+	s.mu.RLock()
+	result := s.store.Batch(statements, s.replicator.statements)
+	s.cache.invalidateStatements(statements)
+	s.mu.RUnlock()
+	s.touch(statements, result)
+	var errs []error
+	if result.HasErrors() {
+		errs = result.ErrorVars()
+		limited.apply(errs)
+		for i := range mapping {
+			for _, err := range errs[i*counterBits : (i+1)*counterBits] {
+				if err != nil {
+					logf(r, "error executing statement %d: %s", mapping[i]+1, err)
+					rejected.add(mapping[i], err.Error())
+					n--
+					break
+				}
+			}
+		}
+	}
+
+	status := statusOK
+	if n != len(lines) {
+		status = statusWarning
+	}
+
+	if raftEffects(r) {
+		s.relay.send("/counter/insert/", rejected.accepted(), defaultValueTimestamp)
+	}
+	message := fmt.Sprintf("processed %d/%d statement(s)", n, len(lines))
+	s.audit(r, auditCounterInsert, appliedKeys(statements, errs), message)
+	writeResponse(w, http.StatusOK, status, message, rejected.data())
+}
+
+func (s *server) handlerCounterQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	key := r.FormValue("key")
+
+	x, ok := s.store.Get(planeKey(key, counterKeyInfix, 0))
+	if !ok {
+		writeError(w, http.StatusNotFound, errorKeyNotFound, "key does not exist")
+		return
+	}
+	s.touchQuery(key)
+
+	args, err := newQueryArgs(r.FormValue("start"), r.FormValue("end"), int64(x.Frequency()))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorInvalidRange, err.Error())
+		return
+	}
+
+	var rows []counterRow
+	for i := 0; i < counterBits; i++ {
+		qs, err := s.store.Query(planeKey(key, counterKeyInfix, i), args.start, args.end, args.interval)
+		if err != nil {
+			writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+			logf(r, "error executing query: %s", err)
+			return
+		}
+		if i == 0 {
+			rows = make([]counterRow, len(qs.Count))
+			for j := range rows {
+				rows[j].Date = qs.Timestamp + int64(j)*qs.Frequency
+				rows[j].Count = qs.Count[j]
+				if qs.Count[j] > 0 {
+					rows[j].Increase = new(int64)
+				}
+			}
+		}
+		for j := range rows {
+			if rows[j].Increase != nil {
+				*rows[j].Increase += qs.Sum[j] << i
+			}
+		}
+	}
+
+	for i := range rows {
+		if rows[i].Increase != nil {
+			rate := float64(*rows[i].Increase) / float64(rows[i].Count*int64(x.Frequency()))
+			rows[i].Rate = &rate
+		}
+	}
+
+	data, err := json.Marshal(rows)
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+		logf(r, "error serializing rows: %s", err)
+		return
+	}
+
+	message := fmt.Sprintf("%d row(s) returned (interval %ds)", len(rows), int(args.interval.Seconds()))
+	writeResponse(w, http.StatusOK, statusOK, message, data)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// A dashboard represents a named set of panels displayed by the UI, Range being
+// the default time range in seconds ending at the current time.
+type dashboard struct {
+	Name    string  `json:"name"`
+	Range   int64   `json:"range"`
+	Refresh int64   `json:"refresh,omitempty"`
+	Panels  []panel `json:"panels"`
+	Updated int64   `json:"updated"`
+}
+
+// A panel displays the results of a query on keys, subtree patterns or composite
+// keys, positioned on a grid using X, Y, Width and Height.
+type panel struct {
+	Title  string   `json:"title,omitempty"`
+	Keys   []string `json:"keys"`
+	Mode   string   `json:"mode,omitempty"`
+	X      int      `json:"x"`
+	Y      int      `json:"y"`
+	Width  int      `json:"width"`
+	Height int      `json:"height"`
+}
+
+func (d dashboard) validate() error {
+	if !validKey.MatchString(d.Name) {
+		return errors.New("name is not valid")
+	}
+	if d.Range <= 0 || d.Refresh < 0 {
+		return errors.New("range is not valid")
+	}
+	for i, p := range d.Panels {
+		if len(p.Keys) == 0 {
+			return fmt.Errorf("panel %d: missing key", i+1)
+		}
+		for _, k := range p.Keys {
+			if !validKey.MatchString(k) && !isSubtree(k) {
+				return fmt.Errorf("panel %d: key %s is not valid", i+1, k)
+			}
+		}
+		switch p.Mode {
+		case "", "default", "availability", "transitions":
+		default:
+			return fmt.Errorf("panel %d: mode is not supported", i+1)
+		}
+		if p.X < 0 || p.Y < 0 || p.Width < 0 || p.Height < 0 {
+			return fmt.Errorf("panel %d: layout is not valid", i+1)
+		}
+	}
+	return nil
+}
+
+func (s *server) handlerDashboards(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		var v any
+		message := "dashboards returned"
+		if name := r.FormValue("name"); name != "" {
+			x, ok := s.meta.dashboard(name)
+			if !ok {
+				writeResponse(w, http.StatusNotFound, statusError, "dashboard does not exist", nil)
+				return
+			}
+			v, message = x, "dashboard returned"
+		} else {
+			v = s.meta.dashboards()
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+			logf(r, "error serializing dashboards: %s", err)
+			return
+		}
+		writeResponse(w, http.StatusOK, statusOK, message, data)
+	case http.MethodPost:
+		s.handlerDashboardsAdd(w, r)
+	case http.MethodDelete:
+		if !s.meta.deleteDashboard(r.FormValue("name")) {
+			writeResponse(w, http.StatusNotFound, statusError, "dashboard does not exist", nil)
+			return
+		}
+		writeResponse(w, http.StatusOK, statusOK, "dashboard deleted", nil)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPost, http.MethodDelete)
+	}
+}
+
+func (s *server) handlerDashboardsAdd(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, statusError, "error reading request body", nil)
+		logf(r, "error reading request body: %s", err)
+		return
+	}
+
+	var d dashboard
+	if err := json.Unmarshal(body, &d); err != nil {
+		writeResponse(w, http.StatusBadRequest, statusError, "error parsing dashboard", nil)
+		return
+	}
+	if err := d.validate(); err != nil {
+		writeResponse(w, http.StatusBadRequest, statusError, err.Error(), nil)
+		return
+	}
+	if d.Panels == nil {
+		d.Panels = []panel{}
+	}
+	d.Updated = time.Now().Unix()
+	s.meta.setDashboard(d)
+
+	writeResponse(w, http.StatusOK, statusOK, "dashboard saved", nil)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Deadlines of insert and query requests, set by -insert-timeout and
+// -query-timeout.
+var (
+	insertTimeout time.Duration
+	queryTimeout  time.Duration
+)
+
+// Errors of the requests whose context is done before their response is computed.
+var (
+	errTimeout  = errors.New("request timed out")
+	errCanceled = errors.New("request canceled")
+)
+
+// deadline returns a handler running h with a context cancelled after d, so that
+// handlers honoring the context of requests stop working on requests exceeding d.
+// NDJSON insert streams are not bounded, their connection being closed when idle
+// instead.
+func deadline(d time.Duration, h http.HandlerFunc) http.HandlerFunc {
+	if d <= 0 {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isNDJSON(r) {
+			h(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		h(w, r.WithContext(ctx))
+	}
+}
+
+// contextError returns the status code and error of the response to a request whose
+// context is done with err: 503, as http.TimeoutHandler, if the deadline of the
+// request is exceeded, or 499 if the client disconnected.
+func contextError(err error) (int, error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusServiceUnavailable, errTimeout
+	}
+	return statusClientClosedRequest, errCanceled
+}
+
+// writeContextError writes the error response of a request whose context is done
+// with err.
+func writeContextError(w http.ResponseWriter, err error) {
+	code, err := contextError(err)
+	writeError(w, code, queryErrorCode(err), err.Error())
+}
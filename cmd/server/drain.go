@@ -0,0 +1,30 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// drain stops accepting write requests and dumps the store, queries being served
+// until shutdown. Draining the default tenant drains every tenant.
+func (s *server) drain() {
+	if s.draining.Swap(true) {
+		return
+	}
+	log.Println("draining, write requests are rejected")
+	s.mu.Lock()
+	s.mu.Unlock() // waits for in-flight batch inserts
+	s.dump()
+	for _, t := range s.tenants {
+		t.drain()
+	}
+}
+
+func (s *server) handlerDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+	s.drain()
+	writeResponse(w, http.StatusOK, statusOK, "server is draining", nil)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// errDuplicate reports a statement identified as a duplicate of a recorded value.
+var errDuplicate = errors.New("duplicate value")
+
+// errOverwrite is the message of the error returned by the sequence package when
+// a statement targets a value that has already been recorded.
+const errOverwrite = "cannot overwrite value"
+
+// A duplicateFilter identifies the statements of an insert request that failed
+// because their (key, timestamp) has already been recorded with the same value,
+// if the request asks for it using duplicates=skip. Such statements are usually
+// sent again by agents retrying after a timeout, and are reported separately
+// instead of being rejected.
+type duplicateFilter struct {
+	s         *server
+	enabled   bool
+	sequences map[string]*sequence.Sequence
+}
+
+func (s *server) newDuplicateFilter(r *http.Request) *duplicateFilter {
+	return &duplicateFilter{s: s, enabled: r.FormValue("duplicates") == "skip"}
+}
+
+// match reports whether x failed with err because it duplicates a recorded value.
+func (d *duplicateFilter) match(x sequence.Statement, err error) bool {
+	if !d.enabled || err == nil || err.Error() != errOverwrite {
+		return false
+	}
+	if d.sequences == nil {
+		d.sequences = make(map[string]*sequence.Sequence)
+	}
+	v, ok := d.sequences[x.Key]
+	if !ok {
+		v, _ = d.s.store.Get(x.Key)
+		d.sequences[x.Key] = v
+	}
+	if v == nil {
+		return false
+	}
+	f := int64(v.Frequency())
+	t := time.Unix(x.Timestamp.Unix()-(x.Timestamp.Unix()-v.Timestamp())%f, 0) // start of the slot
+	values, _, err := v.Values(t, t)
+	return err == nil && len(values) == 1 && values[0] == x.Value
+}
+
+// message returns the message of the response of an insert request.
+func (d *duplicateFilter) message(processed, duplicates, total int) string {
+	if !d.enabled {
+		return fmt.Sprintf("processed %d/%d statement(s)", processed, total)
+	}
+	return fmt.Sprintf("processed %d/%d statement(s), %d duplicate(s)", processed, total, duplicates)
+}
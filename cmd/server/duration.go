@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// maxStatementDuration is the longest duration of an insert statement.
+const maxStatementDuration = 7 * 24 * time.Hour
+
+// statementSamples returns the number of values of key covered by an insert
+// statement lasting d seconds and the frequency of key, values of new keys being
+// spaced by the default frequency, or the reason of the rejection of the statement.
+func (s *server) statementSamples(key string, d int64) (int, int64, string) {
+	if d < 1 {
+		return 0, 0, "duration is not valid"
+	}
+	if d > int64(maxStatementDuration/time.Second) {
+		return 0, 0, fmt.Sprintf("duration exceeds %d seconds", int64(maxStatementDuration/time.Second))
+	}
+	frequency := int64(sequenceFrequency)
+	if x, ok := s.store.Get(key); ok {
+		frequency = int64(x.Frequency())
+	}
+	return int((d + frequency - 1) / frequency), frequency, ""
+}
+
+// futureSamples applies the future timestamp policy to the last of samples values
+// spaced by frequency seconds from t, now being the time of the server. It returns
+// the number of values to record, values ahead of the server being dropped by the
+// clamp policy, or false if the statement is rejected.
+func (s *server) futureSamples(t time.Time, samples int, frequency int64, now time.Time) (int, bool) {
+	step := time.Duration(frequency) * time.Second
+	limit := now.Add(s.futureSkew)
+	if !t.Add(time.Duration(samples-1) * step).After(limit) {
+		return samples, true
+	}
+	switch s.futurePolicy {
+	case futureReject:
+		return 0, false
+	case futureClamp:
+		if n := int(limit.Sub(t)/step) + 1; n > 1 {
+			return n, true
+		}
+		return 1, true
+	}
+	return samples, true
+}
+
+// lineOutcomes calls fn with the outcome of each line of a batch of statements,
+// mapping holding the line of each statement and the statements of a line being
+// consecutive: the first error of its statements, errDuplicate if all its
+// statements are duplicates, or nil.
+func lineOutcomes(mapping []int, errs []error, fn func(line int, err error)) {
+	for j := 0; j < len(errs); {
+		i := mapping[j]
+		var err error
+		duplicate := true
+		for ; j < len(errs) && mapping[j] == i; j++ {
+			if errs[j] != errDuplicate {
+				duplicate = false
+				if err == nil {
+					err = errs[j]
+				}
+			}
+		}
+		if duplicate {
+			err = errDuplicate
+		}
+		fn(i, err)
+	}
+}
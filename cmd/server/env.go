@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envFlags maps flags to the environment variables that can be used to set them.
+var envFlags = map[string]string{
+	"l": "RL_LISTEN",
+	"a": "RL_ALLOW",
+	"T": "RL_TLS_LISTEN",
+	"C": "RL_TLS_CERT",
+	"K": "RL_TLS_KEY",
+	"A": "RL_TLS_ALLOW",
+	"f": "RL_DUMP_FILE",
+	"m": "RL_META_FILE",
+	"c": "RL_CONFIG_FILE",
+	"i": "RL_DUMP_INTERVAL",
+	"r": "RL_RETENTION_DAYS",
+	"R": "RL_RETENTION_OVERRIDES",
+	"u": "RL_ROLLUP_INTERVAL",
+	"t": "RL_IDLE_EXPIRY",
+	"P": "RL_STANDBY",
+	"S": "RL_REPLICATION_LISTEN",
+	"o": "RL_READ_ONLY",
+	"q": "RL_READ_REPLICA",
+	"Q": "RL_READ_REPLICA_REDIRECT",
+	"B": "RL_BACKENDS",
+	"p": "RL_PEERS",
+
+	"seed":      "RL_SEED",
+	"seed-days": "RL_SEED_DAYS",
+	"cache":     "RL_CACHE",
+	"shards":    "RL_SHARDS",
+
+	"query-workers":       "RL_QUERY_WORKERS",
+	"read-header-timeout": "RL_READ_HEADER_TIMEOUT",
+	"read-timeout":        "RL_READ_TIMEOUT",
+	"write-timeout":       "RL_WRITE_TIMEOUT",
+	"idle-timeout":        "RL_IDLE_TIMEOUT",
+	"max-header-bytes":    "RL_MAX_HEADER_BYTES",
+	"backfill-window":     "RL_BACKFILL_WINDOW",
+	"undelete-window":     "RL_UNDELETE_WINDOW",
+	"future-policy":       "RL_FUTURE_POLICY",
+	"future-skew":         "RL_FUTURE_SKEW",
+	"key-pattern":         "RL_KEY_PATTERN",
+	"max-key-length":      "RL_MAX_KEY_LENGTH",
+	"max-statements":      "RL_MAX_STATEMENTS",
+	"max-keys":            "RL_MAX_KEYS",
+	"max-prefix-keys":     "RL_MAX_PREFIX_KEYS",
+	"tenant":              "RL_TENANTS",
+	"audit":               "RL_AUDIT_FILE",
+	"business-hours":      "RL_BUSINESS_HOURS",
+	"relay":               "RL_RELAYS",
+	"relay-token":         "RL_RELAY_TOKEN",
+	"replication-token":   "RL_REPLICATION_TOKEN",
+	"upstream":            "RL_UPSTREAM",
+	"upstream-cache":      "RL_UPSTREAM_CACHE",
+	"stale-after":         "RL_STALE_AFTER",
+	"stale-override":      "RL_STALE_OVERRIDES",
+	"memory-limit":        "RL_MEMORY_LIMIT",
+	"memory-policy":       "RL_MEMORY_POLICY",
+	"insert-timeout":      "RL_INSERT_TIMEOUT",
+	"query-timeout":       "RL_QUERY_TIMEOUT",
+	"disable":             "RL_DISABLE",
+	"log-requests":        "RL_LOG_REQUESTS",
+	"oidc-issuer":         "RL_OIDC_ISSUER",
+	"oidc-client-id":      "RL_OIDC_CLIENT_ID",
+	"oidc-client-secret":  "RL_OIDC_CLIENT_SECRET",
+	"oidc-redirect-url":   "RL_OIDC_REDIRECT_URL",
+	"oidc-audience":       "RL_OIDC_AUDIENCE",
+	"oidc-read-scope":     "RL_OIDC_READ_SCOPE",
+	"oidc-write-scope":    "RL_OIDC_WRITE_SCOPE",
+	"oidc-prefix-claim":   "RL_OIDC_PREFIX_CLAIM",
+	"allow-ip":            "RL_ALLOW_IPS",
+	"deny-ip":             "RL_DENY_IPS",
+	"h2c":                 "RL_H2C",
+	"proxy-protocol":      "RL_PROXY_PROTOCOL",
+	"trusted-proxy":       "RL_TRUSTED_PROXIES",
+	"raft":                "RL_RAFT",
+	"raft-peer":           "RL_RAFT_PEERS",
+	"raft-log":            "RL_RAFT_LOG",
+	"raft-token":          "RL_RAFT_TOKEN",
+}
+
+// repeatableFlags lists the flags whose environment variable holds a comma
+// separated list of values.
+var repeatableFlags = map[string]bool{"R": true, "B": true, "p": true, "tenant": true, "max-prefix-keys": true, "relay": true, "stale-override": true, "allow-ip": true, "deny-ip": true, "trusted-proxy": true, "raft-peer": true}
+
+// applyEnv sets the flags that are not set on the command line, set holding the
+// names of the flags set, using environment variables. Flags set using environment
+// variables are added to set.
+func applyEnv(set map[string]bool) error {
+	for name, env := range envFlags {
+		v, ok := os.LookupEnv(env)
+		if !ok || set[name] {
+			continue
+		}
+		values := []string{v}
+		if repeatableFlags[name] {
+			values = strings.Split(v, ",")
+		}
+		for _, x := range values {
+			if err := flag.Set(name, strings.TrimSpace(x)); err != nil {
+				return fmt.Errorf("%s: %s", env, err)
+			}
+		}
+		set[name] = true
+	}
+	return nil
+}
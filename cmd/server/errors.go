@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Machine-readable error codes returned as the error field of error responses, so
+// that clients do not depend on messages.
+const (
+	errorInvalidRequest    = "invalid_request"
+	errorInvalidRange      = "invalid_range"
+	errorTooManyStatements = "too_many_statements"
+	errorKeyNotFound       = "key_not_found"
+	errorTenantNotFound    = "tenant_not_found"
+	errorKeyExists         = "key_exists"
+	errorQuotaExceeded     = "quota_exceeded"
+	errorNotFound          = "not_found"
+	errorMethodNotAllowed  = "method_not_allowed"
+	errorUnauthorized      = "unauthorized"
+	errorForbidden         = "forbidden"
+	errorInternal          = "internal_error"
+	errorBadGateway        = "bad_gateway"
+	errorUnavailable       = "unavailable"
+	errorTimeout           = "timeout"
+)
+
+// statusClientClosedRequest is the status code of the responses to requests whose
+// client disconnected before the response was computed, as used by nginx.
+const statusClientClosedRequest = 499
+
+// errorCodes maps status codes to the error code of the error responses that do not
+// provide a more specific one.
+var errorCodes = map[int]string{
+	http.StatusBadRequest:          errorInvalidRequest,
+	http.StatusUnauthorized:        errorUnauthorized,
+	http.StatusForbidden:           errorForbidden,
+	http.StatusNotFound:            errorNotFound,
+	http.StatusMethodNotAllowed:    errorMethodNotAllowed,
+	http.StatusConflict:            errorKeyExists,
+	http.StatusInternalServerError: errorInternal,
+	http.StatusBadGateway:          errorBadGateway,
+	http.StatusServiceUnavailable:  errorUnavailable,
+}
+
+// errorCode returns the default error code of status code.
+func errorCode(code int) string {
+	if x, ok := errorCodes[code]; ok {
+		return x
+	}
+	if code >= 500 {
+		return errorInternal
+	}
+	return errorInvalidRequest
+}
+
+// A rangeError reports a time range that cannot be parsed or queried.
+type rangeError string
+
+func (e rangeError) Error() string {
+	return string(e)
+}
+
+// queryErrorCode returns the error code of err, an error returned by cachedQuery.
+func queryErrorCode(err error) string {
+	if err == errKeyNotFound {
+		return errorKeyNotFound
+	}
+	if err == errTimeout {
+		return errorTimeout
+	}
+	if _, ok := err.(rangeError); ok {
+		return errorInvalidRange
+	}
+	if _, ok := err.(quotaError); ok {
+		return errorQuotaExceeded
+	}
+	return errorInvalidRequest
+}
+
+// writeError writes an error response using reason as error code.
+func writeError(w http.ResponseWriter, code int, reason, message string) {
+	writeEnvelope(w, response{Code: code, Status: statusError, Message: message, Error: reason})
+}
+
+// methodNotAllowed writes a 405 error response listing methods in the Allow header.
+func methodNotAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeResponse(w, http.StatusMethodNotAllowed, statusError, "method not allowed", nil)
+}
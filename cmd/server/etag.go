@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// etagBufferSize is the maximum size of the responses whose ETag is computed.
+// Larger responses are streamed without ETag.
+const etagBufferSize = 1 << 20
+
+// An etagWriter is an http.ResponseWriter keeping the response in memory until
+// its body exceeds etagBufferSize, streaming it to w from then on.
+type etagWriter struct {
+	w         http.ResponseWriter
+	code      int
+	body      bytes.Buffer
+	streaming bool
+}
+
+func (e *etagWriter) Header() http.Header {
+	return e.w.Header()
+}
+
+func (e *etagWriter) Write(p []byte) (int, error) {
+	if e.code == 0 {
+		e.code = http.StatusOK
+	}
+	if e.streaming {
+		return e.w.Write(p)
+	}
+	if e.body.Len()+len(p) <= etagBufferSize {
+		return e.body.Write(p)
+	}
+	e.streaming = true
+	e.w.WriteHeader(e.code)
+	if _, err := e.w.Write(e.body.Bytes()); err != nil {
+		return 0, err
+	}
+	e.body.Reset()
+	return e.w.Write(p)
+}
+
+func (e *etagWriter) WriteHeader(code int) {
+	if e.code == 0 {
+		e.code = code
+	}
+}
+
+// etag returns a handler setting the ETag header of successful responses of h to
+// a hash of their body, answering conditional requests whose If-None-Match header
+// matches with a 304 status code and no body. Responses larger than etagBufferSize
+// are streamed without ETag.
+func etag(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			h(w, r)
+			return
+		}
+		e := &etagWriter{w: w}
+		h(e, r)
+		if e.streaming {
+			return
+		}
+		if e.code == 0 {
+			e.code = http.StatusOK
+		}
+		if e.code == http.StatusOK {
+			sum := sha256.Sum256(e.body.Bytes())
+			tag := `"` + hex.EncodeToString(sum[:16]) + `"`
+			w.Header().Set("ETag", tag)
+			w.Header().Set("Cache-Control", "no-cache")
+			if matchETag(r.Header.Get("If-None-Match"), tag) {
+				w.Header().Del("Content-Type")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.WriteHeader(e.code)
+		w.Write(e.body.Bytes())
+	}
+}
+
+// matchETag reports whether the value of an If-None-Match header matches tag,
+// using the weak comparison.
+func matchETag(header, tag string) bool {
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || strings.TrimPrefix(v, "W/") == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// endpointGroups maps the groups of endpoints that can be disabled using -disable,
+// e.g. to run query-only nodes, to their paths. /sequence/, which both exports and
+// imports sequences, belongs to the insert and query groups.
+var endpointGroups = map[string][]string{
+	"insert":   {"/insert/", "/create/", "/gauge/insert/", "/counter/insert/", "/overwrite/", "/intervals/", "/import/", "/sequence/"},
+	"query":    {"/query/", "/export/", "/sequence/", "/longest/", "/sla/", "/gauge/query/", "/counter/query/"},
+	"graphql":  {"/graphql/", "/graphql/schema"},
+	"grpc":     {grpcService},
+	"metadata": {"/maintenance/", "/annotations/", "/composites/", "/dashboards/"},
+	"keys":     {"/keys/", "/undelete/", "/stats/", "/memory/", "/top/"},
+	"alerts":   {"/alerts/"},
+	"admin":    {"/admin/backup", "/admin/restore", "/admin/drain", "/admin/compact"},
+	"metrics":  {"/metrics"},
+	"ui":       {"/", "/static/", "/auth/login", "/auth/callback", "/auth/logout"},
+}
+
+// disabledPaths holds the paths of the endpoints disabled by -disable.
+var disabledPaths = make(map[string]bool)
+
+// disableGroups disables the endpoints of groups.
+func disableGroups(groups []string) error {
+	for _, v := range groups {
+		paths, ok := endpointGroups[v]
+		if !ok {
+			names := make([]string, 0, len(endpointGroups))
+			for k := range endpointGroups {
+				names = append(names, k)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("endpoint group %s is not valid (expected %s)", v, strings.Join(names, ", "))
+		}
+		for _, p := range paths {
+			disabledPaths[p] = true
+		}
+	}
+	return nil
+}
+
+// handle registers h for path on mux, or a handler rejecting requests with a 404
+// status code if the endpoint is disabled, wrapped by the hooked middlewares.
+func handle(mux *http.ServeMux, path string, h http.HandlerFunc) {
+	if disabledPaths[path] {
+		h = handlerDisabled
+	}
+	mux.HandleFunc(path, endpointChain(path).then(h))
+}
+
+func handlerDisabled(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, errorNotFound, "endpoint is disabled")
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// federatedHeader marks requests forwarded to peers, which answer using their own
+// data only.
+const federatedHeader = "X-Federated"
+
+// A responseBuffer is an http.ResponseWriter keeping the response in memory.
+type responseBuffer struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func newResponseBuffer() *responseBuffer {
+	return &responseBuffer{header: make(http.Header), code: http.StatusOK}
+}
+
+func (b *responseBuffer) Header() http.Header         { return b.header }
+func (b *responseBuffer) Write(p []byte) (int, error) { return b.body.Write(p) }
+func (b *responseBuffer) WriteHeader(code int)        { b.code = code }
+
+// federate returns a handler forwarding queries on keys missing from the store to
+// the peers, and merging the results of peers into the results of subtree queries.
+func (s *server) federate(h http.HandlerFunc) http.HandlerFunc {
+	if s.peers == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.FormValue("key")
+		if r.Method != http.MethodGet || r.Header.Get(federatedHeader) != "" || key == "" {
+			h(w, r)
+			return
+		}
+		if !isSubtree(key) {
+			if _, ok := s.get(key); ok {
+				h(w, r)
+				return
+			}
+			// peers that cannot be reached are skipped
+			responses, _ := s.peers.fanout(r)
+			for _, x := range responses {
+				if x.Code == http.StatusOK {
+					writeResponse(w, x.Code, x.Status, x.Message, x.Data)
+					return
+				}
+			}
+			h(w, r)
+			return
+		}
+
+		if r.FormValue("group") != "" && r.FormValue("mode") == "" && r.FormValue("tier") == "" {
+			writeError(w, http.StatusBadRequest, errorInvalidRequest, errGroupNotSupported.Error())
+			return
+		}
+
+		b := newResponseBuffer()
+		h(b, r)
+		var local backendResponse
+		if b.code != http.StatusOK || json.Unmarshal(b.body.Bytes(), &local) != nil || r.FormValue("mode") != "" || r.FormValue("tier") != "" {
+			for k, v := range b.header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(b.code)
+			w.Write(b.body.Bytes())
+			return
+		}
+		merged := make(map[string]json.RawMessage)
+		if err := json.Unmarshal(local.Data, &merged); err != nil {
+			writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+			log.Printf("error merging peer responses: %s", err)
+			return
+		}
+		responses, _ := s.peers.fanout(r)
+		for _, x := range responses {
+			var m map[string]json.RawMessage
+			if x.Code != http.StatusOK || json.Unmarshal(x.Data, &m) != nil {
+				log.Printf("error merging peer response: %s", x.Message)
+				continue
+			}
+			for k, v := range m {
+				if _, ok := merged[k]; !ok {
+					merged[k] = v
+				}
+			}
+		}
+		data, err := json.Marshal(merged)
+		if err != nil {
+			writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+			log.Printf("error serializing query results: %s", err)
+			return
+		}
+		writeResponse(w, http.StatusOK, statusOK, fmt.Sprintf("%d key(s) returned", len(merged)), data)
+	}
+}
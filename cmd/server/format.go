@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Output formats of query results.
+const (
+	formatJSON    = "json"
+	formatCSV     = "csv"
+	formatMsgpack = "msgpack"
+)
+
+// formatTypes maps the media types of the Accept header to output formats.
+var formatTypes = map[string]string{
+	"application/json":        formatJSON,
+	"text/csv":                formatCSV,
+	"application/msgpack":     formatMsgpack,
+	"application/x-msgpack":   formatMsgpack,
+	"application/vnd.msgpack": formatMsgpack,
+}
+
+// queryFormat returns the output format of the results of r, using the format
+// parameter if set, or the supported media type of the Accept header with the
+// highest quality, JSON being used by default.
+func queryFormat(r *http.Request) (string, error) {
+	switch v := r.FormValue("format"); v {
+	case "":
+	case formatJSON, formatCSV, formatMsgpack:
+		return v, nil
+	default:
+		return "", errors.New("format is not supported")
+	}
+	format, quality := formatJSON, 0.0
+	for _, v := range strings.Split(r.Header.Get("Accept"), ",") {
+		t, params, err := mime.ParseMediaType(v)
+		if err != nil {
+			continue
+		}
+		f, ok := formatTypes[t]
+		if !ok {
+			continue
+		}
+		q := 1.0
+		if x, err := strconv.ParseFloat(params["q"], 64); err == nil {
+			q = x
+		}
+		if q > quality {
+			format, quality = f, q
+		}
+	}
+	return format, nil
+}
+
+// A queryRow is a row of the results of a query, as serialized by the sequence
+// package.
+type queryRow struct {
+	Date  int64    `json:"date"`
+	Count int64    `json:"count"`
+	Mean  *float64 `json:"mean"`
+}
+
+// csvHeader is the header of query results encoded as CSV.
+var csvHeader = []string{"key", "date", "count", "mean"}
+
+// writeCSVRows writes the rows of key, data being the rows encoded as JSON.
+func writeCSVRows(w *csv.Writer, key string, data []byte) error {
+	var rows []queryRow
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return err
+	}
+	for _, v := range rows {
+		mean := ""
+		if v.Mean != nil {
+			mean = strconv.FormatFloat(*v.Mean, 'f', -1, 64)
+		}
+		w.Write([]string{key, strconv.FormatInt(v.Date, 10), strconv.FormatInt(v.Count, 10), mean})
+	}
+	return w.Error()
+}
+
+// appendMsgpackRows appends the rows encoded as JSON in data to b as an array of
+// maps.
+func appendMsgpackRows(b, data []byte) ([]byte, error) {
+	var rows []queryRow
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return nil, err
+	}
+	b = appendMsgpackArray(b, len(rows))
+	for _, v := range rows {
+		b = appendMsgpackMap(b, 3)
+		b = appendMsgpackString(b, "date")
+		b = appendMsgpackInt(b, v.Date)
+		b = appendMsgpackString(b, "count")
+		b = appendMsgpackInt(b, v.Count)
+		b = appendMsgpackString(b, "mean")
+		if v.Mean != nil {
+			b = appendMsgpackFloat(b, *v.Mean)
+		} else {
+			b = appendMsgpackNil(b)
+		}
+	}
+	return b, nil
+}
+
+// writeMsgpack writes a successful response using the MessagePack encoding of the
+// envelope of JSON responses, data holding the rows of the query, or the rows of
+// each key of keys if keys is not nil.
+func writeMsgpack(w http.ResponseWriter, message string, keys []string, data [][]byte) {
+	b := appendMsgpackMap(nil, 4)
+	b = appendMsgpackString(b, "code")
+	b = appendMsgpackInt(b, http.StatusOK)
+	b = appendMsgpackString(b, "status")
+	b = appendMsgpackString(b, statusOK)
+	b = appendMsgpackString(b, "message")
+	b = appendMsgpackString(b, message)
+	b = appendMsgpackString(b, "data")
+	if keys != nil {
+		b = appendMsgpackMap(b, len(keys))
+	}
+	var err error
+	for i, v := range data {
+		if keys != nil {
+			b = appendMsgpackString(b, keys[i])
+		}
+		if b, err = appendMsgpackRows(b, v); err != nil {
+			writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+			log.Printf("error serializing response: %s", err)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/msgpack")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// writeCSV writes a successful response holding the rows of key encoded as CSV,
+// data being the rows encoded as JSON.
+func writeCSV(w http.ResponseWriter, key string, data []byte) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	c := csv.NewWriter(buf)
+	c.Write(csvHeader)
+	if err := writeCSVRows(c, key, data); err != nil {
+		writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+		log.Printf("error serializing response: %s", err)
+		return
+	}
+	c.Flush()
+	w.Header().Set("Content-Type", "text/csv")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
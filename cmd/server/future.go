@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Policies applied to insert statements whose time is ahead of the time of the
+// server by more than the allowed skew.
+const (
+	futureAccept = "accept" // record values at their time
+	futureReject = "reject" // reject statements
+	futureClamp  = "clamp"  // record values at the time of the server
+)
+
+// validFuturePolicy returns an error if policy is not a future timestamp policy.
+func validFuturePolicy(policy string) error {
+	switch policy {
+	case futureAccept, futureReject, futureClamp:
+		return nil
+	}
+	return fmt.Errorf("future timestamp policy must be one of %s, %s or %s", futureAccept, futureReject, futureClamp)
+}
+
+// future applies the future timestamp policy to t, the time of a statement, now
+// being the time of the server. It returns the time at which the value is recorded,
+// or false if the statement is rejected.
+func (s *server) future(t, now time.Time) (time.Time, bool) {
+	if !t.After(now.Add(s.futureSkew)) {
+		return t, true
+	}
+	switch s.futurePolicy {
+	case futureReject:
+		return t, false
+	case futureClamp:
+		return now, true
+	}
+	return t, true
+}
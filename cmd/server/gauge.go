@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// Gauges store small-range numeric values as a set of binary sequences, one per bit
+// of the value. Bit sequences are stored alongside regular sequences using internal
+// keys that cannot be produced by the insert protocol.
+const (
+	gaugeBits     = 8
+	gaugeMaxValue = 1<<gaugeBits - 1
+	gaugeKeyInfix = "#g"
+)
+
+var validGaugeStatement = regexp.MustCompile(`^` + keyPattern + ` \d{1,3}(?: \d+)?$`)
+
+// planeKey returns the internal key of the sequence holding bit i of the values
+// associated to key, using infix to identify the series type.
+func planeKey(key, infix string, i int) string {
+	return key + infix + strconv.Itoa(i)
+}
+
+// planes returns copies of the n bit sequences of key using infix, read together
+// so that values are not combined from before and after an insert or a
+// read-modify-write operation (e.g. overwrites) on key.
+func (s *server) planes(key, infix string, n int) ([]*sequence.Sequence, bool) {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = planeKey(key, infix, i)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.store.GetAll(keys)
+}
+
+// gaugeRow represents an aggregated group of gauge values.
+type gaugeRow struct {
+	Date  int64    `json:"date"`
+	Count int64    `json:"count"`
+	Mean  *float64 `json:"mean"`
+	Min   *int     `json:"min"`
+	Max   *int     `json:"max"`
+}
+
+func (s *server) handlerGaugeInsert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	buf, err := readBody(r.Body)
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, statusError, "error reading request body", nil)
+		logf(r, "error reading request body: %s", err)
+		return
+	}
+	defer putBuffer(buf)
+	body := buf.Bytes()
+
+	defaultValueTimestamp := requestTime(r)
+	defaultSequenceTimestamp := defaultValueTimestamp.Truncate(time.Duration(sequenceFrequency) * time.Second)
+
+	lines := bytes.Split(body, []byte("\n"))
+	if tooManyStatements(w, lines) || s.limitIngest(w, r, len(lines)) {
+		return
+	}
+	rejected := newRejections(r, lines)
+	duplicates := s.newDuplicateFilter(r)
+
+	// each valid line expands to one statement per bit
+	mapping := make([]int, 0, len(lines))
+	statements := getStatements(0, len(lines)*gaugeBits)
+	defer func() { putStatements(statements) }()
+
+	for i, line := range lines {
+		if reason := checkStatement(r, validGaugeStatement, line); reason != "" {
+			logf(r, "error parsing statement %d: %s", i+1, reason)
+			rejected.add(i, reason)
+			continue
+		}
+		fields := bytes.Fields(line)
+		value, err := strconv.Atoi(string(fields[1]))
+		if err != nil || value > gaugeMaxValue {
+			logf(r, "error parsing statement %d: value out of range", i+1)
+			rejected.add(i, "value out of range")
+			continue
+		}
+		valueTimestamp, sequenceTimestamp := defaultValueTimestamp, defaultSequenceTimestamp
+		if len(fields) > 2 {
+			x, err := strconv.Atoi(string(fields[2]))
+			if err != nil {
+				logf(r, "error parsing statement %d: timestamp out of range", i+1)
+				rejected.add(i, "timestamp out of range")
+				continue
+			}
+			var ok bool
+			if valueTimestamp, ok = s.future(time.Unix(int64(x), 0), defaultValueTimestamp); !ok {
+				logf(r, "error parsing statement %d: timestamp in the future", i+1)
+				rejected.add(i, "timestamp in the future")
+				continue
+			}
+			sequenceTimestamp = valueTimestamp.Truncate(time.Duration(sequenceFrequency) * time.Second)
+		}
+		for j := 0; j < gaugeBits; j++ {
+			statements = append(statements, sequence.Statement{
+				Key:                 planeKey(string(fields[0]), gaugeKeyInfix, j),
+				Timestamp:           valueTimestamp,
+				Value:               uint8(value>>j) & 1,
+				Type:                sequence.StatementAdd,
+				CreateIfNotExists:   true,
+				CreateWithTimestamp: sequenceTimestamp,
+				CreateWithFrequency: sequenceFrequency,
+			})
+		}
+		mapping = append(mapping, i)
+	}
+
+	n := len(mapping)
+
+	if err := r.Context().Err(); err != nil {
+		writeContextError(w, err)
+		return
+	}
+	limited := s.limitKeys(statements)
+	s.mu.RLock()
+	result := s.store.Batch(statements, s.replicator.statements)
+	s.cache.invalidateStatements(statements)
+	s.mu.RUnlock()
+	s.touch(statements, result)
+	var d int
+	var errs []error
+	if result.HasErrors() {
+		errs = result.ErrorVars()
+		limited.apply(errs)
+		s.backfill(statements, errs)
+		for i := range mapping {
+			// a value is a duplicate if each of its bits is
+			duplicate := true
+			for j, err := range errs[i*gaugeBits : (i+1)*gaugeBits] {
+				if !duplicates.match(statements[i*gaugeBits+j], err) {
+					duplicate = false
+					break
+				}
+			}
+			if duplicate {
+				d++
+				n--
+				continue
+			}
+			for _, err := range errs[i*gaugeBits : (i+1)*gaugeBits] {
+				if err != nil {
+					logf(r, "error executing statement %d: %s", mapping[i]+1, err)
+					rejected.add(mapping[i], err.Error())
+					n--
+					break
+				}
+			}
+		}
+	}
+
+	status := statusOK
+	if n+d != len(lines) {
+		status = statusWarning
+	}
+
+	if raftEffects(r) {
+		s.relay.send("/gauge/insert/", rejected.accepted(), defaultValueTimestamp)
+	}
+	message := duplicates.message(n, d, len(lines))
+	s.audit(r, auditGaugeInsert, appliedKeys(statements, errs), message)
+	writeResponse(w, http.StatusOK, status, message, rejected.data())
+}
+
+func (s *server) handlerGaugeQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	key := r.FormValue("key")
+
+	planes, ok := s.planes(key, gaugeKeyInfix, gaugeBits)
+	if !ok {
+		writeError(w, http.StatusNotFound, errorKeyNotFound, "key does not exist")
+		return
+	}
+	s.touchQuery(key)
+
+	frequency := int64(planes[0].Frequency())
+
+	args, err := newQueryArgs(r.FormValue("start"), r.FormValue("end"), frequency)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorInvalidRange, err.Error())
+		return
+	}
+
+	interval := int64(args.interval.Seconds())
+	rows := make([]gaugeRow, (args.end.Unix()-args.start.Unix())/interval+1)
+	sums := make([]int64, len(rows))
+	for i := range rows {
+		rows[i].Date = args.start.Unix() + int64(i)*interval
+	}
+
+	values, ts, err := planeValues(planes, args.start, args.end)
+	if err == nil {
+		for i, v := range values {
+			if v < 0 {
+				continue
+			}
+			row := &rows[(ts-args.start.Unix()+int64(i)*frequency)/interval]
+			if row.Count == 0 || v < *row.Min {
+				row.Min = &values[i]
+			}
+			if row.Count == 0 || v > *row.Max {
+				row.Max = &values[i]
+			}
+			row.Count++
+			sums[(ts-args.start.Unix()+int64(i)*frequency)/interval] += int64(v)
+		}
+	}
+
+	for i := range rows {
+		if rows[i].Count > 0 {
+			mean := float64(sums[i]) / float64(rows[i].Count)
+			rows[i].Mean = &mean
+		}
+	}
+
+	data, err := json.Marshal(rows)
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+		logf(r, "error serializing rows: %s", err)
+		return
+	}
+
+	message := fmt.Sprintf("%d row(s) returned (interval %ds)", len(rows), interval)
+	writeResponse(w, http.StatusOK, statusOK, message, data)
+}
+
+// planeValues rebuilds the numeric values stored as bits in planes using start and end as
+// closed interval filter. Unknown values are represented as -1. The second return
+// value is the Unix time associated to the first element of the slice.
+func planeValues(planes []*sequence.Sequence, start, end time.Time) ([]int, int64, error) {
+	var values []int
+	var ts int64
+	for i, plane := range planes {
+		bits, t, err := plane.Values(start, end)
+		if err != nil {
+			return nil, 0, err
+		}
+		if i == 0 {
+			values = make([]int, len(bits))
+			ts = t
+		}
+		for j := 0; j < len(values) && j < len(bits); j++ {
+			if values[j] < 0 {
+				continue
+			}
+			switch bits[j] {
+			case sequence.StateActive:
+				values[j] |= 1 << i
+			case sequence.StateUnknown:
+				values[j] = -1
+			}
+		}
+	}
+	return values, ts, nil
+}
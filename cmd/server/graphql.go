@@ -0,0 +1,735 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxGraphQLBodySize is the maximum size of the body of GraphQL requests.
+const maxGraphQLBodySize = 1 << 20
+
+// graphqlSchema is the schema of the GraphQL endpoint, served at /graphql/schema.
+const graphqlSchema = `type Query {
+  "Keys matching a key or a subtree pattern (e.g. eu.web.*), every key by default."
+  keys(pattern: String = "*"): [Key!]!
+  "Key or composite key, null if it does not exist."
+  key(name: String!): Key
+}
+
+type Key {
+  name: String!
+  "Expression of composite keys, null for other keys."
+  composite: String
+  "Aggregated rows of the range, null for gauge and counter keys."
+  series(start: Int!, end: Int!, excludeMaintenance: Boolean = false): Series
+  maintenance: [Window!]!
+  "Annotations of the key and annotations attached to every key."
+  annotations(start: Int, end: Int): [Annotation!]!
+}
+
+type Series {
+  "Interval of rows in seconds."
+  interval: Int!
+  rows: [Row!]!
+}
+
+type Row {
+  "Unix time of the group."
+  time: Int!
+  "Number of known values of the group."
+  count: Int!
+  "Ratio of active values among known values, null if there are none."
+  mean: Float
+}
+
+type Window {
+  start: Int!
+  end: Int!
+}
+
+type Annotation {
+  "Null for annotations attached to every key."
+  key: String
+  time: Int!
+  kind: String!
+  text: String!
+}
+`
+
+// A graphqlRequest is the body of POST requests using the application/json media
+// type, or the parameters of GET requests.
+type graphqlRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+// A graphqlError is an error reported in the errors field of responses.
+type graphqlError struct {
+	Message string   `json:"message"`
+	Path    []string `json:"path,omitempty"`
+}
+
+func (e *graphqlError) Error() string {
+	return e.Message
+}
+
+// handlerGraphQL executes GraphQL queries over keys, their metadata and their
+// aggregated rows. Responses use the format of the GraphQL specification rather
+// than the envelope of other endpoints, so that GraphQL clients can be used, and
+// any error discards the data of the response.
+func (s *server) handlerGraphQL(w http.ResponseWriter, r *http.Request) {
+	var req graphqlRequest
+	switch r.Method {
+	case http.MethodGet:
+		req.Query = r.FormValue("query")
+		req.OperationName = r.FormValue("operationName")
+		if v := r.FormValue("variables"); v != "" {
+			d := json.NewDecoder(strings.NewReader(v))
+			d.UseNumber()
+			if err := d.Decode(&req.Variables); err != nil {
+				writeGraphQLError(w, http.StatusBadRequest, "error parsing variables")
+				return
+			}
+		}
+	case http.MethodPost:
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxGraphQLBodySize))
+		if err != nil {
+			writeGraphQLError(w, http.StatusBadRequest, "error reading request body")
+			return
+		}
+		t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch t {
+		case "application/graphql":
+			req.Query = string(body)
+		case "application/json", "":
+			d := json.NewDecoder(bytes.NewReader(body))
+			d.UseNumber()
+			if err := d.Decode(&req); err != nil {
+				writeGraphQLError(w, http.StatusBadRequest, "error parsing request body")
+				return
+			}
+		default:
+			writeGraphQLError(w, http.StatusUnsupportedMediaType, "content type is not supported")
+			return
+		}
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPost)
+		return
+	}
+	if req.Query == "" {
+		writeGraphQLError(w, http.StatusBadRequest, "query is required")
+		return
+	}
+
+	d, err := parseGraphQL(req.Query)
+	if err != nil {
+		writeGraphQLError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	e, op, err := newGraphQLExecutor(r.Context(), s, d, req.OperationName, req.Variables)
+	if err != nil {
+		writeGraphQLError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	b, err := e.object([]byte(`{"data":`), "Query", op.selections, e.query)
+	if err != nil {
+		var x *graphqlError
+		if !errors.As(err, &x) {
+			logf(r, "error executing graphql query: %s", err)
+			x = &graphqlError{Message: "an unexpected error occurred"}
+		}
+		data, _ := json.Marshal(map[string]any{"errors": []*graphqlError{x}, "data": nil})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+		return
+	}
+	b = append(b, '}')
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// handlerGraphQLSchema writes the schema of the GraphQL endpoint using the schema
+// definition language.
+func (s *server) handlerGraphQLSchema(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, graphqlSchema)
+}
+
+// writeGraphQLError writes a response reporting a request error.
+func writeGraphQLError(w http.ResponseWriter, code int, message string) {
+	data, _ := json.Marshal(map[string]any{"errors": []graphqlError{{Message: message}}})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+// A graphqlExecutor executes an operation of a document, writing its result as
+// JSON.
+type graphqlExecutor struct {
+	s         *server
+	ctx       context.Context // context of the request, stopping series queries when done
+	fragments map[string]*gqlFragment
+	variables map[string]any
+}
+
+// newGraphQLExecutor returns an executor of the operation of d named name, or of
+// its only operation if name is empty, using variables as the values of its
+// variables.
+func newGraphQLExecutor(ctx context.Context, s *server, d *gqlDocument, name string, variables map[string]any) (*graphqlExecutor, *gqlOperation, error) {
+	var op *gqlOperation
+	for _, v := range d.operations {
+		if v.name == name || name == "" && len(d.operations) == 1 {
+			op = v
+			break
+		}
+	}
+	if op == nil {
+		if name == "" {
+			return nil, nil, errors.New("operationName is required for documents with several operations")
+		}
+		return nil, nil, fmt.Errorf("operation %s is not defined", name)
+	}
+	e := &graphqlExecutor{s: s, ctx: ctx, fragments: d.fragments, variables: make(map[string]any)}
+	for _, v := range op.variables {
+		x, ok := variables[v.name]
+		switch {
+		case !ok && v.hasValue:
+			x, ok = v.value, true
+		case v.nonNull && x == nil:
+			return nil, nil, fmt.Errorf("variable $%s is required", v.name)
+		}
+		if ok {
+			e.variables[v.name] = x
+		}
+	}
+	return e, op, nil
+}
+
+// A graphqlResolver appends the value of field f of an object to b, args holding
+// the arguments of the field.
+type graphqlResolver func(b []byte, f *gqlSelection, args graphqlArgs) ([]byte, error)
+
+// object appends the fields of selections of an object of type typename resolved
+// using fn to b.
+func (e *graphqlExecutor) object(b []byte, typename string, selections []*gqlSelection, fn graphqlResolver) ([]byte, error) {
+	var keys []string
+	fields := make(map[string]*gqlSelection)
+	if err := e.collect(typename, selections, &keys, fields, nil); err != nil {
+		return nil, err
+	}
+	b = append(b, '{')
+	for i, k := range keys {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = appendJSONString(b, k)
+		b = append(b, ':')
+		f := fields[k]
+		if f.name == "__typename" {
+			b = appendJSONString(b, typename)
+			continue
+		}
+		args, err := e.arguments(f.args)
+		if err != nil {
+			return nil, err
+		}
+		if b, err = fn(b, f, args); err != nil {
+			var x *graphqlError
+			if errors.As(err, &x) {
+				x.Path = append([]string{f.key()}, x.Path...)
+			}
+			return nil, err
+		}
+	}
+	return append(b, '}'), nil
+}
+
+// collect adds the fields of selections included in the response to fields,
+// flattening fragments applying to typename and merging the subfields of fields
+// using the same response key, keys holding the response keys in order.
+func (e *graphqlExecutor) collect(typename string, selections []*gqlSelection, keys *[]string, fields map[string]*gqlSelection, visited map[string]bool) error {
+	for _, v := range selections {
+		ok, err := e.included(v.directives)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		switch {
+		case v.spread != "":
+			x, ok := e.fragments[v.spread]
+			if !ok {
+				return &graphqlError{Message: fmt.Sprintf("fragment %s is not defined", v.spread)}
+			}
+			if visited[v.spread] {
+				return &graphqlError{Message: fmt.Sprintf("fragment %s spreads itself", v.spread)}
+			}
+			if x.on != typename {
+				continue
+			}
+			if visited == nil {
+				visited = make(map[string]bool)
+			}
+			visited[v.spread] = true
+			err := e.collect(typename, x.selections, keys, fields, visited)
+			delete(visited, v.spread)
+			if err != nil {
+				return err
+			}
+		case v.name == "":
+			if v.on != "" && v.on != typename {
+				continue
+			}
+			if err := e.collect(typename, v.selections, keys, fields, visited); err != nil {
+				return err
+			}
+		default:
+			k := v.key()
+			x, ok := fields[k]
+			if !ok {
+				fields[k] = v
+				*keys = append(*keys, k)
+				continue
+			}
+			if x.name != v.name {
+				return &graphqlError{Message: fmt.Sprintf("fields %s and %s use the same response key %s", x.name, v.name, k)}
+			}
+			if v.selections != nil {
+				merged := *x
+				merged.selections = append(append([]*gqlSelection(nil), x.selections...), v.selections...)
+				fields[k] = &merged
+			}
+		}
+	}
+	return nil
+}
+
+// included reports whether the skip and include directives of a selection include
+// it in the response.
+func (e *graphqlExecutor) included(directives []gqlDirective) (bool, error) {
+	for _, v := range directives {
+		if v.name != "skip" && v.name != "include" {
+			return false, &graphqlError{Message: fmt.Sprintf("directive @%s is not supported", v.name)}
+		}
+		args, err := e.arguments(v.args)
+		if err != nil {
+			return false, err
+		}
+		x, ok, err := args.bool("if")
+		if err == nil && !ok {
+			err = errors.New("argument if is required")
+		}
+		if err != nil {
+			return false, &graphqlError{Message: fmt.Sprintf("directive @%s: %s", v.name, err)}
+		}
+		if x == (v.name == "skip") {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// arguments returns args with variables replaced by their values.
+func (e *graphqlExecutor) arguments(args map[string]any) (graphqlArgs, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+	x := make(graphqlArgs, len(args))
+	for k, v := range args {
+		v, err := e.value(v)
+		if err != nil {
+			return nil, err
+		}
+		x[k] = v
+	}
+	return x, nil
+}
+
+func (e *graphqlExecutor) value(v any) (any, error) {
+	switch x := v.(type) {
+	case gqlVariable:
+		v, ok := e.variables[string(x)]
+		if !ok {
+			return nil, &graphqlError{Message: fmt.Sprintf("variable $%s is not defined", x)}
+		}
+		return v, nil
+	case []any:
+		s := make([]any, len(x))
+		for i := range x {
+			var err error
+			if s[i], err = e.value(x[i]); err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	case map[string]any:
+		m := make(map[string]any, len(x))
+		for k := range x {
+			var err error
+			if m[k], err = e.value(x[k]); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+	return v, nil
+}
+
+// graphqlArgs holds the arguments of a field. Getters report whether the argument
+// is set to a non-null value, and fail if its value does not have the expected
+// type.
+type graphqlArgs map[string]any
+
+// check fails if args holds arguments not in names.
+func (args graphqlArgs) check(f *gqlSelection, names ...string) error {
+	for k := range args {
+		ok := false
+		for _, v := range names {
+			ok = ok || k == v
+		}
+		if !ok {
+			return &graphqlError{Message: fmt.Sprintf("field %s has no argument %s", f.name, k)}
+		}
+	}
+	return nil
+}
+
+func (args graphqlArgs) string(name string) (string, bool, error) {
+	switch x := args[name].(type) {
+	case nil:
+		return "", false, nil
+	case string:
+		return x, true, nil
+	}
+	return "", false, fmt.Errorf("argument %s must be a string", name)
+}
+
+func (args graphqlArgs) int(name string) (int64, bool, error) {
+	switch x := args[name].(type) {
+	case nil:
+		return 0, false, nil
+	case int64:
+		return x, true, nil
+	case json.Number:
+		if v, err := strconv.ParseInt(string(x), 10, 64); err == nil {
+			return v, true, nil
+		}
+	}
+	return 0, false, fmt.Errorf("argument %s must be an integer", name)
+}
+
+func (args graphqlArgs) bool(name string) (bool, bool, error) {
+	switch x := args[name].(type) {
+	case nil:
+		return false, false, nil
+	case bool:
+		return x, true, nil
+	}
+	return false, false, fmt.Errorf("argument %s must be a boolean", name)
+}
+
+// graphqlLeaf fails if f, a field of a scalar type, has a selection of subfields.
+func graphqlLeaf(f *gqlSelection) error {
+	if f.selections != nil {
+		return &graphqlError{Message: fmt.Sprintf("field %s has no subfields", f.name)}
+	}
+	return nil
+}
+
+// graphqlObject fails if f, a field of object type typename, has no selection of
+// subfields.
+func graphqlObject(f *gqlSelection, typename string) error {
+	if f.selections == nil {
+		return &graphqlError{Message: fmt.Sprintf("field %s of type %s must have a selection of subfields", f.name, typename)}
+	}
+	return nil
+}
+
+// query resolves the fields of the Query type.
+func (e *graphqlExecutor) query(b []byte, f *gqlSelection, args graphqlArgs) ([]byte, error) {
+	switch f.name {
+	case "keys":
+		if err := args.check(f, "pattern"); err != nil {
+			return nil, err
+		}
+		if err := graphqlObject(f, "Key"); err != nil {
+			return nil, err
+		}
+		pattern, ok, err := args.string("pattern")
+		if err != nil {
+			return nil, &graphqlError{Message: err.Error()}
+		}
+		if !ok {
+			pattern = "*"
+		}
+		b = append(b, '[')
+		for i, k := range e.s.keys(pattern) {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			if b, err = e.object(b, "Key", f.selections, e.key(k)); err != nil {
+				return nil, err
+			}
+		}
+		return append(b, ']'), nil
+	case "key":
+		if err := args.check(f, "name"); err != nil {
+			return nil, err
+		}
+		if err := graphqlObject(f, "Key"); err != nil {
+			return nil, err
+		}
+		name, ok, err := args.string("name")
+		if err == nil && !ok {
+			err = errors.New("argument name is required")
+		}
+		if err != nil {
+			return nil, &graphqlError{Message: err.Error()}
+		}
+		_, composite := e.s.meta.composite(name)
+		if isSubtree(name) || !composite && len(e.s.keys(name)) == 0 {
+			return append(b, "null"...), nil
+		}
+		return e.object(b, "Key", f.selections, e.key(name))
+	}
+	return nil, &graphqlError{Message: fmt.Sprintf("type Query has no field %s", f.name)}
+}
+
+// key returns the resolver of the fields of the Key type for key.
+func (e *graphqlExecutor) key(key string) graphqlResolver {
+	return func(b []byte, f *gqlSelection, args graphqlArgs) ([]byte, error) {
+		switch f.name {
+		case "name", "composite", "maintenance":
+			if err := args.check(f); err != nil {
+				return nil, err
+			}
+		}
+		switch f.name {
+		case "name":
+			if err := graphqlLeaf(f); err != nil {
+				return nil, err
+			}
+			return appendJSONString(b, key), nil
+		case "composite":
+			if err := graphqlLeaf(f); err != nil {
+				return nil, err
+			}
+			if expression, ok := e.s.meta.composite(key); ok {
+				return appendJSONString(b, expression), nil
+			}
+			return append(b, "null"...), nil
+		case "series":
+			return e.series(b, key, f, args)
+		case "maintenance":
+			if err := graphqlObject(f, "Window"); err != nil {
+				return nil, err
+			}
+			b = append(b, '[')
+			for i, v := range e.s.meta.maintenanceWindows(key) {
+				if i > 0 {
+					b = append(b, ',')
+				}
+				var err error
+				if b, err = e.object(b, "Window", f.selections, windowResolver(v)); err != nil {
+					return nil, err
+				}
+			}
+			return append(b, ']'), nil
+		case "annotations":
+			if err := args.check(f, "start", "end"); err != nil {
+				return nil, err
+			}
+			if err := graphqlObject(f, "Annotation"); err != nil {
+				return nil, err
+			}
+			start, _, err := args.int("start")
+			if err != nil {
+				return nil, &graphqlError{Message: err.Error()}
+			}
+			end, ok, err := args.int("end")
+			if err != nil {
+				return nil, &graphqlError{Message: err.Error()}
+			}
+			if !ok {
+				end = math.MaxInt64
+			}
+			b = append(b, '[')
+			for i, v := range e.s.meta.annotations(key, start, end) {
+				if i > 0 {
+					b = append(b, ',')
+				}
+				if b, err = e.object(b, "Annotation", f.selections, annotationResolver(v)); err != nil {
+					return nil, err
+				}
+			}
+			return append(b, ']'), nil
+		}
+		return nil, &graphqlError{Message: fmt.Sprintf("type Key has no field %s", f.name)}
+	}
+}
+
+// series appends the value of the series field of key to b.
+func (e *graphqlExecutor) series(b []byte, key string, f *gqlSelection, args graphqlArgs) ([]byte, error) {
+	if err := args.check(f, "start", "end", "excludeMaintenance"); err != nil {
+		return nil, err
+	}
+	var bounds [2]string
+	for i, name := range []string{"start", "end"} {
+		x, ok, err := args.int(name)
+		if err == nil && !ok {
+			err = fmt.Errorf("argument %s is required", name)
+		}
+		if err != nil {
+			return nil, &graphqlError{Message: err.Error()}
+		}
+		bounds[i] = strconv.FormatInt(x, 10)
+	}
+	exclude, _, err := args.bool("excludeMaintenance")
+	if err != nil {
+		return nil, &graphqlError{Message: err.Error()}
+	}
+	if err := graphqlObject(f, "Series"); err != nil {
+		return nil, err
+	}
+
+	message, data, code, err := e.s.cachedQuery(e.ctx, key, bounds[0], bounds[1], exclude, nil, e.s.get)
+	switch {
+	case err == errKeyNotFound:
+		return append(b, "null"...), nil
+	case err != nil && code == http.StatusInternalServerError:
+		return nil, err
+	case err != nil:
+		return nil, &graphqlError{Message: err.Error()}
+	}
+	var n, interval int64
+	if _, err := fmt.Sscanf(message, "%d row(s) returned (interval %ds)", &n, &interval); err != nil {
+		return nil, err
+	}
+	var rows []queryRow
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return nil, err
+	}
+
+	return e.object(b, "Series", f.selections, func(b []byte, f *gqlSelection, args graphqlArgs) ([]byte, error) {
+		if err := args.check(f); err != nil {
+			return nil, err
+		}
+		switch f.name {
+		case "interval":
+			if err := graphqlLeaf(f); err != nil {
+				return nil, err
+			}
+			return strconv.AppendInt(b, interval, 10), nil
+		case "rows":
+			if err := graphqlObject(f, "Row"); err != nil {
+				return nil, err
+			}
+			b = append(b, '[')
+			for i, v := range rows {
+				if i > 0 {
+					b = append(b, ',')
+				}
+				var err error
+				if b, err = e.object(b, "Row", f.selections, rowResolver(v)); err != nil {
+					return nil, err
+				}
+			}
+			return append(b, ']'), nil
+		}
+		return nil, &graphqlError{Message: fmt.Sprintf("type Series has no field %s", f.name)}
+	})
+}
+
+// rowResolver returns the resolver of the fields of the Row type for x.
+func rowResolver(x queryRow) graphqlResolver {
+	return func(b []byte, f *gqlSelection, args graphqlArgs) ([]byte, error) {
+		if err := args.check(f); err != nil {
+			return nil, err
+		}
+		if err := graphqlLeaf(f); err != nil {
+			return nil, err
+		}
+		switch f.name {
+		case "time":
+			return strconv.AppendInt(b, x.Date, 10), nil
+		case "count":
+			return strconv.AppendInt(b, x.Count, 10), nil
+		case "mean":
+			if x.Mean == nil {
+				return append(b, "null"...), nil
+			}
+			return strconv.AppendFloat(b, *x.Mean, 'f', -1, 64), nil
+		}
+		return nil, &graphqlError{Message: fmt.Sprintf("type Row has no field %s", f.name)}
+	}
+}
+
+// windowResolver returns the resolver of the fields of the Window type for x.
+func windowResolver(x window) graphqlResolver {
+	return func(b []byte, f *gqlSelection, args graphqlArgs) ([]byte, error) {
+		if err := args.check(f); err != nil {
+			return nil, err
+		}
+		if err := graphqlLeaf(f); err != nil {
+			return nil, err
+		}
+		switch f.name {
+		case "start":
+			return strconv.AppendInt(b, x.Start, 10), nil
+		case "end":
+			return strconv.AppendInt(b, x.End, 10), nil
+		}
+		return nil, &graphqlError{Message: fmt.Sprintf("type Window has no field %s", f.name)}
+	}
+}
+
+// annotationResolver returns the resolver of the fields of the Annotation type for
+// x.
+func annotationResolver(x annotation) graphqlResolver {
+	return func(b []byte, f *gqlSelection, args graphqlArgs) ([]byte, error) {
+		if err := args.check(f); err != nil {
+			return nil, err
+		}
+		if err := graphqlLeaf(f); err != nil {
+			return nil, err
+		}
+		switch f.name {
+		case "key":
+			if x.Key == "" {
+				return append(b, "null"...), nil
+			}
+			return appendJSONString(b, x.Key), nil
+		case "time":
+			return strconv.AppendInt(b, x.Time, 10), nil
+		case "kind":
+			return appendJSONString(b, x.Kind), nil
+		case "text":
+			return appendJSONString(b, x.Text), nil
+		}
+		return nil, &graphqlError{Message: fmt.Sprintf("type Annotation has no field %s", f.name)}
+	}
+}
+
+// appendJSONString appends s encoded as a JSON string to b.
+func appendJSONString(b []byte, s string) []byte {
+	data, _ := json.Marshal(s)
+	return append(b, data...)
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Subset of the GraphQL query language used by the GraphQL endpoint: query
+// operations with variables, aliases, arguments, fragments, inline fragments and
+// the skip and include directives. Type references of variable definitions are
+// parsed but not checked, values being checked by the fields using them.
+
+// Kinds of GraphQL tokens.
+const (
+	gqlEOF = iota
+	gqlPunctuator
+	gqlName
+	gqlInt
+	gqlFloat
+	gqlString
+)
+
+type gqlToken struct {
+	kind  int
+	value string
+	pos   int
+}
+
+// A gqlVariable is a reference to a variable used as a value.
+type gqlVariable string
+
+// A gqlEnum is an enum value.
+type gqlEnum string
+
+// A gqlDirective is a directive applied to a selection.
+type gqlDirective struct {
+	name string
+	args map[string]any
+}
+
+// A gqlSelection is a field, a fragment spread if spread is set, or an inline
+// fragment if selections is set and name is empty.
+type gqlSelection struct {
+	alias      string
+	name       string
+	args       map[string]any
+	directives []gqlDirective
+	selections []*gqlSelection
+	spread     string
+	on         string // type condition of inline fragments
+}
+
+// key returns the name of the field in the response.
+func (x *gqlSelection) key() string {
+	if x.alias != "" {
+		return x.alias
+	}
+	return x.name
+}
+
+// A gqlVariableDefinition is a variable of an operation.
+type gqlVariableDefinition struct {
+	name     string
+	nonNull  bool
+	value    any
+	hasValue bool // whether the variable has a default value
+}
+
+type gqlOperation struct {
+	name       string
+	variables  []gqlVariableDefinition
+	selections []*gqlSelection
+}
+
+type gqlFragment struct {
+	on         string
+	selections []*gqlSelection
+}
+
+// A gqlDocument is a parsed GraphQL document.
+type gqlDocument struct {
+	operations []*gqlOperation
+	fragments  map[string]*gqlFragment
+}
+
+type gqlParser struct {
+	src string
+	pos int
+	tok gqlToken
+	err error
+}
+
+// parseGraphQL parses src, a GraphQL document.
+func parseGraphQL(src string) (*gqlDocument, error) {
+	p := &gqlParser{src: src}
+	p.next()
+	d := &gqlDocument{fragments: make(map[string]*gqlFragment)}
+	for p.err == nil && p.tok.kind != gqlEOF {
+		switch {
+		case p.peek("{"):
+			d.operations = append(d.operations, &gqlOperation{selections: p.selectionSet()})
+		case p.tok.kind == gqlName && p.tok.value == "query":
+			p.next()
+			d.operations = append(d.operations, p.operation())
+		case p.tok.kind == gqlName && (p.tok.value == "mutation" || p.tok.value == "subscription"):
+			return nil, fmt.Errorf("%s operations are not supported", p.tok.value)
+		case p.tok.kind == gqlName && p.tok.value == "fragment":
+			p.next()
+			name := p.name()
+			if name == "on" {
+				p.fail("fragment name")
+			}
+			if _, ok := d.fragments[name]; ok && p.err == nil {
+				return nil, fmt.Errorf("fragment %s is defined more than once", name)
+			}
+			p.keyword("on")
+			x := &gqlFragment{on: p.name()}
+			p.directives()
+			x.selections = p.selectionSet()
+			d.fragments[name] = x
+		default:
+			p.fail("definition")
+		}
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	if len(d.operations) == 0 {
+		return nil, fmt.Errorf("document has no operation")
+	}
+	return d, nil
+}
+
+func (p *gqlParser) operation() *gqlOperation {
+	x := &gqlOperation{}
+	if p.tok.kind == gqlName {
+		x.name = p.name()
+	}
+	if p.accept("(") {
+		for p.err == nil && !p.accept(")") {
+			p.expect("$")
+			v := gqlVariableDefinition{name: p.name()}
+			p.expect(":")
+			v.nonNull = p.typeReference()
+			if p.accept("=") {
+				v.value, v.hasValue = p.value(true), true
+			}
+			x.variables = append(x.variables, v)
+		}
+	}
+	p.directives()
+	x.selections = p.selectionSet()
+	return x
+}
+
+// typeReference parses a type reference, reporting whether it is non-null.
+func (p *gqlParser) typeReference() bool {
+	if p.accept("[") {
+		p.typeReference()
+		p.expect("]")
+	} else {
+		p.name()
+	}
+	return p.accept("!")
+}
+
+func (p *gqlParser) selectionSet() []*gqlSelection {
+	var selections []*gqlSelection
+	p.expect("{")
+	for p.err == nil && !p.accept("}") {
+		x := &gqlSelection{}
+		if p.accept("...") {
+			switch {
+			case p.tok.kind == gqlName && p.tok.value != "on":
+				x.spread = p.name()
+				x.directives = p.directives()
+			default:
+				if p.tok.kind == gqlName {
+					p.next()
+					x.on = p.name()
+				}
+				x.directives = p.directives()
+				x.selections = p.selectionSet()
+			}
+		} else {
+			x.name = p.name()
+			if p.accept(":") {
+				x.alias, x.name = x.name, p.name()
+			}
+			x.args = p.arguments(false)
+			x.directives = p.directives()
+			if p.peek("{") {
+				x.selections = p.selectionSet()
+			}
+		}
+		selections = append(selections, x)
+	}
+	if len(selections) == 0 {
+		p.fail("selection")
+	}
+	return selections
+}
+
+func (p *gqlParser) arguments(constant bool) map[string]any {
+	if !p.accept("(") {
+		return nil
+	}
+	args := make(map[string]any)
+	for p.err == nil && !p.accept(")") {
+		name := p.name()
+		p.expect(":")
+		if _, ok := args[name]; ok && p.err == nil {
+			p.err = fmt.Errorf("argument %s is set more than once", name)
+		}
+		args[name] = p.value(constant)
+	}
+	return args
+}
+
+func (p *gqlParser) directives() []gqlDirective {
+	var directives []gqlDirective
+	for p.err == nil && p.accept("@") {
+		directives = append(directives, gqlDirective{name: p.name(), args: p.arguments(false)})
+	}
+	return directives
+}
+
+// value parses a value, variables being rejected if constant is set.
+func (p *gqlParser) value(constant bool) any {
+	t := p.tok
+	switch t.kind {
+	case gqlInt:
+		p.next()
+		x, err := strconv.ParseInt(t.value, 10, 64)
+		if err != nil {
+			p.fail("integer")
+		}
+		return x
+	case gqlFloat:
+		p.next()
+		x, err := strconv.ParseFloat(t.value, 64)
+		if err != nil {
+			p.fail("float")
+		}
+		return x
+	case gqlString:
+		p.next()
+		return t.value
+	case gqlName:
+		p.next()
+		switch t.value {
+		case "true":
+			return true
+		case "false":
+			return false
+		case "null":
+			return nil
+		}
+		return gqlEnum(t.value)
+	}
+	switch {
+	case !constant && p.accept("$"):
+		return gqlVariable(p.name())
+	case p.accept("["):
+		x := []any{}
+		for p.err == nil && !p.accept("]") {
+			x = append(x, p.value(constant))
+		}
+		return x
+	case p.accept("{"):
+		x := make(map[string]any)
+		for p.err == nil && !p.accept("}") {
+			name := p.name()
+			p.expect(":")
+			x[name] = p.value(constant)
+		}
+		return x
+	}
+	p.fail("value")
+	return nil
+}
+
+// name returns the current token, a name, and advances to the next token.
+func (p *gqlParser) name() string {
+	if p.tok.kind != gqlName {
+		p.fail("name")
+		return ""
+	}
+	s := p.tok.value
+	p.next()
+	return s
+}
+
+// keyword advances to the next token if the current one is the name s.
+func (p *gqlParser) keyword(s string) {
+	if p.tok.kind != gqlName || p.tok.value != s {
+		p.fail(strconv.Quote(s))
+		return
+	}
+	p.next()
+}
+
+// peek reports whether the current token is the punctuator s.
+func (p *gqlParser) peek(s string) bool {
+	return p.err == nil && p.tok.kind == gqlPunctuator && p.tok.value == s
+}
+
+// accept advances to the next token if the current one is the punctuator s.
+func (p *gqlParser) accept(s string) bool {
+	if !p.peek(s) {
+		return false
+	}
+	p.next()
+	return true
+}
+
+func (p *gqlParser) expect(s string) {
+	if !p.accept(s) {
+		p.fail(strconv.Quote(s))
+	}
+}
+
+// fail records a syntax error at the current token, the first error being kept.
+func (p *gqlParser) fail(expected string) {
+	if p.err != nil {
+		return
+	}
+	found := "end of document"
+	if p.tok.kind != gqlEOF {
+		found = strconv.Quote(p.tok.value)
+	}
+	p.err = fmt.Errorf("syntax error at offset %d: expected %s, found %s", p.tok.pos, expected, found)
+}
+
+// next reads the next token, skipping whitespace, commas and comments.
+func (p *gqlParser) next() {
+	if p.err != nil {
+		return
+	}
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' && p.src[p.pos] != '\r' {
+				p.pos++
+			}
+			continue
+		}
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' && c != ',' {
+			break
+		}
+		p.pos++
+	}
+	start := p.pos
+	p.tok = gqlToken{kind: gqlEOF, pos: start}
+	if p.pos == len(p.src) {
+		return
+	}
+	if strings.HasPrefix(p.src[p.pos:], "\ufeff") {
+		p.pos += 3
+		p.next()
+		return
+	}
+
+	c := p.src[p.pos]
+	switch {
+	case strings.HasPrefix(p.src[p.pos:], "..."):
+		p.pos += 3
+		p.tok = gqlToken{kind: gqlPunctuator, value: "...", pos: start}
+	case strings.IndexByte("!$&():=@[]{|}", c) != -1:
+		p.pos++
+		p.tok = gqlToken{kind: gqlPunctuator, value: string(c), pos: start}
+	case c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z':
+		for p.pos < len(p.src) && isNameByte(p.src[p.pos]) {
+			p.pos++
+		}
+		p.tok = gqlToken{kind: gqlName, value: p.src[start:p.pos], pos: start}
+	case c == '-' || '0' <= c && c <= '9':
+		p.number()
+	case strings.HasPrefix(p.src[p.pos:], `"""`):
+		p.blockString()
+	case c == '"':
+		p.string()
+	default:
+		r, _ := utf8.DecodeRuneInString(p.src[p.pos:])
+		p.tok = gqlToken{kind: gqlPunctuator, value: string(r), pos: start}
+		p.fail("token")
+	}
+}
+
+func isNameByte(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+func (p *gqlParser) number() {
+	start := p.pos
+	kind := gqlInt
+	if p.src[p.pos] == '-' {
+		p.pos++
+	}
+	digits := func() int {
+		n := 0
+		for p.pos < len(p.src) && '0' <= p.src[p.pos] && p.src[p.pos] <= '9' {
+			p.pos++
+			n++
+		}
+		return n
+	}
+	n := digits()
+	valid := n > 0 && (n == 1 || p.src[p.pos-n] != '0')
+	if p.pos < len(p.src) && p.src[p.pos] == '.' {
+		p.pos++
+		kind = gqlFloat
+		valid = valid && digits() > 0
+	}
+	if p.pos < len(p.src) && (p.src[p.pos] == 'e' || p.src[p.pos] == 'E') {
+		p.pos++
+		kind = gqlFloat
+		if p.pos < len(p.src) && (p.src[p.pos] == '+' || p.src[p.pos] == '-') {
+			p.pos++
+		}
+		valid = valid && digits() > 0
+	}
+	if p.pos < len(p.src) && (isNameByte(p.src[p.pos]) || p.src[p.pos] == '.') {
+		valid = false
+		p.pos++
+	}
+	p.tok = gqlToken{kind: kind, value: p.src[start:p.pos], pos: start}
+	if !valid {
+		p.fail("number")
+	}
+}
+
+func (p *gqlParser) string() {
+	start := p.pos
+	p.pos++
+	var b strings.Builder
+	for {
+		if p.pos >= len(p.src) || p.src[p.pos] == '\n' || p.src[p.pos] == '\r' {
+			p.tok = gqlToken{kind: gqlString, value: p.src[start:p.pos], pos: start}
+			p.fail("end of string")
+			return
+		}
+		c := p.src[p.pos]
+		if c == '"' {
+			p.pos++
+			break
+		}
+		if c != '\\' {
+			b.WriteByte(c)
+			p.pos++
+			continue
+		}
+		if p.pos+1 >= len(p.src) {
+			p.pos++
+			continue
+		}
+		p.pos += 2
+		switch e := p.src[p.pos-1]; e {
+		case '"', '\\', '/':
+			b.WriteByte(e)
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'u':
+			var x uint64
+			var err error
+			if p.pos+4 <= len(p.src) {
+				x, err = strconv.ParseUint(p.src[p.pos:p.pos+4], 16, 16)
+			}
+			if p.pos+4 > len(p.src) || err != nil {
+				p.tok = gqlToken{kind: gqlString, value: p.src[start:p.pos], pos: start}
+				p.fail("unicode escape sequence")
+				return
+			}
+			b.WriteRune(rune(x))
+			p.pos += 4
+		default:
+			p.tok = gqlToken{kind: gqlString, value: p.src[start:p.pos], pos: start}
+			p.fail("escape sequence")
+			return
+		}
+	}
+	p.tok = gqlToken{kind: gqlString, value: b.String(), pos: start}
+}
+
+// blockString reads a block string, removing its common indentation and its
+// leading and trailing blank lines.
+func (p *gqlParser) blockString() {
+	start := p.pos
+	p.pos += 3
+	i := strings.Index(strings.ReplaceAll(p.src[p.pos:], `\"""`, "\x00\x00\x00\x00"), `"""`)
+	if i == -1 {
+		p.tok = gqlToken{kind: gqlString, value: p.src[start:], pos: start}
+		p.pos = len(p.src)
+		p.fail("end of block string")
+		return
+	}
+	raw := strings.ReplaceAll(p.src[p.pos:p.pos+i], `\"""`, `"""`)
+	p.pos += i + 3
+
+	lines := strings.Split(strings.ReplaceAll(strings.ReplaceAll(raw, "\r\n", "\n"), "\r", "\n"), "\n")
+	indent := -1
+	for _, v := range lines[1:] {
+		n := len(v) - len(strings.TrimLeft(v, " \t"))
+		if n < len(v) && (indent == -1 || n < indent) {
+			indent = n
+		}
+	}
+	if indent > 0 {
+		for i := 1; i < len(lines); i++ {
+			if len(lines[i]) >= indent {
+				lines[i] = lines[i][indent:]
+			} else {
+				lines[i] = strings.TrimLeft(lines[i], " \t")
+			}
+		}
+	}
+	for len(lines) > 0 && strings.TrimLeft(lines[0], " \t") == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimLeft(lines[len(lines)-1], " \t") == "" {
+		lines = lines[:len(lines)-1]
+	}
+	p.tok = gqlToken{kind: gqlString, value: strings.Join(lines, "\n"), pos: start}
+}
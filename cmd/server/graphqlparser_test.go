@@ -0,0 +1,140 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseGraphQLValues(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  any
+	}{
+		{"int", "42", int64(42)},
+		{"negative int", "-7", int64(-7)},
+		{"float", "1.5e3", 1500.0},
+		{"string", `"eu.web"`, "eu.web"},
+		{"escapes", `"a\"b\\c\/d\né"`, "a\"b\\c/d\né"},
+		{"block string", "\"\"\"\n    first\n      second\n    \\\"\"\"\n  \"\"\"", "first\n  second\n\"\"\""},
+		{"booleans and null", "[true, false, null]", []any{true, false, nil}},
+		{"enum", "DAY", gqlEnum("DAY")},
+		{"variable", "$key", gqlVariable("key")},
+		{"list", "[1 2, 3]", []any{int64(1), int64(2), int64(3)}},
+		{"object", `{key: "a", days: [1]}`, map[string]any{"key": "a", "days": []any{int64(1)}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := parseGraphQL("{ f(v: " + tt.value + ") }")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			got := d.operations[0].selections[0].args["v"]
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected %#v, got %#v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseGraphQLDocument(t *testing.T) {
+	src := `
+# comment
+query Series($key: String!, $days: [Int] = [1, 7]) @cached {
+  s: series(key: $key) {
+    ...fields @include(if: true)
+    ... on Series { mean }
+    ... @skip(if: false) { count }
+  }
+}
+
+fragment fields on Series { key, values(days: $days) }
+`
+	d, err := parseGraphQL("\ufeff" + src)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(d.operations) != 1 {
+		t.Fatalf("expected 1 operation, got %d", len(d.operations))
+	}
+	op := d.operations[0]
+	if op.name != "Series" {
+		t.Errorf("expected operation Series, got %q", op.name)
+	}
+	wantVariables := []gqlVariableDefinition{
+		{name: "key", nonNull: true},
+		{name: "days", value: []any{int64(1), int64(7)}, hasValue: true},
+	}
+	if !reflect.DeepEqual(op.variables, wantVariables) {
+		t.Errorf("expected variables %#v, got %#v", wantVariables, op.variables)
+	}
+
+	s := op.selections[0]
+	if s.alias != "s" || s.name != "series" || s.key() != "s" {
+		t.Errorf("expected field series aliased s, got %q aliased %q", s.name, s.alias)
+	}
+	if got := s.args["key"]; got != gqlVariable("key") {
+		t.Errorf("expected argument $key, got %#v", got)
+	}
+	if len(s.selections) != 3 {
+		t.Fatalf("expected 3 selections, got %d", len(s.selections))
+	}
+	spread, inline, untyped := s.selections[0], s.selections[1], s.selections[2]
+	if spread.spread != "fields" || len(spread.directives) != 1 || spread.directives[0].name != "include" {
+		t.Errorf("expected spread of fields with include directive, got %#v", spread)
+	}
+	if inline.on != "Series" || len(inline.selections) != 1 || inline.selections[0].name != "mean" {
+		t.Errorf("expected inline fragment on Series, got %#v", inline)
+	}
+	if untyped.on != "" || len(untyped.directives) != 1 || untyped.directives[0].args["if"] != false {
+		t.Errorf("expected inline fragment without type condition with skip directive, got %#v", untyped)
+	}
+
+	f, ok := d.fragments["fields"]
+	if !ok {
+		t.Fatal("expected fragment fields")
+	}
+	if f.on != "Series" || len(f.selections) != 2 || f.selections[1].args["days"] != gqlVariable("days") {
+		t.Errorf("expected fragment on Series selecting key and values, got %#v", f)
+	}
+}
+
+func TestParseGraphQLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		err  string
+	}{
+		{"empty", "", "document has no operation"},
+		{"fragment only", "fragment f on Series { key }", "document has no operation"},
+		{"mutation", "mutation { insert }", "mutation operations are not supported"},
+		{"subscription", "subscription { watch }", "subscription operations are not supported"},
+		{"empty selection", "{ }", "expected selection"},
+		{"unclosed selection", "{ keys", "syntax error at offset 6: expected name, found end of document"},
+		{"unknown definition", "schema { query: Query }", `syntax error at offset 0: expected definition, found "schema"`},
+		{"duplicate argument", "{ f(a: 1, a: 2) }", "argument a is set more than once"},
+		{"duplicate fragment", "{ f } fragment a on T { f } fragment a on T { f }", "fragment a is defined more than once"},
+		{"fragment named on", "{ f } fragment on on T { f }", `expected fragment name, found "on"`},
+		{"variable in default value", "query ($a: Int = $b) { f }", `expected value, found "$"`},
+		{"leading zero", "{ f(a: 01) }", `expected number, found "01"`},
+		{"invalid number", "{ f(a: 1.) }", "expected number"},
+		{"number followed by name", "{ f(a: 1x) }", `expected number, found "1x"`},
+		{"unterminated string", "{ f(a: \"x\n\") }", "expected end of string"},
+		{"invalid escape", `{ f(a: "\x") }`, "expected escape sequence"},
+		{"invalid unicode escape", `{ f(a: "\u00zz") }`, "expected unicode escape sequence"},
+		{"unterminated block string", `{ f(a: """x) }`, "expected end of block string"},
+		{"unexpected character", "{ f(a: 1) } ?", `syntax error at offset 12: expected token, found "?"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseGraphQL(tt.src)
+			if err == nil {
+				t.Fatalf("expected error %q, got none", tt.err)
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected error %q, got %q", tt.err, err)
+			}
+		})
+	}
+}
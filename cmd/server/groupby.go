@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// maxGroupDepth is the maximum number of segments of the prefixes keys are grouped
+// by.
+const maxGroupDepth = 16
+
+// errGroupNotSupported is returned by the servers that cannot combine the groups
+// of keys stored on other servers (routers and federated servers), the results of
+// each server being rounded.
+var errGroupNotSupported = errors.New("group is not supported by queries spanning multiple servers")
+
+// parseGroupDepth parses the group parameter of subtree queries, a number of
+// dot-separated segments.
+func parseGroupDepth(s string) (int, error) {
+	depth, err := strconv.Atoi(s)
+	if err != nil || depth < 1 || depth > maxGroupDepth {
+		return 0, fmt.Errorf("group must be between 1 and %d", maxGroupDepth)
+	}
+	return depth, nil
+}
+
+// groupPrefix returns the first depth dot-separated segments of key, or key if it
+// has fewer segments.
+func groupPrefix(key string, depth int) string {
+	i := 0
+	for n := 0; n < depth; n++ {
+		j := strings.IndexByte(key[i:], '.')
+		if j == -1 {
+			return key
+		}
+		i += j + 1
+	}
+	return key[:i-1]
+}
+
+// groupInterval returns the smallest aggregation interval that is a multiple of
+// the frequency of every sequence of sequences and returns at most
+// maxNumberOfPoints groups over scope seconds.
+func groupInterval(sequences []*sequence.Sequence, scope int64) (int64, error) {
+	for _, v := range aggregations {
+		if scope/v > maxNumberOfPoints {
+			continue
+		}
+		ok := true
+		for _, x := range sequences {
+			ok = ok && v%int64(x.Frequency()) == 0
+		}
+		if ok {
+			return v, nil
+		}
+	}
+	return 0, rangeError("range is too large")
+}
+
+// handlerQueryGroups executes a subtree query on pattern whose keys are grouped by
+// their first depth dot-separated segments, returning one series per group: the
+// number of known values of the keys of the group and the ratio of active values
+// among them. Groups are aligned on multiples of the interval, which is a multiple
+// of the frequency of every key, so that the groups of different keys can be
+// combined.
+func (s *server) handlerQueryGroups(w http.ResponseWriter, r *http.Request, pattern string, depth int, format string, exclude bool, hours *schedule) {
+	x, y, err := parseRange(r.FormValue("start"), r.FormValue("end"), 1)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorInvalidRange, err.Error())
+		return
+	}
+
+	// keys holding no sequence (e.g. gauges) are ignored
+	var keys []string
+	var sequences []*sequence.Sequence
+	for _, k := range s.keys(pattern) {
+		if seq, ok := s.store.Get(k); ok {
+			keys, sequences = append(keys, k), append(sequences, seq)
+		}
+	}
+
+	interval, err := groupInterval(sequences, y.Unix()-x.Unix())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorInvalidRange, err.Error())
+		return
+	}
+	start := x.Unix() - x.Unix()%interval
+	args := queryArgs{start: time.Unix(start, 0), end: y, interval: time.Duration(interval) * time.Second, hours: hours}
+	n := int((y.Unix()-start)/interval + 1)
+
+	groups := make(map[string]*sequence.QuerySet)
+	for i, k := range keys {
+		if err := r.Context().Err(); err != nil {
+			logf(r, "query stopped after %d/%d key(s): %s", i, len(keys), err)
+			writeContextError(w, err)
+			return
+		}
+		qs, err := s.query(k, sequences[i], args, exclude)
+		if err != nil {
+			writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+			logf(r, "error executing query: %s", err)
+			return
+		}
+		name := groupPrefix(k, depth)
+		g, ok := groups[name]
+		if !ok {
+			g = &sequence.QuerySet{Timestamp: start, Frequency: interval, Sum: make([]int64, n), Count: make([]int64, n)}
+			groups[name] = g
+		}
+		for j := 0; j < n && j < len(qs.Count); j++ {
+			g.Sum[j] += qs.Sum[j]
+			g.Count[j] += qs.Count[j]
+		}
+	}
+
+	names := make([]string, 0, len(groups))
+	for k := range groups {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	data := make([][]byte, len(names))
+	for i, k := range names {
+		data[i] = groups[k].Serialize("", time.UTC, 2, serializeFlag)
+	}
+
+	message := fmt.Sprintf("%d group(s) returned over %d key(s) (interval %ds)", len(names), len(keys), interval)
+	switch format {
+	case formatCSV:
+		writeGroupsCSV(w, r, names, data)
+		return
+	case formatMsgpack:
+		writeMsgpack(w, message, names, data)
+		return
+	}
+	m := make(map[string]json.RawMessage, len(names))
+	for i, k := range names {
+		m[k] = data[i]
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+		logf(r, "error serializing response: %s", err)
+		return
+	}
+	writeResponse(w, http.StatusOK, statusOK, message, b)
+}
+
+// writeGroupsCSV writes a successful response holding the rows of each group of
+// names encoded as CSV, data holding the rows of each group encoded as JSON.
+func writeGroupsCSV(w http.ResponseWriter, r *http.Request, names []string, data [][]byte) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	c := csv.NewWriter(buf)
+	c.Write(csvHeader)
+	for i, k := range names {
+		if err := writeCSVRows(c, k, data[i]); err != nil {
+			writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+			logf(r, "error serializing response: %s", err)
+			return
+		}
+	}
+	c.Flush()
+	w.Header().Set("Content-Type", "text/csv")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
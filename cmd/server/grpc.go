@@ -0,0 +1,470 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// grpcService is the path prefix of the methods of the gRPC service described by
+// proto/runlength.proto.
+const grpcService = "/runlength.v1.RunLength/"
+
+// grpcMaxMessageSize is the maximum size of the messages received by the gRPC
+// service, the default of most gRPC implementations.
+const grpcMaxMessageSize = 4 << 20
+
+// gRPC status codes.
+const (
+	grpcOK                 = 0
+	grpcCanceled           = 1
+	grpcInvalidArgument    = 3
+	grpcNotFound           = 5
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+)
+
+// A grpcError is an error returned to gRPC clients using code as status code.
+type grpcError struct {
+	code    int
+	message string
+}
+
+func (e *grpcError) Error() string {
+	return e.message
+}
+
+// A grpcStream reads the messages of a gRPC request and writes the messages of
+// its response.
+type grpcStream struct {
+	w       http.ResponseWriter
+	r       *http.Request
+	started bool
+}
+
+// recv returns the next message of the request, or io.EOF at the end of the
+// request.
+func (x *grpcStream) recv() ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(x.r.Body, prefix[:]); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, &grpcError{grpcInvalidArgument, "error reading request: " + err.Error()}
+	}
+	if prefix[0] != 0 {
+		return nil, &grpcError{grpcUnimplemented, "compressed messages are not supported"}
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > grpcMaxMessageSize {
+		return nil, &grpcError{grpcResourceExhausted, fmt.Sprintf("message exceeds %d bytes", grpcMaxMessageSize)}
+	}
+	m := make([]byte, size)
+	if _, err := io.ReadFull(x.r.Body, m); err != nil {
+		return nil, &grpcError{grpcInvalidArgument, "error reading request: " + err.Error()}
+	}
+	return m, nil
+}
+
+// recvOne returns the message of a unary request.
+func (x *grpcStream) recvOne() ([]byte, error) {
+	m, err := x.recv()
+	if err == io.EOF {
+		return nil, &grpcError{grpcInvalidArgument, "missing request message"}
+	}
+	return m, err
+}
+
+// start writes the headers of the response.
+func (x *grpcStream) start() {
+	if !x.started {
+		x.w.WriteHeader(http.StatusOK)
+		x.started = true
+	}
+}
+
+// send writes m as the next message of the response.
+func (x *grpcStream) send(m []byte) error {
+	x.start()
+	b := make([]byte, 5, 5+len(m))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(m)))
+	if _, err := x.w.Write(append(b, m...)); err != nil {
+		return err
+	}
+	if f, ok := x.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// handlerGRPC serves the methods of the gRPC service. gRPC requires HTTP/2, used
+// by the TLS listener, and by the plaintext listener if h2c is enabled.
+func (s *server) handlerGRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+	if r.ProtoMajor != 2 {
+		writeResponse(w, http.StatusBadRequest, statusError, "gRPC requires HTTP/2", nil)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/grpc" && ct != "application/grpc+proto" {
+		writeResponse(w, http.StatusUnsupportedMediaType, statusError, "content type is not supported", nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	x := &grpcStream{w: w, r: r}
+
+	var err error
+	switch strings.TrimPrefix(r.URL.Path, grpcService) {
+	case "Insert":
+		err = s.grpcInsert(x)
+	case "Query":
+		err = s.grpcQuery(x)
+	case "ListKeys":
+		err = s.grpcListKeys(x)
+	case "Watch":
+		err = s.grpcWatch(x)
+	default:
+		err = &grpcError{grpcUnimplemented, "unknown method"}
+	}
+
+	code, message := grpcOK, ""
+	if err != nil {
+		code, message = grpcInternal, "an unexpected error occurred"
+		var e *grpcError
+		if errors.As(err, &e) {
+			code, message = e.code, e.message
+		} else {
+			logf(r, "error serving gRPC request %s: %s", r.URL.Path, err)
+		}
+	}
+	x.start()
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", url.PathEscape(message))
+}
+
+// grpcInsert applies the statements of each InsertRequest message as a batch as
+// messages are received, and returns a single InsertResponse.
+func (s *server) grpcInsert(x *grpcStream) error {
+	if s.readOnly {
+		return &grpcError{grpcFailedPrecondition, "server is read-only"}
+	}
+	if s.raft != nil {
+		return &grpcError{grpcFailedPrecondition, "gRPC inserts are not replicated in raft mode"}
+	}
+	if s.draining.Load() {
+		return &grpcError{grpcUnavailable, "server is draining"}
+	}
+
+	var processed, duplicates, total int64
+	var rejected []byte
+	reject := func(i int64, reason string) {
+		var m []byte
+		m = appendProtoInt(m, 1, i)
+		m = appendProtoString(m, 2, reason)
+		rejected = appendProtoBytes(rejected, 4, m)
+	}
+
+	for {
+		m, err := x.recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		var raw [][]byte
+		var skip bool
+		p := protoReader{b: m}
+		for {
+			field, ok := p.next()
+			if !ok {
+				break
+			}
+			switch field {
+			case 1:
+				raw = append(raw, p.bytes())
+			case 2:
+				skip = p.bool()
+			}
+		}
+		if p.err != nil {
+			return &grpcError{grpcInvalidArgument, "InsertRequest: " + p.err.Error()}
+		}
+		if maxStatements > 0 && len(raw) > maxStatements {
+			return &grpcError{grpcResourceExhausted, fmt.Sprintf("request exceeds %d statement(s)", maxStatements)}
+		}
+		if _, err := s.ingestQuota(len(raw)); err != nil {
+			return &grpcError{grpcResourceExhausted, err.Error()}
+		}
+
+		mapping := make([]int64, 0, len(raw))
+		statements := make([]sequence.Statement, 0, len(raw))
+		for i, b := range raw {
+			v, reason := s.grpcStatement(b, now)
+			if reason != "" {
+				reject(total+int64(i), reason)
+				continue
+			}
+			mapping = append(mapping, total+int64(i))
+			statements = append(statements, v)
+		}
+		errs := s.insert(x.r, statements, &duplicateFilter{s: s, enabled: skip})
+		for i, err := range errs {
+			switch {
+			case err == nil:
+				processed++
+			case err == errDuplicate:
+				duplicates++
+			default:
+				reject(mapping[i], err.Error())
+			}
+		}
+		total += int64(len(raw))
+		s.audit(x.r, auditInsert, appliedKeys(statements, errs), fmt.Sprintf("gRPC batch of %d statement(s)", len(raw)))
+	}
+
+	var m []byte
+	m = appendProtoInt(m, 1, processed)
+	m = appendProtoInt(m, 2, duplicates)
+	m = appendProtoInt(m, 3, total)
+	return x.send(append(m, rejected...))
+}
+
+// grpcStatement returns the statement represented by m, a Statement message, or
+// the reason of its rejection.
+func (s *server) grpcStatement(m []byte, now time.Time) (sequence.Statement, string) {
+	var key []byte
+	var state, ts int64
+	p := protoReader{b: m}
+	for {
+		field, ok := p.next()
+		if !ok {
+			break
+		}
+		switch field {
+		case 1:
+			key = p.bytes()
+		case 2:
+			state = p.int()
+		case 3:
+			ts = p.int()
+		}
+	}
+	if p.err != nil {
+		return sequence.Statement{}, "statement is not valid"
+	}
+	if reason := checkKey(key); reason != "" {
+		return sequence.Statement{}, reason
+	}
+	if state < 0 || state > int64(sequence.StateUnknown) {
+		return sequence.Statement{}, "state is not valid"
+	}
+	t := now
+	if ts != 0 {
+		var ok bool
+		if t, ok = s.future(time.Unix(ts, 0), now); !ok {
+			return sequence.Statement{}, "timestamp in the future"
+		}
+	}
+	return sequence.Statement{
+		Key:                 string(key),
+		Timestamp:           t,
+		Value:               uint8(state),
+		Type:                sequence.StatementAdd,
+		CreateIfNotExists:   true,
+		CreateWithTimestamp: t.Truncate(time.Duration(sequenceFrequency) * time.Second),
+		CreateWithFrequency: sequenceFrequency,
+	}, ""
+}
+
+// grpcQuery executes a query on a key or a subtree as /query/ does, returning the
+// rows of each key in a QueryResponse.
+func (s *server) grpcQuery(x *grpcStream) error {
+	m, err := x.recvOne()
+	if err != nil {
+		return err
+	}
+	var key, start, end string
+	var exclude bool
+	p := protoReader{b: m}
+	for {
+		field, ok := p.next()
+		if !ok {
+			break
+		}
+		switch field {
+		case 1:
+			key = p.string()
+		case 2:
+			start = p.string()
+		case 3:
+			end = p.string()
+		case 4:
+			exclude = p.bool()
+		}
+	}
+	if p.err != nil {
+		return &grpcError{grpcInvalidArgument, "QueryRequest: " + p.err.Error()}
+	}
+
+	var resp []byte
+	fn := func(k string, r keyResult) error {
+		if r.err != nil {
+			switch {
+			case r.code == http.StatusInternalServerError:
+				return r.err
+			case r.err == errKeyNotFound:
+				return &grpcError{grpcNotFound, fmt.Sprintf("key %s does not exist", k)}
+			case r.err == errCanceled:
+				return &grpcError{grpcCanceled, r.err.Error()}
+			case queryErrorCode(r.err) == errorQuotaExceeded:
+				return &grpcError{grpcResourceExhausted, r.err.Error()}
+			}
+			return &grpcError{grpcInvalidArgument, r.err.Error()}
+		}
+		series, err := appendProtoRows(appendProtoString(nil, 1, k), r.data)
+		if err != nil {
+			return err
+		}
+		resp = appendProtoBytes(resp, 1, series)
+		return nil
+	}
+
+	if !isSubtree(key) {
+		var r keyResult
+		_, r.data, r.code, r.err = s.cachedQuery(x.r.Context(), key, start, end, exclude, nil, s.get)
+		if err := fn(key, r); err != nil {
+			return err
+		}
+		return x.send(resp)
+	}
+	s.queryKeys(x.r.Context(), s.keys(key), start, end, exclude, nil, func(k string, r keyResult) bool {
+		if r.err == errKeyNotFound {
+			return true
+		}
+		err = fn(k, r)
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	return x.send(resp)
+}
+
+// appendProtoRows appends the rows encoded as JSON in data to b, a Series message,
+// as Row messages.
+func appendProtoRows(b, data []byte) ([]byte, error) {
+	var rows []queryRow
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return nil, err
+	}
+	for _, v := range rows {
+		var m []byte
+		m = appendProtoInt(m, 1, v.Date)
+		m = appendProtoInt(m, 2, v.Count)
+		if v.Mean != nil {
+			m = appendProtoDouble(m, 3, *v.Mean)
+		}
+		b = appendProtoBytes(b, 2, m)
+	}
+	return b, nil
+}
+
+// grpcListKeys returns the keys matching a key or a subtree pattern, every key if
+// the pattern is empty.
+func (s *server) grpcListKeys(x *grpcStream) error {
+	m, err := x.recvOne()
+	if err != nil {
+		return err
+	}
+	pattern := "*"
+	p := protoReader{b: m}
+	for {
+		field, ok := p.next()
+		if !ok {
+			break
+		}
+		if field == 1 {
+			pattern = p.string()
+		}
+	}
+	if p.err != nil {
+		return &grpcError{grpcInvalidArgument, "ListKeysRequest: " + p.err.Error()}
+	}
+	var resp []byte
+	for _, k := range s.keys(pattern) {
+		resp = appendProtoString(resp, 1, k)
+	}
+	return x.send(resp)
+}
+
+// grpcWatch streams the values applied to the keys matching a key or a subtree
+// pattern as WatchEvent messages, until the client cancels the call. The call fails
+// if the client falls behind.
+func (s *server) grpcWatch(x *grpcStream) error {
+	m, err := x.recvOne()
+	if err != nil {
+		return err
+	}
+	var pattern string
+	p := protoReader{b: m}
+	for {
+		field, ok := p.next()
+		if !ok {
+			break
+		}
+		if field == 1 {
+			pattern = p.string()
+		}
+	}
+	if p.err != nil {
+		return &grpcError{grpcInvalidArgument, "WatchRequest: " + p.err.Error()}
+	}
+	if pattern == "" {
+		return &grpcError{grpcInvalidArgument, "missing pattern"}
+	}
+
+	// watches are not bound by the write timeout of the listener
+	http.NewResponseController(x.w).SetWriteDeadline(time.Time{})
+
+	w := s.watchers.watch(pattern)
+	defer s.watchers.stop(w)
+	x.start()
+	if f, ok := x.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	for {
+		select {
+		case <-x.r.Context().Done():
+			return nil
+		case v, ok := <-w.events:
+			if !ok {
+				return &grpcError{grpcResourceExhausted, "watcher fell behind"}
+			}
+			var m []byte
+			m = appendProtoString(m, 1, v.key)
+			m = appendProtoInt(m, 2, v.time)
+			m = appendProtoInt(m, 3, int64(v.state))
+			if err := x.send(m); err != nil {
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build go1.24
+
+package main
+
+import "net/http"
+
+// enableH2C makes srv, a plaintext server, accept HTTP/2 connections without TLS
+// (h2c with prior knowledge) in addition to HTTP/1 connections.
+func enableH2C(srv *http.Server) error {
+	var p http.Protocols
+	p.SetHTTP1(true)
+	p.SetUnencryptedHTTP2(true)
+	srv.Protocols = &p
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !go1.24
+
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// enableH2C returns an error, unencrypted HTTP/2 requiring a server built with Go
+// 1.24 or later.
+func enableH2C(srv *http.Server) error {
+	return errors.New("h2c requires a server built with Go 1.24 or later")
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// Layouts of heatmaps, rows being calendar days or weeks (starting on Monday) and
+// columns hours or days of the week.
+const (
+	heatmapDayHour = "day-hour"
+	heatmapWeekDay = "week-day"
+)
+
+var (
+	heatmapHours = []string{"00", "01", "02", "03", "04", "05", "06", "07", "08", "09", "10", "11", "12", "13", "14", "15", "16", "17", "18", "19", "20", "21", "22", "23"}
+	heatmapDays  = []string{"Mon", "Tue", "Wed", "Thu", "Fri", "Sat", "Sun"}
+)
+
+// heatmap represents the availability of a key as a matrix, for calendar heatmaps.
+type heatmap struct {
+	Layout   string       `json:"layout"`
+	Timezone string       `json:"timezone"`
+	Columns  []string     `json:"columns"`
+	Rows     []heatmapRow `json:"rows"`
+}
+
+// heatmapRow represents a row of a heatmap starting at Unix time date. Cells hold
+// the availability of each column, null if no value is known.
+type heatmapRow struct {
+	Date  int64      `json:"date"`
+	Cells []*float64 `json:"cells"`
+}
+
+// column returns the column of layout holding t.
+func column(layout string, t time.Time) int {
+	if layout == heatmapWeekDay {
+		return (int(t.Weekday()) + 6) % 7
+	}
+	return t.Hour()
+}
+
+// newHeatmap computes the heatmap of values, starting at Unix time ts and spaced
+// by frequency seconds, over the closed interval defined by start and end, using
+// the calendar of loc.
+func newHeatmap(layout string, loc *time.Location, values []uint8, ts, frequency int64, start, end time.Time) (heatmap, error) {
+	h := heatmap{Layout: layout, Timezone: loc.String(), Columns: heatmapHours, Rows: []heatmapRow{}}
+	if layout == heatmapWeekDay {
+		h.Columns = heatmapDays
+	}
+
+	period := calendarDay
+	if layout == heatmapWeekDay {
+		period = calendarWeek
+	}
+	bounds, err := calendarBounds(period, loc, start, end)
+	if err != nil {
+		return heatmap{}, err
+	}
+	dates := bounds[:len(bounds)-1]
+
+	rows := make(map[int64]int, len(dates))
+	for i, v := range dates {
+		rows[v.Unix()] = i
+	}
+	active := make([][]int64, len(dates))
+	known := make([][]int64, len(dates))
+	for i := range dates {
+		active[i] = make([]int64, len(h.Columns))
+		known[i] = make([]int64, len(h.Columns))
+	}
+	for i, v := range values {
+		if v == sequence.StateUnknown {
+			continue
+		}
+		t := time.Unix(ts+int64(i)*frequency, 0).In(loc)
+		row, ok := rows[calendarStart(period, t).Unix()]
+		if !ok {
+			continue
+		}
+		c := column(layout, t)
+		known[row][c]++
+		if v == sequence.StateActive {
+			active[row][c]++
+		}
+	}
+
+	for i, v := range dates {
+		row := heatmapRow{Date: v.Unix(), Cells: make([]*float64, len(h.Columns))}
+		for c := range row.Cells {
+			if known[i][c] > 0 {
+				x := percent(active[i][c], known[i][c])
+				row.Cells[c] = &x
+			}
+		}
+		h.Rows = append(h.Rows, row)
+	}
+	return h, nil
+}
+
+func (s *server) handlerQueryHeatmap(w http.ResponseWriter, r *http.Request, key string) {
+	x, ok := s.get(key)
+	if !ok {
+		writeError(w, http.StatusNotFound, errorKeyNotFound, "key does not exist")
+		return
+	}
+
+	layout := r.FormValue("layout")
+	switch layout {
+	case "":
+		layout = heatmapDayHour
+	case heatmapDayHour, heatmapWeekDay:
+	default:
+		writeResponse(w, http.StatusBadRequest, statusError, "layout is not valid", nil)
+		return
+	}
+
+	loc, err := queryLocation(r)
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, statusError, err.Error(), nil)
+		return
+	}
+
+	start, end, err := parseRange(r.FormValue("start"), r.FormValue("end"), int64(x.Frequency()))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorInvalidRange, err.Error())
+		return
+	}
+
+	hours, err := queryHours(r.FormValue("hours"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorInvalidRequest, err.Error())
+		return
+	}
+
+	values, ts := s.values(key, x, queryArgs{start: start, end: end, hours: hours}, r.FormValue("maintenance") == "exclude")
+	h, err := newHeatmap(layout, loc, values, ts, int64(x.Frequency()), start, end)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorInvalidRange, err.Error())
+		return
+	}
+
+	data, err := json.Marshal(h)
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+		logf(r, "error serializing heatmap: %s", err)
+		return
+	}
+	writeResponse(w, http.StatusOK, statusOK, fmt.Sprintf("%d row(s) returned", len(h.Rows)), data)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// businessHours holds the schedule applied by queries using hours=business.
+var businessHours schedule
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// A schedule represents recurring hours on a set of days of the week, e.g. business
+// hours, in the calendar of a location. Hours are minutes since midnight, end being
+// exclusive. A schedule whose end precedes its start spans midnight, its days
+// being the days it starts on.
+//
+// schedule implements the flag.Value interface, parsing values formatted as
+// "days start-end [timezone]", e.g. "Mon-Fri 08:00-18:00 Europe/Paris".
+type schedule struct {
+	spec  string
+	days  [7]bool
+	start int
+	end   int
+	loc   *time.Location
+}
+
+// parseSchedule parses spec, a comma separated list of days or ranges of days
+// followed by a range of hours and optionally by an IANA time zone (UTC by default).
+func parseSchedule(spec string) (*schedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 2 && len(fields) != 3 {
+		return nil, errors.New(`expected "days start-end [timezone]"`)
+	}
+	s := &schedule{spec: strings.Join(fields, " "), loc: time.UTC}
+	for _, v := range strings.Split(fields[0], ",") {
+		first, last, _ := strings.Cut(v, "-")
+		if last == "" {
+			last = first
+		}
+		x, ok := weekdays[strings.ToLower(first)]
+		y, ok2 := weekdays[strings.ToLower(last)]
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("days %s are not valid", v)
+		}
+		for d := x; ; d = (d + 1) % 7 {
+			s.days[d] = true
+			if d == y {
+				break
+			}
+		}
+	}
+	start, end, _ := strings.Cut(fields[1], "-")
+	var err error
+	if s.start, err = parseClock(start); err != nil || s.start == 24*60 {
+		return nil, fmt.Errorf("hours %s are not valid", fields[1])
+	}
+	if s.end, err = parseClock(end); err != nil || s.end == s.start {
+		return nil, fmt.Errorf("hours %s are not valid", fields[1])
+	}
+	if len(fields) == 3 {
+		if s.loc, err = time.LoadLocation(fields[2]); err != nil {
+			return nil, fmt.Errorf("timezone %s is not valid", fields[2])
+		}
+	}
+	return s, nil
+}
+
+// parseClock parses v, formatted as hh:mm, into minutes since midnight, 24:00
+// being allowed.
+func parseClock(v string) (int, error) {
+	h, m, ok := strings.Cut(v, ":")
+	x, err := strconv.Atoi(h)
+	if err != nil || !ok || len(m) != 2 {
+		return 0, errors.New("expected hh:mm")
+	}
+	y, err := strconv.Atoi(m)
+	if err != nil || x < 0 || y < 0 || y > 59 || x*60+y > 24*60 {
+		return 0, errors.New("expected hh:mm")
+	}
+	return x*60 + y, nil
+}
+
+func (s *schedule) String() string {
+	return s.spec
+}
+
+func (s *schedule) Set(value string) error {
+	x, err := parseSchedule(value)
+	if err != nil {
+		return err
+	}
+	*s = *x
+	return nil
+}
+
+// contains reports whether Unix time t falls within s.
+func (s *schedule) contains(t int64) bool {
+	x := time.Unix(t, 0).In(s.loc)
+	minutes := x.Hour()*60 + x.Minute()
+	if s.start < s.end {
+		return s.days[x.Weekday()] && minutes >= s.start && minutes < s.end
+	}
+	if minutes >= s.start {
+		return s.days[x.Weekday()]
+	}
+	return minutes < s.end && s.days[(x.Weekday()+6)%7]
+}
+
+// mask sets values, starting at Unix time ts and spaced by frequency seconds, that
+// fall outside s to unknown.
+func (s *schedule) mask(values []uint8, ts, frequency int64) {
+	for i := range values {
+		if !s.contains(ts + int64(i)*frequency) {
+			values[i] = sequence.StateUnknown
+		}
+	}
+}
+
+// queryHours returns the schedule selected by the hours parameter of a query, nil
+// if it is empty: the business hours of the server if it is "business", or a
+// schedule formatted as for -business-hours.
+func queryHours(hours string) (*schedule, error) {
+	switch hours {
+	case "":
+		return nil, nil
+	case "business":
+		if businessHours.spec == "" {
+			return nil, errors.New("business hours are not configured")
+		}
+		x := businessHours
+		return &x, nil
+	}
+	return parseSchedule(hours)
+}
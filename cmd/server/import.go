@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+const (
+	importChunkSize = 10000
+	maxImportErrors = 1000
+)
+
+// An importProgress reports the progress of an import: the number of data rows
+// handled and their outcome, the last line read, whether the whole body was
+// imported or the line to resume from, and the first rejected rows.
+type importProgress struct {
+	Rows       int         `json:"rows"`
+	Processed  int         `json:"processed"`
+	Duplicates int         `json:"duplicates"`
+	Rejected   int         `json:"rejected"`
+	Line       int         `json:"line"`
+	Complete   bool        `json:"complete"`
+	Resume     int         `json:"resume,omitempty"`
+	Errors     []rejection `json:"errors"`
+}
+
+// reject records the rejection of the row at line for reason.
+func (p *importProgress) reject(line int, content []string, reason string) {
+	p.Rejected++
+	if len(p.Errors) >= maxImportErrors {
+		return
+	}
+	c := strings.Join(content, ",")
+	if len(c) > maxRejectedContent {
+		c = c[:maxRejectedContent]
+	}
+	p.Errors = append(p.Errors, rejection{Line: line, Content: c, Reason: reason})
+}
+
+// parseImportState parses the state of a row, a value of the insert protocol or
+// the name of a state.
+func parseImportState(v string) (uint8, bool) {
+	switch strings.ToLower(v) {
+	case "0", "inactive":
+		return sequence.StateInactive, true
+	case "1", "active":
+		return sequence.StateActive, true
+	case "2", "unknown":
+		return sequence.StateUnknown, true
+	}
+	return 0, false
+}
+
+// parseImportTime parses the timestamp of a row, a Unix time or an RFC 3339 date.
+func parseImportTime(v string) (time.Time, bool) {
+	if x, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(x, 0), true
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	return t, err == nil
+}
+
+// importChunk applies statements of r, read from the rows at lines, in
+// chronological order per key, and records their outcome in p. It returns the keys
+// of the applied statements.
+func (s *server) importChunk(r *http.Request, statements []sequence.Statement, lines []int, duplicates *duplicateFilter, p *importProgress) []string {
+	order := make([]int, len(statements))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := statements[order[i]], statements[order[j]]
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		return a.Timestamp.Before(b.Timestamp)
+	})
+	sorted := make([]sequence.Statement, len(statements))
+	for i, j := range order {
+		sorted[i] = statements[j]
+	}
+
+	errs := s.insert(r, sorted, duplicates)
+	for i, err := range errs {
+		switch {
+		case err == errDuplicate:
+			p.Duplicates++
+		case err != nil:
+			v := sorted[i]
+			p.reject(lines[order[i]], []string{v.Key, strconv.FormatInt(v.Timestamp.Unix(), 10), strconv.Itoa(int(v.Value))}, err.Error())
+		default:
+			p.Processed++
+		}
+	}
+	return appliedKeys(sorted, errs)
+}
+
+// handlerImport imports a CSV body of key,timestamp,state rows, an optional header
+// being skipped. Rows are parsed as the body is read and applied as inserts in
+// chunks, so that large files are imported in constant memory.
+func (s *server) handlerImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	reader := csv.NewReader(r.Body)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	// parameters are read from the URL, parsing the form would consume the body
+	duplicates := &duplicateFilter{s: s, enabled: r.URL.Query().Get("duplicates") == "skip"}
+	progress := importProgress{Errors: []rejection{}}
+	keys := make(map[string]bool)
+
+	// rows of the current chunk, not applied yet
+	var statements []sequence.Statement
+	var lines []int
+	var failure string
+	flush := func() bool {
+		if len(statements) == 0 {
+			return true
+		}
+		// imports are paced to the ingest rate quota rather than rejected
+		if err := s.waitIngest(r.Context(), len(statements)); err != nil {
+			failure = "request canceled"
+			progress.Rows -= len(statements)
+			progress.Resume = lines[0]
+			return false
+		}
+		for _, k := range s.importChunk(r, statements, lines, duplicates, &progress) {
+			keys[k] = true
+		}
+		statements, lines = statements[:0], lines[:0]
+		return true
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			progress.Complete = flush()
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			progress.Rows++
+			progress.Line = parseErr.Line
+			progress.reject(parseErr.StartLine, nil, "row is not valid: "+parseErr.Err.Error())
+			continue
+		}
+		if err != nil {
+			logf(r, "error reading request body: %s", err)
+			if flush() {
+				failure = "error reading request body"
+				progress.Resume = progress.Line + 1
+			}
+			break
+		}
+		line, _ := reader.FieldPos(0)
+		progress.Line = line
+		if progress.Rows == 0 && len(record) > 0 && strings.EqualFold(record[0], "key") {
+			continue // header
+		}
+		progress.Rows++
+
+		if len(record) != 3 {
+			progress.reject(line, record, "row must hold 3 fields")
+			continue
+		}
+		if reason := checkKey([]byte(record[0])); reason != "" {
+			progress.reject(line, record, reason)
+			continue
+		}
+		if reason := checkTokenKey(r, []byte(record[0])); reason != "" {
+			progress.reject(line, record, reason)
+			continue
+		}
+		t, ok := parseImportTime(record[1])
+		if !ok {
+			progress.reject(line, record, "timestamp is not valid")
+			continue
+		}
+		state, ok := parseImportState(record[2])
+		if !ok {
+			progress.reject(line, record, "state is not valid")
+			continue
+		}
+		if t, ok = s.future(t, time.Now()); !ok {
+			progress.reject(line, record, "timestamp in the future")
+			continue
+		}
+		lines = append(lines, line)
+		statements = append(statements, sequence.Statement{
+			Key:                 record[0],
+			Timestamp:           t,
+			Value:               state,
+			Type:                sequence.StatementAdd,
+			CreateIfNotExists:   true,
+			CreateWithTimestamp: t.Truncate(time.Duration(sequenceFrequency) * time.Second),
+			CreateWithFrequency: sequenceFrequency,
+		})
+		if len(statements) == importChunkSize && !flush() {
+			break
+		}
+	}
+
+	status := statusOK
+	message := fmt.Sprintf("processed %d/%d row(s)", progress.Processed, progress.Rows)
+	if progress.Duplicates > 0 {
+		message += fmt.Sprintf(", %d duplicate(s)", progress.Duplicates)
+	}
+	switch {
+	case !progress.Complete:
+		status = statusWarning
+		message += fmt.Sprintf(", stopped before line %d: %s", progress.Resume, failure)
+	case progress.Rejected > 0:
+		status = statusWarning
+	}
+	applied := make([]string, 0, len(keys))
+	for k := range keys {
+		applied = append(applied, k)
+	}
+	sort.Strings(applied)
+	s.audit(r, auditImport, applied, message)
+
+	data, err := json.Marshal(progress)
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+		logf(r, "error serializing import progress: %s", err)
+		return
+	}
+	writeResponse(w, http.StatusOK, status, message, data)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// maxIntervalValues is the largest number of values of a key set by a request to
+// /intervals/, about 8 years of values spaced by 15 seconds.
+const maxIntervalValues = 1 << 24
+
+// An interval sets the values of a key within the half-open interval defined by
+// start and end, Unix times, to state.
+type interval struct {
+	line       int
+	state      uint8
+	start, end int64
+}
+
+// fillIntervals sets the unknown values of key within intervals, creating key if
+// needed and extending its sequence backwards and forwards to hold them, and
+// returns the number of values set and the encoding of the sequence. Intervals are
+// applied in order, later intervals taking precedence over earlier ones. s.mu must
+// be held for writing.
+func (s *server) fillIntervals(key string, intervals []interval, limit *keyLimits) (int, []byte, error) {
+	x, ok := s.store.Get(key)
+	frequency := int64(sequenceFrequency)
+	if ok {
+		frequency = int64(x.Frequency())
+	} else if err := limit.check(key); err != nil {
+		return 0, nil, err
+	}
+
+	lo, hi := intervals[0].start, intervals[0].end
+	for _, v := range intervals[1:] {
+		if v.start < lo {
+			lo = v.start
+		}
+		if v.end > hi {
+			hi = v.end
+		}
+	}
+	lo -= lo % frequency
+	hi = ceilInt64(hi, frequency)
+	var values []uint8
+	if ok {
+		values = x.All()
+		if x.Timestamp() < lo {
+			lo = x.Timestamp()
+		}
+		if end := x.Timestamp() + int64(len(values))*frequency; end > hi {
+			hi = end
+		}
+	}
+	n := (hi - lo) / frequency
+	switch {
+	case n > maxIntervalValues:
+		return 0, nil, fmt.Errorf("intervals exceed %d values", maxIntervalValues)
+	case ok && x.Length() > 0 && n > int64(x.Length()):
+		return 0, nil, fmt.Errorf("intervals exceed the length of key (%d values)", x.Length())
+	}
+
+	y := make([]uint8, n)
+	for i := range y {
+		y[i] = sequence.StateUnknown
+	}
+	var offset int64
+	if ok {
+		offset = (x.Timestamp() - lo) / frequency
+		copy(y[offset:], values)
+	}
+	// known values of key are kept
+	known := func(p int64) bool {
+		q := p - offset
+		return q >= 0 && q < int64(len(values)) && values[q] != sequence.StateUnknown
+	}
+	for _, v := range intervals {
+		for p := ceilInt64(v.start-lo, frequency) / frequency; p < n && lo+p*frequency < v.end; p++ {
+			if !known(p) {
+				y[p] = v.state
+			}
+		}
+	}
+	var set int
+	for p, v := range y {
+		if v != sequence.StateUnknown && !known(int64(p)) {
+			set++
+		}
+	}
+
+	z := sequence.NewWithValues(time.Unix(lo, 0), uint16(frequency), y)
+	if ok && x.Length() > 0 {
+		z.SetLength(x.Length())
+	}
+	s.store.Add(key, z)
+	s.cache.invalidate(key)
+	return set, z.Bytes(), nil
+}
+
+// handlerIntervals sets the values of keys within intervals, each line holding a
+// key, a state and the start and end of a half-open interval. Lines are grouped by
+// key so that the sequence of each key is rebuilt once.
+func (s *server) handlerIntervals(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, statusError, "error reading request body", nil)
+		logf(r, "error reading request body: %s", err)
+		return
+	}
+
+	lines := bytes.Split(body, []byte("\n"))
+	if tooManyStatements(w, lines) {
+		return
+	}
+	rejected := newRejections(r, lines)
+
+	var keys []string
+	groups := make(map[string][]interval)
+	for i, line := range lines {
+		// same format as overwrite statements, intervals being half-open
+		if reason := checkStatement(r, validOverwriteStatement, line); reason != "" {
+			logf(r, "error parsing statement %d: %s", i+1, reason)
+			rejected.add(i, reason)
+			continue
+		}
+		fields := bytes.Fields(line)
+		key := string(fields[0])
+		start, err1 := strconv.ParseInt(string(fields[2]), 10, 64)
+		end, err2 := strconv.ParseInt(string(fields[3]), 10, 64)
+		if err1 != nil || err2 != nil {
+			logf(r, "error parsing statement %d: timestamp out of range", i+1)
+			rejected.add(i, "timestamp out of range")
+			continue
+		}
+		if start >= end {
+			logf(r, "error parsing statement %d: range is not valid", i+1)
+			rejected.add(i, "range is not valid")
+			continue
+		}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], interval{line: i, state: fields[1][0] - '0', start: start, end: end})
+	}
+	limit := s.keyLimits()
+
+	var n, values int
+	var applied []string
+	sequences := make(map[string][]byte)
+	s.mu.Lock()
+	for _, k := range keys {
+		x, data, err := s.fillIntervals(k, groups[k], limit)
+		if err != nil {
+			for _, v := range groups[k] {
+				logf(r, "error executing statement %d: %s", v.line+1, err)
+				rejected.add(v.line, err.Error())
+			}
+			continue
+		}
+		sequences[k] = data
+		applied = append(applied, k)
+		values += x
+		n += len(groups[k])
+	}
+	if len(sequences) > 0 {
+		// sent while locked so that the standby receives later statements afterwards
+		s.replicator.send(replicationMessage{Sequences: sequences})
+	}
+	s.mu.Unlock()
+
+	status := statusOK
+	if n != len(lines) {
+		status = statusWarning
+	}
+
+	message := fmt.Sprintf("processed %d/%d statement(s), %d value(s) set", n, len(lines), values)
+	s.audit(r, auditIntervals, applied, message)
+	writeResponse(w, http.StatusOK, status, message, rejected.data())
+}
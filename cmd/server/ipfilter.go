@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// allGroups is the name of the rules applying to every endpoint.
+const allGroups = "all"
+
+// ipRules are the address ranges allowed or denied by endpoint group, set by
+// -allow-ip and -deny-ip, formatted as group=cidr.
+type ipRules map[string][]netip.Prefix
+
+// Client addresses allowed and denied by endpoint group.
+var (
+	allowedIPs = make(ipRules)
+	deniedIPs  = make(ipRules)
+)
+
+func (x ipRules) String() string {
+	var s []string
+	for k, v := range x {
+		for _, p := range v {
+			s = append(s, k+"="+p.String())
+		}
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func (x ipRules) Set(value string) error {
+	group, cidr, ok := strings.Cut(value, "=")
+	if !ok {
+		return errors.New("expected group=cidr")
+	}
+	if _, ok := endpointGroups[group]; !ok && group != allGroups {
+		return fmt.Errorf("endpoint group %s is not valid", group)
+	}
+	p, err := parsePrefix(cidr)
+	if err != nil {
+		return err
+	}
+	x[group] = append(x[group], p)
+	return nil
+}
+
+// parsePrefix parses a CIDR range or a single address.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		a, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("address %s is not valid", s)
+		}
+		return netip.PrefixFrom(a.Unmap(), a.Unmap().BitLen()), nil
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("range %s is not valid", s)
+	}
+	return p.Masked(), nil
+}
+
+// clientIP returns the address of the client of r, read from its forwarding
+// headers if r was sent by a trusted proxy.
+func clientIP(r *http.Request) (netip.Addr, bool) {
+	a, ok := peerIP(r)
+	if !ok {
+		return a, false
+	}
+	return forwardedFor(r, a), true
+}
+
+// peerIP returns the remote address of r.
+func peerIP(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	a, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return a.Unmap(), true
+}
+
+// pathGroups returns the names of the rules applying to the endpoint registered
+// for path: its groups and allGroups.
+func pathGroups(path string) []string {
+	names := []string{allGroups}
+	for k, v := range endpointGroups {
+		for _, p := range v {
+			if p == path {
+				names = append(names, k)
+			}
+		}
+	}
+	return names
+}
+
+// containsIP reports whether one of prefixes contains a.
+func containsIP(prefixes []netip.Prefix, a netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterIPs is the hook rejecting the requests whose client address is denied by
+// one of the groups of their endpoint, or not allowed by one of the groups of their
+// endpoint having an allowlist.
+func filterIPs(path string) middleware {
+	var allow [][]netip.Prefix
+	var deny []netip.Prefix
+	for _, v := range pathGroups(path) {
+		if len(allowedIPs[v]) > 0 {
+			allow = append(allow, allowedIPs[v])
+		}
+		deny = append(deny, deniedIPs[v]...)
+	}
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil
+	}
+	return func(h http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			a, ok := clientIP(r)
+			allowed := ok && !containsIP(deny, a)
+			for _, v := range allow {
+				allowed = allowed && containsIP(v, a)
+			}
+			if !allowed {
+				writeError(w, http.StatusForbidden, errorForbidden, "client address is not allowed")
+				logf(r, "rejecting request from %s to %s: client address is not allowed", clientAddr(r), path)
+				return
+			}
+			h(w, r)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// jwtLeeway is the clock skew tolerated when checking the expiry and the start of
+// validity of tokens.
+const jwtLeeway = time.Minute
+
+// Errors of tokens that are not valid.
+var (
+	errTokenMalformed = errors.New("token is malformed")
+	errTokenSignature = errors.New("token signature is not valid")
+	errTokenExpired   = errors.New("token is expired")
+)
+
+// jwtAlgorithms maps the supported signature algorithms of tokens to their hash
+// function.
+var jwtAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// A jwtHeader is the header of a signed token.
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// claims represents the claims of a token used by the server.
+type claims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud"`
+	Expiry    int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	Nonce     string   `json:"nonce"`
+	Email     string   `json:"email"`
+	Scope     scopes   `json:"scope"`
+	Scp       scopes   `json:"scp"`
+
+	// Prefixes are the key prefixes the token is restricted to, nil if the token
+	// is not restricted.
+	Prefixes []string `json:"-"`
+	// Session reports whether the token is the ID token of a UI session.
+	Session bool `json:"-"`
+}
+
+// audience is the audience of a token, encoded as a string or an array of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		*a = audience{s}
+		return nil
+	}
+	var v []string
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*a = v
+	return nil
+}
+
+// contains reports whether a contains v.
+func (a audience) contains(v string) bool {
+	for _, x := range a {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// parseJWT decodes the compact serialization of a signed token into its header,
+// the signed part, its payload and its signature.
+func parseJWT(token string) (jwtHeader, string, []byte, []byte, error) {
+	var h jwtHeader
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return h, "", nil, nil, errTokenMalformed
+	}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(header, &h) != nil {
+		return h, "", nil, nil, errTokenMalformed
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return h, "", nil, nil, errTokenMalformed
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return h, "", nil, nil, errTokenMalformed
+	}
+	return h, parts[0] + "." + parts[1], payload, sig, nil
+}
+
+// verifySignature verifies the signature sig of signed using key and the
+// algorithm alg.
+func verifySignature(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	hash, ok := jwtAlgorithms[alg]
+	if !ok {
+		return fmt.Errorf("token algorithm %s is not supported", alg)
+	}
+	hh := hash.New()
+	hh.Write([]byte(signed))
+	digest := hh.Sum(nil)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg[0] != 'R' || rsa.VerifyPKCS1v15(k, hash, digest, sig) != nil {
+			return errTokenSignature
+		}
+	case *ecdsa.PublicKey:
+		bits := k.Curve.Params().BitSize
+		size := (bits + 7) / 8
+		if alg != map[int]string{256: "ES256", 384: "ES384", 521: "ES512"}[bits] || len(sig) != 2*size {
+			return errTokenSignature
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errTokenSignature
+		}
+	default:
+		return errTokenSignature
+	}
+	return nil
+}
+
+// validAt returns an error if c is expired or not yet valid at t.
+func (c claims) validAt(t time.Time) error {
+	if c.Expiry == 0 || t.Add(-jwtLeeway).Unix() >= c.Expiry {
+		return errTokenExpired
+	}
+	if c.NotBefore != 0 && t.Add(jwtLeeway).Unix() < c.NotBefore {
+		return errors.New("token is not valid yet")
+	}
+	return nil
+}
+
+// A jwk is a public key of a JSON Web Key Set.
+type jwk struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+// publicKey returns the RSA or ECDSA public key of k.
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, errors.New("key parameter is not valid")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.KeyType {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("key exponent is not valid")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("key curve %s is not supported", k.Curve)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		if _, err := key.ECDH(); err != nil {
+			return nil, errors.New("key is not on its curve")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("key type %s is not supported", k.KeyType)
+}
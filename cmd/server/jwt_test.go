@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "https://sso.example.com"
+	testAudience = "run-length"
+)
+
+// signTestToken returns a token with header and payload signed by key using RS256,
+// whatever the algorithm of header.
+func signTestToken(t *testing.T, key *rsa.PrivateKey, header, payload any) string {
+	t.Helper()
+	encode := func(v any) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := encode(header) + "." + encode(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestVerify(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &oidcProvider{
+		issuer:   testIssuer,
+		audience: testAudience,
+		keys:     map[string]crypto.PublicKey{"k1": &key.PublicKey},
+		fetched:  time.Now(),
+	}
+	now := time.Now().Unix()
+	valid := map[string]any{"iss": testIssuer, "sub": "alice", "aud": testAudience, "exp": now + 3600}
+	with := func(k string, v any) map[string]any {
+		x := make(map[string]any)
+		for k, v := range valid {
+			x[k] = v
+		}
+		x[k] = v
+		return x
+	}
+	header := func(alg string) map[string]string { return map[string]string{"alg": alg, "kid": "k1"} }
+	token := signTestToken(t, key, header("RS256"), valid)
+	parts := strings.Split(token, ".")
+
+	tests := []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{"valid", token, ""},
+		{"audience array", signTestToken(t, key, header("RS256"), with("aud", []string{"other", testAudience})), ""},
+		{"wrong algorithm", signTestToken(t, key, header("ES256"), valid), errTokenSignature.Error()},
+		{"unsupported algorithm", signTestToken(t, key, header("HS256"), valid), "token algorithm HS256 is not supported"},
+		{"none algorithm", base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"k1"}`)) + "." + parts[1] + ".", "token algorithm none is not supported"},
+		{"expired", signTestToken(t, key, header("RS256"), with("exp", now-2*int64(jwtLeeway.Seconds()))), errTokenExpired.Error()},
+		{"expired within leeway", signTestToken(t, key, header("RS256"), with("exp", now-int64(jwtLeeway.Seconds())/2)), ""},
+		{"no expiry", signTestToken(t, key, header("RS256"), with("exp", 0)), errTokenExpired.Error()},
+		{"not valid yet", signTestToken(t, key, header("RS256"), with("nbf", now+3600)), "token is not valid yet"},
+		{"wrong audience", signTestToken(t, key, header("RS256"), with("aud", "other")), "token audience is not valid"},
+		{"wrong issuer", signTestToken(t, key, header("RS256"), with("iss", "https://evil.example.com")), "token issuer https://evil.example.com is not valid"},
+		{"unknown key", signTestToken(t, key, map[string]string{"alg": "RS256", "kid": "k2"}, valid), `token key "k2" is unknown`},
+		{"tampered payload", parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"`+testIssuer+`","sub":"root","aud":"`+testAudience+`"}`)) + "." + parts[2], errTokenSignature.Error()},
+		{"malformed header encoding", "!!." + parts[1] + "." + parts[2], errTokenMalformed.Error()},
+		{"malformed header json", base64.RawURLEncoding.EncodeToString([]byte(`{"alg":`)) + "." + parts[1] + "." + parts[2], errTokenMalformed.Error()},
+		{"missing parts", parts[0] + "." + parts[1], errTokenMalformed.Error()},
+		{"empty", "", errTokenMalformed.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := p.verify(tt.token, testAudience)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("unexpected error: %s", err)
+			case tt.err != "" && err == nil:
+				t.Fatalf("expected error %q, got none", tt.err)
+			case tt.err != "" && err.Error() != tt.err:
+				t.Fatalf("expected error %q, got %q", tt.err, err)
+			case tt.err == "" && c.Subject != "alice":
+				t.Fatalf("expected subject alice, got %q", c.Subject)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+// Limits of insert requests, 0 meaning unlimited. They are set on startup.
+var (
+	maxKeyLength  = defaultMaxKeyLength
+	maxStatements int
+)
+
+// defaultMaxKeyLength is the default maximum length of keys in bytes, which is also
+// the maximum length of keys accepted by the dump tool.
+const defaultMaxKeyLength = 1024
+
+// reservedKeyCharacters cannot be part of keys, as they separate the fields of
+// statements, identify internal keys and subtree patterns or group the terms of
+// composite expressions.
+const reservedKeyCharacters = " \t\n#*()"
+
+// setKeyPattern replaces the key pattern used to validate keys and statements.
+func setKeyPattern(pattern string) error {
+	key := `(?:` + pattern + `)`
+	x, err := regexp.Compile(`^` + key + `$`)
+	if err != nil {
+		return fmt.Errorf("key pattern is not valid: %s", err)
+	}
+	for _, c := range reservedKeyCharacters {
+		if x.MatchString(string(c)) || x.MatchString("a"+string(c)+"a") {
+			return fmt.Errorf("key pattern must not match %q", c)
+		}
+	}
+	validKey = x
+	validStatement = regexp.MustCompile(`^` + key + ` [012](?: \d+(?: \d+)?)?$`)
+	validCreateStatement = regexp.MustCompile(`^` + key + ` \d+(?: \d+)?$`)
+	validGaugeStatement = regexp.MustCompile(`^` + key + ` \d{1,3}(?: \d+)?$`)
+	validCounterStatement = regexp.MustCompile(`^` + key + ` \d{1,20}(?: \d+)?$`)
+	validMaintenanceStatement = regexp.MustCompile(`^` + key + ` \d+ \d+$`)
+	validOverwriteStatement = regexp.MustCompile(`^` + key + ` [012] \d+ \d+$`)
+	return nil
+}
+
+// checkStatement returns the reason of the rejection of line, a statement of r, if
+// its key is not valid or not allowed by the token of r, or if it does not match
+// format, or an empty string. Keys are checked first, so that keys violating the
+// key rules are reported as such.
+func checkStatement(r *http.Request, format *regexp.Regexp, line []byte) string {
+	if len(line) == 0 {
+		return "statement is not valid"
+	}
+	key := line
+	if i := bytes.IndexByte(line, ' '); i != -1 {
+		key = line[:i]
+	}
+	if reason := checkKey(key); reason != "" {
+		return reason
+	}
+	if reason := checkTokenKey(r, key); reason != "" {
+		return reason
+	}
+	if !format.Match(line) {
+		return "statement is not valid"
+	}
+	return ""
+}
+
+// checkKey returns the reason of the rejection of key if it is too long or does not
+// match the key pattern, or an empty string.
+func checkKey(key []byte) string {
+	switch {
+	case maxKeyLength > 0 && len(key) > maxKeyLength:
+		return fmt.Sprintf("key exceeds %d bytes", maxKeyLength)
+	case !validKey.Match(key) || bytes.ContainsAny(key, reservedKeyCharacters):
+		return "key is not valid"
+	}
+	return ""
+}
+
+// tooManyStatements writes an error response and returns true if lines, the lines
+// of an insert request, exceed the maximum number of statements per request.
+func tooManyStatements(w http.ResponseWriter, lines [][]byte) bool {
+	if maxStatements <= 0 || len(lines) <= maxStatements {
+		return false
+	}
+	writeError(w, http.StatusRequestEntityTooLarge, errorTooManyStatements, fmt.Sprintf("request exceeds %d statement(s)", maxStatements))
+	return true
+}
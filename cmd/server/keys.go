@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// internalKeySeparator separates a key from the suffix of the internal keys holding
+// its gauge or counter bit sequences.
+const internalKeySeparator = "#"
+
+// isSubtree reports whether pattern addresses a subtree of keys, i.e. "*" or a key
+// prefix ending with a hierarchy separator followed by "*" (e.g. "eu.web.*").
+func isSubtree(pattern string) bool {
+	if pattern == "*" {
+		return true
+	}
+	return strings.HasSuffix(pattern, ".*") || strings.HasSuffix(pattern, "/*")
+}
+
+// matchKey reports whether key matches pattern, either a key or a subtree.
+func matchKey(key, pattern string) bool {
+	if !isSubtree(pattern) {
+		return key == pattern
+	}
+	return strings.HasPrefix(key, pattern[:len(pattern)-1])
+}
+
+// keys returns the sorted names of the series matching pattern, internal keys
+// being reported using the name of the series they belong to.
+func (s *server) keys(pattern string) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, k := range s.store.Keys() {
+		if i := strings.Index(k, internalKeySeparator); i != -1 {
+			k = k[:i]
+		}
+		if seen[k] || !matchKey(k, pattern) {
+			continue
+		}
+		seen[k] = true
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// deleteKey removes all sequences and metadata associated to the series key.
+func (s *server) deleteKey(key string) {
+	s.store.Delete(key)
+	for i := 0; i < gaugeBits; i++ {
+		s.store.Delete(planeKey(key, gaugeKeyInfix, i))
+	}
+	for i := 0; i < counterBits; i++ {
+		s.store.Delete(planeKey(key, counterKeyInfix, i))
+	}
+	for i := 0; i < rollupBits; i++ {
+		s.store.Delete(planeKey(key, rollupKeyInfix, i))
+	}
+	s.countersMu.Lock()
+	delete(s.counters, key)
+	s.countersMu.Unlock()
+	s.activityMu.Lock()
+	delete(s.activity, key)
+	delete(s.queried, key)
+	s.activityMu.Unlock()
+	s.alerts.forget(key)
+	s.dispatcher.forget(key)
+	s.meta.deleteKey(key)
+	s.cache.invalidate(key)
+	s.replicator.send(replicationMessage{Deleted: []string{key}})
+}
+
+// A deletion represents the result of a delete request on /keys/: the number of
+// keys deleted, or the number of values deleted and of keys they belong to for
+// requests deleting a range.
+type deletion struct {
+	Keys   int `json:"keys"`
+	Values int `json:"values,omitempty"`
+}
+
+func (s *server) handlerKeys(w http.ResponseWriter, r *http.Request) {
+	pattern := r.FormValue("key")
+	if pattern == "" {
+		pattern = "*"
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		keys := s.keys(pattern)
+		if keys == nil {
+			keys = []string{}
+		}
+		data, err := json.Marshal(keys)
+		if err != nil {
+			writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+			logf(r, "error serializing keys: %s", err)
+			return
+		}
+		writeResponse(w, http.StatusOK, statusOK, fmt.Sprintf("%d key(s) returned", len(keys)), data)
+	case http.MethodDelete:
+		if r.FormValue("key") == "" {
+			writeResponse(w, http.StatusBadRequest, statusError, "missing key", nil)
+			return
+		}
+		if r.FormValue("start") != "" || r.FormValue("end") != "" {
+			s.handlerDeleteRange(w, r, pattern)
+			return
+		}
+		keys := s.keys(pattern)
+		for _, k := range keys {
+			if err := s.softDeleteKey(k); err != nil {
+				writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+				logf(r, "error deleting key %s: %s", k, err)
+				return
+			}
+		}
+		message := fmt.Sprintf("%d key(s) deleted", len(keys))
+		s.audit(r, auditDelete, keys, message)
+		data, _ := json.Marshal(deletion{Keys: len(keys)})
+		writeResponse(w, http.StatusOK, statusOK, message, data)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// listenOptions represents the listeners of the server: a plaintext listener,
+// optionally accepting HTTP/2 without TLS (h2c), and an optional TLS listener, each
+// restricted to a set of paths if not empty, as well as the timeouts and limits
+// applied to the connections of both listeners, whose connections start with a
+// PROXY protocol header if proxyProtocol is set.
+type listenOptions struct {
+	addr     string
+	allow    []string
+	tlsAddr  string
+	tlsCert  string
+	tlsKey   string
+	tlsAllow []string
+	h2c      bool
+
+	proxyProtocol bool
+
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	maxHeaderBytes    int
+}
+
+// server returns an HTTP server using h as handler, restricted to paths, and the
+// timeouts and limits of o.
+func (o listenOptions) server(paths []string, h http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           allowPaths(paths, h),
+		ReadHeaderTimeout: o.readHeaderTimeout,
+		ReadTimeout:       o.readTimeout,
+		WriteTimeout:      o.writeTimeout,
+		IdleTimeout:       o.idleTimeout,
+		MaxHeaderBytes:    o.maxHeaderBytes,
+	}
+}
+
+// splitList splits a comma separated list, ignoring empty values.
+func splitList(s string) []string {
+	var values []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// allowPaths returns a handler rejecting requests whose path is not allowed, "/"
+// matching the root path only and other values matching the path and the paths
+// below it, calling h otherwise. Paths of tenants are matched without their tenant
+// prefix. All paths are allowed if paths is empty.
+func allowPaths(paths []string, h http.Handler) http.Handler {
+	if len(paths) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if rest, ok := strings.CutPrefix(path, tenantPrefix); ok {
+			_, p, _ := strings.Cut(rest, "/")
+			path = "/" + p
+		}
+		for _, v := range paths {
+			if path == v || (v != "/" && strings.HasPrefix(path, strings.TrimSuffix(v, "/")+"/")) {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		writeResponse(w, http.StatusForbidden, statusError, "path is not allowed on this listener", nil)
+	})
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAllowPaths(t *testing.T) {
+	h := allowPaths([]string{"/", "/query", "/insert/"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		path    string
+		allowed bool
+	}{
+		{"/", true},
+		{"/static/app.js", false},
+		{"/query", true},
+		{"/query/", true},
+		{"/query/sub", true},
+		{"/query-foo", false},
+		{"/querying/", false},
+		{"/insert/", true},
+		{"/insert", false},
+		{"/tenants/acme/insert/", true},
+		{"/tenants/acme/query", true},
+		{"/tenants/acme/query-foo", false},
+		{"/tenants/acme/keys/", false},
+		{"/tenants/acme/", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if allowed := w.Code != http.StatusForbidden; allowed != tt.allowed {
+				t.Fatalf("expected allowed %t, got status code %d", tt.allowed, w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// maxRunValues is the maximum number of values scanned by requests for the longest
+// run of a key.
+const maxRunValues = 10000000
+
+// A run represents contiguous values sharing the same state, end being exclusive.
+type run struct {
+	Start    int64 `json:"start"`
+	End      int64 `json:"end"`
+	Duration int64 `json:"duration"`
+}
+
+// longestRun returns the longest run of values equal to state, starting at
+// Unix time ts and spaced by frequency seconds. The second return value is
+// false if no value is equal to state.
+func longestRun(values []uint8, ts, frequency int64, state uint8) (run, bool) {
+	var best, n int
+	bestIndex := -1
+	for i, v := range values {
+		if v != state {
+			n = 0
+			continue
+		}
+		n++
+		if n > best {
+			best, bestIndex = n, i-n+1
+		}
+	}
+	if bestIndex == -1 {
+		return run{}, false
+	}
+	start := ts + int64(bestIndex)*frequency
+	duration := int64(best) * frequency
+	return run{Start: start, End: start + duration, Duration: duration}, true
+}
+
+func (s *server) handlerLongest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	key := r.FormValue("key")
+
+	x, ok := s.get(key)
+	if !ok {
+		writeError(w, http.StatusNotFound, errorKeyNotFound, "key does not exist")
+		return
+	}
+
+	start, end, err := parseRange(r.FormValue("start"), r.FormValue("end"), int64(x.Frequency()))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorInvalidRange, err.Error())
+		return
+	}
+	// values after the last value of the key are unknown
+	frequency := int64(x.Frequency())
+	if last := x.Timestamp() + (int64(len(x.All()))-1)*frequency; end.Unix() > last {
+		end = time.Unix(last, 0)
+	}
+	from := start.Unix()
+	if from < x.Timestamp() {
+		from = x.Timestamp()
+	}
+	if end.Unix() >= from && (end.Unix()-from)/frequency >= maxRunValues {
+		writeError(w, http.StatusBadRequest, errorInvalidRange, fmt.Sprintf("range exceeds %d values", maxRunValues))
+		return
+	}
+
+	var state uint8
+	switch r.FormValue("state") {
+	case "", "0":
+		state = sequence.StateInactive
+	case "1":
+		state = sequence.StateActive
+	case "2":
+		state = sequence.StateUnknown
+	default:
+		writeResponse(w, http.StatusBadRequest, statusError, "state is not valid", nil)
+		return
+	}
+
+	hours, err := queryHours(r.FormValue("hours"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorInvalidRequest, err.Error())
+		return
+	}
+
+	values, ts := s.values(key, x, queryArgs{start: start, end: end, hours: hours}, r.FormValue("maintenance") == "exclude")
+
+	longest, ok := longestRun(values, ts, frequency, state)
+	if !ok {
+		writeResponse(w, http.StatusOK, statusOK, "no run found", []byte("null"))
+		return
+	}
+
+	data, err := json.Marshal(longest)
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+		logf(r, "error serializing run: %s", err)
+		return
+	}
+
+	message := fmt.Sprintf("longest run found (%s)", time.Duration(longest.Duration)*time.Second)
+	writeResponse(w, http.StatusOK, statusOK, message, data)
+}
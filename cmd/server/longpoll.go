@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// maxQueryWait is the longest duration a query can wait for new values.
+const maxQueryWait = 2 * time.Minute
+
+// parseWait parses the wait parameter of a query, a duration up to maxQueryWait.
+func parseWait(v string) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, errors.New("wait is not valid")
+	}
+	if d > maxQueryWait {
+		return 0, fmt.Errorf("wait exceeds %s", maxQueryWait)
+	}
+	return d, nil
+}
+
+// hasValuesAfter reports whether x holds values after Unix time t.
+func hasValuesAfter(x *sequence.Sequence, t int64) bool {
+	return x.Timestamp()+int64(len(x.All())-1)*int64(x.Frequency()) > t
+}
+
+// waitValues blocks until the keys matching pattern, a key or a subtree, hold
+// values after the end parameter of a query, until wait elapses or until ctx is
+// done. It returns immediately if end is not valid, the query reporting the error.
+func (s *server) waitValues(ctx context.Context, pattern, end string, wait time.Duration) {
+	t, err := strconv.ParseInt(end, 10, 64)
+	if err != nil || wait == 0 {
+		return
+	}
+
+	// registered before looking at the store so that values applied in between
+	// are not missed
+	w := s.watchers.watch(pattern)
+	defer s.watchers.stop(w)
+
+	keys := []string{pattern}
+	if isSubtree(pattern) {
+		keys = s.keys(pattern)
+	}
+	for _, k := range keys {
+		if x, ok := s.store.Get(k); ok && hasValuesAfter(x, t) {
+			return
+		}
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			return
+		case v, ok := <-w.events:
+			if !ok || v.time > t {
+				return
+			}
+		}
+	}
+}
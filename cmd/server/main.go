@@ -4,17 +4,24 @@ import (
 	"bytes"
 	"context"
 	"embed"
+	"encoding/csv"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"regexp"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -27,32 +34,240 @@ const (
 	serializeFlag     = sequence.SerializeCount | sequence.SerializeMean
 	maskTime          = "2006-01-02 15:04:05"
 
+	// keys are made of word characters, dots and slashes acting as hierarchy separators
+	// by default, see -key-pattern
+	keyPattern = `[\w./]+`
+
 	statusOK      = "ok"
 	statusWarning = "warning"
 	statusError   = "error"
 )
 
 var (
-	aggregations   = []int64{15, 30, 60, 120, 300, 600, 900, 1200, 1800, 3600, 7200, 14400, 43200, 86400}
-	validStatement = regexp.MustCompile(`^\w+ [012](?: \d+)?$`)
+	errKeyNotFound = errors.New("key does not exist")
+
+	aggregations         = []int64{15, 30, 60, 120, 300, 600, 900, 1200, 1800, 3600, 7200, 14400, 43200, 86400}
+	validStatement       = regexp.MustCompile(`^` + keyPattern + ` [012](?: \d+(?: \d+)?)?$`)
+	validCreateStatement = regexp.MustCompile(`^` + keyPattern + ` \d+(?: \d+)?$`)
 )
 
 //go:embed assets
 var assets embed.FS
 
 type server struct {
-	store *sequence.Store
+	store      *shardedStore
+	mu         sync.RWMutex // held for reading by batch inserts, for writing by read-modify-write operations on sequences
+	meta       *metadata
+	dumpFile   string
+	metaFile   string
+	dumpMu     sync.Mutex // serializes dumps
+	counters   map[string]uint64
+	countersMu sync.Mutex
+	activity   map[string]time.Time
+	queried    map[string]time.Time
+	activityMu sync.Mutex // guards activity and queried
+	alerts     *alerter
+	dispatcher *dispatcher
+	replicator *replicator
+	relay      *relay
+	upstream   *upstream
+	peers      *router
+	raft       *raftNode
+	cache      *queryCache
+	settingsMu sync.RWMutex
+	current    settings
+	// read replica mode
+	readOnly        bool
+	draining        atomic.Bool
+	replica         *url.URL
+	replicaRedirect bool
+	// number of queries executed concurrently by subtree queries
+	queryWorkers int
+	// age of the oldest values accepted by inserts older than the last value of a key
+	backfillWindow time.Duration
+	// duration during which deleted keys can be undeleted
+	undeleteWindow time.Duration
+	// policy applied to insert statements ahead of the time of the server by more than futureSkew
+	futurePolicy string
+	futureSkew   time.Duration
+	// watchers of the values applied by insert requests
+	watchers watchHub
+	// insert statements allowed by the ingest rate quota
+	ingest rateLimiter
+	// series whose creation was rejected by key limits
+	keyRejections keyRejections
+	// whether the memory budget is exceeded, rejecting new keys under the refuse policy
+	memoryExceeded atomic.Bool
+	// name of the tenant, empty for the default tenant
+	name string
+	// log of mutating operations, shared by tenants
+	auditLog *auditLog
+	// tenants other than the default tenant, by name
+	tenants map[string]*tenant
 }
 
 func main() {
-	var listen, dumpFile string
-	var dumpInterval, retentionPolicy int
+	var listen, allow, tlsListen, tlsCert, tlsKey, tlsAllow, dumpFile, metaFile, configFile, auditFile, primaryOf, standbyOf, replicationToken, replica, upstreamURL string
+	var readOnly, replicaRedirect, logRequestLines, h2c, proxyProtocol bool
+	var dumpInterval, retentionPolicy, idleExpiry, rollupInterval, seedKeys, seedDays, cacheSize, shards, queryWorkers int
+	var readHeaderTimeout, readTimeout, writeTimeout, idleTimeout, backfillWindow, undeleteWindow, futureSkew, upstreamCache time.Duration
+	var futurePolicy, keyRegexp, relayToken, disable, raftSelf, raftLog, raftToken string
+	var maxHeaderBytes int
+	var overrides retentionOverrides
+	var routerBackends, peers, relays, raftPeers backends
+	var tenants tenantNames
 	flag.StringVar(&listen, "l", "127.0.0.1:8080", "Listening address:port")
+	flag.StringVar(&allow, "a", "", "Comma separated paths allowed on the plaintext listener (empty to allow all)")
+	flag.StringVar(&tlsListen, "T", "", "TLS listening address:port (optional)")
+	flag.StringVar(&tlsCert, "C", "", "Full path to TLS certificate file")
+	flag.StringVar(&tlsKey, "K", "", "Full path to TLS key file")
+	flag.StringVar(&tlsAllow, "A", "", "Comma separated paths allowed on the TLS listener (empty to allow all)")
+	flag.BoolVar(&h2c, "h2c", false, "Accept HTTP/2 without TLS (prior knowledge) on the plaintext listener, e.g. for gRPC clients behind a load balancer")
+	flag.BoolVar(&proxyProtocol, "proxy-protocol", false, "Require a PROXY protocol header (version 1 or 2) on the connections of both listeners, passing the address of clients behind a load balancer")
+	flag.Var(&trustedProxies, "trusted-proxy", "Address range of proxies whose Forwarded and X-Forwarded-For headers are trusted to identify clients (repeatable)")
+	flag.BoolVar(&logRequestLines, "log-requests", false, "Log a line per request (method, URI, status code, size, duration and client address)")
+	flag.StringVar(&oidcIssuer, "oidc-issuer", "", "URL of the OpenID Connect provider whose tokens are accepted (e.g. https://sso.example.com/realms/ops)")
+	flag.StringVar(&oidcClientID, "oidc-client-id", "", "OpenID Connect client ID of the UI, enabling the UI login")
+	flag.StringVar(&oidcClientSecret, "oidc-client-secret", "", "OpenID Connect client secret of the UI")
+	flag.StringVar(&oidcRedirectURL, "oidc-redirect-url", "", "URL of the /auth/callback endpoint registered with the OpenID Connect provider (defaults to the host of the request)")
+	flag.StringVar(&oidcAudience, "oidc-audience", "", "Audience of the OpenID Connect tokens of API requests (defaults to the client ID)")
+	flag.StringVar(&oidcReadScope, "oidc-read-scope", "", "Scope of the OpenID Connect tokens granting read access (empty to grant read access to every token)")
+	flag.StringVar(&oidcWriteScope, "oidc-write-scope", "", "Scope of the OpenID Connect tokens granting write access, including read access (empty to grant write access to every token)")
+	flag.StringVar(&oidcPrefixClaim, "oidc-prefix-claim", "", "Claim of the OpenID Connect tokens restricting them to key prefixes (optional)")
+	flag.Var(allowedIPs, "allow-ip", "Client address range allowed to use a group of endpoints (or all), formatted as group=cidr, other addresses being rejected (repeatable)")
+	flag.Var(deniedIPs, "deny-ip", "Client address range denied a group of endpoints (or all), formatted as group=cidr (repeatable)")
+	flag.StringVar(&disable, "disable", "", "Comma separated groups of endpoints to disable (insert, query, graphql, grpc, metadata, keys, alerts, admin, metrics or ui)")
+	flag.DurationVar(&readHeaderTimeout, "read-header-timeout", 10*time.Second, "Maximum duration for reading request headers (0 to disable)")
+	flag.DurationVar(&readTimeout, "read-timeout", time.Minute, "Maximum duration for reading requests, including bodies (0 to disable)")
+	flag.DurationVar(&writeTimeout, "write-timeout", 5*time.Minute, "Maximum duration before timing out writes of responses (0 to disable)")
+	flag.DurationVar(&insertTimeout, "insert-timeout", 0, "Maximum duration of insert requests, NDJSON streams excepted (0 to disable)")
+	flag.DurationVar(&queryTimeout, "query-timeout", 0, "Maximum duration of query requests (0 to disable)")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 2*time.Minute, "Maximum duration to wait for the next request on keep-alive connections (0 to use the read timeout)")
+	flag.IntVar(&maxHeaderBytes, "max-header-bytes", 64<<10, "Maximum size of request headers in bytes")
 	flag.StringVar(&dumpFile, "f", "./store.dump", "Full path to dump file")
+	flag.StringVar(&metaFile, "m", "./store.meta", "Full path to metadata file")
+	flag.StringVar(&configFile, "c", "", "Full path to configuration file, JSON or TOML (.toml) (optional)")
+	flag.StringVar(&auditFile, "audit", "", "Full path to audit log file to which mutating operations are appended (optional)")
 	flag.IntVar(&dumpInterval, "i", 0, "Dump interval in seconds (0 or less to disable)")
 	flag.IntVar(&retentionPolicy, "r", 365, "Retention policy in days (0 or less to disable)")
+	flag.Var(&overrides, "R", "Retention policy override in days for keys starting with a prefix, formatted as prefix=days (repeatable)")
+	flag.IntVar(&rollupInterval, "u", 0, "Rollup interval in seconds used to downsample values dropped by the retention policy, at most 65535 (0 or less to disable)")
+	flag.StringVar(&primaryOf, "P", "", "Standby address:port receiving applied changes (optional)")
+	flag.StringVar(&standbyOf, "S", "", "Listening address:port for changes replicated from a primary (optional)")
+	flag.StringVar(&replicationToken, "replication-token", "", "Shared secret authenticating primaries and standbys, required by -P and -S")
+	flag.BoolVar(&readOnly, "o", false, "Read-only mode, rejecting write requests (e.g. read replica)")
+	flag.StringVar(&replica, "q", "", "Read replica base URL to which read requests are forwarded (optional)")
+	flag.BoolVar(&replicaRedirect, "Q", false, "Redirect read requests to the read replica instead of proxying them")
+	flag.Var(&routerBackends, "B", "Backend base URL, enabling router mode distributing keys across backends (repeatable)")
+	flag.Var(&peers, "p", "Peer base URL queried for keys missing from the store (repeatable)")
+	flag.Var(&relays, "relay", "Downstream server base URL to which accepted insert statements are forwarded (repeatable)")
+	flag.StringVar(&relayToken, "relay-token", "", "Bearer token sent to downstream servers (optional)")
+	flag.StringVar(&raftSelf, "raft", "", "Base URL of this node, enabling raft mode replicating inserts and creations to the nodes of -raft-peer (optional)")
+	flag.Var(&raftPeers, "raft-peer", "Base URL of another node of the raft cluster (repeatable)")
+	flag.StringVar(&raftLog, "raft-log", "./raft.log", "Full path to raft log file, the store being rebuilt from it and its snapshot file (.snapshot suffix) at startup in raft mode")
+	flag.StringVar(&raftToken, "raft-token", "", "Bearer token authenticating the requests between the nodes of the raft cluster, required by -raft")
+	flag.StringVar(&upstreamURL, "upstream", "", "Upstream server base URL to which reads of keys missing from the store are forwarded (optional)")
+	flag.DurationVar(&upstreamCache, "upstream-cache", 0, "Duration during which successful responses of the upstream server are cached (0 to disable)")
+	flag.IntVar(&idleExpiry, "t", 0, "Delete keys without inserts for this number of seconds (0 or less to disable)")
+	flag.DurationVar(&staleAfter, "stale-after", 0, "Record unknown values for keys without inserts for this duration until inserts resume (0 to disable)")
+	flag.Var(&staleOverrides, "stale-override", "Stale timeout override for keys starting with a prefix, formatted as prefix=duration (repeatable)")
+	flag.IntVar(&seedKeys, "seed", 0, "Populate an empty store with synthetic values for this number of demo keys (0 or less to disable)")
+	flag.IntVar(&seedDays, "seed-days", 21, "Number of days of synthetic values generated by -seed")
+	flag.IntVar(&shards, "shards", 16, "Number of shards of the store, batch inserts on keys of different shards running concurrently")
+	flag.IntVar(&queryWorkers, "query-workers", 8, "Maximum number of queries executed concurrently by a subtree query")
+	flag.IntVar(&cacheSize, "cache", 0, "Memory budget of the query results cache in megabytes (0 or less to disable)")
+	flag.StringVar(&keyRegexp, "key-pattern", keyPattern, "Regular expression matched by keys")
+	flag.IntVar(&maxKeyLength, "max-key-length", defaultMaxKeyLength, "Maximum length of keys in bytes (0 or less to disable)")
+	flag.IntVar(&maxStatements, "max-statements", 0, "Maximum number of statements per insert request (0 or less to disable)")
+	flag.IntVar(&maxKeys, "max-keys", 0, "Maximum number of keys of each tenant, gauges and counters counting as one key (0 or less to disable)")
+	flag.IntVar(&memoryLimit, "memory-limit", 0, "Memory budget of the sequences of each tenant in megabytes (0 or less to disable)")
+	flag.StringVar(&memoryPolicy, "memory-policy", memoryEvict, "Policy applied when the memory budget is exceeded (evict or refuse)")
+	flag.Var(&maxPrefixKeys, "max-prefix-keys", "Maximum number of keys of each tenant starting with a prefix, formatted as prefix=keys (repeatable)")
+	flag.StringVar(&futurePolicy, "future-policy", futureAccept, "Policy applied to insert statements ahead of the time of the server by more than the allowed skew (accept, reject or clamp)")
+	flag.DurationVar(&futureSkew, "future-skew", 0, "Maximum duration insert statements can be ahead of the time of the server before applying the future timestamp policy")
+	flag.Var(&tenants, "tenant", "Tenant served under /tenants/<name>/ or using the X-Tenant header, with its own store and files (repeatable)")
+	flag.DurationVar(&backfillWindow, "backfill-window", 0, "Maximum age of values older than the last value of a key filling its unknown values (0 to disable)")
+	flag.DurationVar(&undeleteWindow, "undelete-window", 0, "Duration during which deleted keys are kept and can be undeleted (0 to disable)")
+	flag.Var(&businessHours, "business-hours", "Business hours applied by queries using hours=business, formatted as \"days start-end [timezone]\" (e.g. \"Mon-Fri 08:00-18:00 Europe/Paris\")")
 	flag.Parse()
 
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if err := applyEnv(set); err != nil {
+		log.Fatalf("error reading environment: %s", err)
+	}
+
+	if err := setKeyPattern(keyRegexp); err != nil {
+		log.Fatal(err)
+	}
+
+	conf := &config{}
+	if configFile != "" {
+		var err error
+		if conf, err = loadConfig(configFile); err != nil {
+			log.Fatalf("error loading configuration: %s", err)
+		}
+		if err := conf.applyFlags(set); err != nil {
+			log.Fatalf("error loading configuration: %s", err)
+		}
+	}
+
+	if rollupInterval > 0 && (rollupInterval < sequenceFrequency || aggregations[len(aggregations)-1]%int64(rollupInterval) != 0) {
+		log.Fatalf("rollup interval must be a divisor of %d greater or equal to %d", aggregations[len(aggregations)-1], sequenceFrequency)
+	}
+	// rollups are sequences, whose frequency is stored on 16 bits
+	if rollupInterval > math.MaxUint16 {
+		log.Fatalf("rollup interval must be less or equal to %d", math.MaxUint16)
+	}
+
+	if queryWorkers < 1 {
+		log.Fatalf("number of query workers must be greater than 0")
+	}
+
+	if shards < 1 {
+		log.Fatalf("number of shards must be greater than 0")
+	}
+
+	if err := validFuturePolicy(futurePolicy); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := validMemoryPolicy(memoryPolicy); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := disableGroups(splitList(disable)); err != nil {
+		log.Fatal(err)
+	}
+
+	use(countRequests)
+	if logRequestLines {
+		use(logRequests)
+	}
+	use(filterIPs)
+	use(authorize)
+
+	if tlsListen != "" && (tlsCert == "" || tlsKey == "") {
+		log.Fatalf("tls listener requires a certificate and a key")
+	}
+	opts := listenOptions{
+		addr:     listen,
+		allow:    splitList(allow),
+		tlsAddr:  tlsListen,
+		tlsCert:  tlsCert,
+		tlsKey:   tlsKey,
+		tlsAllow: splitList(tlsAllow),
+		h2c:      h2c,
+
+		proxyProtocol: proxyProtocol,
+
+		readHeaderTimeout: readHeaderTimeout,
+		readTimeout:       readTimeout,
+		writeTimeout:      writeTimeout,
+		idleTimeout:       idleTimeout,
+		maxHeaderBytes:    maxHeaderBytes,
+	}
+
 	html, err := assets.ReadFile("assets/templates/index.html")
 	if err != nil {
 		log.Fatal(err)
@@ -63,38 +278,302 @@ func main() {
 		log.Fatal(err)
 	}
 
-	s := &server{store: sequence.NewStore()}
+	b := readBuildInfo()
+	log.Printf("starting version %s (commit %s, dump format %d)", b.Version, b.Commit, b.DumpFormat)
+	handle(http.DefaultServeMux, "/version", handlerVersion)
+
+	if len(routerBackends) > 0 {
+		newRouter(routerBackends).register()
+		serve(opts, html, static, chain{requestID}, func() {})
+		return
+	}
 
-	if _, err := os.Stat(dumpFile); errors.Is(err, os.ErrNotExist) {
-		log.Println("file does not exist, starting with empty store")
-	} else {
-		f, err := os.ReadFile(dumpFile)
+	if oidcIssuer != "" {
+		p, err := newOIDCProvider(oidcIssuer, oidcClientID, oidcClientSecret, oidcRedirectURL, oidcAudience)
 		if err != nil {
-			log.Fatalf("error reading file: %s", err)
+			log.Fatalf("error configuring OpenID Connect provider: %s", err)
 		}
-		if err := s.store.Load(f); err != nil {
-			log.Fatalf("error loading store: %s", err)
+		oidcAuth = p
+		log.Printf("accepting tokens issued by %s (audience %s)", p.issuer, p.audience)
+	}
+
+	s := &server{
+		store:      newShardedStore(shards),
+		meta:       newMetadata(),
+		dumpFile:   dumpFile,
+		metaFile:   metaFile,
+		counters:   make(map[string]uint64),
+		activity:   make(map[string]time.Time),
+		queried:    make(map[string]time.Time),
+		alerts:     newAlerter(conf.Rules),
+		dispatcher: newDispatcher(conf.Webhooks, conf.Notifiers),
+		cache:      newQueryCache(cacheSize << 20),
+		readOnly:   readOnly,
+		tenants:    make(map[string]*tenant),
+	}
+
+	if auditFile != "" {
+		if s.auditLog, err = newAuditLog(auditFile); err != nil {
+			log.Fatal(err)
 		}
 	}
 
-	if dumpInterval > 0 {
-		go func() {
-			for range time.Tick(time.Duration(dumpInterval) * time.Second) {
-				s.dump(dumpFile)
+	s.queryWorkers = queryWorkers
+	s.backfillWindow = backfillWindow
+	s.undeleteWindow = undeleteWindow
+	s.futurePolicy, s.futureSkew = futurePolicy, futureSkew
+
+	base := settings{dumpInterval: dumpInterval, retention: retentionPolicy, overrides: overrides}
+	s.current = base.withConfig(conf, set)
+
+	if replica != "" {
+		u, err := url.Parse(replica)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatalf("read replica url is not valid")
+		}
+		s.replica, s.replicaRedirect = u, replicaRedirect
+	}
+
+	// in raft mode, the store is rebuilt from the raft snapshot and log rather than
+	// loaded
+	if raftSelf != "" {
+		u, err := url.Parse(raftSelf)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatalf("raft url is not valid")
+		}
+		if len(raftPeers) == 0 {
+			log.Fatalf("raft mode requires at least one peer")
+		}
+		// raft RPCs are authenticated by the raft token only
+		if raftToken == "" {
+			log.Fatalf("raft mode requires -raft-token")
+		}
+		// changes applied outside of the raft log would make the stores of nodes diverge
+		if primaryOf != "" || standbyOf != "" || readOnly || len(tenants) > 0 || seedKeys > 0 || idleExpiry > 0 ||
+			staleAfter > 0 || len(staleOverrides) > 0 || memoryLimit > 0 || backfillWindow > 0 {
+			log.Fatalf("raft mode is not compatible with -P, -S, -o, -tenant, -seed, -t, -stale-after, -stale-override, -memory-limit and -backfill-window")
+		}
+		if s.raft, err = newRaftNode(s, raftSelf, raftPeers, raftToken, raftLog); err != nil {
+			log.Fatal(err)
+		}
+	} else if err := s.loadStore(); err != nil {
+		log.Fatal(err)
+	}
+
+	if seedKeys > 0 {
+		if seedDays < 1 {
+			log.Fatalf("seed days must be greater than 0")
+		}
+		if len(s.store.Keys()) > 0 {
+			log.Println("store is not empty, skipping seed")
+		} else {
+			s.seed(seedKeys, seedDays)
+		}
+	}
+
+	if err := s.loadMeta(); err != nil {
+		log.Fatal(err)
+	}
+
+	for _, name := range tenants {
+		t, err := s.newTenant(name, shards, cacheSize, conf, base, set)
+		if err != nil {
+			log.Fatalf("tenant %s: %s", name, err)
+		}
+		s.tenants[name] = t
+	}
+	for name := range conf.Tenants {
+		if _, ok := s.tenants[name]; !ok {
+			log.Fatalf("tenant %s of the configuration file is not declared", name)
+		}
+	}
+
+	if len(peers) > 0 {
+		s.peers = newRouter(peers)
+	}
+
+	// standbys replace their store using snapshots received from primaries
+	if (primaryOf != "" || standbyOf != "") && replicationToken == "" {
+		log.Fatalf("replication requires -replication-token")
+	}
+	if primaryOf != "" {
+		s.replicator = newReplicator(primaryOf, replicationToken, s.snapshot)
+	}
+
+	s.relay = newRelay(relays, relayToken)
+
+	if upstreamURL != "" {
+		u, err := url.Parse(upstreamURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatalf("upstream url is not valid")
+		}
+		s.upstream = newUpstream(u, upstreamCache)
+	}
+
+	background := newLoops()
+
+	if standbyOf != "" {
+		background.run(func(ctx context.Context) { s.standby(ctx, standbyOf, replicationToken) })
+	}
+
+	last := make(map[*server]time.Time)
+	for _, x := range s.servers() {
+		last[x] = time.Now()
+	}
+	background.every(time.Second, func() {
+		for _, x := range s.servers() {
+			if v := x.settings().dumpInterval; v > 0 && time.Since(last[x]) >= time.Duration(v)*time.Second {
+				x.dump()
+				last[x] = time.Now()
 			}
-		}()
+		}
+	})
+
+	if undeleteWindow > 0 {
+		background.every(time.Minute, func() {
+			for _, x := range s.servers() {
+				x.purge()
+			}
+		})
 	}
 
-	if retentionPolicy > 0 {
-		retention := time.Duration(retentionPolicy) * 86400 * time.Second
-		go func() {
-			for range time.Tick(86400 * time.Second) {
-				s.store.TrimLeft(time.Now().Add(-retention).Truncate(time.Duration(sequenceFrequency) * time.Second))
+	background.every(86400*time.Second, func() {
+		for _, x := range s.servers() {
+			st := x.settings()
+			x.trim(st.retention, st.overrides, int64(rollupInterval))
+		}
+	})
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
+		for v := range sig {
+			switch v {
+			case syscall.SIGUSR1:
+				log.Println("dumping store on SIGUSR1")
+				for _, x := range s.servers() {
+					x.dump()
+				}
+			case syscall.SIGUSR2:
+				s.drain()
+			default:
+				s.reload(configFile, base, set)
 			}
-		}()
+		}
+	}()
+
+	for _, v := range conf.Reports {
+		v := v
+		background.run(func(ctx context.Context) { s.schedule(ctx, v) })
+	}
+
+	if idleExpiry > 0 {
+		ttl := time.Duration(idleExpiry) * time.Second
+		tick := time.Minute
+		if ttl < tick {
+			tick = ttl
+		}
+		background.every(tick, func() {
+			for _, x := range s.servers() {
+				x.expire(ttl)
+			}
+		})
 	}
 
-	httpServer := http.Server{Addr: listen}
+	// unknown values are replicated, standbys not seeing inserts
+	if (staleAfter > 0 || len(staleOverrides) > 0) && standbyOf == "" {
+		background.every(time.Duration(sequenceFrequency)*time.Second, func() {
+			for _, x := range s.servers() {
+				x.markStale()
+			}
+		})
+	}
+
+	// evictions are replicated, standbys not creating keys
+	if memoryLimit > 0 && standbyOf == "" {
+		background.every(time.Duration(sequenceFrequency)*time.Second, func() {
+			for _, x := range s.servers() {
+				x.enforceMemory()
+			}
+		})
+	}
+
+	s.routes(http.DefaultServeMux)
+	if s.raft != nil {
+		s.raft.register(http.DefaultServeMux)
+		s.raft.start(background)
+	}
+	if oidcAuth != nil && oidcAuth.clientID != "" {
+		oidcAuth.routes(http.DefaultServeMux)
+	}
+	handle(http.DefaultServeMux, "/metrics", s.handlerMetrics)
+
+	serve(opts, html, static, chain{requestID, s.tenancy, s.auth}, func() {
+		// a dump in progress completes before the final dump
+		background.stop()
+		for _, x := range s.servers() {
+			x.dump()
+		}
+	})
+}
+
+// routes registers the endpoints of the API on mux, wrapped by the middlewares
+// rejecting writes on read-only servers, forwarding reads to the read replica and
+// applying deadlines and quotas.
+func (s *server) routes(mux *http.ServeMux) {
+	writes := chain{s.write}
+	inserts := writes.with(timeout(insertTimeout))
+	local := writes.with(s.raft.local)
+	queries := chain{s.read, timeout(queryTimeout), s.limitRange}
+	cached := queries.with(etag, s.readThrough)
+
+	handle(mux, "/insert/", inserts.then(s.raft.handle("/insert/", s.handlerInsert)))
+	handle(mux, "/create/", writes.then(s.raft.handle("/create/", s.handlerCreate)))
+	handle(mux, "/query/", cached.with(s.federate).then(s.handlerQuery))
+	handle(mux, "/export/", queries.with(s.readThrough).then(s.handlerExport))
+	handle(mux, "/sequence/", local.with(s.limitRange, s.readThrough).then(s.handlerSequence))
+	handle(mux, "/gauge/insert/", inserts.then(s.raft.handle("/gauge/insert/", s.handlerGaugeInsert)))
+	handle(mux, "/gauge/query/", cached.then(s.handlerGaugeQuery))
+	handle(mux, "/counter/insert/", inserts.then(s.raft.handle("/counter/insert/", s.handlerCounterInsert)))
+	handle(mux, "/counter/query/", cached.then(s.handlerCounterQuery))
+	handle(mux, "/maintenance/", local.then(s.handlerMaintenance))
+	handle(mux, "/overwrite/", local.then(s.handlerOverwrite))
+	handle(mux, "/intervals/", local.then(s.handlerIntervals))
+	handle(mux, "/import/", local.then(s.handlerImport))
+	handle(mux, "/keys/", local.then(s.handlerKeys))
+	handle(mux, "/undelete/", local.then(s.handlerUndelete))
+	handle(mux, "/stats/", s.handlerStats)
+	handle(mux, "/memory/", s.handlerMemory)
+	handle(mux, "/top/", s.handlerTop)
+	handle(mux, "/longest/", cached.then(s.handlerLongest))
+	handle(mux, "/sla/", queries.then(s.handlerSLA))
+	handle(mux, "/annotations/", local.then(s.handlerAnnotations))
+	handle(mux, "/composites/", local.then(s.handlerComposites))
+	handle(mux, "/dashboards/", local.then(s.handlerDashboards))
+	handle(mux, "/alerts/", s.handlerAlerts)
+	handle(mux, "/admin/backup", s.handlerBackup)
+	handle(mux, "/admin/restore", local.then(s.handlerRestore))
+	handle(mux, "/admin/drain", s.handlerDrain)
+	handle(mux, "/admin/compact", s.handlerCompact)
+	handle(mux, grpcService, s.handlerGRPC)
+	handle(mux, "/graphql/", chain{s.read, timeout(queryTimeout)}.then(s.handlerGraphQL))
+	handle(mux, "/graphql/schema", s.handlerGraphQLSchema)
+}
+
+// serve registers the UI handlers and serves HTTP requests on the listeners defined
+// by opts, the plaintext listener being replaced by the sockets passed by systemd
+// if any, until the process receives SIGTERM or SIGINT, calling shutdown after
+// closing the servers. The handler of the servers is wrapped by the middlewares of
+// wrap, applying to every request including requests to unknown paths.
+func serve(opts listenOptions, html []byte, static fs.FS, wrap chain, shutdown func()) {
+	h := wrap.then(http.DefaultServeMux.ServeHTTP)
+	httpServer := opts.server(opts.allow, h)
+	httpsServer := opts.server(opts.tlsAllow, h)
+	if opts.h2c {
+		if err := enableH2C(httpServer); err != nil {
+			log.Fatalf("error enabling h2c: %s", err)
+		}
+	}
 
 	closed := make(chan struct{})
 	go func() {
@@ -102,82 +581,196 @@ func main() {
 		signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
 		<-sig
 		log.Println("graceful shutdown")
-		s.dump(dumpFile)
+		// requests in progress complete first, so that the final dump holds their changes
 		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 		defer cancel()
 		httpServer.Shutdown(ctx)
+		httpsServer.Shutdown(ctx)
+		shutdown()
 		close(closed)
 	}()
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path != "/" {
-			http.NotFound(w, r)
-			return
+	// unknown paths are answered by the default handler of the mux if the UI is disabled
+	if !disabledPaths["/"] {
+		handle(http.DefaultServeMux, "/", func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(html)
+		})
+
+		handle(http.DefaultServeMux, "/static/", http.StripPrefix("/static/", http.FileServer(http.FS(static))).ServeHTTP)
+	}
+
+	listeners, err := systemdListeners()
+	if err != nil {
+		log.Fatalf("error using socket activation: %s", err)
+	}
+	if len(listeners) == 0 && opts.addr != "" {
+		l, err := net.Listen("tcp", opts.addr)
+		if err != nil {
+			log.Fatal(err)
 		}
-		w.Write(html)
-	})
+		listeners = append(listeners, l)
+	}
 
-	http.HandleFunc("/insert/", s.handlerInsert)
-	http.HandleFunc("/query/", s.handlerQuery)
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(static))))
+	if opts.proxyProtocol {
+		for i, l := range listeners {
+			listeners[i] = proxyListener{l}
+		}
+	}
 
-	log.Printf("listening on %s", listen)
+	if opts.tlsAddr != "" {
+		l, err := net.Listen("tcp", opts.tlsAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if opts.proxyProtocol {
+			l = proxyListener{l}
+		}
+		go func() {
+			log.Printf("listening on %s (tls)", l.Addr())
+			if err := httpsServer.ServeTLS(l, opts.tlsCert, opts.tlsKey); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
 
-	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
-		log.Fatal(err)
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			log.Printf("listening on %s", l.Addr())
+			if err := httpServer.Serve(l); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}(l)
 	}
+
 	<-closed
 }
 
-func (s *server) dump(f string) {
+// dump writes the store and metadata of s to their files. Dumps triggered
+// concurrently (e.g. by the dump interval and SIGUSR1) are run one at a time.
+func (s *server) dump() {
+	s.dumpMu.Lock()
+	defer s.dumpMu.Unlock()
 	buf, err := s.store.Dump()
 	if err != nil {
 		log.Printf("error dumping store: %s", err)
 		return
 	}
-	err = os.WriteFile(f, buf, 0660)
+	err = writeFile(s.dumpFile, buf)
+	if err != nil {
+		log.Printf("error writing file: %s", err)
+		return
+	}
+	log.Printf("writing store to file %s (%d bytes)", s.dumpFile, len(buf))
+
+	buf, err = s.meta.bytes()
+	if err != nil {
+		log.Printf("error dumping metadata: %s", err)
+		return
+	}
+	err = writeFile(s.metaFile, buf)
 	if err != nil {
 		log.Printf("error writing file: %s", err)
 		return
 	}
-	log.Printf("writing store to file (%d bytes)", len(buf))
+	log.Printf("writing metadata to file %s (%d bytes)", s.metaFile, len(buf))
+}
+
+// writeFile writes data to a temporary file renamed to name, so that name always
+// holds a complete dump, e.g. when copied by backup scripts.
+func writeFile(name string, data []byte) error {
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, 0660); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// loadStore loads the dump file of s, if it exists.
+func (s *server) loadStore() error {
+	if _, err := os.Stat(s.dumpFile); errors.Is(err, os.ErrNotExist) {
+		log.Printf("file %s does not exist, starting with empty store", s.dumpFile)
+		return nil
+	}
+	f, err := os.ReadFile(s.dumpFile)
+	if err != nil {
+		return fmt.Errorf("error reading file: %s", err)
+	}
+	if err := s.store.Load(f); err != nil {
+		return fmt.Errorf("error loading store: %s", err)
+	}
+	return nil
+}
+
+// loadMeta loads the metadata file of s, if it exists.
+func (s *server) loadMeta() error {
+	if _, err := os.Stat(s.metaFile); errors.Is(err, os.ErrNotExist) {
+		log.Printf("metadata file %s does not exist, starting with empty metadata", s.metaFile)
+		return nil
+	}
+	f, err := os.ReadFile(s.metaFile)
+	if err != nil {
+		return fmt.Errorf("error reading file: %s", err)
+	}
+	if err := s.meta.load(f); err != nil {
+		return fmt.Errorf("error loading metadata: %s", err)
+	}
+	return nil
 }
 
 func (s *server) handlerInsert(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		writeResponse(w, http.StatusMethodNotAllowed, statusError, "method not allowed", nil)
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+	if isNDJSON(r) {
+		s.handlerInsertStream(w, r)
 		return
 	}
 
-	body, err := io.ReadAll(r.Body)
+	buf, err := readBody(r.Body)
 	if err != nil {
 		writeResponse(w, http.StatusBadRequest, statusError, "error reading request body", nil)
-		log.Printf("error reading request body: %s", err)
+		logf(r, "error reading request body: %s", err)
 		return
 	}
+	defer putBuffer(buf)
+	body := buf.Bytes()
 
-	defaultValueTimestamp := time.Now()
+	defaultValueTimestamp := requestTime(r)
 	defaultSequenceTimestamp := defaultValueTimestamp.Truncate(time.Duration(sequenceFrequency) * time.Second)
 
 	lines := bytes.Split(body, []byte("\n"))
+	if tooManyStatements(w, lines) || s.limitIngest(w, r, len(lines)) {
+		return
+	}
+	rejected := newRejections(r, lines)
+	duplicates := s.newDuplicateFilter(r)
 
-	mapping := make([]int, len(lines))
-
-	var n int
+	valid := make([]int, 0, len(lines))
 	for i := 0; i < len(lines); i++ {
-		if !validStatement.Match(lines[i]) {
-			log.Printf("error parsing statement %d", i+1)
+		if reason := checkStatement(r, validStatement, lines[i]); reason != "" {
+			logf(r, "error parsing statement %d: %s", i+1, reason)
+			rejected.add(i, reason)
 			continue
 		}
-		mapping[n] = i
-		n++
+		valid = append(valid, i)
 	}
 
-	statements := make([]sequence.Statement, n)
+	statements := getStatements(0, len(valid))
+	defer func() { putStatements(statements) }()
+
+	// line of each statement, statements with a duration expanding into one
+	// statement per value
+	mapping := make([]int, 0, len(valid))
 
-	for i := 0; i < n; i++ {
-		line := lines[mapping[i]]
+	for _, i := range valid {
+		line := lines[i]
 		p := bytes.IndexByte(line, ' ')
+		key := string(line[:p])
 		// verbose conversion for the sake of clarity
 		var value uint8
 		switch line[p+1] {
@@ -188,36 +781,183 @@ func (s *server) handlerInsert(w http.ResponseWriter, r *http.Request) {
 		case '2':
 			value = sequence.StateUnknown
 		default:
-			log.Panic("poor validation panic")
+			logf(r, "error parsing statement %d: invalid value", i+1)
+			rejected.add(i, "invalid value")
+			continue
 		}
 		valueTimestamp, sequenceTimestamp := defaultValueTimestamp, defaultSequenceTimestamp
+		samples, frequency := 1, int64(sequenceFrequency)
 		if len(line) > p+2 {
-			x, err := strconv.Atoi(string(line[p+3:]))
+			fields := bytes.Fields(line[p+3:])
+			x, err := strconv.Atoi(string(fields[0]))
 			if err != nil {
-				log.Panic("poor validation panic")
+				logf(r, "error parsing statement %d: timestamp out of range", i+1)
+				rejected.add(i, "timestamp out of range")
+				continue
+			}
+			if len(fields) > 1 {
+				d, _ := strconv.ParseInt(string(fields[1]), 10, 64)
+				var reason string
+				if samples, frequency, reason = s.statementSamples(key, d); reason != "" {
+					logf(r, "error parsing statement %d: %s", i+1, reason)
+					rejected.add(i, reason)
+					continue
+				}
+			}
+			var ok bool
+			if valueTimestamp, ok = s.future(time.Unix(int64(x), 0), defaultValueTimestamp); ok {
+				samples, ok = s.futureSamples(valueTimestamp, samples, frequency, defaultValueTimestamp)
+			}
+			if !ok {
+				logf(r, "error parsing statement %d: timestamp in the future", i+1)
+				rejected.add(i, "timestamp in the future")
+				continue
 			}
-			valueTimestamp = time.Unix(int64(x), 0)
 			sequenceTimestamp = valueTimestamp.Truncate(time.Duration(sequenceFrequency) * time.Second)
 		}
-		statements[i] = sequence.Statement{
-			Key:                 string(line[:p]),
-			Timestamp:           valueTimestamp,
-			Value:               value,
-			Type:                sequence.StatementAdd,
-			CreateIfNotExists:   true,
-			CreateWithTimestamp: sequenceTimestamp,
-			CreateWithFrequency: sequenceFrequency,
+		for j := 0; j < samples; j++ {
+			mapping = append(mapping, i)
+			statements = append(statements, sequence.Statement{
+				Key:                 key,
+				Timestamp:           valueTimestamp.Add(time.Duration(int64(j)*frequency) * time.Second),
+				Value:               value,
+				Type:                sequence.StatementAdd,
+				CreateIfNotExists:   true,
+				CreateWithTimestamp: sequenceTimestamp,
+				CreateWithFrequency: sequenceFrequency,
+			})
 		}
 	}
 
-	result := s.store.Batch(statements)
-	if result.HasErrors() {
-		for i, err := range result.ErrorVars() {
+	if err := r.Context().Err(); err != nil {
+		writeContextError(w, err)
+		return
+	}
+	var n, d int
+	errs := s.insert(r, statements, duplicates)
+	lineOutcomes(mapping, errs, func(i int, err error) {
+		switch {
+		case err == errDuplicate:
+			d++
+		case err != nil:
+			logf(r, "error executing statement %d: %s", i+1, err)
+			rejected.add(i, err.Error())
+		default:
+			n++
+		}
+	})
+
+	status := statusOK
+	if n+d != len(lines) {
+		status = statusWarning
+	}
+
+	message := duplicates.message(n, d, len(lines))
+	s.audit(r, auditInsert, appliedKeys(statements, errs), message)
+	writeResponse(w, http.StatusOK, status, message, rejected.data())
+}
+
+// insert executes statements of r setting the state of keys, returning the error of
+// each statement: nil if it was applied, errDuplicate if duplicates identifies it
+// as a duplicate of a recorded value, the error of the exceeded key limit if it
+// would create a key beyond key limits.
+func (s *server) insert(r *http.Request, statements []sequence.Statement, duplicates *duplicateFilter) []error {
+	limited := s.limitKeys(statements)
+	s.mu.RLock()
+	result := s.store.Batch(statements, s.replicator.statements)
+	s.cache.invalidateStatements(statements)
+	s.mu.RUnlock()
+	s.touch(statements, result)
+	s.notify(r, statements, result)
+	relay := s.relay
+	if !raftEffects(r) {
+		relay = nil
+	}
+	if !result.HasErrors() {
+		relay.statements("/insert/", statements, nil)
+		return make([]error, len(statements))
+	}
+	errs := result.ErrorVars()
+	limited.apply(errs)
+	s.backfill(statements, errs)
+	for i, err := range errs {
+		if duplicates.match(statements[i], err) {
+			errs[i] = errDuplicate
+		}
+	}
+	relay.statements("/insert/", statements, errs)
+	return errs
+}
+
+func (s *server) handlerCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, statusError, "error reading request body", nil)
+		logf(r, "error reading request body: %s", err)
+		return
+	}
+
+	now := requestTime(r)
+
+	lines := bytes.Split(body, []byte("\n"))
+	if tooManyStatements(w, lines) {
+		return
+	}
+	rejected := newRejections(r, lines)
+	limit := s.keyLimits()
+
+	var n int
+	var created []string
+	for i, line := range lines {
+		if reason := checkStatement(r, validCreateStatement, line); reason != "" {
+			logf(r, "error parsing statement %d: %s", i+1, reason)
+			rejected.add(i, reason)
+			continue
+		}
+		fields := bytes.Fields(line)
+		key := string(fields[0])
+		// frequencies must divide the largest grouping interval to keep groups aligned
+		frequency, err := strconv.Atoi(string(fields[1]))
+		if err != nil || frequency < 1 || frequency > math.MaxUint16 || aggregations[len(aggregations)-1]%int64(frequency) != 0 {
+			logf(r, "error executing statement %d: invalid frequency", i+1)
+			rejected.add(i, "invalid frequency")
+			continue
+		}
+		timestamp := now
+		if len(fields) > 2 {
+			x, err := strconv.Atoi(string(fields[2]))
 			if err != nil {
-				log.Printf("error executing statement %d: %s", mapping[i]+1, err)
-				n--
+				logf(r, "error executing statement %d: timestamp out of range", i+1)
+				rejected.add(i, "timestamp out of range")
+				continue
 			}
+			timestamp = time.Unix(int64(x), 0)
+		}
+		if _, ok := s.store.Get(key); ok {
+			logf(r, "error executing statement %d: key already exists", i+1)
+			rejected.add(i, "key already exists")
+			continue
+		}
+		if err := limit.check(key); err != nil {
+			logf(r, "error executing statement %d: %s", i+1, err)
+			rejected.add(i, err.Error())
+			continue
+		}
+		timestamp = timestamp.Truncate(time.Duration(frequency) * time.Second)
+		// checked again while creating, the key may be created since
+		if !s.store.Create(timestamp, uint16(frequency), key) {
+			logf(r, "error executing statement %d: key already exists", i+1)
+			rejected.add(i, "key already exists")
+			continue
 		}
+		s.replicator.send(replicationMessage{Created: []createdKey{{Key: key, Timestamp: timestamp, Frequency: uint16(frequency)}}})
+		created = append(created, key)
+		n++
 	}
 
 	status := statusOK
@@ -225,67 +965,478 @@ func (s *server) handlerInsert(w http.ResponseWriter, r *http.Request) {
 		status = statusWarning
 	}
 
-	writeResponse(w, http.StatusOK, status, fmt.Sprintf("processed %d/%d statement(s)", n, len(lines)), nil)
+	message := fmt.Sprintf("processed %d/%d statement(s)", n, len(lines))
+	s.audit(r, auditCreate, created, message)
+	writeResponse(w, http.StatusOK, status, message, rejected.data())
 }
 
 func (s *server) handlerQuery(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		writeResponse(w, http.StatusBadRequest, statusError, "method is not allowed", nil)
+		methodNotAllowed(w, http.MethodGet)
 		return
 	}
 
 	key := r.FormValue("key")
+	exclude := r.FormValue("maintenance") == "exclude"
+
+	w.Header().Add("Vary", "Accept")
+	format, err := queryFormat(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorInvalidRequest, err.Error())
+		return
+	}
+	mode := r.FormValue("mode")
+	if format != formatJSON && (r.FormValue("tier") == "rollup" || (mode != "" && mode != "default") || r.FormValue("annotations") == "1" || r.FormValue("calendar") != "" || r.FormValue("q") != "") {
+		writeError(w, http.StatusBadRequest, errorInvalidRequest, "format is only supported by default queries")
+		return
+	}
 
-	args, err := newQueryArgs(r.FormValue("start"), r.FormValue("end"))
+	if q := r.FormValue("q"); q != "" {
+		s.handlerQueryExpression(w, r, q)
+		return
+	}
+
+	if r.FormValue("tier") == "rollup" {
+		s.handlerQueryRollup(w, r, key)
+		return
+	}
+
+	switch mode {
+	case "", "default":
+	case "availability":
+		s.handlerQueryAvailability(w, r, key)
+		return
+	case "transitions":
+		s.handlerQueryTransitions(w, r, key)
+		return
+	case "heatmap":
+		s.handlerQueryHeatmap(w, r, key)
+		return
+	default:
+		writeResponse(w, http.StatusBadRequest, statusError, "mode is not supported", nil)
+		return
+	}
+
+	hours, err := queryHours(r.FormValue("hours"))
 	if err != nil {
-		writeResponse(w, http.StatusBadRequest, statusError, err.Error(), nil)
+		writeError(w, http.StatusBadRequest, errorInvalidRequest, err.Error())
+		return
+	}
+
+	if r.FormValue("calendar") != "" {
+		if isSubtree(key) {
+			writeError(w, http.StatusBadRequest, errorInvalidRequest, "calendar is not supported by subtree queries")
+			return
+		}
+		s.handlerQueryCalendar(w, r, key, hours)
+		return
+	}
+
+	if v := r.FormValue("wait"); v != "" {
+		wait, err := parseWait(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errorInvalidRequest, err.Error())
+			return
+		}
+		s.waitValues(r.Context(), key, r.FormValue("end"), wait)
+	}
+
+	if v := r.FormValue("group"); v != "" {
+		if !isSubtree(key) {
+			writeError(w, http.StatusBadRequest, errorInvalidRequest, "group is only supported by subtree queries")
+			return
+		}
+		depth, err := parseGroupDepth(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errorInvalidRequest, err.Error())
+			return
+		}
+		s.handlerQueryGroups(w, r, key, depth, format, exclude, hours)
+		return
+	}
+
+	if isSubtree(key) {
+		// results are written key by key as they are computed, the message following
+		// them since the number of keys returned is only known at the end
+		var n int
+		var c *csv.Writer
+		keys, data := []string{}, [][]byte{} // held until the end using MessagePack
+		ok := s.queryKeys(r.Context(), s.keys(key), r.FormValue("start"), r.FormValue("end"), exclude, hours, func(k string, x keyResult) bool {
+			if x.err == errKeyNotFound {
+				return true
+			}
+			if x.err != nil {
+				if n > 0 && format != formatMsgpack {
+					logf(r, "error executing query on key %s: %s", k, x.err)
+					panic(http.ErrAbortHandler)
+				}
+				if x.code == http.StatusInternalServerError {
+					writeResponse(w, x.code, statusError, "an unexpected error occurred", nil)
+					logf(r, "error executing query: %s", x.err)
+					return false
+				}
+				writeError(w, x.code, queryErrorCode(x.err), x.err.Error())
+				return false
+			}
+			switch format {
+			case formatCSV:
+				if n == 0 {
+					w.Header().Set("Content-Type", "text/csv")
+					w.WriteHeader(http.StatusOK)
+					c = csv.NewWriter(w)
+					c.Write(csvHeader)
+				}
+				if err := writeCSVRows(c, k, x.data); err != nil {
+					logf(r, "error serializing rows of key %s: %s", k, err)
+					panic(http.ErrAbortHandler)
+				}
+				c.Flush()
+				n++
+				return true
+			case formatMsgpack:
+				keys, data = append(keys, k), append(data, x.data)
+				n++
+				return true
+			}
+			if n == 0 {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusOK)
+				fmt.Fprintf(w, `{"code":%d,"status":"%s","data":{`, http.StatusOK, statusOK)
+			} else {
+				io.WriteString(w, ",")
+			}
+			name, _ := json.Marshal(k)
+			w.Write(name)
+			io.WriteString(w, ":")
+			w.Write(x.data)
+			n++
+			return true
+		})
+		if !ok {
+			if err := r.Context().Err(); err != nil {
+				// results already written cannot be replaced by an error response
+				if n > 0 && format != formatMsgpack {
+					panic(http.ErrAbortHandler)
+				}
+				writeContextError(w, err)
+			}
+			return
+		}
+		switch {
+		case format == formatCSV && n == 0:
+			writeCSV(w, "", []byte("[]"))
+			return
+		case format == formatCSV:
+			return
+		case format == formatMsgpack:
+			writeMsgpack(w, fmt.Sprintf("%d key(s) returned", n), keys, data)
+			return
+		}
+		if n == 0 {
+			writeResponse(w, http.StatusOK, statusOK, "0 key(s) returned", []byte("{}"))
+			return
+		}
+		fmt.Fprintf(w, `},"message":"%d key(s) returned"}`, n)
+		return
+	}
+
+	if r.FormValue("annotations") != "1" {
+		message, data, code, err := s.cachedQuery(r.Context(), key, r.FormValue("start"), r.FormValue("end"), exclude, hours, s.get)
+		if code == http.StatusInternalServerError {
+			writeResponse(w, code, statusError, "an unexpected error occurred", nil)
+			logf(r, "error executing query: %s", err)
+			return
+		}
+		if err != nil {
+			writeError(w, code, queryErrorCode(err), err.Error())
+			return
+		}
+		switch format {
+		case formatCSV:
+			writeCSV(w, key, data)
+		case formatMsgpack:
+			writeMsgpack(w, message, nil, [][]byte{data})
+		default:
+			writeResponse(w, http.StatusOK, statusOK, message, data)
+		}
 		return
 	}
 
 	// until better error handling
-	if _, ok := s.store.Get(key); !ok {
-		writeResponse(w, http.StatusBadRequest, statusError, "key does not exist", nil)
+	x, ok := s.get(key)
+	if !ok {
+		writeError(w, http.StatusNotFound, errorKeyNotFound, "key does not exist")
+		return
+	}
+
+	args, err := newQueryArgs(r.FormValue("start"), r.FormValue("end"), int64(x.Frequency()))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorInvalidRange, err.Error())
 		return
 	}
+	args.hours = hours
 
-	qs, err := s.store.Query(key, args.start, args.end, args.interval)
+	qs, err := s.query(key, x, args, exclude)
 	if err != nil {
 		writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
-		log.Printf("error executing query: %s", err)
+		logf(r, "error executing query: %s", err)
 		return
 	}
 
 	message := fmt.Sprintf("%d row(s) returned (interval %ds)", len(qs.Count), int(args.interval.Seconds()))
-	writeResponse(w, http.StatusOK, statusOK, message, qs.Serialize("", time.UTC, 2, serializeFlag))
+
+	annotations, err := json.Marshal(s.meta.annotations(key, args.start.Unix(), args.end.Unix()))
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+		logf(r, "error serializing annotations: %s", err)
+		return
+	}
+	writeEnvelope(w, response{
+		Code:        http.StatusOK,
+		Status:      statusOK,
+		Message:     message,
+		Data:        qs.Serialize("", time.UTC, 2, serializeFlag),
+		Annotations: annotations,
+	})
 }
 
-type queryArgs struct {
-	start    time.Time
-	end      time.Time
-	interval time.Duration
+// A keyResult holds the data of the response to a query on a key, or the error
+// and status code of the response if the query failed.
+type keyResult struct {
+	data []byte
+	code int
+	err  error
 }
 
-func newQueryArgs(start, end string) (queryArgs, error) {
-	v, err := strconv.Atoi(start)
+// queryKeys executes queries on keys using start, end, exclude and hours as for
+// /query/, running up to s.queryWorkers queries concurrently, and passes their
+// results to fn in the order of keys. Keys are processed in groups of
+// s.queryWorkers so that the results of a single group are held in memory. It stops
+// when fn returns false or ctx is done, reporting whether the results of every key
+// were passed to fn.
+func (s *server) queryKeys(ctx context.Context, keys []string, start, end string, exclude bool, hours *schedule, fn func(string, keyResult) bool) bool {
+	results := make([]keyResult, s.queryWorkers)
+	for i := 0; i < len(keys); i += s.queryWorkers {
+		if err := ctx.Err(); err != nil {
+			log.Printf("query stopped after %d/%d key(s): %s", i, len(keys), err)
+			return false
+		}
+		group := keys[i:]
+		if len(group) > s.queryWorkers {
+			group = group[:s.queryWorkers]
+		}
+		var wg sync.WaitGroup
+		for j, k := range group {
+			wg.Add(1)
+			go func(j int, k string) {
+				defer wg.Done()
+				var x keyResult
+				_, x.data, x.code, x.err = s.cachedQuery(ctx, k, start, end, exclude, hours, s.store.Get)
+				results[j] = x
+			}(j, k)
+		}
+		wg.Wait()
+		// results of a group interrupted by ctx are incomplete
+		if err := ctx.Err(); err != nil {
+			log.Printf("query stopped after %d/%d key(s): %s", i, len(keys), err)
+			return false
+		}
+		for j, k := range group {
+			if !fn(k, results[j]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// cachedQuery executes a query on key using start, end, exclude and hours as for
+// /query/, get returning a copy of the sequence of key, and returns the message and
+// data of the response. Results are cached, except for composite keys whose results
+// depend on other keys. If an error occurs, the status code of the response is
+// returned. Queries are not executed once ctx is done, e.g. when the client
+// disconnected.
+func (s *server) cachedQuery(ctx context.Context, key, start, end string, exclude bool, hours *schedule, get func(string) (*sequence.Sequence, bool)) (string, []byte, int, error) {
+	if err := s.checkRangeValues(start, end); err != nil {
+		return "", nil, http.StatusBadRequest, err
+	}
+	k := cacheKey{key: key, start: start, end: end, exclude: exclude}
+	if hours != nil {
+		k.hours = hours.spec
+	}
+	if message, data, ok := s.cache.get(k); ok {
+		return message, data, http.StatusOK, nil
+	}
+	if err := ctx.Err(); err != nil {
+		code, err := contextError(err)
+		return "", nil, code, err
+	}
+
+	version := s.cache.version(key)
+	x, ok := get(key)
+	if !ok {
+		return "", nil, http.StatusNotFound, errKeyNotFound
+	}
+
+	args, err := newQueryArgs(start, end, int64(x.Frequency()))
 	if err != nil {
-		return queryArgs{}, errors.New("error parsing start date")
+		return "", nil, http.StatusBadRequest, err
 	}
-	x := time.Unix(ceilInt64(int64(v), sequenceFrequency), 0)
+	args.hours = hours
 
-	v, err = strconv.Atoi(end)
+	qs, err := s.query(key, x, args, exclude)
 	if err != nil {
-		return queryArgs{}, errors.New("error parsing end date")
+		return "", nil, http.StatusInternalServerError, err
 	}
-	y := time.Unix(int64(v), 0)
 
-	if x.After(y) {
-		return queryArgs{}, errors.New("range is not valid")
+	message := fmt.Sprintf("%d row(s) returned (interval %ds)", len(qs.Count), int(args.interval.Seconds()))
+	data := qs.Serialize("", time.UTC, 2, serializeFlag)
+	if _, ok := s.meta.composite(key); !ok {
+		s.cache.put(k, version, message, data)
+	}
+	return message, data, http.StatusOK, nil
+}
+
+// query executes a query on key, x being a copy of its sequence. If exclude is true,
+// values recorded during maintenance windows of the key are ignored, as are values
+// outside args.hours if it is set.
+func (s *server) query(key string, x *sequence.Sequence, args queryArgs, exclude bool) (sequence.QuerySet, error) {
+	windows := s.meta.maintenanceWindows(key)
+	if args.hours == nil && (!exclude || len(windows) == 0) {
+		return x.Query(args.start, args.end, args.interval)
+	}
+	values, ts := s.values(key, x, args, exclude)
+	return aggregate(values, ts, int64(x.Frequency()), args), nil
+}
+
+// values returns the raw values of key, x being a copy of its sequence, using args
+// as time filter. If exclude is true, values recorded during maintenance windows of
+// the key are set to unknown, as are values outside args.hours if it is set. The
+// second return value is the Unix time associated to the first element of the slice.
+func (s *server) values(key string, x *sequence.Sequence, args queryArgs, exclude bool) ([]uint8, int64) {
+	values, ts, _ := x.Values(args.start, args.end)
+	if exclude {
+		for _, v := range s.meta.maintenanceWindows(key) {
+			maskValues(values, ts, int64(x.Frequency()), v.Start, v.End)
+		}
+	}
+	if args.hours != nil {
+		args.hours.mask(values, ts, int64(x.Frequency()))
+	}
+	return values, ts
+}
+
+func (s *server) handlerExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeResponse(w, http.StatusBadRequest, statusError, "error parsing request", nil)
+		return
+	}
+
+	var keys []string
+	for _, k := range r.Form["key"] {
+		if isSubtree(k) {
+			keys = append(keys, s.keys(k)...)
+			continue
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		writeResponse(w, http.StatusBadRequest, statusError, "missing key", nil)
+		return
+	}
+
+	var rows parquetRows
+	for _, key := range keys {
+		if err := r.Context().Err(); err != nil {
+			logf(r, "export stopped: %s", err)
+			writeContextError(w, err)
+			return
+		}
+		x, ok := s.get(key)
+		if !ok {
+			writeError(w, http.StatusNotFound, errorKeyNotFound, fmt.Sprintf("key %s does not exist", key))
+			return
+		}
+		args, err := newQueryArgs(r.FormValue("start"), r.FormValue("end"), int64(x.Frequency()))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errorInvalidRange, err.Error())
+			return
+		}
+		qs, err := x.Query(args.start, args.end, args.interval)
+		if err != nil {
+			writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+			logf(r, "error executing query: %s", err)
+			return
+		}
+		rows.append(key, qs.Timestamp, qs.Frequency, qs.Count, qs.Sum)
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apache.parquet")
+	w.Header().Set("Content-Disposition", `attachment; filename="export.parquet"`)
+	w.Write(rows.bytes())
+}
+
+// aggregate groups values, starting at Unix time ts and spaced by frequency
+// seconds, using args as time filter and grouping interval. It mimics
+// sequence.Query, allowing raw values to be altered before aggregation.
+func aggregate(values []uint8, ts, frequency int64, args queryArgs) sequence.QuerySet {
+	start, interval := args.start.Unix(), int64(args.interval.Seconds())
+	n := (args.end.Unix()-start)/interval + 1
+	qs := sequence.QuerySet{
+		Timestamp: start,
+		Frequency: interval,
+		Sum:       make([]int64, n),
+		Count:     make([]int64, n),
+	}
+	for i, v := range values {
+		t := ts + int64(i)*frequency
+		if v == sequence.StateUnknown || t < start || t > args.end.Unix() {
+			continue
+		}
+		j := (t - start) / interval
+		if v == sequence.StateActive {
+			qs.Sum[j]++
+		}
+		qs.Count[j]++
+	}
+	return qs
+}
+
+// maskValues sets values, starting at Unix time ts and spaced by frequency
+// seconds, to unknown within the closed interval defined by start and end.
+func maskValues(values []uint8, ts, frequency, start, end int64) {
+	for i := range values {
+		if t := ts + int64(i)*frequency; t >= start && t <= end {
+			values[i] = sequence.StateUnknown
+		}
+	}
+}
+
+type queryArgs struct {
+	start    time.Time
+	end      time.Time
+	interval time.Duration
+	hours    *schedule // values outside hours are ignored, if set
+}
+
+func newQueryArgs(start, end string, frequency int64) (queryArgs, error) {
+	x, y, err := parseRange(start, end, frequency)
+	if err != nil {
+		return queryArgs{}, err
 	}
 
 	scope := y.Unix() - x.Unix()
 
 	var aggregation int64
 	for _, v := range aggregations {
+		if v%frequency != 0 {
+			continue
+		}
 		if scope/v <= maxNumberOfPoints {
 			aggregation = v
 			break
@@ -293,12 +1444,34 @@ func newQueryArgs(start, end string) (queryArgs, error) {
 	}
 
 	if aggregation == 0 {
-		return queryArgs{}, errors.New("range is too large")
+		return queryArgs{}, rangeError("range is too large")
 	}
 
 	return queryArgs{start: x, end: y, interval: time.Duration(aggregation) * time.Second}, nil
 }
 
+// parseRange parses start and end as Unix times, start being rounded up to
+// a multiple of frequency.
+func parseRange(start, end string, frequency int64) (time.Time, time.Time, error) {
+	v, err := strconv.Atoi(start)
+	if err != nil {
+		return time.Time{}, time.Time{}, rangeError("error parsing start date")
+	}
+	x := time.Unix(ceilInt64(int64(v), frequency), 0)
+
+	v, err = strconv.Atoi(end)
+	if err != nil {
+		return time.Time{}, time.Time{}, rangeError("error parsing end date")
+	}
+	y := time.Unix(int64(v), 0)
+
+	if x.After(y) {
+		return time.Time{}, time.Time{}, rangeError("range is not valid")
+	}
+
+	return x, y, nil
+}
+
 func ceilInt64(x int64, step int64) int64 {
 	r := x % step
 	if r != 0 {
@@ -307,17 +1480,46 @@ func ceilInt64(x int64, step int64) int64 {
 	return x
 }
 
+// A response represents the JSON envelope of the responses of the API. Error holds
+// the error code of error responses. Data and annotations hold JSON encoded values
+// and are omitted when empty.
+type response struct {
+	Code        int             `json:"code"`
+	Status      string          `json:"status"`
+	Message     string          `json:"message"`
+	Error       string          `json:"error,omitempty"`
+	Data        json.RawMessage `json:"data,omitempty"`
+	Annotations json.RawMessage `json:"annotations,omitempty"`
+	RequestID   string          `json:"request_id,omitempty"`
+}
+
+// writeResponse writes a response made of the common fields and data, if not nil.
+// Error responses get the default error code of code.
 func writeResponse(w http.ResponseWriter, code int, status, message string, data []byte) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	if data == nil {
-		fmt.Fprintf(w, `{"code":%d,"status":"%s","message":"%s"}`, code, status, message)
-		return
+	x := response{Code: code, Status: status, Message: message, Data: data}
+	if status == statusError {
+		x.Error = errorCode(code)
+	}
+	writeEnvelope(w, x)
+}
+
+// writeEnvelope writes x using x.Code as status code. Responses other than ok
+// responses get the ID of the request, if any.
+func writeEnvelope(w http.ResponseWriter, x response) {
+	if x.Status != statusOK {
+		x.RequestID = w.Header().Get(requestIDHeader)
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(x); err != nil {
+		log.Printf("error serializing response: %s", err)
+		buf.Reset()
+		x = response{Code: http.StatusInternalServerError, Status: statusError, Message: "an unexpected error occurred", RequestID: w.Header().Get(requestIDHeader)}
+		enc.Encode(x)
 	}
-	prefix := fmt.Sprintf(`{"code":%d,"status":"%s","message":"%s","data":`, code, status, message)
-	var buf bytes.Buffer
-	buf.WriteString(prefix)
-	buf.Write(data)
-	buf.WriteByte('}')
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(x.Code)
 	w.Write(buf.Bytes())
 }
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+var validMaintenanceStatement = regexp.MustCompile(`^` + keyPattern + ` \d+ \d+$`)
+
+func (s *server) handlerMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.handlerMaintenanceList(w, r)
+	case http.MethodPost:
+		s.handlerMaintenanceAdd(w, r)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+func (s *server) handlerMaintenanceList(w http.ResponseWriter, r *http.Request) {
+	windows := s.meta.maintenanceWindows(r.FormValue("key"))
+	if windows == nil {
+		windows = []window{}
+	}
+	data, err := json.Marshal(windows)
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+		logf(r, "error serializing windows: %s", err)
+		return
+	}
+	writeResponse(w, http.StatusOK, statusOK, fmt.Sprintf("%d window(s) returned", len(windows)), data)
+}
+
+func (s *server) handlerMaintenanceAdd(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, statusError, "error reading request body", nil)
+		logf(r, "error reading request body: %s", err)
+		return
+	}
+
+	lines := bytes.Split(body, []byte("\n"))
+	if tooManyStatements(w, lines) {
+		return
+	}
+	rejected := newRejections(r, lines)
+
+	var n int
+	for i, line := range lines {
+		if reason := checkStatement(r, validMaintenanceStatement, line); reason != "" {
+			logf(r, "error parsing statement %d: %s", i+1, reason)
+			rejected.add(i, reason)
+			continue
+		}
+		fields := bytes.Fields(line)
+		start, err1 := strconv.ParseInt(string(fields[1]), 10, 64)
+		end, err2 := strconv.ParseInt(string(fields[2]), 10, 64)
+		if err1 != nil || err2 != nil {
+			logf(r, "error executing statement %d: timestamp out of range", i+1)
+			rejected.add(i, "timestamp out of range")
+			continue
+		}
+		if start > end {
+			logf(r, "error executing statement %d: range is not valid", i+1)
+			rejected.add(i, "range is not valid")
+			continue
+		}
+		s.meta.addMaintenanceWindow(string(fields[0]), window{Start: start, End: end})
+		s.cache.invalidate(string(fields[0]))
+		n++
+	}
+
+	status := statusOK
+	if n != len(lines) {
+		status = statusWarning
+	}
+
+	writeResponse(w, http.StatusOK, status, fmt.Sprintf("processed %d/%d statement(s)", n, len(lines)), rejected.data())
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// Memory budget of the sequences of each tenant in megabytes, set by
+// -memory-limit, and policy applied when it is exceeded, set by -memory-policy.
+var (
+	memoryLimit  int
+	memoryPolicy = memoryEvict
+)
+
+// Policies applied when the estimated memory used by the sequences of a tenant
+// exceeds the memory budget.
+const (
+	memoryEvict  = "evict"  // dump and delete the least recently queried keys
+	memoryRefuse = "refuse" // reject statements creating keys
+)
+
+// errMemoryLimit is the error of statements that would create a key while the
+// memory budget is exceeded.
+var errMemoryLimit = errors.New("memory limit exceeded")
+
+// validMemoryPolicy returns an error if policy is not a memory policy.
+func validMemoryPolicy(policy string) error {
+	switch policy {
+	case memoryEvict, memoryRefuse:
+		return nil
+	}
+	return fmt.Errorf("memory policy must be one of %s or %s", memoryEvict, memoryRefuse)
+}
+
+// touchQuery records the current time as last query of the series of key.
+func (s *server) touchQuery(key string) {
+	now := time.Now()
+	s.activityMu.Lock()
+	s.queried[seriesKey(key)] = now
+	s.activityMu.Unlock()
+}
+
+// seriesSizes returns the estimated number of bytes used by the sequences of each
+// series, as reported by /memory/, and their total.
+func (s *server) seriesSizes() (map[string]int, int) {
+	sizes := make(map[string]int)
+	var total int
+	for _, k := range s.store.Keys() {
+		if x, ok := s.store.Get(k); ok {
+			n := len(k) + len(x.Bytes()) + sequenceOverhead
+			sizes[seriesKey(k)] += n
+			total += n
+		}
+	}
+	return sizes, total
+}
+
+// enforceMemory applies the memory policy if the sequences of s exceed the memory
+// budget: keys are evicted, least recently queried first, until the budget is met,
+// or the creation of keys is rejected until it is met again.
+func (s *server) enforceMemory() {
+	limit := memoryLimit << 20
+	sizes, total := s.seriesSizes()
+	if total <= limit {
+		if s.memoryExceeded.Swap(false) {
+			log.Printf("memory usage back under the budget (%d bytes), accepting new keys", limit)
+		}
+		return
+	}
+	if memoryPolicy == memoryRefuse {
+		if !s.memoryExceeded.Swap(true) {
+			log.Printf("memory budget exceeded (%d/%d bytes), rejecting new keys", total, limit)
+		}
+		return
+	}
+
+	keys := make([]string, 0, len(sizes))
+	for k := range sizes {
+		keys = append(keys, k)
+	}
+	// keys never queried come first, the least recently inserted first
+	s.activityMu.Lock()
+	queried, inserted := make(map[string]time.Time), make(map[string]time.Time)
+	for _, k := range keys {
+		queried[k], inserted[k] = s.queried[k], s.activity[k]
+	}
+	s.activityMu.Unlock()
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if !queried[a].Equal(queried[b]) {
+			return queried[a].Before(queried[b])
+		}
+		if !inserted[a].Equal(inserted[b]) {
+			return inserted[a].Before(inserted[b])
+		}
+		return a < b
+	})
+	var n int
+	for total > limit && n < len(keys) {
+		total -= sizes[keys[n]]
+		n++
+	}
+
+	file, err := s.evict(keys[:n])
+	if err != nil {
+		log.Printf("error evicting keys: %s", err)
+		return
+	}
+	log.Printf("memory budget exceeded, evicting %d key(s) to file %s", n, file)
+	s.audit(nil, auditEvict, keys[:n], fmt.Sprintf("%d key(s) evicted to file %s", n, file))
+}
+
+// evict writes the sequences of keys to a dump file named after the dump file of s,
+// which can be loaded using /admin/restore, then deletes keys. It returns the name
+// of the file. Keys are kept if the file cannot be written.
+func (s *server) evict(keys []string) (string, error) {
+	file := tenantFile(s.dumpFile, fmt.Sprintf("evicted-%d", time.Now().Unix()))
+	// inserts are blocked so that no value is lost between the dump and deletions
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	store := sequence.NewStore()
+	for _, k := range keys {
+		for _, x := range sequenceKeys(k) {
+			if y, ok := s.store.Get(x); ok {
+				store.Add(x, y)
+			}
+		}
+	}
+	data, err := store.Dump()
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(file, data, 0660); err != nil {
+		return "", err
+	}
+	for _, k := range keys {
+		s.deleteKey(k)
+	}
+	return file, nil
+}
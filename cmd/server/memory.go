@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+	"unsafe"
+)
+
+// Approximations of the memory used by the structures holding a key on top of
+// their content: an entry of a map indexed by key, and a sequence including its
+// entry in the store.
+const (
+	mapEntryOverhead = 48
+	sequenceOverhead = 96
+)
+
+// keyMemory represents the estimated number of bytes used by a series: its
+// sequences (e.g. gauge planes), its metadata (maintenance windows, annotations
+// and last insert time) and its cached query results. Estimates do not include the
+// spare capacity of sequences, released by compacting the store.
+type keyMemory struct {
+	Key       string `json:"key"`
+	Sequences int    `json:"sequences"`
+	Metadata  int    `json:"metadata"`
+	Cache     int    `json:"cache"`
+	Total     int    `json:"total"`
+}
+
+func (s *server) handlerMemory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	pattern := r.FormValue("key")
+	if pattern == "" {
+		pattern = "*"
+	}
+	order := r.FormValue("sort")
+	if order != "" && order != "key" && order != "total" {
+		writeResponse(w, http.StatusBadRequest, statusError, "sort is not valid", nil)
+		return
+	}
+
+	meta := s.meta.keySizes()
+	cache := s.cache.keySizes()
+	s.activityMu.Lock()
+	for k := range s.activity {
+		meta[k] += len(k) + mapEntryOverhead + int(unsafe.Sizeof(time.Time{}))
+	}
+	s.activityMu.Unlock()
+
+	rows := []keyMemory{}
+	var total int
+	for _, k := range s.keys(pattern) {
+		m := keyMemory{Key: k, Metadata: meta[k]}
+		for _, x := range sequenceKeys(k) {
+			if y, ok := s.store.Get(x); ok {
+				m.Sequences += len(x) + len(y.Bytes()) + sequenceOverhead
+			}
+			m.Cache += cache[x]
+		}
+		m.Total = m.Sequences + m.Metadata + m.Cache
+		total += m.Total
+		rows = append(rows, m)
+	}
+	if order == "total" {
+		sort.SliceStable(rows, func(i, j int) bool { return rows[i].Total > rows[j].Total })
+	}
+
+	data, err := json.Marshal(rows)
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+		logf(r, "error serializing key memory usage: %s", err)
+		return
+	}
+	writeResponse(w, http.StatusOK, statusOK, fmt.Sprintf("%d key(s) returned, %d byte(s) estimated", len(rows), total), data)
+}
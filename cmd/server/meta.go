@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"unsafe"
+)
+
+// A window represents a closed time interval using Unix times.
+type window struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// An annotation represents a timestamped note attached to a key or, if key is
+// empty, to every key.
+type annotation struct {
+	Key  string `json:"key,omitempty"`
+	Time int64  `json:"time"`
+	Kind string `json:"kind"`
+	Text string `json:"text"`
+}
+
+// metadata holds information attached to keys that cannot be represented as
+// sequences. It is persisted as JSON alongside the store dump.
+type metadata struct {
+	mu          sync.RWMutex
+	Maintenance map[string][]window  `json:"maintenance"`
+	Annotations []annotation         `json:"annotations"`
+	Composites  map[string]string    `json:"composites"`
+	Dashboards  map[string]dashboard `json:"dashboards"`
+	Tombstones  map[string]tombstone `json:"tombstones"`
+}
+
+func newMetadata() *metadata {
+	return &metadata{Maintenance: make(map[string][]window), Composites: make(map[string]string), Dashboards: make(map[string]dashboard), Tombstones: make(map[string]tombstone)}
+}
+
+// load replaces the content of m using data, a JSON encoding of metadata.
+func (m *metadata) load(data []byte) error {
+	x, err := decodeMetadata(data)
+	if err != nil {
+		return err
+	}
+	m.replace(x)
+	return nil
+}
+
+// decodeMetadata returns the metadata encoded as JSON in data.
+func decodeMetadata(data []byte) (*metadata, error) {
+	x := newMetadata()
+	if err := json.Unmarshal(data, x); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// replace replaces the content of m using the content of x.
+func (m *metadata) replace(x *metadata) {
+	m.mu.Lock()
+	m.Maintenance = x.Maintenance
+	m.Annotations = x.Annotations
+	m.Composites = x.Composites
+	m.Dashboards = x.Dashboards
+	m.Tombstones = x.Tombstones
+	m.mu.Unlock()
+}
+
+// merge adds the content of x to m. Maintenance windows and annotations missing
+// from m are added, and composite keys, dashboards and tombstones are added unless
+// m holds an entry of the same name.
+func (m *metadata) merge(x *metadata) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k, v := range x.Maintenance {
+		windows := m.Maintenance[k]
+		for _, w := range v {
+			if !containsWindow(windows, w) {
+				windows = append(windows, w)
+			}
+		}
+		sort.Slice(windows, func(i, j int) bool { return windows[i].Start < windows[j].Start })
+		m.Maintenance[k] = windows
+	}
+	annotations := make(map[annotation]bool, len(m.Annotations))
+	for _, v := range m.Annotations {
+		annotations[v] = true
+	}
+	for _, v := range x.Annotations {
+		if !annotations[v] {
+			m.Annotations = append(m.Annotations, v)
+		}
+	}
+	sort.SliceStable(m.Annotations, func(i, j int) bool { return m.Annotations[i].Time < m.Annotations[j].Time })
+	for k, v := range x.Composites {
+		if _, ok := m.Composites[k]; !ok {
+			m.Composites[k] = v
+		}
+	}
+	for k, v := range x.Dashboards {
+		if _, ok := m.Dashboards[k]; !ok {
+			m.Dashboards[k] = v
+		}
+	}
+	for k, v := range x.Tombstones {
+		if _, ok := m.Tombstones[k]; !ok {
+			m.Tombstones[k] = v
+		}
+	}
+}
+
+// containsWindow reports whether windows holds x.
+func containsWindow(windows []window, x window) bool {
+	for _, v := range windows {
+		if v == x {
+			return true
+		}
+	}
+	return false
+}
+
+// bytes returns m encoded as JSON.
+func (m *metadata) bytes() ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return json.Marshal(m)
+}
+
+// addMaintenanceWindow adds a maintenance window to key, keeping windows sorted by
+// start time.
+func (m *metadata) addMaintenanceWindow(key string, x window) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	windows := append(m.Maintenance[key], x)
+	sort.Slice(windows, func(i, j int) bool { return windows[i].Start < windows[j].Start })
+	m.Maintenance[key] = windows
+}
+
+// maintenanceWindows returns a copy of the maintenance windows of key.
+func (m *metadata) maintenanceWindows(key string) []window {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]window(nil), m.Maintenance[key]...)
+}
+
+// deleteKey removes the metadata associated to key.
+func (m *metadata) deleteKey(key string) {
+	m.mu.Lock()
+	delete(m.Maintenance, key)
+	annotations := m.Annotations[:0]
+	for _, v := range m.Annotations {
+		if v.Key != key {
+			annotations = append(annotations, v)
+		}
+	}
+	m.Annotations = annotations
+	m.mu.Unlock()
+}
+
+// keySizes returns the approximate number of bytes used by the maintenance windows
+// and annotations of each key, global annotations being ignored.
+func (m *metadata) keySizes() map[string]int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	sizes := make(map[string]int)
+	for k, v := range m.Maintenance {
+		sizes[k] += len(k) + mapEntryOverhead + len(v)*int(unsafe.Sizeof(window{}))
+	}
+	for _, v := range m.Annotations {
+		if v.Key != "" {
+			sizes[v.Key] += int(unsafe.Sizeof(v)) + len(v.Key) + len(v.Kind) + len(v.Text)
+		}
+	}
+	return sizes
+}
+
+// addAnnotations adds annotations, keeping annotations sorted by time.
+func (m *metadata) addAnnotations(x ...annotation) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Annotations = append(m.Annotations, x...)
+	sort.SliceStable(m.Annotations, func(i, j int) bool { return m.Annotations[i].Time < m.Annotations[j].Time })
+}
+
+// annotations returns the annotations of key, including global annotations, within
+// the closed interval defined by start and end. If key is empty, annotations of all
+// keys are returned.
+func (m *metadata) annotations(key string, start, end int64) []annotation {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s := []annotation{}
+	for _, v := range m.Annotations {
+		if v.Time < start || v.Time > end {
+			continue
+		}
+		if key == "" || v.Key == "" || v.Key == key {
+			s = append(s, v)
+		}
+	}
+	return s
+}
+
+// composite returns the expression of the composite key.
+func (m *metadata) composite(key string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	x, ok := m.Composites[key]
+	return x, ok
+}
+
+// composites returns a copy of the composite keys definitions.
+func (m *metadata) composites() map[string]string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	x := make(map[string]string, len(m.Composites))
+	for k, v := range m.Composites {
+		x[k] = v
+	}
+	return x
+}
+
+// setComposite defines key as a composite key using expression.
+func (m *metadata) setComposite(key, expression string) {
+	m.mu.Lock()
+	m.Composites[key] = expression
+	m.mu.Unlock()
+}
+
+// deleteComposite removes the composite key.
+func (m *metadata) deleteComposite(key string) {
+	m.mu.Lock()
+	delete(m.Composites, key)
+	m.mu.Unlock()
+}
+
+// dashboard returns the dashboard name.
+func (m *metadata) dashboard(name string) (dashboard, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	x, ok := m.Dashboards[name]
+	return x, ok
+}
+
+// dashboards returns the dashboards sorted by name.
+func (m *metadata) dashboards() []dashboard {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	x := make([]dashboard, 0, len(m.Dashboards))
+	for _, v := range m.Dashboards {
+		x = append(x, v)
+	}
+	sort.Slice(x, func(i, j int) bool { return x[i].Name < x[j].Name })
+	return x
+}
+
+// setDashboard creates or replaces the dashboard named after x.
+func (m *metadata) setDashboard(x dashboard) {
+	m.mu.Lock()
+	m.Dashboards[x.Name] = x
+	m.mu.Unlock()
+}
+
+// deleteDashboard removes the dashboard name, reporting whether it existed.
+func (m *metadata) deleteDashboard(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.Dashboards[name]
+	delete(m.Dashboards, name)
+	return ok
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A middleware wraps the handler of requests, e.g. to reject them before they reach
+// the handler or to observe their responses.
+type middleware func(http.HandlerFunc) http.HandlerFunc
+
+// A chain is a sequence of middlewares, the first one being the outermost.
+type chain []middleware
+
+// then returns h wrapped by the middlewares of c.
+func (c chain) then(h http.HandlerFunc) http.HandlerFunc {
+	for i := len(c) - 1; i >= 0; i-- {
+		h = c[i](h)
+	}
+	return h
+}
+
+// with returns a copy of c followed by m.
+func (c chain) with(m ...middleware) chain {
+	return append(append(chain(nil), c...), m...)
+}
+
+// hooks return the middlewares wrapping every endpoint registered using handle,
+// outside of the middlewares of the endpoint, given its path. They are registered
+// using use, before routes are registered, by features applying to all endpoints
+// and by programs embedding the server.
+var hooks []func(path string) middleware
+
+// use registers a hook returning the middleware of the endpoint registered for
+// path, or nil to leave the endpoint unchanged.
+func use(hook func(path string) middleware) {
+	hooks = append(hooks, hook)
+}
+
+// endpointChain returns the hooked middlewares of the endpoint registered for path.
+func endpointChain(path string) chain {
+	var c chain
+	for _, hook := range hooks {
+		if m := hook(path); m != nil {
+			c = append(c, m)
+		}
+	}
+	return c
+}
+
+// timeout returns a middleware bounding the work of requests to d (see deadline).
+func timeout(d time.Duration) middleware {
+	return func(h http.HandlerFunc) http.HandlerFunc {
+		return deadline(d, h)
+	}
+}
+
+// A statusWriter records the status code and size of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	code  int
+	bytes int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// Flush implements http.Flusher, used by streamed responses.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying writer, used by http.ResponseController.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// observe returns a handler calling h and then fn with the status code of the
+// response, 200 if h wrote nothing, its size and the time spent handling the
+// request. The writer is only wrapped once per request, observers sharing it.
+func observe(h http.HandlerFunc, fn func(r *http.Request, code, size int, d time.Duration)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sw, ok := w.(*statusWriter)
+		if !ok {
+			sw = &statusWriter{ResponseWriter: w}
+		}
+		t := time.Now()
+		defer func() {
+			code := sw.code
+			if code == 0 {
+				code = http.StatusOK
+			}
+			fn(r, code, sw.bytes, time.Since(t))
+		}()
+		h(sw, r)
+	}
+}
+
+// logRequests is the hook logging a line per request (method, URI, status code, size
+// of the response, duration and client address), set by -log-requests.
+func logRequests(path string) middleware {
+	return func(h http.HandlerFunc) http.HandlerFunc {
+		return observe(h, func(r *http.Request, code, size int, d time.Duration) {
+			logf(r, "%s %s %d %d %s %s", r.Method, r.URL.RequestURI(), code, size, d.Round(time.Microsecond), clientAddr(r))
+		})
+	}
+}
+
+// requestCounts holds the number of requests and the time spent handling them by
+// endpoint and status code, exposed by /metrics.
+var requestCounts = struct {
+	sync.Mutex
+	m map[requestLabels]*requestCount
+}{m: make(map[requestLabels]*requestCount)}
+
+type requestLabels struct {
+	path string
+	code int
+}
+
+type requestCount struct {
+	n       uint64
+	seconds float64
+}
+
+// countRequests is the hook recording the number of requests of endpoints and the
+// time spent handling them.
+func countRequests(path string) middleware {
+	return func(h http.HandlerFunc) http.HandlerFunc {
+		return observe(h, func(r *http.Request, code, size int, d time.Duration) {
+			k := requestLabels{path, code}
+			requestCounts.Lock()
+			x, ok := requestCounts.m[k]
+			if !ok {
+				x = &requestCount{}
+				requestCounts.m[k] = x
+			}
+			x.n++
+			x.seconds += d.Seconds()
+			requestCounts.Unlock()
+		})
+	}
+}
+
+// writeRequestMetrics writes the request counts in the Prometheus text format.
+func writeRequestMetrics(b *strings.Builder) {
+	requestCounts.Lock()
+	labels := make([]requestLabels, 0, len(requestCounts.m))
+	counts := make(map[requestLabels]requestCount, len(requestCounts.m))
+	for k, v := range requestCounts.m {
+		labels = append(labels, k)
+		counts[k] = *v
+	}
+	requestCounts.Unlock()
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].path != labels[j].path {
+			return labels[i].path < labels[j].path
+		}
+		return labels[i].code < labels[j].code
+	})
+	b.WriteString("# HELP rl_http_requests_total Number of HTTP requests by endpoint and status code.\n# TYPE rl_http_requests_total counter\n")
+	for _, k := range labels {
+		fmt.Fprintf(b, "rl_http_requests_total{path=%q,code=\"%d\"} %d\n", k.path, k.code, counts[k].n)
+	}
+	b.WriteString("# HELP rl_http_request_duration_seconds Time spent handling HTTP requests by endpoint and status code.\n# TYPE rl_http_request_duration_seconds summary\n")
+	for _, k := range labels {
+		fmt.Fprintf(b, "rl_http_request_duration_seconds_sum{path=%q,code=\"%d\"} %g\n", k.path, k.code, counts[k].seconds)
+		fmt.Fprintf(b, "rl_http_request_duration_seconds_count{path=%q,code=\"%d\"} %d\n", k.path, k.code, counts[k].n)
+	}
+}
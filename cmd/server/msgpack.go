@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Subset of the MessagePack format used to encode query results: maps with string
+// keys, arrays, strings, integers, float64 and nil.
+
+// appendMsgpackMap appends the header of a map of n key / value pairs to b.
+func appendMsgpackMap(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xde), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, 0xdf), uint32(n))
+}
+
+// appendMsgpackArray appends the header of an array of n elements to b.
+func appendMsgpackArray(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xdc), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, 0xdd), uint32(n))
+}
+
+// appendMsgpackString appends s to b.
+func appendMsgpackString(b []byte, s string) []byte {
+	n := len(s)
+	switch {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+	}
+	return append(b, s...)
+}
+
+// appendMsgpackInt appends x to b using the smallest representation.
+func appendMsgpackInt(b []byte, x int64) []byte {
+	switch {
+	case x >= 0 && x < 128:
+		return append(b, byte(x))
+	case x < 0 && x >= -32:
+		return append(b, byte(x))
+	case x >= math.MinInt32 && x <= math.MaxInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(x))
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(x))
+}
+
+// appendMsgpackFloat appends x to b as a float64.
+func appendMsgpackFloat(b []byte, x float64) []byte {
+	return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(x))
+}
+
+// appendMsgpackNil appends nil to b.
+func appendMsgpackNil(b []byte) []byte {
+	return append(b, 0xc0)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+const (
+	maxStreamRecord   = 64 << 10
+	streamIdleTimeout = 5 * time.Minute
+)
+
+// A streamRecord is a statement of an NDJSON insert stream. Timestamp and Duration
+// are optional, as in the line protocol.
+type streamRecord struct {
+	Key       string `json:"key"`
+	State     *uint8 `json:"state"`
+	Timestamp int64  `json:"timestamp"`
+	Duration  int64  `json:"duration"`
+}
+
+// isNDJSON reports whether the body of r is newline-delimited JSON.
+func isNDJSON(r *http.Request) bool {
+	t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return t == "application/x-ndjson" || t == "application/ndjson"
+}
+
+// streamStatements returns the statements of the record b of r, expanded into one
+// statement per value if it has a duration, or the reason of its rejection.
+func (s *server) streamStatements(r *http.Request, b []byte, now time.Time) ([]sequence.Statement, string) {
+	var v streamRecord
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, "statement is not valid"
+	}
+	if reason := checkKey([]byte(v.Key)); reason != "" {
+		return nil, reason
+	}
+	if reason := checkTokenKey(r, []byte(v.Key)); reason != "" {
+		return nil, reason
+	}
+	if v.State == nil || *v.State > sequence.StateUnknown {
+		return nil, "state is not valid"
+	}
+	if v.Duration != 0 && v.Timestamp == 0 {
+		return nil, "duration requires a timestamp"
+	}
+
+	t, samples, frequency := now, 1, int64(sequenceFrequency)
+	if v.Timestamp != 0 {
+		if v.Duration != 0 {
+			var reason string
+			if samples, frequency, reason = s.statementSamples(v.Key, v.Duration); reason != "" {
+				return nil, reason
+			}
+		}
+		var ok bool
+		if t, ok = s.future(time.Unix(v.Timestamp, 0), now); ok {
+			samples, ok = s.futureSamples(t, samples, frequency, now)
+		}
+		if !ok {
+			return nil, "timestamp in the future"
+		}
+	}
+	statements := make([]sequence.Statement, samples)
+	for i := range statements {
+		statements[i] = sequence.Statement{
+			Key:                 v.Key,
+			Timestamp:           t.Add(time.Duration(int64(i)*frequency) * time.Second),
+			Value:               *v.State,
+			Type:                sequence.StatementAdd,
+			CreateIfNotExists:   true,
+			CreateWithTimestamp: t.Truncate(time.Duration(sequenceFrequency) * time.Second),
+			CreateWithFrequency: sequenceFrequency,
+		}
+	}
+	return statements, ""
+}
+
+// handlerInsertStream applies an NDJSON body, one record per line, as it is
+// received, so that agents can hold a request open and push records continuously.
+// Records received together are applied as a batch. The response is sent once
+// the client closes the request body.
+func (s *server) handlerInsertStream(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	// streams outlive the timeouts of the server, being closed when idle instead
+	rc.SetWriteDeadline(time.Time{})
+
+	// parameters are read from the URL, parsing the form would consume the body
+	query := r.URL.Query()
+	duplicates := &duplicateFilter{s: s, enabled: query.Get("duplicates") == "skip"}
+	verbose := query.Get("verbose") == "1"
+
+	var n, d, total, line int
+	rejected := []rejection{}
+	reject := func(i int, content []byte, reason string) {
+		logf(r, "error executing statement %d: %s", i, reason)
+		if !verbose || len(rejected) >= maxImportErrors {
+			return
+		}
+		if len(content) > maxRejectedContent {
+			content = content[:maxRejectedContent]
+		}
+		rejected = append(rejected, rejection{Line: i, Content: string(content), Reason: reason})
+	}
+
+	// records of the current batch, not applied yet
+	var statements []sequence.Statement
+	var mapping []int
+	contents := make(map[int][]byte)
+	var failure string
+	flush := func() bool {
+		if len(statements) == 0 {
+			return true
+		}
+		if s.draining.Load() {
+			failure = "server is draining"
+			return false
+		}
+		if err := s.waitIngest(r.Context(), len(statements)); err != nil {
+			failure = "request canceled"
+			return false
+		}
+		errs := s.insert(r, statements, duplicates)
+		lineOutcomes(mapping, errs, func(i int, err error) {
+			switch {
+			case err == errDuplicate:
+				d++
+			case err != nil:
+				reject(i, contents[i], err.Error())
+			default:
+				n++
+			}
+		})
+		s.audit(r, auditInsert, appliedKeys(statements, errs), fmt.Sprintf("NDJSON batch of %d statement(s)", len(mapping)))
+		statements, mapping = statements[:0], mapping[:0]
+		for k := range contents {
+			delete(contents, k)
+		}
+		return true
+	}
+
+	reader := bufio.NewReaderSize(r.Body, maxStreamRecord)
+	for {
+		rc.SetReadDeadline(time.Now().Add(streamIdleTimeout))
+		b, err := reader.ReadSlice('\n')
+		if len(b) > 0 {
+			line++
+		}
+		if err == bufio.ErrBufferFull {
+			total++
+			reject(line, b, "statement is too long")
+			for err == bufio.ErrBufferFull {
+				_, err = reader.ReadSlice('\n')
+			}
+			b = nil
+		}
+		// empty lines are ignored
+		if b = bytes.TrimSpace(b); len(b) > 0 {
+			total++
+			v, reason := s.streamStatements(r, b, time.Now())
+			if reason != "" {
+				reject(line, b, reason)
+			} else {
+				for range v {
+					mapping = append(mapping, line)
+				}
+				statements = append(statements, v...)
+				if verbose {
+					contents[line] = append([]byte(nil), b...)
+				}
+			}
+		}
+		if err == io.EOF {
+			flush()
+			break
+		}
+		if err != nil {
+			logf(r, "error reading request body: %s", err)
+			flush()
+			failure = "error reading request body"
+			break
+		}
+		if (reader.Buffered() == 0 || len(statements) >= importChunkSize) && !flush() {
+			break
+		}
+	}
+
+	status := statusOK
+	if n+d != total {
+		status = statusWarning
+	}
+	message := duplicates.message(n, d, total)
+	if failure != "" {
+		message += ", stream stopped: " + failure
+	}
+	data, _ := json.Marshal(rejected)
+	if !verbose {
+		data = nil
+	}
+	if failure != "" {
+		// the rest of the body is not read
+		w.Header().Set("Connection", "close")
+	}
+	if failure == "server is draining" {
+		writeResponse(w, http.StatusServiceUnavailable, statusError, message, data)
+		return
+	}
+	writeResponse(w, http.StatusOK, status, message, data)
+}
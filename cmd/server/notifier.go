@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Notifier types.
+const (
+	notifierSlack = "slack"
+	notifierEmail = "email"
+)
+
+const (
+	defaultNotifierTemplate = "[{{.Status}}] rule {{.Rule}}, key {{.Key}} at {{date .Time}}"
+	defaultNotifierSubject  = "[{{.Status}}] {{.Rule}} {{.Key}}"
+)
+
+var notifierFuncs = template.FuncMap{
+	"date": func(ts int64) string {
+		return time.Unix(ts, 0).UTC().Format(time.RFC3339)
+	},
+}
+
+// A notifierConfig defines a named notifier sending alert messages to a Slack
+// incoming webhook (URL) or by email using an SMTP server (Address, formatted as
+// host:port). Template and Subject are text/template templates executed with the
+// alert event, defaults being used if empty.
+type notifierConfig struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	URL      string   `json:"url"`
+	Address  string   `json:"address"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	Subject  string   `json:"subject"`
+	Template string   `json:"template"`
+}
+
+func (c notifierConfig) validate() error {
+	if c.Name == "" {
+		return errors.New("name is required")
+	}
+	switch c.Type {
+	case notifierSlack:
+		u, err := url.Parse(c.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("url is not valid")
+		}
+	case notifierEmail:
+		if _, _, err := net.SplitHostPort(c.Address); err != nil {
+			return errors.New("address is not valid")
+		}
+		if c.From == "" || len(c.To) == 0 {
+			return errors.New("from and to are required")
+		}
+	default:
+		return errors.New("type is not valid")
+	}
+	if _, err := c.templates(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// templates parses the message and subject templates of c.
+func (c notifierConfig) templates() ([2]*template.Template, error) {
+	var t [2]*template.Template
+	for i, v := range [2]string{c.Template, c.Subject} {
+		if v == "" {
+			v = [2]string{defaultNotifierTemplate, defaultNotifierSubject}[i]
+		}
+		x, err := template.New("").Funcs(notifierFuncs).Parse(v)
+		if err != nil {
+			return t, fmt.Errorf("error parsing template: %s", err)
+		}
+		t[i] = x
+	}
+	return t, nil
+}
+
+// A notifier renders alert events and delivers the resulting messages.
+type notifier struct {
+	config   notifierConfig
+	message  *template.Template
+	subject  *template.Template
+	queue    chan []byte
+	dispatch *dispatcher
+}
+
+func newNotifier(c notifierConfig, d *dispatcher) *notifier {
+	t, err := c.templates()
+	if err != nil {
+		// templates are validated when loading the configuration
+		log.Panic(err)
+	}
+	n := &notifier{config: c, message: t[0], subject: t[1], queue: make(chan []byte, notificationQueueSize), dispatch: d}
+	go deliver(c.Name, n.queue, n.send)
+	return n
+}
+
+// alert queues the message rendered from e.
+func (n *notifier) alert(e alertEvent) {
+	var b bytes.Buffer
+	if n.config.Type == notifierEmail {
+		var subject bytes.Buffer
+		if err := n.subject.Execute(&subject, e); err != nil {
+			log.Printf("error rendering notification for %s: %s", n.config.Name, err)
+			return
+		}
+		fmt.Fprintf(&b, "From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n",
+			n.config.From, strings.Join(n.config.To, ", "), strings.ReplaceAll(subject.String(), "\n", " "))
+	}
+	if err := n.message.Execute(&b, e); err != nil {
+		log.Printf("error rendering notification for %s: %s", n.config.Name, err)
+		return
+	}
+	select {
+	case n.queue <- b.Bytes():
+	default:
+		log.Printf("error queuing notification: queue of notifier %s is full", n.config.Name)
+	}
+}
+
+func (n *notifier) send(message []byte) error {
+	if n.config.Type == notifierSlack {
+		payload, err := json.Marshal(struct {
+			Text string `json:"text"`
+		}{string(message)})
+		if err != nil {
+			return err
+		}
+		return n.dispatch.post(n.config.URL, "application/json", payload)
+	}
+	var auth smtp.Auth
+	if n.config.Username != "" {
+		host, _, _ := net.SplitHostPort(n.config.Address)
+		auth = smtp.PlainAuth("", n.config.Username, n.config.Password, host)
+	}
+	return smtp.SendMail(n.config.Address, auth, n.config.From, n.config.To, message)
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpenID Connect options, set by -oidc-issuer, -oidc-client-id, -oidc-client-secret,
+// -oidc-redirect-url and -oidc-audience.
+var (
+	oidcIssuer       string
+	oidcClientID     string
+	oidcClientSecret string
+	oidcRedirectURL  string
+	oidcAudience     string
+)
+
+// oidcAuth is the OpenID Connect provider authenticating requests, nil if
+// -oidc-issuer is not set.
+var oidcAuth *oidcProvider
+
+// Cookies of the UI login: the session cookie holds the ID token of the user, the
+// login cookie the state of a login in progress.
+const (
+	sessionCookie = "rl_session"
+	loginCookie   = "rl_login"
+)
+
+// oidcScopes are the scopes requested when users log in to the UI.
+const oidcScopes = "openid profile email"
+
+// An oidcProvider validates the tokens issued by an OpenID Connect provider, the
+// bearer tokens of API requests and the ID tokens of UI sessions, and logs users in
+// to the UI using the authorization code flow if a client ID is set.
+type oidcProvider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	audience     string
+
+	authURL  string
+	tokenURL string
+	jwksURL  string
+	client   *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// newOIDCProvider returns the provider of issuer, reading its configuration and
+// keys. Bearer tokens must be issued for aud, or for clientID if aud is empty.
+func newOIDCProvider(issuer, clientID, clientSecret, redirectURL, aud string) (*oidcProvider, error) {
+	p := &oidcProvider{
+		issuer:       issuer,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		redirectURL:  redirectURL,
+		audience:     aud,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+	if p.audience == "" {
+		p.audience = clientID
+	}
+	if p.audience == "" {
+		return nil, errors.New("client ID or audience must be set")
+	}
+	var doc struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err := p.getJSON(strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", &doc); err != nil {
+		return nil, fmt.Errorf("error reading provider configuration: %s", err)
+	}
+	if doc.Issuer != issuer {
+		return nil, fmt.Errorf("issuer %s does not match the issuer of the provider configuration (%s)", issuer, doc.Issuer)
+	}
+	if doc.JWKSURI == "" || (clientID != "" && (doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "")) {
+		return nil, errors.New("provider configuration is missing endpoints")
+	}
+	p.authURL, p.tokenURL, p.jwksURL = doc.AuthorizationEndpoint, doc.TokenEndpoint, doc.JWKSURI
+	if err := p.refreshKeys(); err != nil {
+		return nil, fmt.Errorf("error reading provider keys: %s", err)
+	}
+	return p, nil
+}
+
+// getJSON decodes the JSON response to a GET request to u into v.
+func (p *oidcProvider) getJSON(u string, v any) error {
+	resp, err := p.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d from %s", resp.StatusCode, u)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// refreshKeys reads the signing keys of the provider, keys of unsupported types
+// being ignored. The caller must hold p.mu once p is in use.
+func (p *oidcProvider) refreshKeys() error {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := p.getJSON(p.jwksURL, &set); err != nil {
+		return err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key, err := k.publicKey(); err == nil {
+			keys[k.KeyID] = key
+		}
+	}
+	if len(keys) == 0 {
+		return errors.New("no supported signing key")
+	}
+	p.keys, p.fetched = keys, time.Now()
+	return nil
+}
+
+// key returns the signing key kid. Keys are read again, at most once a minute, if
+// kid is unknown, so that rotated keys are picked up.
+func (p *oidcProvider) key(kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	if time.Since(p.fetched) >= time.Minute {
+		if err := p.refreshKeys(); err != nil {
+			log.Printf("error reading provider keys: %s", err)
+		} else if k, ok := p.keys[kid]; ok {
+			return k, nil
+		}
+	}
+	return nil, fmt.Errorf("token key %q is unknown", kid)
+}
+
+// verify returns the claims of token, a token issued by the provider for aud, or
+// an error if it is not valid.
+func (p *oidcProvider) verify(token, aud string) (claims, error) {
+	var c claims
+	h, signed, payload, sig, err := parseJWT(token)
+	if err != nil {
+		return c, err
+	}
+	key, err := p.key(h.KeyID)
+	if err != nil {
+		return c, err
+	}
+	if err := verifySignature(h.Algorithm, key, signed, sig); err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return c, errTokenMalformed
+	}
+	if err := c.readPrefixes(payload); err != nil {
+		return c, err
+	}
+	if c.Issuer != p.issuer {
+		return c, fmt.Errorf("token issuer %s is not valid", c.Issuer)
+	}
+	if !c.Audience.contains(aud) {
+		return c, errors.New("token audience is not valid")
+	}
+	return c, c.validAt(time.Now())
+}
+
+// authenticate returns the claims of the bearer token of r or, without bearer
+// token, of the ID token of its UI session.
+func (p *oidcProvider) authenticate(r *http.Request) (claims, error) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return p.verify(token, p.audience)
+	}
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || p.clientID == "" {
+		return claims{}, errors.New("request has no token")
+	}
+	c, err := p.verify(cookie.Value, p.clientID)
+	c.Session = true
+	return c, err
+}
+
+// login reports whether users log in to the UI using the provider.
+func (p *oidcProvider) login() bool {
+	return p.clientID != "" && !disabledPaths["/auth/login"]
+}
+
+// routes registers the login endpoints of the UI on mux.
+func (p *oidcProvider) routes(mux *http.ServeMux) {
+	handle(mux, "/auth/login", p.handlerLogin)
+	handle(mux, "/auth/callback", p.handlerCallback)
+	handle(mux, "/auth/logout", p.handlerLogout)
+}
+
+// callbackURL returns the URL the provider redirects users to once logged in: the
+// redirect URL if set, or the callback endpoint on the host of r.
+func (p *oidcProvider) callbackURL(r *http.Request) string {
+	if p.redirectURL != "" {
+		return p.redirectURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + "/auth/callback"
+}
+
+// localPath reports whether v is a path on the server, so that users are not
+// redirected to other sites once logged in.
+func localPath(v string) bool {
+	return strings.HasPrefix(v, "/") && !strings.HasPrefix(v, "//") && !strings.HasPrefix(v, "/\\")
+}
+
+// randomString returns n random bytes encoded as base64url.
+func randomString(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// setCookie sets a cookie of the UI login, only sent by browsers over HTTPS if r is
+// an HTTPS request. A negative maxAge deletes the cookie.
+func setCookie(w http.ResponseWriter, r *http.Request, name, value, path string, expires time.Time, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Expires:  expires,
+		MaxAge:   maxAge,
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// handlerLogin redirects users to the provider, the state of the login (state,
+// nonce, PKCE verifier and page to return to) being kept in the login cookie.
+func (p *oidcProvider) handlerLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	next := r.FormValue("next")
+	if !localPath(next) {
+		next = "/"
+	}
+	state := url.Values{
+		"state":    {randomString(16)},
+		"nonce":    {randomString(16)},
+		"verifier": {randomString(32)},
+		"next":     {next},
+	}
+	setCookie(w, r, loginCookie, base64.RawURLEncoding.EncodeToString([]byte(state.Encode())), "/auth/", time.Time{}, 600)
+
+	challenge := sha256.Sum256([]byte(state.Get("verifier")))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.clientID},
+		"redirect_uri":          {p.callbackURL(r)},
+		"scope":                 {oidcScopes},
+		"state":                 {state.Get("state")},
+		"nonce":                 {state.Get("nonce")},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(p.authURL, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, p.authURL+sep+q.Encode(), http.StatusFound)
+}
+
+// handlerCallback exchanges the authorization code returned by the provider for an
+// ID token, stored in the session cookie, and redirects users to the page they
+// requested.
+func (p *oidcProvider) handlerCallback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	if v := r.FormValue("error"); v != "" {
+		writeError(w, http.StatusUnauthorized, errorUnauthorized, "login failed: "+v)
+		return
+	}
+	var state url.Values
+	if cookie, err := r.Cookie(loginCookie); err == nil {
+		if b, err := base64.RawURLEncoding.DecodeString(cookie.Value); err == nil {
+			state, _ = url.ParseQuery(string(b))
+		}
+	}
+	if state.Get("state") == "" || subtle.ConstantTimeCompare([]byte(state.Get("state")), []byte(r.FormValue("state"))) != 1 {
+		writeError(w, http.StatusBadRequest, errorInvalidRequest, "login state is not valid")
+		return
+	}
+	setCookie(w, r, loginCookie, "", "/auth/", time.Time{}, -1)
+
+	token, err := p.exchange(r, r.FormValue("code"), state.Get("verifier"))
+	if err != nil {
+		writeError(w, http.StatusBadGateway, errorBadGateway, "error exchanging authorization code")
+		logf(r, "error exchanging authorization code: %s", err)
+		return
+	}
+	c, err := p.verify(token, p.clientID)
+	if err == nil && subtle.ConstantTimeCompare([]byte(c.Nonce), []byte(state.Get("nonce"))) != 1 {
+		err = errors.New("token nonce is not valid")
+	}
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, errorUnauthorized, "ID token is not valid")
+		logf(r, "error verifying ID token: %s", err)
+		return
+	}
+	setCookie(w, r, sessionCookie, token, "/", time.Unix(c.Expiry, 0), 0)
+	logf(r, "login of %s", c.identity())
+	http.Redirect(w, r, state.Get("next"), http.StatusSeeOther)
+}
+
+// exchange returns the ID token the provider grants in exchange for code.
+func (p *oidcProvider) exchange(r *http.Request, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.callbackURL(r)},
+		"client_id":     {p.clientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, p.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var x struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&x); err != nil {
+		return "", fmt.Errorf("unexpected response (status code %d)", resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK || x.IDToken == "" {
+		return "", fmt.Errorf("status code %d: %s %s", resp.StatusCode, x.Error, x.ErrorDescription)
+	}
+	return x.IDToken, nil
+}
+
+// handlerLogout deletes the session cookie. Users are still logged in to the
+// provider.
+func (p *oidcProvider) handlerLogout(w http.ResponseWriter, r *http.Request) {
+	setCookie(w, r, sessionCookie, "", "/", time.Time{}, -1)
+	writeResponse(w, http.StatusOK, statusOK, "logged out", nil)
+}
+
+// identity returns the identity of the user holding c, as recorded in the audit log.
+func (c claims) identity() string {
+	return "oidc:" + c.Subject
+}
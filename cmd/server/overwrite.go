@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+var validOverwriteStatement = regexp.MustCompile(`^` + keyPattern + ` [012] \d+ \d+$`)
+
+// errNoOverlap is returned when a range does not overlap the values of a key.
+var errNoOverlap = errors.New("range does not overlap the values of key")
+
+// fillRange sets the values of the sequence of key within the closed interval
+// defined by start and end, Unix times, to state, and returns the number of values
+// set. Values beyond the last value of the sequence are not created.
+func (s *server) fillRange(key string, state uint8, start, end int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	x, ok := s.store.Get(key)
+	if !ok {
+		return 0, errKeyNotFound
+	}
+	frequency := int64(x.Frequency())
+	values := x.All()
+	var n int
+	for i := range values {
+		if t := x.Timestamp() + int64(i)*frequency; t >= start && t <= end {
+			values[i] = state
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, errNoOverlap
+	}
+	// sent while locked so that the standby receives later statements afterwards
+	s.replicator.send(replicationMessage{Sequences: map[string][]byte{key: s.replaceValues(key, x, x.Timestamp(), values)}})
+	return n, nil
+}
+
+// clearRange removes the values of the series key within the half-open interval
+// defined by start and end, Unix times, and returns the largest number of values
+// removed from one of its sequences (e.g. gauge planes). Values at the start or at
+// the end of a sequence are trimmed, so that inserts can set them again, and other
+// values are set to unknown.
+func (s *server) clearRange(key string, start, end int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var found bool
+	var n int
+	sequences := make(map[string][]byte)
+	for _, k := range sequenceKeys(key) {
+		x, ok := s.store.Get(k)
+		if !ok {
+			continue
+		}
+		found = true
+		frequency := int64(x.Frequency())
+		values := x.All()
+		first, last := -1, -1 // indexes of the first and last values of the range
+		for i := range values {
+			if t := x.Timestamp() + int64(i)*frequency; t >= start && t < end {
+				if first == -1 {
+					first = i
+				}
+				last = i
+			}
+		}
+		if first == -1 {
+			continue
+		}
+		if last-first+1 > n {
+			n = last - first + 1
+		}
+		ts := x.Timestamp()
+		switch {
+		case last == len(values)-1:
+			values = values[:first]
+		case first == 0:
+			values = values[last+1:]
+			ts += int64(last+1) * frequency
+		default:
+			for i := first; i <= last; i++ {
+				values[i] = sequence.StateUnknown
+			}
+		}
+		sequences[k] = s.replaceValues(k, x, ts, values)
+	}
+	if !found {
+		return 0, errKeyNotFound
+	}
+	if len(sequences) > 0 {
+		// sent while locked so that the standby receives later statements afterwards
+		s.replicator.send(replicationMessage{Sequences: sequences})
+	}
+	return n, nil
+}
+
+// replaceValues replaces the sequence x of key by a sequence of values starting at
+// Unix time ts, keeping the frequency and length of x, and returns its encoding.
+// s.mu must be held for writing.
+func (s *server) replaceValues(key string, x *sequence.Sequence, ts int64, values []uint8) []byte {
+	y := sequence.NewWithValues(time.Unix(ts, 0), x.Frequency(), values)
+	if length := x.Length(); length > 0 {
+		y.SetLength(length)
+	}
+	s.store.Add(key, y)
+	s.cache.invalidate(seriesKey(key))
+	return y.Bytes()
+}
+
+func (s *server) handlerOverwrite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, statusError, "error reading request body", nil)
+		logf(r, "error reading request body: %s", err)
+		return
+	}
+
+	lines := bytes.Split(body, []byte("\n"))
+	if tooManyStatements(w, lines) {
+		return
+	}
+	rejected := newRejections(r, lines)
+
+	var n, values int
+	var keys []string
+	for i, line := range lines {
+		if reason := checkStatement(r, validOverwriteStatement, line); reason != "" {
+			logf(r, "error parsing statement %d: %s", i+1, reason)
+			rejected.add(i, reason)
+			continue
+		}
+		fields := bytes.Fields(line)
+		key := string(fields[0])
+		start, err1 := strconv.ParseInt(string(fields[2]), 10, 64)
+		end, err2 := strconv.ParseInt(string(fields[3]), 10, 64)
+		if err1 != nil || err2 != nil {
+			logf(r, "error executing statement %d: timestamp out of range", i+1)
+			rejected.add(i, "timestamp out of range")
+			continue
+		}
+		if start > end {
+			logf(r, "error executing statement %d: range is not valid", i+1)
+			rejected.add(i, "range is not valid")
+			continue
+		}
+		x, err := s.fillRange(key, fields[1][0]-'0', start, end)
+		if err != nil {
+			logf(r, "error executing statement %d: %s", i+1, err)
+			rejected.add(i, err.Error())
+			continue
+		}
+		keys = append(keys, key)
+		values += x
+		n++
+	}
+
+	status := statusOK
+	if n != len(lines) {
+		status = statusWarning
+	}
+
+	message := fmt.Sprintf("processed %d/%d statement(s)", n, len(lines))
+	s.audit(r, auditOverwrite, seriesNames(keys), fmt.Sprintf("%s, %d value(s) overwritten", message, values))
+	writeResponse(w, http.StatusOK, status, message, rejected.data())
+}
+
+// handlerDeleteRange removes the values of the keys matching pattern within the
+// half-open interval defined by the start and end parameters.
+func (s *server) handlerDeleteRange(w http.ResponseWriter, r *http.Request, pattern string) {
+	start, err := strconv.ParseInt(r.FormValue("start"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorInvalidRange, "error parsing start date")
+		return
+	}
+	end, err := strconv.ParseInt(r.FormValue("end"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorInvalidRange, "error parsing end date")
+		return
+	}
+	if start >= end {
+		writeError(w, http.StatusBadRequest, errorInvalidRange, "range is not valid")
+		return
+	}
+
+	keys := s.keys(pattern)
+	if len(keys) == 0 && !isSubtree(pattern) {
+		writeError(w, http.StatusNotFound, errorKeyNotFound, errKeyNotFound.Error())
+		return
+	}
+	var n int
+	var affected []string
+	for _, k := range keys {
+		x, err := s.clearRange(k, start, end)
+		if err != nil {
+			// deleted since keys were listed
+			continue
+		}
+		if x > 0 {
+			affected = append(affected, k)
+			n += x
+		}
+	}
+
+	message := fmt.Sprintf("%d value(s) deleted from %d key(s)", n, len(affected))
+	s.audit(r, auditDeleteRange, affected, message)
+	data, _ := json.Marshal(deletion{Keys: len(affected), Values: n})
+	writeResponse(w, http.StatusOK, statusOK, message, data)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+// Subset of the Apache Parquet format used to export aggregated query results.
+// Files hold a single row group with one uncompressed PLAIN encoded data page per
+// column. Metadata structures are encoded using the Thrift compact protocol.
+const (
+	parquetMagic = "PAR1"
+
+	parquetTypeInt64     = 2
+	parquetTypeDouble    = 5
+	parquetTypeByteArray = 6
+
+	parquetRepetitionRequired = 0
+	parquetRepetitionOptional = 1
+
+	parquetConvertedUTF8            = 0
+	parquetConvertedTimestampMillis = 9
+
+	parquetEncodingPlain = 0
+	parquetEncodingRLE   = 3
+
+	thriftTypeI32    = 5
+	thriftTypeI64    = 6
+	thriftTypeBinary = 8
+	thriftTypeList   = 9
+	thriftTypeStruct = 12
+)
+
+// parquetRows holds aggregated query results as columns, one row per key and group.
+type parquetRows struct {
+	key   []string
+	date  []int64
+	count []int64
+	sum   []int64
+	mean  []float64
+	valid []bool
+}
+
+// append adds the groups of a query result to the rows using key as identifier.
+func (p *parquetRows) append(key string, ts, frequency int64, count, sum []int64) {
+	for i := range count {
+		p.key = append(p.key, key)
+		p.date = append(p.date, (ts+int64(i)*frequency)*1000)
+		p.count = append(p.count, count[i])
+		p.sum = append(p.sum, sum[i])
+		if count[i] == 0 {
+			p.mean = append(p.mean, 0)
+			p.valid = append(p.valid, false)
+			continue
+		}
+		p.mean = append(p.mean, float64(sum[i])/float64(count[i]))
+		p.valid = append(p.valid, true)
+	}
+}
+
+// parquetColumn represents a column definition and its PLAIN encoded values.
+type parquetColumn struct {
+	name       string
+	typ        int32
+	converted  int32
+	repetition int32
+	values     []byte
+	levels     []bool
+}
+
+// bytes returns the rows encoded as a Parquet file.
+func (p *parquetRows) bytes() []byte {
+	n := len(p.key)
+	columns := []parquetColumn{
+		{name: "key", typ: parquetTypeByteArray, converted: parquetConvertedUTF8},
+		{name: "date", typ: parquetTypeInt64, converted: parquetConvertedTimestampMillis},
+		{name: "count", typ: parquetTypeInt64, converted: -1},
+		{name: "sum", typ: parquetTypeInt64, converted: -1},
+		{name: "mean", typ: parquetTypeDouble, converted: -1, repetition: parquetRepetitionOptional, levels: p.valid},
+	}
+	for i := 0; i < n; i++ {
+		columns[0].values = binary.LittleEndian.AppendUint32(columns[0].values, uint32(len(p.key[i])))
+		columns[0].values = append(columns[0].values, p.key[i]...)
+		columns[1].values = binary.LittleEndian.AppendUint64(columns[1].values, uint64(p.date[i]))
+		columns[2].values = binary.LittleEndian.AppendUint64(columns[2].values, uint64(p.count[i]))
+		columns[3].values = binary.LittleEndian.AppendUint64(columns[3].values, uint64(p.sum[i]))
+		if p.valid[i] {
+			columns[4].values = binary.LittleEndian.AppendUint64(columns[4].values, math.Float64bits(p.mean[i]))
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(parquetMagic)
+
+	offsets := make([]int64, len(columns))
+	sizes := make([]int64, len(columns))
+	for i, c := range columns {
+		page := c.values
+		if c.repetition == parquetRepetitionOptional {
+			levels := encodeDefinitionLevels(c.levels)
+			page = binary.LittleEndian.AppendUint32(nil, uint32(len(levels)))
+			page = append(page, levels...)
+			page = append(page, c.values...)
+		}
+		var t thriftWriter
+		t.i32(1, 0)
+		t.i32(2, int32(len(page)))
+		t.i32(3, int32(len(page)))
+		t.structBegin(5)
+		t.i32(1, int32(n))
+		t.i32(2, parquetEncodingPlain)
+		t.i32(3, parquetEncodingRLE)
+		t.i32(4, parquetEncodingRLE)
+		t.structEnd()
+		t.stop()
+		offsets[i] = int64(buf.Len())
+		sizes[i] = int64(t.buf.Len() + len(page))
+		buf.Write(t.buf.Bytes())
+		buf.Write(page)
+	}
+
+	var t thriftWriter
+	t.i32(1, 1)
+	t.listBegin(2, thriftTypeStruct, len(columns)+1)
+	t.elemBegin()
+	t.binary(4, []byte("schema"))
+	t.i32(5, int32(len(columns)))
+	t.elemEnd()
+	for _, c := range columns {
+		t.elemBegin()
+		t.i32(1, c.typ)
+		t.i32(3, c.repetition)
+		t.binary(4, []byte(c.name))
+		if c.converted >= 0 {
+			t.i32(6, c.converted)
+		}
+		t.elemEnd()
+	}
+	t.i64(3, int64(n))
+	t.listBegin(4, thriftTypeStruct, 1)
+	t.elemBegin()
+	t.listBegin(1, thriftTypeStruct, len(columns))
+	var total int64
+	for i, c := range columns {
+		t.elemBegin()
+		t.i64(2, offsets[i])
+		t.structBegin(3)
+		t.i32(1, c.typ)
+		t.listBegin(2, thriftTypeI32, 2)
+		t.varint(parquetEncodingPlain)
+		t.varint(parquetEncodingRLE)
+		t.listBegin(3, thriftTypeBinary, 1)
+		t.bytes([]byte(c.name))
+		t.i32(4, 0)
+		t.i64(5, int64(n))
+		t.i64(6, sizes[i])
+		t.i64(7, sizes[i])
+		t.i64(9, offsets[i])
+		t.structEnd()
+		t.elemEnd()
+		total += sizes[i]
+	}
+	t.i64(2, total)
+	t.i64(3, int64(n))
+	t.elemEnd()
+	t.binary(6, []byte("run-length-example"))
+	t.stop()
+
+	buf.Write(t.buf.Bytes())
+	buf.Write(binary.LittleEndian.AppendUint32(nil, uint32(t.buf.Len())))
+	buf.WriteString(parquetMagic)
+	return buf.Bytes()
+}
+
+// encodeDefinitionLevels encodes levels using the RLE / bit-packing hybrid encoding
+// with a bit width of 1, only relying on RLE runs.
+func encodeDefinitionLevels(levels []bool) []byte {
+	var buf []byte
+	for i := 0; i < len(levels); {
+		j := i + 1
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		buf = binary.AppendUvarint(buf, uint64(j-i)<<1)
+		if levels[i] {
+			buf = append(buf, 1)
+		} else {
+			buf = append(buf, 0)
+		}
+		i = j
+	}
+	return buf
+}
+
+// A thriftWriter encodes structures using the Thrift compact protocol.
+type thriftWriter struct {
+	buf   bytes.Buffer
+	last  int16
+	stack []int16
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	if delta := id - t.last; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.varint(int64(id))
+	}
+	t.last = id
+}
+
+func (t *thriftWriter) varint(x int64) {
+	t.buf.Write(binary.AppendUvarint(nil, uint64((x<<1)^(x>>63))))
+}
+
+func (t *thriftWriter) bytes(x []byte) {
+	t.buf.Write(binary.AppendUvarint(nil, uint64(len(x))))
+	t.buf.Write(x)
+}
+
+func (t *thriftWriter) i32(id int16, x int32) {
+	t.field(id, thriftTypeI32)
+	t.varint(int64(x))
+}
+
+func (t *thriftWriter) i64(id int16, x int64) {
+	t.field(id, thriftTypeI64)
+	t.varint(x)
+}
+
+func (t *thriftWriter) binary(id int16, x []byte) {
+	t.field(id, thriftTypeBinary)
+	t.bytes(x)
+}
+
+func (t *thriftWriter) listBegin(id int16, typ byte, n int) {
+	t.field(id, thriftTypeList)
+	if n < 15 {
+		t.buf.WriteByte(byte(n)<<4 | typ)
+		return
+	}
+	t.buf.WriteByte(0xf0 | typ)
+	t.buf.Write(binary.AppendUvarint(nil, uint64(n)))
+}
+
+func (t *thriftWriter) structBegin(id int16) {
+	t.field(id, thriftTypeStruct)
+	t.elemBegin()
+}
+
+func (t *thriftWriter) structEnd() {
+	t.elemEnd()
+}
+
+// elemBegin starts a structure without field header, as found in lists.
+func (t *thriftWriter) elemBegin() {
+	t.stack = append(t.stack, t.last)
+	t.last = 0
+}
+
+func (t *thriftWriter) elemEnd() {
+	t.stop()
+	t.last = t.stack[len(t.stack)-1]
+	t.stack = t.stack[:len(t.stack)-1]
+}
+
+func (t *thriftWriter) stop() {
+	t.buf.WriteByte(0)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeDefinitionLevels(t *testing.T) {
+	tests := []struct {
+		name   string
+		levels []bool
+		want   []byte
+	}{
+		{"empty", nil, nil},
+		{"single run", []bool{true, true, true}, []byte{6, 1}},
+		{"alternating runs", []bool{false, true, true, false}, []byte{2, 0, 4, 1, 2, 0}},
+		{"long run", make([]bool, 100), []byte{0xc8, 0x01, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := encodeDefinitionLevels(tt.levels); !bytes.Equal(got, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestThriftWriter(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(*thriftWriter)
+		want  []byte
+	}{
+		{"short field deltas", func(t *thriftWriter) { t.i32(1, 1); t.i32(3, -1) }, []byte{0x15, 0x02, 0x25, 0x01}},
+		{"long field delta", func(t *thriftWriter) { t.i64(20, 300) }, []byte{0x06, 0x28, 0xd8, 0x04}},
+		{"binary", func(t *thriftWriter) { t.binary(1, []byte("ab")) }, []byte{0x18, 0x02, 'a', 'b'}},
+		{"short list", func(t *thriftWriter) { t.listBegin(1, thriftTypeI32, 2) }, []byte{0x19, 0x25}},
+		{"long list", func(t *thriftWriter) { t.listBegin(1, thriftTypeI32, 20) }, []byte{0x19, 0xf5, 0x14}},
+		{"nested struct", func(t *thriftWriter) {
+			t.i32(1, 0)
+			t.structBegin(5)
+			t.i32(1, 0)
+			t.structEnd()
+			t.i32(6, 0)
+			t.stop()
+		}, []byte{0x15, 0x00, 0x4c, 0x15, 0x00, 0x00, 0x15, 0x00, 0x00}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var w thriftWriter
+			tt.write(&w)
+			if got := w.buf.Bytes(); !bytes.Equal(got, tt.want) {
+				t.Fatalf("expected % x, got % x", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParquetRows(t *testing.T) {
+	var p parquetRows
+	p.append("eu.web", 1692316800, 3600, []int64{4, 0}, []int64{3, 0})
+	p.append("us.web", 1692316800, 3600, []int64{2}, []int64{2})
+
+	want := parquetRows{
+		key:   []string{"eu.web", "eu.web", "us.web"},
+		date:  []int64{1692316800000, 1692320400000, 1692316800000},
+		count: []int64{4, 0, 2},
+		sum:   []int64{3, 0, 2},
+		mean:  []float64{0.75, 0, 1},
+		valid: []bool{true, false, true},
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Fatalf("expected %+v, got %+v", want, p)
+	}
+
+	b := p.bytes()
+	if !bytes.HasPrefix(b, []byte(parquetMagic)) || !bytes.HasSuffix(b, []byte(parquetMagic)) {
+		t.Fatal("expected file to start and end with the magic number")
+	}
+	size := int(binary.LittleEndian.Uint32(b[len(b)-8:]))
+	if size <= 0 || size > len(b)-12 {
+		t.Fatalf("footer size %d is out of range", size)
+	}
+	footer := b[len(b)-8-size : len(b)-8]
+	for _, v := range []string{"schema", "key", "date", "count", "sum", "mean", "run-length-example"} {
+		if !bytes.Contains(footer, []byte(v)) {
+			t.Errorf("expected footer to hold %q", v)
+		}
+	}
+
+	// the mean column is optional, null values having no value in its page
+	levels := encodeDefinitionLevels(p.valid)
+	mean := binary.LittleEndian.AppendUint32(nil, uint32(len(levels)))
+	mean = append(mean, levels...)
+	mean = binary.LittleEndian.AppendUint64(mean, math.Float64bits(0.75))
+	mean = binary.LittleEndian.AppendUint64(mean, math.Float64bits(1))
+	if !bytes.Contains(b, mean) {
+		t.Error("expected the page of the mean column to hold definition levels and non-null values")
+	}
+	var keys []byte
+	for _, v := range p.key {
+		keys = binary.LittleEndian.AppendUint32(keys, uint32(len(v)))
+		keys = append(keys, v...)
+	}
+	if !bytes.Contains(b, keys) {
+		t.Error("expected the page of the key column to hold the length prefixed keys")
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// maxPooledBufferSize and maxPooledStatements bound the capacity of the buffers
+// and statement slices returned to their pool, so that a few large requests do not
+// keep memory allocated.
+const (
+	maxPooledBufferSize = 1 << 20
+	maxPooledStatements = 1 << 14
+)
+
+var bufferPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// getBuffer returns an empty buffer from the pool.
+func getBuffer() *bytes.Buffer {
+	b := bufferPool.Get().(*bytes.Buffer)
+	b.Reset()
+	return b
+}
+
+// putBuffer returns b to the pool. b must not be used afterwards.
+func putBuffer(b *bytes.Buffer) {
+	if b.Cap() <= maxPooledBufferSize {
+		bufferPool.Put(b)
+	}
+}
+
+// readBody reads the body of a request into a buffer from the pool, to be returned
+// using putBuffer once the content of the body is no longer referenced.
+func readBody(r io.Reader) (*bytes.Buffer, error) {
+	b := getBuffer()
+	if _, err := b.ReadFrom(r); err != nil {
+		putBuffer(b)
+		return nil, err
+	}
+	return b, nil
+}
+
+var statementsPool sync.Pool
+
+// getStatements returns a slice of statements of length n and capacity c, c being
+// greater or equal to n, reusing a slice from the pool if possible.
+func getStatements(n, c int) []sequence.Statement {
+	if x, ok := statementsPool.Get().(*[]sequence.Statement); ok && cap(*x) >= c {
+		return (*x)[:n]
+	}
+	return make([]sequence.Statement, n, c)
+}
+
+// putStatements returns x to the pool. x must not be used afterwards.
+func putStatements(x []sequence.Statement) {
+	if cap(x) > maxPooledStatements {
+		return
+	}
+	x = x[:cap(x)]
+	for i := range x {
+		x[i] = sequence.Statement{} // releases keys
+	}
+	x = x[:0]
+	statementsPool.Put(&x)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Subset of the Protocol Buffers wire format used by the gRPC API: varints, 64-bit
+// doubles and length-delimited fields (strings and embedded messages).
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+var errProtoMalformed = errors.New("malformed message")
+
+// appendProtoTag appends the key of field using wire type t to b.
+func appendProtoTag(b []byte, field, t int) []byte {
+	return binary.AppendUvarint(b, uint64(field)<<3|uint64(t))
+}
+
+// appendProtoInt appends field holding x to b, omitting it if x is 0.
+func appendProtoInt(b []byte, field int, x int64) []byte {
+	if x == 0 {
+		return b
+	}
+	return binary.AppendUvarint(appendProtoTag(b, field, protoVarint), uint64(x))
+}
+
+// appendProtoDouble appends field holding x to b.
+func appendProtoDouble(b []byte, field int, x float64) []byte {
+	return binary.LittleEndian.AppendUint64(appendProtoTag(b, field, protoFixed64), math.Float64bits(x))
+}
+
+// appendProtoBytes appends field holding x, a string or an embedded message, to b.
+func appendProtoBytes(b []byte, field int, x []byte) []byte {
+	b = binary.AppendUvarint(appendProtoTag(b, field, protoBytes), uint64(len(x)))
+	return append(b, x...)
+}
+
+// appendProtoString appends field holding s to b, omitting it if s is empty.
+func appendProtoString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = binary.AppendUvarint(appendProtoTag(b, field, protoBytes), uint64(len(s)))
+	return append(b, s...)
+}
+
+// A protoReader reads the fields of a message. Errors are sticky: once an error
+// occurs, next returns false and err holds the error.
+type protoReader struct {
+	b    []byte
+	t    int
+	err  error
+	x    uint64 // value of varint and fixed fields
+	data []byte // value of length-delimited fields
+}
+
+// next reads the next field, returning its number, or false at the end of the
+// message or if an error occurred.
+func (r *protoReader) next() (int, bool) {
+	if r.err != nil || len(r.b) == 0 {
+		return 0, false
+	}
+	key, n := binary.Uvarint(r.b)
+	if n <= 0 || key>>3 == 0 || key>>3 > math.MaxInt32 {
+		r.err = errProtoMalformed
+		return 0, false
+	}
+	r.b = r.b[n:]
+	r.t = int(key & 7)
+	switch r.t {
+	case protoVarint:
+		r.x, n = binary.Uvarint(r.b)
+		if n <= 0 {
+			r.err = errProtoMalformed
+			return 0, false
+		}
+		r.b = r.b[n:]
+	case protoFixed64:
+		if len(r.b) < 8 {
+			r.err = errProtoMalformed
+			return 0, false
+		}
+		r.x, r.b = binary.LittleEndian.Uint64(r.b), r.b[8:]
+	case protoFixed32:
+		if len(r.b) < 4 {
+			r.err = errProtoMalformed
+			return 0, false
+		}
+		r.x, r.b = uint64(binary.LittleEndian.Uint32(r.b)), r.b[4:]
+	case protoBytes:
+		size, n := binary.Uvarint(r.b)
+		if n <= 0 || size > uint64(len(r.b)-n) {
+			r.err = errProtoMalformed
+			return 0, false
+		}
+		r.data, r.b = r.b[n:n+int(size)], r.b[n+int(size):]
+	default:
+		r.err = errProtoMalformed
+		return 0, false
+	}
+	return int(key >> 3), true
+}
+
+// int returns the value of the current field, a varint.
+func (r *protoReader) int() int64 {
+	if r.t != protoVarint {
+		r.err = errProtoMalformed
+	}
+	return int64(r.x)
+}
+
+// bool returns the value of the current field, a varint.
+func (r *protoReader) bool() bool {
+	return r.int() != 0
+}
+
+// bytes returns the value of the current field, a length-delimited field.
+func (r *protoReader) bytes() []byte {
+	if r.t != protoBytes {
+		r.err = errProtoMalformed
+	}
+	return r.data
+}
+
+// string returns the value of the current field, a length-delimited field.
+func (r *protoReader) string() string {
+	return string(r.bytes())
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// prefixList is a list of address ranges set by a repeatable flag.
+type prefixList []netip.Prefix
+
+// trustedProxies are the address ranges of the proxies whose forwarding headers
+// are trusted, set by -trusted-proxy.
+var trustedProxies prefixList
+
+func (x *prefixList) String() string {
+	s := make([]string, len(*x))
+	for i, p := range *x {
+		s[i] = p.String()
+	}
+	return strings.Join(s, ",")
+}
+
+func (x *prefixList) Set(value string) error {
+	p, err := parsePrefix(value)
+	if err != nil {
+		return err
+	}
+	*x = append(*x, p)
+	return nil
+}
+
+// forwardedFor returns the address of the client of r, sent by peer, from the
+// forwarding headers of r: the Forwarded header, or the X-Forwarded-For header if
+// r has none. Addresses are read from the last one, appended by peer, until an
+// address that is not a trusted proxy, so that clients cannot forge their address.
+// peer is returned if it is not a trusted proxy.
+func forwardedFor(r *http.Request, peer netip.Addr) netip.Addr {
+	if len(trustedProxies) == 0 || !containsIP(trustedProxies, peer) {
+		return peer
+	}
+	hops := forwardedHops(r.Header["Forwarded"])
+	if hops == nil {
+		hops = splitHeader(r.Header["X-Forwarded-For"])
+	}
+	a := peer
+	for i := len(hops) - 1; i >= 0 && containsIP(trustedProxies, a); i-- {
+		v, ok := parseHop(hops[i])
+		if !ok {
+			break
+		}
+		a = v
+	}
+	return a
+}
+
+// forwardedHops returns the values of the for parameters of the elements of the
+// Forwarded headers values, an empty value standing for elements without one.
+func forwardedHops(values []string) []string {
+	var hops []string
+	for _, e := range splitHeader(values) {
+		hop := ""
+		for _, p := range strings.Split(e, ";") {
+			k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+			if strings.EqualFold(k, "for") {
+				hop = strings.Trim(v, `"`)
+			}
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
+
+// splitHeader splits the comma separated lists of values, ignoring empty values.
+func splitHeader(values []string) []string {
+	var s []string
+	for _, v := range values {
+		s = append(s, splitList(v)...)
+	}
+	return s
+}
+
+// parseHop parses the address of a forwarding header, with or without port, IPv6
+// addresses with a port being enclosed in square brackets. Obfuscated identifiers
+// and unknown addresses are not valid.
+func parseHop(s string) (netip.Addr, bool) {
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	a, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return a.Unmap(), true
+}
+
+// clientAddr returns the address of the client of r used by logs: the remote
+// address of r, or the address read from its forwarding headers if r was sent by a
+// trusted proxy.
+func clientAddr(r *http.Request) string {
+	peer, ok := peerIP(r)
+	if !ok {
+		return r.RemoteAddr
+	}
+	if a := forwardedFor(r, peer); a != peer {
+		return a.String()
+	}
+	return r.RemoteAddr
+}
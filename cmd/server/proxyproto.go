@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout is the maximum duration to wait for the PROXY protocol header
+// of a connection.
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyV2Signature starts the headers of version 2 of the PROXY protocol.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// errProxyHeader is returned when reading connections whose PROXY protocol header
+// is not valid.
+var errProxyHeader = errors.New("PROXY protocol header is not valid")
+
+// proxyListener is a listener whose connections start with a PROXY protocol
+// header (version 1 or 2), sent by a load balancer to pass the address of the
+// client.
+type proxyListener struct {
+	net.Listener
+}
+
+func (l proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+// proxyConn is a connection accepted by a proxyListener. The header is read by the
+// first call to Read or RemoteAddr, from the goroutine serving the connection, so
+// that slow clients do not block Accept.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the address of the client passed by the header, or the
+// address of the load balancer if the header does not hold one (e.g. health checks).
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readHeader reads the header of c, closing c if not valid.
+func (c *proxyConn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+	b, err := c.r.Peek(len(proxyV2Signature))
+	switch {
+	case err == nil && bytes.Equal(b, proxyV2Signature):
+		c.remote, c.err = readProxyV2(c.r)
+	case len(b) >= 6 && string(b[:6]) == "PROXY ":
+		c.remote, c.err = readProxyV1(c.r)
+	default:
+		c.err = errProxyHeader
+	}
+	if c.err != nil {
+		log.Printf("rejecting connection from %s: %s", c.Conn.RemoteAddr(), c.err)
+		c.Conn.Close()
+	}
+}
+
+// readProxyV1 reads a header of version 1 of the PROXY protocol, a line of at most
+// 107 bytes, returning the source address, or nil for UNKNOWN connections.
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, errProxyHeader
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, errProxyHeader
+	}
+	fields := strings.Split(s, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a header of version 2 of the PROXY protocol, returning the
+// source address of TCP over IPv4 or IPv6 connections, or nil for LOCAL connections
+// and other protocols.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	h := make([]byte, 16)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return nil, errProxyHeader
+	}
+	if h[12]>>4 != 2 || h[12]&0xf > 1 {
+		return nil, errProxyHeader
+	}
+	data := make([]byte, binary.BigEndian.Uint16(h[14:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, errProxyHeader
+	}
+	if h[12]&0xf == 0 {
+		return nil, nil
+	}
+	switch h[13] {
+	case 0x11:
+		if len(data) < 12 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(data[:4]), Port: int(binary.BigEndian.Uint16(data[8:]))}, nil
+	case 0x21:
+		if len(data) < 36 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(data[:16]), Port: int(binary.BigEndian.Uint16(data[32:]))}, nil
+	}
+	return nil, nil
+}
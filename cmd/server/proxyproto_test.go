@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyV1(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		addr   string // empty for UNKNOWN connections
+		err    bool
+	}{
+		{"tcp4", "PROXY TCP4 192.0.2.1 198.51.100.1 51234 443\r\n", "192.0.2.1:51234", false},
+		{"tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 51234 443\r\n", "[2001:db8::1]:51234", false},
+		{"unknown", "PROXY UNKNOWN\r\n", "", false},
+		{"unknown with addresses", "PROXY UNKNOWN 192.0.2.1 198.51.100.1 51234 443\r\n", "", false},
+		{"missing crlf", "PROXY TCP4 192.0.2.1 198.51.100.1 51234 443\n", "", true},
+		{"missing fields", "PROXY TCP4 192.0.2.1 198.51.100.1 51234\r\n", "", true},
+		{"unknown protocol", "PROXY UDP4 192.0.2.1 198.51.100.1 51234 443\r\n", "", true},
+		{"invalid address", "PROXY TCP4 192.0.2 198.51.100.1 51234 443\r\n", "", true},
+		{"protocol mismatch", "PROXY TCP4 2001:db8::1 2001:db8::2 51234 443\r\n", "", true},
+		{"port out of range", "PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n", "", true},
+		{"too long", "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", "", true},
+		{"truncated", "PROXY TCP4 192.0.2.1", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, err := readProxyV1(bufio.NewReader(strings.NewReader(tt.header)))
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected error, got address %v", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if tt.addr == "" {
+				if addr != nil {
+					t.Fatalf("expected no address, got %v", addr)
+				}
+				return
+			}
+			if addr == nil || addr.String() != tt.addr {
+				t.Fatalf("expected address %s, got %v", tt.addr, addr)
+			}
+		})
+	}
+}
+
+// proxyV2Header returns a header of version 2 of the PROXY protocol with the
+// version and command byte vc, the family and protocol byte fp, and data.
+func proxyV2Header(vc, fp byte, data []byte) string {
+	h := append([]byte{}, proxyV2Signature...)
+	h = append(h, vc, fp, 0, 0)
+	binary.BigEndian.PutUint16(h[14:], uint16(len(data)))
+	return string(append(h, data...))
+}
+
+func TestReadProxyV2(t *testing.T) {
+	tcp4 := append(append(net.ParseIP("192.0.2.1").To4(), net.ParseIP("198.51.100.1").To4()...), 0xc8, 0x22, 0x01, 0xbb)
+	tcp6 := append(append(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")...), 0xc8, 0x22, 0x01, 0xbb)
+	tests := []struct {
+		name   string
+		header string
+		addr   string // empty for LOCAL connections and other protocols
+		err    bool
+	}{
+		{"tcp4", proxyV2Header(0x21, 0x11, tcp4), "192.0.2.1:51234", false},
+		{"tcp6", proxyV2Header(0x21, 0x21, tcp6), "[2001:db8::1]:51234", false},
+		{"tcp4 with tlvs", proxyV2Header(0x21, 0x11, append(tcp4, 0x04, 0x00, 0x01, 0x00)), "192.0.2.1:51234", false},
+		{"local", proxyV2Header(0x20, 0x00, nil), "", false},
+		{"udp4", proxyV2Header(0x21, 0x12, tcp4), "", false},
+		{"unix", proxyV2Header(0x21, 0x31, make([]byte, 216)), "", false},
+		{"wrong version", proxyV2Header(0x11, 0x11, tcp4), "", true},
+		{"unknown command", proxyV2Header(0x22, 0x11, tcp4), "", true},
+		{"short tcp4 addresses", proxyV2Header(0x21, 0x11, tcp4[:8]), "", true},
+		{"short tcp6 addresses", proxyV2Header(0x21, 0x21, tcp4), "", true},
+		{"truncated data", proxyV2Header(0x21, 0x11, tcp4)[:20], "", true},
+		{"truncated header", string(proxyV2Signature), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, err := readProxyV2(bufio.NewReader(strings.NewReader(tt.header)))
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected error, got address %v", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if tt.addr == "" {
+				if addr != nil {
+					t.Fatalf("expected no address, got %v", addr)
+				}
+				return
+			}
+			if addr == nil || addr.String() != tt.addr {
+				t.Fatalf("expected address %s, got %v", tt.addr, addr)
+			}
+		})
+	}
+}
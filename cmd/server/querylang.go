@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// Functions of the query language. avail returns the availability of each key,
+// the other functions reducing the availabilities of all keys to a single series.
+const (
+	exprAvail = "avail"
+	exprMin   = "min"
+	exprMax   = "max"
+	exprAvg   = "avg"
+)
+
+// defaultExpressionRange is the range of expressions without over clause.
+const defaultExpressionRange = 3600
+
+// spanUnits maps the units of spans to their number of seconds.
+var spanUnits = map[byte]int64{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 604800}
+
+// An expression is a query of the query language:
+//
+//	function(selector[,selector...]) [over span] [by span] [at unixTime]
+//
+// Selectors are keys or patterns in which * matches any sequence of characters.
+// over sets the range ending at the at time (the current time by default), by the
+// grouping interval.
+type expression struct {
+	function  string
+	selectors []string
+	over      int64
+	by        int64 // 0 for an automatic interval
+	at        int64 // 0 for the current time
+}
+
+// parseExpression parses s, an expression of the query language.
+func parseExpression(s string) (expression, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')' || c == ',':
+			tokens = append(tokens, s[i:i+1])
+			i++
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" \t\n\r(),", rune(s[j])) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+
+	e := expression{over: defaultExpressionRange}
+	if len(tokens) < 4 || tokens[1] != "(" {
+		return e, errors.New("expression must start with function(selector)")
+	}
+	switch e.function = tokens[0]; e.function {
+	case exprAvail, exprMin, exprMax, exprAvg:
+	default:
+		return e, fmt.Errorf("function %s is not supported", e.function)
+	}
+	i := 2
+	for {
+		if i >= len(tokens) || tokens[i] == "," || tokens[i] == ")" {
+			return e, errors.New("selector is missing")
+		}
+		if err := checkSelector(tokens[i]); err != nil {
+			return e, err
+		}
+		e.selectors = append(e.selectors, tokens[i])
+		i++
+		if i < len(tokens) && tokens[i] == ")" {
+			i++
+			break
+		}
+		if i >= len(tokens) || tokens[i] != "," {
+			return e, errors.New("selectors must be separated by commas and followed by )")
+		}
+		i++
+	}
+
+	seen := make(map[string]bool)
+	for ; i < len(tokens); i += 2 {
+		clause := tokens[i]
+		if seen[clause] {
+			return e, fmt.Errorf("clause %s is set more than once", clause)
+		}
+		seen[clause] = true
+		if i+1 >= len(tokens) {
+			return e, fmt.Errorf("clause %s has no value", clause)
+		}
+		v := tokens[i+1]
+		var err error
+		switch clause {
+		case "over":
+			e.over, err = parseSpan(v)
+		case "by":
+			e.by, err = parseSpan(v)
+		case "at":
+			e.at, err = strconv.ParseInt(v, 10, 64)
+			if err != nil || e.at <= 0 {
+				err = fmt.Errorf("error parsing time %s", v)
+			}
+		default:
+			return e, fmt.Errorf("clause %s is not supported", clause)
+		}
+		if err != nil {
+			return e, err
+		}
+	}
+	return e, nil
+}
+
+// checkSelector fails if s is neither a valid key nor a pattern.
+func checkSelector(s string) error {
+	if !strings.Contains(s, "*") {
+		if reason := checkKey([]byte(s)); reason != "" {
+			return fmt.Errorf("selector %s: %s", s, reason)
+		}
+		return nil
+	}
+	if maxKeyLength > 0 && len(s) > maxKeyLength {
+		return fmt.Errorf("selector exceeds %d bytes", maxKeyLength)
+	}
+	return nil
+}
+
+// parseSpan parses s, a positive number of seconds (s), minutes (m), hours (h),
+// days (d) or weeks (w), e.g. 15m.
+func parseSpan(s string) (int64, error) {
+	if len(s) < 2 {
+		return 0, fmt.Errorf("error parsing span %s", s)
+	}
+	unit, ok := spanUnits[s[len(s)-1]]
+	x, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if !ok || err != nil || x <= 0 || x > math.MaxInt64/unit {
+		return 0, fmt.Errorf("error parsing span %s", s)
+	}
+	return x * unit, nil
+}
+
+// matchSelector reports whether key matches the selector pattern, * matching any
+// sequence of characters.
+func matchSelector(key, pattern string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return key == pattern
+	}
+	if !strings.HasPrefix(key, parts[0]) {
+		return false
+	}
+	key = key[len(parts[0]):]
+	for _, v := range parts[1 : len(parts)-1] {
+		i := strings.Index(key, v)
+		if i == -1 {
+			return false
+		}
+		key = key[i+len(v):]
+	}
+	return strings.HasSuffix(key, parts[len(parts)-1])
+}
+
+// A queryPlan holds the keys and the arguments used to execute an expression.
+type queryPlan struct {
+	keys      []string
+	sequences []*sequence.Sequence
+	args      queryArgs
+}
+
+// plan resolves the selectors of e to keys, keys selected by patterns but holding
+// no sequence (e.g. gauges) being ignored, and sets the range ending at now and
+// the grouping interval. Groups are aligned on multiples of the interval, which
+// must be a multiple of the frequency of every key, so that the groups of
+// different keys can be combined.
+func (s *server) plan(e expression, now time.Time) (queryPlan, error) {
+	var p queryPlan
+	var all []string
+	seen := make(map[string]bool)
+	for _, selector := range e.selectors {
+		if !strings.Contains(selector, "*") {
+			if seen[selector] {
+				continue
+			}
+			x, ok := s.get(selector)
+			if !ok {
+				return p, fmt.Errorf("key %s: %w", selector, errKeyNotFound)
+			}
+			seen[selector] = true
+			p.keys, p.sequences = append(p.keys, selector), append(p.sequences, x)
+			continue
+		}
+		if all == nil {
+			all = s.keys("*")
+			for k := range s.meta.composites() {
+				all = append(all, k)
+			}
+			sort.Strings(all)
+		}
+		for _, k := range all {
+			if seen[k] || !matchSelector(k, selector) {
+				continue
+			}
+			if x, ok := s.get(k); ok {
+				seen[k] = true
+				p.keys, p.sequences = append(p.keys, k), append(p.sequences, x)
+			}
+		}
+	}
+
+	end := now.Unix()
+	if e.at != 0 {
+		end = e.at
+	}
+	if err := s.checkRange(end-e.over+1, end); err != nil {
+		return p, err
+	}
+	interval := e.by
+	if interval == 0 {
+		for _, v := range aggregations {
+			if e.over/v > maxNumberOfPoints {
+				continue
+			}
+			ok := true
+			for _, x := range p.sequences {
+				ok = ok && v%int64(x.Frequency()) == 0
+			}
+			if ok {
+				interval = v
+				break
+			}
+		}
+		if interval == 0 {
+			return p, rangeError("range is too large")
+		}
+	}
+	if e.over/interval > maxNumberOfPoints {
+		return p, rangeError("range is too large for the grouping interval")
+	}
+	for i, x := range p.sequences {
+		if interval%int64(x.Frequency()) != 0 {
+			return p, rangeError(fmt.Sprintf("grouping interval is not a multiple of the frequency of key %s", p.keys[i]))
+		}
+	}
+	start := end - e.over + 1
+	start -= start % interval
+	p.args = queryArgs{start: time.Unix(start, 0), end: time.Unix(end, 0), interval: time.Duration(interval) * time.Second}
+	return p, nil
+}
+
+// An expressionRow is a row of the results of an expression, value being the
+// percentage of active values among known values, or nil if there are none.
+type expressionRow struct {
+	Date  int64    `json:"date"`
+	Value *float64 `json:"value"`
+}
+
+// handlerQueryExpression executes the expression q, returning the rows of each
+// key for avail and the reduced rows otherwise.
+func (s *server) handlerQueryExpression(w http.ResponseWriter, r *http.Request, q string) {
+	e, err := parseExpression(q)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorInvalidRequest, "error parsing expression: "+err.Error())
+		return
+	}
+	p, err := s.plan(e, time.Now())
+	if errors.Is(err, errKeyNotFound) {
+		writeError(w, http.StatusNotFound, errorKeyNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, queryErrorCode(err), err.Error())
+		return
+	}
+
+	exclude := r.FormValue("maintenance") == "exclude"
+	n := int((p.args.end.Unix()-p.args.start.Unix())/int64(p.args.interval.Seconds()) + 1)
+	active, known := make([]int64, n), make([]int64, n)
+	values := make([]*float64, n) // reduced value of each group
+	series := make(map[string][]expressionRow)
+	for i, k := range p.keys {
+		if err := r.Context().Err(); err != nil {
+			logf(r, "query stopped after %d/%d key(s): %s", i, len(p.keys), err)
+			writeContextError(w, err)
+			return
+		}
+		qs, err := s.query(k, p.sequences[i], p.args, exclude)
+		if err != nil {
+			writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+			logf(r, "error executing query: %s", err)
+			return
+		}
+		rows := make([]expressionRow, n)
+		for j := range rows {
+			rows[j].Date = p.args.start.Unix() + int64(j)*int64(p.args.interval.Seconds())
+			if j >= len(qs.Count) || qs.Count[j] == 0 {
+				continue
+			}
+			x := percent(qs.Sum[j], qs.Count[j])
+			rows[j].Value = &x
+			active[j] += qs.Sum[j]
+			known[j] += qs.Count[j]
+			switch v := values[j]; {
+			case v == nil, e.function == exprMin && x < *v, e.function == exprMax && x > *v:
+				values[j] = &x
+			}
+		}
+		if e.function == exprAvail {
+			series[k] = rows
+		}
+	}
+
+	var data []byte
+	var message string
+	if e.function == exprAvail {
+		data, err = json.Marshal(series)
+		message = fmt.Sprintf("%d key(s) returned (interval %ds)", len(series), int(p.args.interval.Seconds()))
+	} else {
+		rows := make([]expressionRow, n)
+		for j := range rows {
+			rows[j].Date = p.args.start.Unix() + int64(j)*int64(p.args.interval.Seconds())
+			rows[j].Value = values[j]
+			if e.function == exprAvg && known[j] > 0 {
+				x := percent(active[j], known[j])
+				rows[j].Value = &x
+			}
+		}
+		data, err = json.Marshal(rows)
+		message = fmt.Sprintf("%d row(s) returned over %d key(s) (interval %ds)", n, len(p.keys), int(p.args.interval.Seconds()))
+	}
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+		logf(r, "error serializing response: %s", err)
+		return
+	}
+	writeResponse(w, http.StatusOK, statusOK, message, data)
+}
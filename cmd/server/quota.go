@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ingestBurst is the number of seconds of ingest rate quota that can be used at
+// once.
+const ingestBurst = 10
+
+// errKeyQuota is the error of statements that would create a key beyond the key
+// quota of their tenant.
+var errKeyQuota = errors.New("key quota exceeded")
+
+// A quota limits the resources used by a tenant. Zero values disable limits.
+type quota struct {
+	maxKeys    int     // number of series
+	ingestRate float64 // insert statements per second
+	maxRange   int64   // range of queries in seconds
+}
+
+// A quotaError reports a request exceeding a quota.
+type quotaError string
+
+func (e quotaError) Error() string {
+	return string(e)
+}
+
+// seriesKey returns the name of the series key belongs to.
+func seriesKey(key string) string {
+	if i := strings.Index(key, internalKeySeparator); i != -1 {
+		return key[:i]
+	}
+	return key
+}
+
+// A rateLimiter is a token bucket allowing requests while it holds tokens, the
+// tokens consumed by a request being allowed to exceed the available tokens.
+type rateLimiter struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// take consumes n tokens using rate as the number of tokens added per second,
+// returning false and the duration before tokens are available if the bucket is
+// empty.
+func (l *rateLimiter) take(n int, rate float64, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	capacity := rate * ingestBurst
+	if l.last.IsZero() {
+		l.tokens = capacity
+	} else {
+		l.tokens = math.Min(capacity, l.tokens+now.Sub(l.last).Seconds()*rate)
+	}
+	l.last = now
+	if l.tokens <= 0 {
+		return time.Duration((-l.tokens + 1) / rate * float64(time.Second)), false
+	}
+	l.tokens -= float64(n)
+	return 0, true
+}
+
+// ingestQuota consumes the ingest rate quota of s for a request holding n
+// statements, returning a quotaError and the duration before the quota allows
+// requests if it is exceeded.
+func (s *server) ingestQuota(n int) (time.Duration, error) {
+	rate := s.settings().quota.ingestRate
+	if rate <= 0 {
+		return 0, nil
+	}
+	if wait, ok := s.ingest.take(n, rate, time.Now()); !ok {
+		return wait, quotaError(fmt.Sprintf("ingest rate quota exceeded (%g statement(s) per second)", rate))
+	}
+	return 0, nil
+}
+
+// limitIngest writes an error response and returns true if r, a request holding n
+// statements, exceeds the ingest rate quota of s. Requests applying raft entries
+// were charged when proposed to the leader.
+func (s *server) limitIngest(w http.ResponseWriter, r *http.Request, n int) bool {
+	if raftApplied(r) {
+		return false
+	}
+	wait, err := s.ingestQuota(n)
+	if err == nil {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeError(w, http.StatusTooManyRequests, errorQuotaExceeded, err.Error())
+	return true
+}
+
+// waitIngest consumes the ingest rate quota of s for n statements, waiting for the
+// quota to allow them rather than rejecting them, until ctx is done.
+func (s *server) waitIngest(ctx context.Context, n int) error {
+	for {
+		wait, err := s.ingestQuota(n)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// checkRange returns a quotaError if the range from start to end, Unix times,
+// exceeds the query range quota of s.
+func (s *server) checkRange(start, end int64) error {
+	max := s.settings().quota.maxRange
+	if max > 0 && end-start > max {
+		return quotaError(fmt.Sprintf("range exceeds the query range quota (%d seconds)", max))
+	}
+	return nil
+}
+
+// checkRangeValues is like checkRange for start and end as passed to endpoints,
+// ranges that cannot be parsed being left to the endpoints.
+func (s *server) checkRangeValues(start, end string) error {
+	x, err := strconv.ParseInt(start, 10, 64)
+	if err != nil {
+		return nil
+	}
+	y, err := strconv.ParseInt(end, 10, 64)
+	if err != nil {
+		return nil
+	}
+	return s.checkRange(x, y)
+}
+
+// limitRange returns a handler rejecting requests whose range, set by the start and
+// end parameters of the query string, exceeds the query range quota of s. Request
+// bodies are left unread.
+func (s *server) limitRange(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if err := s.checkRangeValues(q.Get("start"), q.Get("end")); err != nil {
+			writeError(w, http.StatusBadRequest, errorQuotaExceeded, err.Error())
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,1078 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	raftHeartbeat       = 150 * time.Millisecond
+	raftElectionTimeout = time.Second // randomized up to twice this duration
+	raftRPCTimeout      = 2 * time.Second
+	raftCommitTimeout   = 10 * time.Second
+	raftSnapshotTimeout = time.Minute
+	raftMaxEntries      = 256  // entries per append request
+	raftSnapshotEntries = 4096 // applied entries compacted into a snapshot
+)
+
+// Roles of raft nodes.
+const (
+	raftFollower = iota
+	raftCandidate
+	raftLeader
+)
+
+var raftRoles = []string{"follower", "candidate", "leader"}
+
+// errNotLeader is returned when proposing entries to a node that is not the leader.
+var errNotLeader = errors.New("node is not the raft leader")
+
+// A raftEntry represents a write request replicated by the raft log: a request to
+// the endpoint Path applied by every node with Time as current time, so that nodes
+// record the same values. Prefixes restrict the keys of the statements if the
+// request was authenticated by a restricted token. Entries without path are
+// appended by leaders when elected.
+type raftEntry struct {
+	Term       uint64    `json:"term"`
+	Time       time.Time `json:"time"`
+	Path       string    `json:"path,omitempty"`
+	Query      string    `json:"query,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"`
+	Restricted bool      `json:"restricted,omitempty"`
+	Prefixes   []string  `json:"prefixes,omitempty"`
+	Body       []byte    `json:"body,omitempty"`
+}
+
+// A raftRecord is a line of the raft log file: an entry stored at Index, replacing
+// the entries from Index, or the term and vote of the node if Entry is nil.
+type raftRecord struct {
+	Term  uint64     `json:"term,omitempty"`
+	Vote  string     `json:"vote,omitempty"`
+	Index int        `json:"index,omitempty"`
+	Entry *raftEntry `json:"entry,omitempty"`
+}
+
+type raftVoteRequest struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+	LastIndex int    `json:"last_index"`
+	LastTerm  uint64 `json:"last_term"`
+}
+
+type raftVoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type raftAppendRequest struct {
+	Term      uint64      `json:"term"`
+	Leader    string      `json:"leader"`
+	PrevIndex int         `json:"prev_index"`
+	PrevTerm  uint64      `json:"prev_term"`
+	Entries   []raftEntry `json:"entries"`
+	Commit    int         `json:"commit"`
+}
+
+type raftAppendResponse struct {
+	Term      uint64 `json:"term"`
+	Success   bool   `json:"success"`
+	LastIndex int    `json:"last_index"`
+}
+
+// A raftSnapshot holds the store once the entries up to Index, of term Term, are
+// applied. It replaces these entries in the log.
+type raftSnapshot struct {
+	Index int    `json:"index"`
+	Term  uint64 `json:"term"`
+	Store []byte `json:"store"`
+}
+
+type raftSnapshotRequest struct {
+	Term     uint64       `json:"term"`
+	Leader   string       `json:"leader"`
+	Snapshot raftSnapshot `json:"snapshot"`
+}
+
+type raftSnapshotResponse struct {
+	Term uint64 `json:"term"`
+}
+
+// raftStatus represents the state of a node returned by /raft/status.
+type raftStatus struct {
+	Node      string `json:"node"`
+	Role      string `json:"role"`
+	Term      uint64 `json:"term"`
+	Leader    string `json:"leader"`
+	LastIndex int    `json:"last_index"`
+	Commit    int    `json:"commit"`
+	Applied   int    `json:"applied"`
+	Snapshot  int    `json:"snapshot"`
+}
+
+// A raftNode replicates the write requests of a few endpoints (see handle) to the
+// nodes of a raft cluster: requests are appended to the log of the leader, copied
+// to the logs of the other nodes, and applied by every node once stored by a
+// majority of nodes. The log is the source of truth of the store, which is rebuilt
+// from the last snapshot and the following entries of the log at startup. Applied
+// entries are compacted into snapshots, sent to the peers missing these entries.
+// The members of the cluster are fixed. A nil raftNode applies requests directly.
+type raftNode struct {
+	s        *server
+	self     string
+	peers    []*url.URL
+	token    string
+	client   *http.Client
+	handlers map[string]http.HandlerFunc
+	path     string // log file, the snapshot file adding the .snapshot suffix
+
+	// applying is held while applying entries, so that snapshots are taken and
+	// installed between entries
+	applying sync.Mutex
+
+	mu         sync.Mutex
+	file       *os.File
+	term       uint64
+	vote       string
+	offset     int    // index of the last entry replaced by the snapshot
+	offsetTerm uint64 // term of the entry at offset
+	entries    []raftEntry
+	loaded     int // index of the last entry loaded from the log file
+	role       int
+	leader     string
+	commit     int
+	applied    int
+	next       []int
+	match      []int
+	deadline   time.Time
+	waiting    map[int]chan *responseBuffer
+	applyc     chan struct{}
+	sendc      []chan struct{}
+}
+
+// newRaftNode returns the node self, a base URL, of the cluster made of self and
+// peers, loading the store from the snapshot file of path, if any, and its term,
+// vote and entries from the log file path.
+func newRaftNode(s *server, self string, peers backends, token, path string) (*raftNode, error) {
+	n := &raftNode{
+		s:        s,
+		self:     strings.TrimSuffix(self, "/"),
+		peers:    peers,
+		token:    token,
+		client:   &http.Client{},
+		handlers: make(map[string]http.HandlerFunc),
+		path:     path,
+		next:     make([]int, len(peers)),
+		match:    make([]int, len(peers)),
+		waiting:  make(map[int]chan *responseBuffer),
+		applyc:   make(chan struct{}, 1),
+		sendc:    make([]chan struct{}, len(peers)),
+	}
+	for i := range n.sendc {
+		n.sendc[i] = make(chan struct{}, 1)
+	}
+	if x, err := n.readSnapshot(); err != nil {
+		return nil, fmt.Errorf("error loading raft snapshot: %w", err)
+	} else if x != nil {
+		if err := s.store.Load(x.Store); err != nil {
+			return nil, fmt.Errorf("error loading raft snapshot: %w", err)
+		}
+		n.offset, n.offsetTerm = x.Index, x.Term
+		n.commit, n.applied = x.Index, x.Index
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening raft log: %w", err)
+	}
+	if err := n.load(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error loading raft log: %w", err)
+	}
+	n.loaded = n.lastIndex()
+	n.file = f
+	return n, nil
+}
+
+// load reads the records of f following the snapshot, truncating an incomplete last
+// record written when the node stopped. The log may hold entries replaced by the
+// snapshot if the node stopped before rewriting it.
+func (n *raftNode) load(f *os.File) error {
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("discarding incomplete record at the end of the raft log")
+				return f.Truncate(offset)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var x raftRecord
+		if err := json.Unmarshal(line, &x); err != nil {
+			return fmt.Errorf("record at offset %d: %w", offset, err)
+		}
+		switch {
+		case x.Entry == nil:
+			n.term, n.vote = x.Term, x.Vote
+		case x.Index < 1 || x.Index > n.lastIndex()+1:
+			return fmt.Errorf("record at offset %d: index %d out of range", offset, x.Index)
+		case x.Index <= n.offset:
+			// the entry is replaced by the snapshot, and following entries by the
+			// next records
+			n.entries = n.entries[:0]
+		default:
+			n.entries = append(n.entries[:x.Index-n.offset-1], *x.Entry)
+		}
+		offset += int64(len(line))
+	}
+}
+
+// write appends records to the log file and flushes it to disk. Nodes cannot
+// proceed without their log, so that errors are fatal.
+func (n *raftNode) write(records ...raftRecord) {
+	var b bytes.Buffer
+	for _, v := range records {
+		line, err := json.Marshal(v)
+		if err != nil {
+			log.Fatalf("error encoding raft record: %s", err)
+		}
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	if _, err := n.file.Write(b.Bytes()); err != nil {
+		log.Fatalf("error writing raft log: %s", err)
+	}
+	if err := n.file.Sync(); err != nil {
+		log.Fatalf("error writing raft log: %s", err)
+	}
+}
+
+// rewrite replaces the log file by a file holding the term, the vote and the
+// entries following the snapshot, once the snapshot is written.
+func (n *raftNode) rewrite() {
+	tmp := n.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		log.Fatalf("error rewriting raft log: %s", err)
+	}
+	old := n.file
+	n.file = f
+	records := []raftRecord{{Term: n.term, Vote: n.vote}}
+	for i := range n.entries {
+		records = append(records, raftRecord{Index: n.offset + 1 + i, Entry: &n.entries[i]})
+	}
+	n.write(records...)
+	if err := os.Rename(tmp, n.path); err != nil {
+		log.Fatalf("error rewriting raft log: %s", err)
+	}
+	old.Close()
+}
+
+// snapshotFile returns the name of the snapshot file.
+func (n *raftNode) snapshotFile() string {
+	return n.path + ".snapshot"
+}
+
+// readSnapshot returns the snapshot of the snapshot file, or nil if it does not
+// exist.
+func (n *raftNode) readSnapshot() (*raftSnapshot, error) {
+	f, err := os.Open(n.snapshotFile())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var x raftSnapshot
+	if err := gob.NewDecoder(bufio.NewReader(f)).Decode(&x); err != nil {
+		return nil, err
+	}
+	return &x, nil
+}
+
+// writeSnapshot replaces the snapshot file by x. Nodes cannot compact their log
+// without it, so that errors are fatal.
+func (n *raftNode) writeSnapshot(x *raftSnapshot) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(x); err != nil {
+		log.Fatalf("error encoding raft snapshot: %s", err)
+	}
+	tmp := n.snapshotFile() + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err == nil {
+		_, err = f.Write(b.Bytes())
+		if err == nil {
+			err = f.Sync()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmp, n.snapshotFile())
+	}
+	if err != nil {
+		log.Fatalf("error writing raft snapshot: %s", err)
+	}
+}
+
+// compact replaces the applied entries by a snapshot of the store. It is called by
+// the applier, so that the store holds the entries up to the applied index.
+func (n *raftNode) compact() {
+	n.mu.Lock()
+	index, term := n.applied, n.termAt(n.applied)
+	n.mu.Unlock()
+	m, err := n.s.snapshot()
+	if err != nil {
+		log.Printf("error compacting raft log: %s", err)
+		return
+	}
+	n.writeSnapshot(&raftSnapshot{Index: index, Term: term, Store: m.Store})
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.entries = append([]raftEntry(nil), n.entries[index-n.offset:]...)
+	n.offset, n.offsetTerm = index, term
+	n.rewrite()
+	log.Printf("raft node %s compacted log up to index %d (snapshot of %d bytes)", n.self, index, len(m.Store))
+}
+
+// start starts the election timer, the replication to every peer and the applier
+// as loops of background, stopped on shutdown.
+func (n *raftNode) start(background *loops) {
+	n.mu.Lock()
+	n.resetDeadline()
+	n.mu.Unlock()
+	log.Printf("raft node %s starting at term %d with %d entries following snapshot index %d", n.self, n.term, len(n.entries), n.offset)
+	background.every(raftHeartbeat/3, n.elections)
+	background.run(n.applier)
+	for i := range n.peers {
+		i := i
+		background.run(func(ctx context.Context) { n.replicate(ctx, i) })
+	}
+}
+
+// resetDeadline postpones the next election by a random election timeout.
+func (n *raftNode) resetDeadline() {
+	n.deadline = time.Now().Add(raftElectionTimeout + time.Duration(rand.Int63n(int64(raftElectionTimeout))))
+}
+
+// majority returns the number of nodes forming a majority of the cluster.
+func (n *raftNode) majority() int {
+	return (len(n.peers)+1)/2 + 1
+}
+
+// last returns the index and term of the last entry of the log.
+func (n *raftNode) last() (int, uint64) {
+	return n.lastIndex(), n.termAt(n.lastIndex())
+}
+
+// lastIndex returns the index of the last entry of the log, or of the snapshot.
+func (n *raftNode) lastIndex() int {
+	return n.offset + len(n.entries)
+}
+
+// entry returns the entry at index, which must follow the snapshot.
+func (n *raftNode) entry(index int) raftEntry {
+	return n.entries[index-n.offset-1]
+}
+
+// termAt returns the term of the entry at index, 0 being the index preceding the
+// first entry, or 0 if the entry is unknown or replaced by the snapshot, except the
+// last entry of the snapshot.
+func (n *raftNode) termAt(index int) uint64 {
+	switch {
+	case index == n.offset:
+		return n.offsetTerm
+	case index < n.offset || index > n.lastIndex():
+		return 0
+	}
+	return n.entry(index).Term
+}
+
+// setTerm records term, and vote as the candidate voted for during term.
+func (n *raftNode) setTerm(term uint64, vote string) {
+	n.term, n.vote = term, vote
+	n.write(raftRecord{Term: term, Vote: vote})
+}
+
+// stepDown makes the node a follower, moving to term if it is newer. Requests
+// waiting for their entries to be applied fail, the new leader deciding whether
+// they are committed.
+func (n *raftNode) stepDown(term uint64) {
+	if term > n.term {
+		n.setTerm(term, "")
+	}
+	if n.role == raftLeader {
+		log.Printf("raft node %s stepping down at term %d", n.self, n.term)
+	}
+	n.role = raftFollower
+	for k, ch := range n.waiting {
+		close(ch)
+		delete(n.waiting, k)
+	}
+}
+
+// wake wakes up ch without blocking.
+func wake(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// elections starts an election if the election deadline passed without hearing
+// from a leader.
+func (n *raftNode) elections() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.role != raftLeader && time.Now().After(n.deadline) {
+		n.campaign()
+	}
+}
+
+// campaign starts an election for the next term, the node becoming the leader
+// once it gets the votes of a majority of nodes.
+func (n *raftNode) campaign() {
+	n.role = raftCandidate
+	n.leader = ""
+	n.setTerm(n.term+1, n.self)
+	n.resetDeadline()
+	index, term := n.last()
+	req := raftVoteRequest{Term: n.term, Candidate: n.self, LastIndex: index, LastTerm: term}
+	votes := 1
+	for i := range n.peers {
+		go func(i int) {
+			var resp raftVoteResponse
+			if err := n.call(i, "/raft/vote", raftRPCTimeout, req, &resp); err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if resp.Term > n.term {
+				n.stepDown(resp.Term)
+				return
+			}
+			if !resp.Granted || n.role != raftCandidate || n.term != req.Term {
+				return
+			}
+			if votes++; votes == n.majority() {
+				n.lead()
+			}
+		}(i)
+	}
+}
+
+// lead makes the node the leader of the current term, appending an empty entry so
+// that the entries of previous terms are committed with it.
+func (n *raftNode) lead() {
+	log.Printf("raft node %s elected leader at term %d", n.self, n.term)
+	n.role, n.leader = raftLeader, n.self
+	for i := range n.peers {
+		n.next[i], n.match[i] = n.lastIndex()+1, 0
+	}
+	n.append(raftEntry{Term: n.term, Time: time.Now()})
+}
+
+// append appends e to the log of the leader and wakes up the replication to peers,
+// returning the index of e.
+func (n *raftNode) append(e raftEntry) int {
+	n.entries = append(n.entries, e)
+	index := n.lastIndex()
+	n.write(raftRecord{Index: index, Entry: &e})
+	for _, ch := range n.sendc {
+		wake(ch)
+	}
+	return index
+}
+
+// replicate sends the entries missing from the log of peer i, or a heartbeat,
+// while the node is the leader, until ctx is done. The snapshot is sent instead if
+// the entries are replaced by the snapshot.
+func (n *raftNode) replicate(ctx context.Context, i int) {
+	t := time.NewTicker(raftHeartbeat)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-n.sendc[i]:
+		case <-t.C:
+		}
+		n.mu.Lock()
+		if n.role != raftLeader {
+			n.mu.Unlock()
+			continue
+		}
+		prev := n.next[i] - 1
+		if prev < n.offset {
+			n.mu.Unlock()
+			n.sendSnapshot(i)
+			continue
+		}
+		end := n.lastIndex()
+		if end > prev+raftMaxEntries {
+			end = prev + raftMaxEntries
+		}
+		req := raftAppendRequest{
+			Term:      n.term,
+			Leader:    n.self,
+			PrevIndex: prev,
+			PrevTerm:  n.termAt(prev),
+			Entries:   append([]raftEntry{}, n.entries[prev-n.offset:end-n.offset]...),
+			Commit:    n.commit,
+		}
+		n.mu.Unlock()
+
+		var resp raftAppendResponse
+		if err := n.call(i, "/raft/append", raftRPCTimeout, req, &resp); err != nil {
+			continue
+		}
+		n.mu.Lock()
+		switch {
+		case resp.Term > n.term:
+			n.stepDown(resp.Term)
+		case n.role != raftLeader || n.term != req.Term:
+		case resp.Success:
+			n.match[i] = req.PrevIndex + len(req.Entries)
+			n.next[i] = n.match[i] + 1
+			n.advance()
+			if n.next[i] <= n.lastIndex() {
+				wake(n.sendc[i])
+			}
+		default:
+			// the log of the peer diverges or is shorter, retrying from the
+			// last entry it may share with the leader
+			next := n.next[i] - 1
+			if resp.LastIndex+1 < next {
+				next = resp.LastIndex + 1
+			}
+			if next < 1 {
+				next = 1
+			}
+			n.next[i] = next
+			wake(n.sendc[i])
+		}
+		n.mu.Unlock()
+	}
+}
+
+// sendSnapshot sends the snapshot to peer i, whose missing entries are replaced by
+// the snapshot.
+func (n *raftNode) sendSnapshot(i int) {
+	x, err := n.readSnapshot()
+	if err != nil || x == nil {
+		log.Printf("error reading raft snapshot: %v", err)
+		return
+	}
+	n.mu.Lock()
+	if n.role != raftLeader {
+		n.mu.Unlock()
+		return
+	}
+	req := raftSnapshotRequest{Term: n.term, Leader: n.self, Snapshot: *x}
+	n.mu.Unlock()
+	var resp raftSnapshotResponse
+	if err := n.call(i, "/raft/snapshot", raftSnapshotTimeout, req, &resp); err != nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	switch {
+	case resp.Term > n.term:
+		n.stepDown(resp.Term)
+	case n.role != raftLeader || n.term != req.Term:
+	default:
+		if x.Index > n.match[i] {
+			n.match[i] = x.Index
+		}
+		n.next[i] = n.match[i] + 1
+		wake(n.sendc[i])
+	}
+}
+
+// advance commits the entries of the current term stored by a majority of nodes,
+// and the entries preceding them.
+func (n *raftNode) advance() {
+	for index := n.lastIndex(); index > n.commit && n.entry(index).Term == n.term; index-- {
+		count := 1
+		for _, v := range n.match {
+			if v >= index {
+				count++
+			}
+		}
+		if count >= n.majority() {
+			n.commit = index
+			wake(n.applyc)
+			return
+		}
+	}
+}
+
+// call sends req to the endpoint path of peer i, decoding the response into resp,
+// failing after timeout.
+func (n *raftNode) call(i int, path string, timeout time.Duration, req, resp any) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	u := *n.peers[i]
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer "+n.token)
+	x, err := n.client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer x.Body.Close()
+	if x.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", x.StatusCode)
+	}
+	return json.NewDecoder(x.Body).Decode(resp)
+}
+
+// applier applies the committed entries in order until ctx is done, the entry
+// being applied completing first, and compacts the log every raftSnapshotEntries
+// applied entries.
+func (n *raftNode) applier(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-n.applyc:
+		}
+		n.applying.Lock()
+		for ctx.Err() == nil {
+			n.mu.Lock()
+			if n.applied >= n.commit {
+				n.mu.Unlock()
+				break
+			}
+			n.applied++
+			e := n.entry(n.applied)
+			ch := n.waiting[n.applied]
+			delete(n.waiting, n.applied)
+			x := raftApply{time: e.Time, live: ch != nil, replay: n.applied <= n.loaded}
+			compact := n.applied-n.offset >= raftSnapshotEntries
+			n.mu.Unlock()
+			b := n.apply(e, x)
+			if ch != nil {
+				ch <- b
+			}
+			if compact {
+				n.compact()
+			}
+		}
+		n.applying.Unlock()
+	}
+}
+
+type raftApplyKey struct{}
+
+// A raftApply represents the application of a raft entry by a request.
+type raftApply struct {
+	time   time.Time // time of the entry
+	live   bool      // applied by the leader that proposed the entry, answering its client
+	replay bool      // entry stored in the log before the node started
+}
+
+// raftApplyOf returns the raft entry application of r, if any.
+func raftApplyOf(r *http.Request) (raftApply, bool) {
+	x, ok := r.Context().Value(raftApplyKey{}).(raftApply)
+	return x, ok
+}
+
+// requestTime returns the current time of r: the time of the raft entry applied by
+// r, or the time of the server.
+func requestTime(r *http.Request) time.Time {
+	if x, ok := raftApplyOf(r); ok {
+		return x.time
+	}
+	return time.Now()
+}
+
+// raftApplied reports whether r applies a raft entry.
+func raftApplied(r *http.Request) bool {
+	_, ok := raftApplyOf(r)
+	return ok
+}
+
+// raftReplayed reports whether r applies a raft entry replayed at startup, r
+// being nil for changes not made by requests.
+func raftReplayed(r *http.Request) bool {
+	if r == nil {
+		return false
+	}
+	x, ok := raftApplyOf(r)
+	return ok && x.replay
+}
+
+// raftEffects reports whether the side effects of r (notifications, alerts, relays
+// and audit records) apply, r being nil for changes not made by requests. Entries
+// are applied by every node and again whenever the log is replayed, so that their
+// side effects only apply when applied by the leader that proposed them.
+func raftEffects(r *http.Request) bool {
+	if r == nil {
+		return true
+	}
+	x, ok := raftApplyOf(r)
+	return !ok || x.live
+}
+
+// apply applies e using the handler of its endpoint, returning the response.
+func (n *raftNode) apply(e raftEntry, x raftApply) *responseBuffer {
+	b := newResponseBuffer()
+	h, ok := n.handlers[e.Path]
+	if !ok {
+		if e.Path != "" {
+			log.Printf("error applying raft entry: endpoint %s is not replicated", e.Path)
+		}
+		return b
+	}
+	ctx := context.WithValue(context.Background(), raftApplyKey{}, x)
+	ctx = context.WithValue(ctx, requestIDKey{}, e.RequestID)
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, e.Path+"?"+e.Query, bytes.NewReader(e.Body))
+	if err != nil {
+		log.Printf("error applying raft entry: %s", err)
+		return b
+	}
+	if e.Restricted {
+		// a restricted token without prefixes grants access to no key
+		prefixes := e.Prefixes
+		if prefixes == nil {
+			prefixes = []string{}
+		}
+		r = withClaims(r, claims{Prefixes: prefixes})
+	}
+	b.header.Set(requestIDHeader, e.RequestID)
+	h(b, r)
+	return b
+}
+
+// propose appends e to the log of the leader, returning a channel receiving the
+// response of e once applied, or closed if the node steps down before.
+func (n *raftNode) propose(e raftEntry) (chan *responseBuffer, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.role != raftLeader {
+		return nil, errNotLeader
+	}
+	e.Term = n.term
+	ch := make(chan *responseBuffer, 1)
+	n.waiting[n.append(e)] = ch
+	return ch, nil
+}
+
+// handle returns a handler replicating the write requests of the endpoint path,
+// applied by h on every node. Followers redirect write requests to the leader (307),
+// which answers once the request is applied. Requests other than creations are
+// subject to the ingest rate quota when proposed.
+func (n *raftNode) handle(path string, h http.HandlerFunc) http.HandlerFunc {
+	if n == nil {
+		return h
+	}
+	n.handlers[path] = h
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			h(w, r)
+			return
+		}
+		if isNDJSON(r) {
+			writeError(w, http.StatusBadRequest, errorInvalidRequest, "NDJSON streams are not supported in raft mode")
+			return
+		}
+		n.mu.Lock()
+		role, leader := n.role, n.leader
+		n.mu.Unlock()
+		if role != raftLeader {
+			n.redirect(w, r, leader)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeResponse(w, http.StatusBadRequest, statusError, "error reading request body", nil)
+			logf(r, "error reading request body: %s", err)
+			return
+		}
+		if path != "/create/" && n.s.limitIngest(w, r, bytes.Count(body, []byte("\n"))+1) {
+			return
+		}
+		e := raftEntry{Time: time.Now(), Path: path, Query: r.URL.RawQuery, RequestID: requestIDOf(r), Body: body}
+		if c, ok := tokenClaims(r); ok && c.Prefixes != nil {
+			e.Restricted, e.Prefixes = true, c.Prefixes
+		}
+		ch, err := n.propose(e)
+		if err != nil {
+			n.redirect(w, r, "")
+			return
+		}
+		timer := time.NewTimer(raftCommitTimeout)
+		defer timer.Stop()
+		select {
+		case b, ok := <-ch:
+			if !ok {
+				writeError(w, http.StatusServiceUnavailable, errorUnavailable, "leader stepped down, statements may not be applied")
+				return
+			}
+			for k, v := range b.header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(b.code)
+			w.Write(b.body.Bytes())
+		case <-timer.C:
+			writeError(w, http.StatusServiceUnavailable, errorUnavailable, "statements were not committed in time, they may be applied later")
+		case <-r.Context().Done():
+			writeContextError(w, r.Context().Err())
+		}
+	}
+}
+
+// redirect redirects r to leader (307), or rejects it if no leader is known.
+func (n *raftNode) redirect(w http.ResponseWriter, r *http.Request, leader string) {
+	if leader == "" || leader == n.self {
+		writeError(w, http.StatusServiceUnavailable, errorUnavailable, "no raft leader")
+		return
+	}
+	u, err := url.Parse(leader)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, errorUnavailable, "no raft leader")
+		return
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + r.URL.Path
+	u.RawQuery = r.URL.RawQuery
+	http.Redirect(w, r, u.String(), http.StatusTemporaryRedirect)
+}
+
+// local returns a handler rejecting the write requests of endpoints whose changes
+// are not replicated by the raft log, calling h otherwise.
+func (n *raftNode) local(h http.HandlerFunc) http.HandlerFunc {
+	if n == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeError(w, http.StatusForbidden, errorForbidden, "endpoint is not replicated in raft mode")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// raftRPCs are the endpoints receiving the requests of the other nodes, which are
+// authenticated by the raft token rather than the tokens of the server.
+var raftRPCs = map[string]bool{"/raft/vote": true, "/raft/append": true, "/raft/snapshot": true}
+
+// register registers the endpoints of the raft protocol on mux.
+func (n *raftNode) register(mux *http.ServeMux) {
+	handle(mux, "/raft/vote", n.authenticate(n.handlerVote))
+	handle(mux, "/raft/append", n.authenticate(n.handlerAppend))
+	handle(mux, "/raft/snapshot", n.authenticate(n.handlerSnapshot))
+	handle(mux, "/raft/status", n.handlerStatus)
+}
+
+// authenticate returns a handler rejecting the requests without the raft token.
+func (n *raftNode) authenticate(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(n.token)) != 1 {
+			writeResponse(w, http.StatusUnauthorized, statusError, "unauthorized", nil)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// decodeRPC decodes the body of r into x, writing an error response on failure.
+func decodeRPC(w http.ResponseWriter, r *http.Request, x any) bool {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(x); err != nil {
+		writeResponse(w, http.StatusBadRequest, statusError, "error parsing request body", nil)
+		return false
+	}
+	return true
+}
+
+// writeRPC writes x, the response of a raft RPC.
+func writeRPC(w http.ResponseWriter, x any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(x)
+}
+
+func (n *raftNode) handlerVote(w http.ResponseWriter, r *http.Request) {
+	var req raftVoteRequest
+	if !decodeRPC(w, r, &req) {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term > n.term {
+		n.stepDown(req.Term)
+	}
+	resp := raftVoteResponse{Term: n.term}
+	index, term := n.last()
+	upToDate := req.LastTerm > term || (req.LastTerm == term && req.LastIndex >= index)
+	if req.Term == n.term && (n.vote == "" || n.vote == req.Candidate) && upToDate {
+		if n.vote == "" {
+			n.setTerm(n.term, req.Candidate)
+		}
+		n.resetDeadline()
+		resp.Granted = true
+	}
+	writeRPC(w, resp)
+}
+
+func (n *raftNode) handlerAppend(w http.ResponseWriter, r *http.Request) {
+	var req raftAppendRequest
+	if !decodeRPC(w, r, &req) {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term < n.term {
+		writeRPC(w, raftAppendResponse{Term: n.term, LastIndex: n.lastIndex()})
+		return
+	}
+	if req.Term > n.term || n.role != raftFollower {
+		n.stepDown(req.Term)
+	}
+	if n.leader != req.Leader {
+		log.Printf("raft node %s following %s at term %d", n.self, req.Leader, n.term)
+	}
+	n.leader = req.Leader
+	n.resetDeadline()
+	resp := raftAppendResponse{Term: n.term}
+	// entries replaced by the snapshot are applied, matching the log of the leader
+	if last := n.lastIndex(); req.PrevIndex > last || (req.PrevIndex >= n.offset && n.termAt(req.PrevIndex) != req.PrevTerm) {
+		resp.LastIndex = last
+		if req.PrevIndex <= last {
+			resp.LastIndex = req.PrevIndex - 1
+		}
+		writeRPC(w, resp)
+		return
+	}
+	var records []raftRecord
+	for i, e := range req.Entries {
+		index := req.PrevIndex + 1 + i
+		if index <= n.offset {
+			continue
+		}
+		if index <= n.lastIndex() {
+			if n.entry(index).Term == e.Term {
+				continue
+			}
+			n.entries = n.entries[:index-n.offset-1]
+		}
+		n.entries = append(n.entries, e)
+		records = append(records, raftRecord{Index: index, Entry: &req.Entries[i]})
+	}
+	if len(records) > 0 {
+		n.write(records...)
+	}
+	// entries past the entries of req may not match the log of the leader, and the
+	// commit index of a stale request may be lower than the index already known
+	commit := req.Commit
+	if last := req.PrevIndex + len(req.Entries); commit > last {
+		commit = last
+	}
+	if commit > n.commit {
+		n.commit = commit
+		wake(n.applyc)
+	}
+	resp.Success, resp.LastIndex = true, n.lastIndex()
+	writeRPC(w, resp)
+}
+
+// handlerSnapshot installs the snapshot of the leader, replacing the store and the
+// entries of the log up to the snapshot. Following entries are kept if the log
+// holds the last entry of the snapshot.
+func (n *raftNode) handlerSnapshot(w http.ResponseWriter, r *http.Request) {
+	var req raftSnapshotRequest
+	if !decodeRPC(w, r, &req) {
+		return
+	}
+	x := req.Snapshot
+	n.applying.Lock()
+	defer n.applying.Unlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term < n.term {
+		writeRPC(w, raftSnapshotResponse{Term: n.term})
+		return
+	}
+	if req.Term > n.term || n.role != raftFollower {
+		n.stepDown(req.Term)
+	}
+	n.leader = req.Leader
+	n.resetDeadline()
+	if x.Index <= n.applied {
+		writeRPC(w, raftSnapshotResponse{Term: n.term})
+		return
+	}
+	if err := n.s.store.Load(x.Store); err != nil {
+		writeResponse(w, http.StatusBadRequest, statusError, "snapshot is not valid", nil)
+		logf(r, "error loading raft snapshot: %s", err)
+		return
+	}
+	n.s.cache.reset()
+	// loading may take longer than the election timeout
+	n.resetDeadline()
+	n.writeSnapshot(&x)
+	if x.Index <= n.lastIndex() && n.termAt(x.Index) == x.Term {
+		n.entries = append([]raftEntry(nil), n.entries[x.Index-n.offset:]...)
+	} else {
+		n.entries = nil
+	}
+	n.offset, n.offsetTerm = x.Index, x.Term
+	n.rewrite()
+	n.applied = x.Index
+	if n.commit < x.Index {
+		n.commit = x.Index
+	}
+	log.Printf("raft node %s installed snapshot up to index %d from %s", n.self, x.Index, req.Leader)
+	writeRPC(w, raftSnapshotResponse{Term: n.term})
+}
+
+func (n *raftNode) handlerStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	n.mu.Lock()
+	x := raftStatus{Node: n.self, Role: raftRoles[n.role], Term: n.term, Leader: n.leader, LastIndex: n.lastIndex(), Commit: n.commit, Applied: n.applied, Snapshot: n.offset}
+	n.mu.Unlock()
+	data, err := json.Marshal(x)
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+		logf(r, "error serializing raft status: %s", err)
+		return
+	}
+	writeResponse(w, http.StatusOK, statusOK, fmt.Sprintf("%s at term %d", raftRoles[n.role], x.Term), data)
+}
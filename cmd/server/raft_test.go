@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestRaftNode returns a node of a cluster of two nodes using the log file path.
+func newTestRaftNode(t *testing.T, path string) *raftNode {
+	t.Helper()
+	s := &server{store: newShardedStore(2), cache: newQueryCache(0), meta: newMetadata()}
+	peer, _ := url.Parse("http://127.0.0.1:1")
+	n, err := newRaftNode(s, "http://127.0.0.1:2", backends{peer}, "token", path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	t.Cleanup(func() { n.file.Close() })
+	return n
+}
+
+func TestRaftCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "raft.log")
+	n := newTestRaftNode(t, path)
+	n.setTerm(1, "")
+	for i := 0; i < 5; i++ {
+		n.append(raftEntry{Term: 1, Time: time.Now()})
+	}
+	n.s.store.Create(time.Now(), 60, "eu.web")
+	n.commit, n.applied = 3, 3
+	n.compact()
+	if n.offset != 3 || n.offsetTerm != 1 || len(n.entries) != 2 {
+		t.Fatalf("expected 2 entries following snapshot index 3, got %d entries following index %d", len(n.entries), n.offset)
+	}
+
+	x := newTestRaftNode(t, path)
+	if x.offset != 3 || x.lastIndex() != 5 || x.applied != 3 || x.loaded != 5 {
+		t.Fatalf("expected log up to index 5 following snapshot index 3 applied, got %d following %d applied up to %d", x.lastIndex(), x.offset, x.applied)
+	}
+	if _, ok := x.s.store.Get("eu.web"); !ok {
+		t.Fatal("expected store to be loaded from the snapshot")
+	}
+	if x.term != 1 || x.termAt(3) != 1 || x.termAt(4) != 1 || x.termAt(2) != 0 {
+		t.Fatalf("expected term 1 of entries 3 and 4, and unknown term of entry 2")
+	}
+}
+
+func TestRaftLoadStaleLog(t *testing.T) {
+	// the node stopped once the snapshot was written, before rewriting the log,
+	// whose entries 4 and 5 were replaced by entries of term 2 before being applied
+	path := filepath.Join(t.TempDir(), "raft.log")
+	n := newTestRaftNode(t, path)
+	for i := 0; i < 5; i++ {
+		n.append(raftEntry{Term: 1})
+	}
+	e := raftEntry{Term: 2}
+	n.write(raftRecord{Index: 4, Entry: &e}, raftRecord{Index: 5, Entry: &e}, raftRecord{Index: 6, Entry: &e})
+	n.writeSnapshot(&raftSnapshot{Index: 4, Term: 2})
+
+	x := newTestRaftNode(t, path)
+	if x.offset != 4 || x.lastIndex() != 6 {
+		t.Fatalf("expected log up to index 6 following snapshot index 4, got %d following %d", x.lastIndex(), x.offset)
+	}
+	if x.termAt(5) != 2 || x.termAt(6) != 2 {
+		t.Fatalf("expected entries 5 and 6 of term 2, got terms %d and %d", x.termAt(5), x.termAt(6))
+	}
+}
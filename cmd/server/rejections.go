@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// maxRejectedContent is the maximum number of bytes of a line reported in the
+// details of a rejected statement.
+const maxRejectedContent = 256
+
+// A rejection describes a line of an insert request that was not applied.
+type rejection struct {
+	Line    int    `json:"line"`
+	Content string `json:"content"`
+	Reason  string `json:"reason"`
+}
+
+// rejections collects the details of the lines of an insert request that were not
+// applied, if the request asks for them using verbose=1.
+type rejections struct {
+	lines    [][]byte
+	rejected []bool
+	verbose  bool
+	list     []rejection
+}
+
+func newRejections(r *http.Request, lines [][]byte) *rejections {
+	return &rejections{lines: lines, rejected: make([]bool, len(lines)), verbose: r.FormValue("verbose") == "1", list: []rejection{}}
+}
+
+// add records the rejection of the line at index i for reason.
+func (x *rejections) add(i int, reason string) {
+	x.rejected[i] = true
+	if !x.verbose {
+		return
+	}
+	content := x.lines[i]
+	if len(content) > maxRejectedContent {
+		content = content[:maxRejectedContent]
+	}
+	x.list = append(x.list, rejection{Line: i + 1, Content: string(content), Reason: reason})
+}
+
+// accepted returns the lines that were not rejected.
+func (x *rejections) accepted() [][]byte {
+	var lines [][]byte
+	for i, v := range x.lines {
+		if !x.rejected[i] {
+			lines = append(lines, v)
+		}
+	}
+	return lines
+}
+
+// data returns the rejections sorted by line encoded as JSON, or nil if they were
+// not asked for.
+func (x *rejections) data() []byte {
+	if !x.verbose {
+		return nil
+	}
+	sort.Slice(x.list, func(i, j int) bool { return x.list[i].Line < x.list[j].Line })
+	data, _ := json.Marshal(x.list)
+	return data
+}
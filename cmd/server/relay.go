@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+const (
+	relayQueueSize  = 4096
+	relayMaxBackoff = 30 * time.Second
+	relayTimeout    = 30 * time.Second
+)
+
+// A relayBatch represents the accepted lines of an insert request, sent to path.
+type relayBatch struct {
+	path string
+	body []byte
+}
+
+// A relay forwards the accepted lines of insert requests to downstream servers
+// (e.g. a disaster recovery site). Each downstream server has its own queue, batches
+// being dropped when it is full, and failed batches are retried with exponential
+// backoff until they are delivered or rejected. A nil relay discards batches.
+type relay struct {
+	targets []*url.URL
+	queues  []chan relayBatch
+	token   string
+	client  *http.Client
+}
+
+// newRelay returns a relay forwarding batches to targets using token as bearer
+// token if it is set, or nil if there is no target.
+func newRelay(targets backends, token string) *relay {
+	if len(targets) == 0 {
+		return nil
+	}
+	x := &relay{targets: targets, queues: make([]chan relayBatch, len(targets)), token: token, client: &http.Client{Timeout: relayTimeout}}
+	for i := range targets {
+		x.queues[i] = make(chan relayBatch, relayQueueSize)
+		go x.run(i)
+	}
+	return x
+}
+
+// send queues lines, insert statements of the endpoint path, for delivery to the
+// downstream servers, t being added as timestamp to the lines without timestamp so
+// that values are recorded at the same time.
+func (x *relay) send(path string, lines [][]byte, t time.Time) {
+	if x == nil {
+		return
+	}
+	var b bytes.Buffer
+	ts := []byte(" " + strconv.FormatInt(t.Unix(), 10))
+	for _, v := range lines {
+		if len(v) == 0 {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteByte('\n')
+		}
+		b.Write(v)
+		if bytes.Count(v, []byte(" ")) == 1 {
+			b.Write(ts)
+		}
+	}
+	if b.Len() == 0 {
+		return
+	}
+	batch := relayBatch{path: path, body: b.Bytes()}
+	for i, q := range x.queues {
+		select {
+		case q <- batch:
+		default:
+			log.Printf("error queuing relayed batch: queue of %s is full", x.targets[i])
+		}
+	}
+}
+
+// statements queues the statements of a batch that were applied, errs holding the
+// error of each statement or being nil if all statements were applied, as lines of
+// the endpoint path.
+func (x *relay) statements(path string, statements []sequence.Statement, errs []error) {
+	if x == nil {
+		return
+	}
+	var lines [][]byte
+	for i, v := range statements {
+		if errs == nil || errs[i] == nil {
+			lines = append(lines, []byte(fmt.Sprintf("%s %d %d", v.Key, v.Value, v.Timestamp.Unix())))
+		}
+	}
+	x.send(path, lines, time.Now())
+}
+
+// run delivers the batches queued for target i.
+func (x *relay) run(i int) {
+	for batch := range x.queues[i] {
+		backoff := time.Second
+		for {
+			retry, err := x.post(x.targets[i], batch)
+			if err == nil {
+				break
+			}
+			if !retry {
+				log.Printf("error relaying batch to %s, giving up: %s", x.targets[i], err)
+				break
+			}
+			log.Printf("error relaying batch to %s, retrying in %s: %s", x.targets[i], backoff, err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > relayMaxBackoff {
+				backoff = relayMaxBackoff
+			}
+		}
+	}
+}
+
+// post sends batch to target, reporting whether a failed attempt can be retried:
+// network errors, server errors and rate limiting are retried, other errors are
+// not.
+func (x *relay) post(target *url.URL, batch relayBatch) (bool, error) {
+	u := *target
+	u.Path = strings.TrimSuffix(u.Path, "/") + batch.path
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(batch.body))
+	if err != nil {
+		return false, err
+	}
+	if x.token != "" {
+		req.Header.Set("Authorization", "Bearer "+x.token)
+	}
+	resp, err := x.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return false, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+)
+
+// write returns a handler rejecting requests other than GET and HEAD requests when
+// the server is read-only or draining, calling h otherwise.
+func (s *server) write(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			if s.readOnly {
+				writeResponse(w, http.StatusForbidden, statusError, "server is read-only", nil)
+				return
+			}
+			if s.draining.Load() {
+				writeResponse(w, http.StatusServiceUnavailable, statusError, "server is draining", nil)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+// read returns a handler forwarding requests to the read replica, by proxying or
+// redirecting them, if one is configured, calling h otherwise.
+func (s *server) read(h http.HandlerFunc) http.HandlerFunc {
+	if s.replica == nil {
+		return h
+	}
+	if s.replicaRedirect {
+		return func(w http.ResponseWriter, r *http.Request) {
+			u := *s.replica
+			u.Path = strings.TrimSuffix(u.Path, "/") + r.URL.Path
+			u.RawQuery = r.URL.RawQuery
+			http.Redirect(w, r, u.String(), http.StatusTemporaryRedirect)
+		}
+	}
+	proxy := httputil.NewSingleHostReverseProxy(s.replica)
+	dropRequestID(proxy)
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		writeResponse(w, http.StatusBadGateway, statusError, "error forwarding request to read replica", nil)
+		log.Printf("error forwarding request to read replica: %s", err)
+	}
+	return proxy.ServeHTTP
+}
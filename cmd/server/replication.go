@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+const (
+	replicationQueueSize        = 4096
+	replicationMaxBackoff       = 30 * time.Second
+	replicationNonceSize        = 32
+	replicationHandshakeTimeout = 10 * time.Second
+)
+
+// A replicationMessage represents a change forwarded to a standby. A message
+// holding a store snapshot replaces the store and metadata of the standby, while
+// Sequences replaces the sequences of a few keys (e.g. backfilled values).
+type replicationMessage struct {
+	Store      []byte
+	Meta       []byte
+	Statements []sequence.Statement
+	Created    []createdKey
+	Deleted    []string
+	Sequences  map[string][]byte
+}
+
+// A createdKey represents a key created with an explicit frequency.
+type createdKey struct {
+	Key       string
+	Timestamp time.Time
+	Frequency uint16
+}
+
+// A replicator forwards applied changes to a standby over a persistent connection.
+// On each connection, both ends prove they share token, then pending changes are
+// discarded and a snapshot of the store is sent first. If the queue is full, the connection is closed to resynchronize the
+// standby. A nil replicator discards changes.
+type replicator struct {
+	addr     string
+	token    string
+	snapshot func() (replicationMessage, error)
+	queue    chan replicationMessage
+	mu       sync.Mutex
+	conn     net.Conn
+}
+
+func newReplicator(addr, token string, snapshot func() (replicationMessage, error)) *replicator {
+	r := &replicator{addr: addr, token: token, snapshot: snapshot, queue: make(chan replicationMessage, replicationQueueSize)}
+	go r.run()
+	return r
+}
+
+func (r *replicator) run() {
+	backoff := time.Second
+	for {
+		conn, err := net.DialTimeout("tcp", r.addr, 10*time.Second)
+		if err == nil {
+			if err = authenticate(conn, r.token, true); err != nil {
+				conn.Close()
+			}
+		}
+		if err != nil {
+			log.Printf("error connecting to standby: %s", err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > replicationMaxBackoff {
+				backoff = replicationMaxBackoff
+			}
+			continue
+		}
+		backoff = time.Second
+		r.mu.Lock()
+		r.conn = conn
+		r.mu.Unlock()
+		if err := r.stream(conn); err != nil {
+			log.Printf("error replicating to standby: %s", err)
+		}
+		r.mu.Lock()
+		r.conn = nil
+		r.mu.Unlock()
+		conn.Close()
+	}
+}
+
+// stream sends a snapshot followed by queued changes to conn.
+func (r *replicator) stream(conn net.Conn) error {
+	for len(r.queue) > 0 {
+		<-r.queue
+	}
+	m, err := r.snapshot()
+	if err != nil {
+		return err
+	}
+	enc := gob.NewEncoder(conn)
+	if err := enc.Encode(m); err != nil {
+		return err
+	}
+	log.Printf("replicating to %s (snapshot of %d bytes)", r.addr, len(m.Store))
+	for m := range r.queue {
+		if err := enc.Encode(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *replicator) send(m replicationMessage) {
+	if r == nil {
+		return
+	}
+	select {
+	case r.queue <- m:
+	default:
+		r.mu.Lock()
+		if r.conn != nil {
+			log.Printf("replication queue is full, resynchronizing standby")
+			r.conn.Close()
+		}
+		r.mu.Unlock()
+	}
+}
+
+// statements forwards the statements successfully executed in batch.
+func (r *replicator) statements(statements []sequence.Statement, result sequence.BatchResult) {
+	if r == nil {
+		return
+	}
+	// statements are copied since callers may reuse the slice
+	var errs []error
+	if result.HasErrors() {
+		errs = result.ErrorVars()
+	}
+	applied := make([]sequence.Statement, 0, len(statements))
+	for i, v := range statements {
+		if errs == nil || errs[i] == nil {
+			applied = append(applied, v)
+		}
+	}
+	if len(applied) > 0 {
+		r.send(replicationMessage{Statements: applied})
+	}
+}
+
+// snapshot returns a message holding the current store and metadata.
+func (s *server) snapshot() (replicationMessage, error) {
+	var m replicationMessage
+	var err error
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m.Store, err = s.store.Dump(); err != nil {
+		return m, err
+	}
+	m.Meta, err = s.meta.bytes()
+	return m, err
+}
+
+// standby listens on addr and applies the changes received from a primary sharing
+// token until ctx is done, closing the connections of primaries.
+func (s *server) standby(ctx context.Context, addr, token string) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("error listening for replication: %s", err)
+	}
+	log.Printf("listening for replication on %s", addr)
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	var wg sync.WaitGroup
+	for {
+		conn, err := l.Accept()
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			log.Printf("error accepting replication connection: %s", err)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// closing the connection stops the message being applied at the next read
+			done := make(chan struct{})
+			go func() {
+				select {
+				case <-ctx.Done():
+					conn.Close()
+				case <-done:
+				}
+			}()
+			if err := authenticate(conn, token, false); err != nil {
+				log.Printf("error authenticating replication from %s: %s", conn.RemoteAddr(), err)
+				conn.Close()
+			} else {
+				s.apply(conn)
+			}
+			close(done)
+		}()
+	}
+	wg.Wait()
+	log.Printf("replication listener on %s closed", addr)
+}
+
+func (s *server) apply(conn net.Conn) {
+	defer conn.Close()
+	log.Printf("receiving replication from %s", conn.RemoteAddr())
+	dec := gob.NewDecoder(conn)
+	for {
+		var m replicationMessage
+		if err := dec.Decode(&m); err != nil {
+			log.Printf("error receiving replication: %s", err)
+			return
+		}
+		if m.Store != nil {
+			s.mu.Lock()
+			err := s.store.Load(m.Store)
+			s.mu.Unlock()
+			if err != nil {
+				log.Printf("error loading replicated store: %s", err)
+				return
+			}
+			if err := s.meta.load(m.Meta); err != nil {
+				log.Printf("error loading replicated metadata: %s", err)
+			}
+			s.cache.reset()
+			s.replicator.send(m)
+		}
+		for _, v := range m.Created {
+			s.store.Create(v.Timestamp, v.Frequency, v.Key)
+		}
+		if len(m.Created) > 0 {
+			s.replicator.send(replicationMessage{Created: m.Created})
+		}
+		if len(m.Sequences) > 0 {
+			s.mu.Lock()
+			for k, v := range m.Sequences {
+				x, err := sequence.FromBytes(v)
+				if err != nil {
+					log.Printf("error decoding replicated sequence %s: %s", k, err)
+					continue
+				}
+				s.store.Add(k, x)
+				s.cache.invalidate(k)
+			}
+			s.replicator.send(replicationMessage{Sequences: m.Sequences})
+			s.mu.Unlock()
+		}
+		if len(m.Statements) > 0 {
+			s.mu.RLock()
+			result := s.store.Batch(m.Statements, s.replicator.statements)
+			s.cache.invalidateStatements(m.Statements)
+			s.mu.RUnlock()
+			s.touch(m.Statements, result)
+		}
+		for _, k := range m.Deleted {
+			s.deleteKey(k)
+		}
+	}
+}
+
+// authenticate proves to the peer of conn that both ends share token. Each end
+// sends a random nonce and answers the nonce of its peer with an HMAC-SHA256 digest
+// keyed by token and bound to its role, so that no change is applied from, nor any
+// snapshot sent to, a peer not knowing token.
+func authenticate(conn net.Conn, token string, primary bool) error {
+	conn.SetDeadline(time.Now().Add(replicationHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	nonce := make([]byte, replicationNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	if _, err := conn.Write(nonce); err != nil {
+		return err
+	}
+	peer := make([]byte, replicationNonceSize)
+	if _, err := io.ReadFull(conn, peer); err != nil {
+		return err
+	}
+	if _, err := conn.Write(replicationDigest(token, primary, peer)); err != nil {
+		return err
+	}
+	digest := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, digest); err != nil {
+		return err
+	}
+	if !hmac.Equal(digest, replicationDigest(token, !primary, nonce)) {
+		return errors.New("replication token does not match")
+	}
+	return nil
+}
+
+// replicationDigest returns the answer of the primary, or of the standby, to nonce.
+func replicationDigest(token string, primary bool, nonce []byte) []byte {
+	h := hmac.New(sha256.New, []byte(token))
+	if primary {
+		h.Write([]byte("primary"))
+	} else {
+		h.Write([]byte("standby"))
+	}
+	h.Write(nonce)
+	return h.Sum(nil)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAuthenticate(t *testing.T) {
+	tests := []struct {
+		name                 string
+		primary, standby     string
+		primaryOK, standbyOK bool
+	}{
+		{"same token", "secret", "secret", true, true},
+		{"different tokens", "secret", "other", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			standby := make(chan error, 1)
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					standby <- err
+					return
+				}
+				defer conn.Close()
+				standby <- authenticate(conn, tt.standby, false)
+			}()
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if err := authenticate(conn, tt.primary, true); (err == nil) != tt.primaryOK {
+				t.Errorf("expected primary authentication to succeed: %v, got error %v", tt.primaryOK, err)
+			}
+			if err := <-standby; (err == nil) != tt.standbyOK {
+				t.Errorf("expected standby authentication to succeed: %v, got error %v", tt.standbyOK, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// A report defines an availability summary of Keys (keys or subtree patterns)
+// computed at the end of each calendar period (daily, weekly or monthly, in the IANA
+// time zone Timezone, UTC by default) over the elapsed period. Reports are written to Directory and / or posted to URL
+// using Format (json or csv).
+type report struct {
+	Name        string   `json:"name"`
+	Schedule    string   `json:"schedule"`
+	Keys        []string `json:"keys"`
+	Format      string   `json:"format"`
+	Directory   string   `json:"directory"`
+	URL         string   `json:"url"`
+	Maintenance string   `json:"maintenance"`
+	Timezone    string   `json:"timezone"`
+}
+
+func (r report) validate() error {
+	switch {
+	case r.Name == "" || !validKey.MatchString(r.Name):
+		return errors.New("name is not valid")
+	case r.Schedule != "daily" && r.Schedule != "weekly" && r.Schedule != "monthly":
+		return errors.New("schedule is not valid")
+	case r.Format != "" && r.Format != "json" && r.Format != "csv":
+		return errors.New("format is not valid")
+	case r.Directory == "" && r.URL == "":
+		return errors.New("directory or url is required")
+	case len(r.Keys) == 0:
+		return errors.New("keys are required")
+	}
+	if _, err := time.LoadLocation(r.Timezone); err != nil {
+		return errors.New("timezone is not valid")
+	}
+	for _, k := range r.Keys {
+		if !validKey.MatchString(k) && !isSubtree(k) {
+			return fmt.Errorf("key %q is not valid", k)
+		}
+	}
+	if r.URL != "" {
+		u, err := url.Parse(r.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("url is not valid")
+		}
+	}
+	return nil
+}
+
+// period returns the start of the period of r containing t and the start of the
+// next period, days lasting 23 or 25 hours across daylight saving time changes.
+func (r report) period(t time.Time) (time.Time, time.Time) {
+	loc, err := time.LoadLocation(r.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	t = t.In(loc)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	switch r.Schedule {
+	case "weekly":
+		start := day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+		return start, start.AddDate(0, 0, 7)
+	case "monthly":
+		start := day.AddDate(0, 0, 1-day.Day())
+		return start, start.AddDate(0, 1, 0)
+	}
+	return day, day.AddDate(0, 0, 1)
+}
+
+// reportRow represents the availability of a key over the period of a report.
+type reportRow struct {
+	Key   string `json:"key"`
+	Start int64  `json:"start"`
+	End   int64  `json:"end"`
+	availability
+}
+
+// schedule generates r at the end of each period until ctx is done.
+func (s *server) schedule(ctx context.Context, r report) {
+	for {
+		_, next := r.period(time.Now())
+		t := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		start, _ := r.period(next.Add(-time.Second))
+		s.report(r, start, next.Add(-time.Second))
+	}
+}
+
+// report generates r over the closed interval [start, end], writing and / or
+// posting the result.
+func (s *server) report(r report, start, end time.Time) {
+	var keys []string
+	for _, k := range r.Keys {
+		if isSubtree(k) {
+			keys = append(keys, s.keys(k)...)
+			continue
+		}
+		keys = append(keys, k)
+	}
+
+	rows := make([]reportRow, 0, len(keys))
+	for _, k := range keys {
+		x, ok := s.get(k)
+		if !ok {
+			continue
+		}
+		frequency := int64(x.Frequency())
+		args := queryArgs{start: time.Unix(ceilInt64(start.Unix(), frequency), 0), end: end}
+		values, _ := s.values(k, x, args, r.Maintenance == "exclude")
+		var active, known int64
+		for _, v := range values {
+			switch v {
+			case sequence.StateActive:
+				active++
+				known++
+			case sequence.StateInactive:
+				known++
+			}
+		}
+		rows = append(rows, reportRow{Key: k, Start: start.Unix(), End: end.Unix(), availability: newAvailability(active, known, int64(len(values)))})
+	}
+
+	data, contentType, err := reportData(rows, r.Format)
+	if err != nil {
+		log.Printf("error serializing report %s: %s", r.Name, err)
+		return
+	}
+
+	if r.Directory != "" {
+		ext := "json"
+		if r.Format == "csv" {
+			ext = "csv"
+		}
+		f := filepath.Join(r.Directory, fmt.Sprintf("%s-%s.%s", r.Name, start.Format("20060102"), ext))
+		if err := os.WriteFile(f, data, 0660); err != nil {
+			log.Printf("error writing file: %s", err)
+		} else {
+			log.Printf("writing report %s to file (%d bytes)", r.Name, len(data))
+		}
+	}
+	if r.URL != "" {
+		if err := s.dispatcher.post(r.URL, contentType, data); err != nil {
+			log.Printf("error posting report %s: %s", r.Name, err)
+		}
+	}
+}
+
+// reportData returns the encoding of rows using format and its content type.
+func reportData(rows []reportRow, format string) ([]byte, string, error) {
+	if format != "csv" {
+		data, err := json.Marshal(rows)
+		return data, "application/json", err
+	}
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	w.Write([]string{"key", "start", "end", "active", "inactive", "unknown", "availability"})
+	for _, v := range rows {
+		var a string
+		if v.Availability != nil {
+			a = strconv.FormatFloat(*v.Availability, 'f', -1, 64)
+		}
+		w.Write([]string{
+			v.Key,
+			strconv.FormatInt(v.Start, 10),
+			strconv.FormatInt(v.End, 10),
+			strconv.FormatFloat(v.Active, 'f', -1, 64),
+			strconv.FormatFloat(v.Inactive, 'f', -1, 64),
+			strconv.FormatFloat(v.Unknown, 'f', -1, 64),
+			a,
+		})
+	}
+	w.Flush()
+	return b.Bytes(), "text/csv", w.Error()
+}
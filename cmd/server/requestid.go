@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+)
+
+// requestIDHeader is the header holding the ID of requests, set by clients or
+// generated by the server, and returned in responses.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the maximum length of the request IDs set by clients.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// requestID is the middleware assigning an ID to every request: the value of the
+// request ID header if valid, or a random ID. The ID is returned in the response
+// header, recorded in the context and in the header of the request, so that
+// requests forwarded to other servers keep it.
+func requestID(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+			r.Header.Set(requestIDHeader, id)
+		}
+		w.Header().Set(requestIDHeader, id)
+		h(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	}
+}
+
+// validRequestID reports whether id is a non-empty request ID of at most
+// maxRequestIDLength printable ASCII characters other than spaces.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random request ID of 16 hexadecimal characters.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestIDOf returns the ID of r, or an empty string for requests made by the
+// server.
+func requestIDOf(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// logf logs a message about request r, prefixed by the ID of r if any.
+func logf(r *http.Request, format string, v ...any) {
+	if id := requestIDOf(r); id != "" {
+		format = "[" + id + "] " + format
+	}
+	log.Output(2, fmt.Sprintf(format, v...))
+}
+
+// forwardRequestID copies the ID of r to req, a request made to another server on
+// behalf of r.
+func forwardRequestID(req, r *http.Request) {
+	if id := requestIDOf(r); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+}
+
+// dropRequestID removes the request ID header of the responses of proxied
+// requests, the ID being already set in the response of the server.
+func dropRequestID(proxy *httputil.ReverseProxy) {
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		resp.Header.Del(requestIDHeader)
+		return nil
+	}
+}
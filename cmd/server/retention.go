@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A retentionOverride defines the retention policy in days of the keys starting
+// with prefix.
+type retentionOverride struct {
+	prefix string
+	days   int
+}
+
+// retentionOverrides implements the flag.Value interface, parsing values formatted
+// as prefix=days.
+type retentionOverrides []retentionOverride
+
+func (r *retentionOverrides) String() string {
+	s := make([]string, len(*r))
+	for i, v := range *r {
+		s[i] = fmt.Sprintf("%s=%d", v.prefix, v.days)
+	}
+	return strings.Join(s, ",")
+}
+
+func (r *retentionOverrides) Set(value string) error {
+	p := strings.LastIndexByte(value, '=')
+	if p < 1 {
+		return errors.New("expected prefix=days")
+	}
+	days, err := strconv.Atoi(value[p+1:])
+	if err != nil {
+		return errors.New("expected prefix=days")
+	}
+	*r = append(*r, retentionOverride{prefix: value[:p], days: days})
+	return nil
+}
+
+// lookup returns the retention policy of key, using the longest matching prefix
+// or fallback if no override matches.
+func (r retentionOverrides) lookup(key string, fallback int) int {
+	days, n := fallback, -1
+	for _, v := range r {
+		if strings.HasPrefix(key, v.prefix) && len(v.prefix) > n {
+			days, n = v.days, len(v.prefix)
+		}
+	}
+	return days
+}
+
+// trim drops values older than the retention policy of each key, days being the
+// default policy. Policies of 0 or less days disable trimming. If rollup is greater
+// than 0, values of state sequences are downsampled into rollup sequences using
+// rollup as interval in seconds before being dropped.
+func (s *server) trim(days int, overrides retentionOverrides, rollup int64) {
+	now := time.Now()
+	keys := s.store.Keys()
+	// rollups outlive the retention policy, so that stores holding rollups of a
+	// previous run are trimmed key by key
+	if len(overrides) == 0 && rollup <= 0 && !hasRollups(keys) {
+		if days > 0 {
+			t := now.Add(-time.Duration(days) * 86400 * time.Second).Truncate(time.Duration(sequenceFrequency) * time.Second)
+			s.store.TrimLeft(t)
+			s.cache.reset()
+			s.audit(nil, auditTrim, s.keys("*"), fmt.Sprintf("values before %d dropped", t.Unix()))
+		}
+		return
+	}
+	var trimmed []string
+	for _, k := range keys {
+		if strings.Contains(k, rollupKeyInfix) {
+			continue
+		}
+		name := k
+		if i := strings.Index(k, internalKeySeparator); i != -1 {
+			name = k[:i]
+		}
+		d := overrides.lookup(name, days)
+		if d <= 0 {
+			continue
+		}
+		t := now.Add(-time.Duration(d) * 86400 * time.Second)
+		if rollup > 0 {
+			t = t.Truncate(time.Duration(rollup) * time.Second)
+		}
+		s.mu.Lock()
+		if x, ok := s.store.Get(k); ok {
+			if rollup > 0 && name == k {
+				s.rollup(k, x, t, rollup)
+			}
+			x.TrimLeft(t)
+			s.store.Add(k, x)
+			s.cache.invalidate(k)
+		}
+		s.mu.Unlock()
+		trimmed = append(trimmed, name)
+	}
+	if len(trimmed) > 0 {
+		s.audit(nil, auditTrim, seriesNames(trimmed), "values older than the retention policy of each key dropped")
+	}
+}
+
+// hasRollups reports whether keys hold the key of a rollup sequence.
+func hasRollups(keys []string) bool {
+	for _, k := range keys {
+		if strings.Contains(k, rollupKeyInfix) {
+			return true
+		}
+	}
+	return false
+}
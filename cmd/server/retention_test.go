@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+func TestTrimKeepsRollups(t *testing.T) {
+	s := &server{store: newShardedStore(2), cache: newQueryCache(0)}
+	start := time.Now().Add(-10 * 24 * time.Hour).Truncate(time.Hour)
+	for _, k := range []string{"eu.web", planeKey("eu.web", rollupKeyInfix, 0)} {
+		x := sequence.New(start, sequenceFrequency)
+		x.Add(start, sequence.StateActive)
+		s.store.Add(k, x)
+	}
+
+	s.trim(5, nil, 0)
+
+	x, _ := s.store.Get("eu.web")
+	if v := x.Timestamp(); v <= start.Unix() {
+		t.Fatalf("expected values of eu.web to be trimmed, first value at %d", v)
+	}
+	y, _ := s.store.Get(planeKey("eu.web", rollupKeyInfix, 0))
+	if v := y.Timestamp(); v != start.Unix() {
+		t.Fatalf("expected rollup values to be kept, first value at %d instead of %d", v, start.Unix())
+	}
+}
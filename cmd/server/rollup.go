@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// Rollups hold the percentage of active values of a sequence per rollup interval,
+// computed from values about to be trimmed by the retention policy. They are stored
+// as bit sequences, in the same way as gauges, and are not subject to retention.
+const (
+	rollupBits     = 7
+	rollupKeyInfix = "#r"
+)
+
+// rollupRow represents an aggregated group of rollup values.
+type rollupRow struct {
+	Date  int64    `json:"date"`
+	Count int64    `json:"count"`
+	Mean  *float64 `json:"mean"`
+}
+
+// rollup downsamples the values of x older than t into the rollup sequences of key,
+// using interval as rollup interval in seconds. Groups are aligned on interval and
+// t is expected to be a multiple of interval.
+func (s *server) rollup(key string, x *sequence.Sequence, t time.Time, interval int64) {
+	frequency := int64(x.Frequency())
+	if interval%frequency != 0 || t.Unix() <= x.Timestamp() {
+		return
+	}
+	values, ts, err := x.Values(time.Unix(x.Timestamp(), 0), t.Add(-time.Second))
+	if err != nil {
+		return
+	}
+	var statements []sequence.Statement
+	var sum, count int64
+	group := ts - ts%interval
+	flush := func() {
+		if count == 0 {
+			return
+		}
+		percent := (sum*100 + count/2) / count
+		for i := 0; i < rollupBits; i++ {
+			statements = append(statements, sequence.Statement{
+				Key:                 planeKey(key, rollupKeyInfix, i),
+				Timestamp:           time.Unix(group, 0),
+				Value:               uint8(percent>>i) & 1,
+				Type:                sequence.StatementAdd,
+				CreateIfNotExists:   true,
+				CreateWithTimestamp: time.Unix(group, 0),
+				CreateWithFrequency: uint16(interval),
+			})
+		}
+	}
+	for i, v := range values {
+		if g := ts + int64(i)*frequency; g-g%interval != group {
+			flush()
+			group, sum, count = g-g%interval, 0, 0
+		}
+		if v == sequence.StateUnknown {
+			continue
+		}
+		if v == sequence.StateActive {
+			sum++
+		}
+		count++
+	}
+	flush()
+	// groups already rolled up by a previous run are rejected by the store
+	s.store.Batch(statements, nil)
+}
+
+func (s *server) handlerQueryRollup(w http.ResponseWriter, r *http.Request, key string) {
+	planes, ok := s.planes(key, rollupKeyInfix, rollupBits)
+	if !ok {
+		writeError(w, http.StatusNotFound, errorKeyNotFound, "key does not exist")
+		return
+	}
+
+	frequency := int64(planes[0].Frequency())
+
+	args, err := newQueryArgs(r.FormValue("start"), r.FormValue("end"), frequency)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorInvalidRange, err.Error())
+		return
+	}
+
+	interval := int64(args.interval.Seconds())
+	rows := make([]rollupRow, (args.end.Unix()-args.start.Unix())/interval+1)
+	sums := make([]int64, len(rows))
+	for i := range rows {
+		rows[i].Date = args.start.Unix() + int64(i)*interval
+	}
+
+	values, ts, err := planeValues(planes, args.start, args.end)
+	if err == nil {
+		for i, v := range values {
+			if v < 0 {
+				continue
+			}
+			j := (ts - args.start.Unix() + int64(i)*frequency) / interval
+			rows[j].Count++
+			sums[j] += int64(v)
+		}
+	}
+
+	for i := range rows {
+		if rows[i].Count > 0 {
+			mean := float64(sums[i]) / float64(rows[i].Count) / 100
+			rows[i].Mean = &mean
+		}
+	}
+
+	data, err := json.Marshal(rows)
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+		logf(r, "error serializing rows: %s", err)
+		return
+	}
+
+	message := fmt.Sprintf("%d row(s) returned (interval %ds)", len(rows), interval)
+	writeResponse(w, http.StatusOK, statusOK, message, data)
+}
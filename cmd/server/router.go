@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backends implements the flag.Value interface, parsing backend base URLs.
+type backends []*url.URL
+
+func (b *backends) String() string {
+	s := make([]string, len(*b))
+	for i, v := range *b {
+		s[i] = v.String()
+	}
+	return strings.Join(s, ",")
+}
+
+func (b *backends) Set(value string) error {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url is not valid")
+	}
+	*b = append(*b, u)
+	return nil
+}
+
+// A router distributes keys across backends using a hash of the key, forwarding
+// requests to the backend owning the key and merging the results of requests
+// spanning multiple backends. It is also used to query federation peers.
+type router struct {
+	backends backends
+	proxies  []*httputil.ReverseProxy
+	client   *http.Client
+}
+
+func newRouter(b backends) *router {
+	rt := &router{backends: b, proxies: make([]*httputil.ReverseProxy, len(b)), client: &http.Client{Timeout: 30 * time.Second}}
+	for i, v := range b {
+		rt.proxies[i] = httputil.NewSingleHostReverseProxy(v)
+		dropRequestID(rt.proxies[i])
+		rt.proxies[i].ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			writeResponse(w, http.StatusBadGateway, statusError, "error forwarding request to backend", nil)
+			log.Printf("error forwarding request to backend: %s", err)
+		}
+	}
+	return rt
+}
+
+func (rt *router) register() {
+	handle(http.DefaultServeMux, "/insert/", rt.handlerStatements)
+	handle(http.DefaultServeMux, "/create/", rt.handlerStatements)
+	handle(http.DefaultServeMux, "/gauge/insert/", rt.handlerStatements)
+	handle(http.DefaultServeMux, "/counter/insert/", rt.handlerStatements)
+	handle(http.DefaultServeMux, "/query/", rt.handlerQuery)
+	handle(http.DefaultServeMux, "/export/", rt.handlerExport)
+	handle(http.DefaultServeMux, "/gauge/query/", rt.handlerKey)
+	handle(http.DefaultServeMux, "/counter/query/", rt.handlerKey)
+	handle(http.DefaultServeMux, "/longest/", rt.handlerKey)
+	handle(http.DefaultServeMux, "/maintenance/", rt.handlerMaintenance)
+	handle(http.DefaultServeMux, "/keys/", rt.handlerKeys)
+}
+
+// owner returns the index of the backend owning key.
+func (rt *router) owner(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(rt.backends)))
+}
+
+// backendResponse represents the response of a backend.
+type backendResponse struct {
+	Code    int             `json:"code"`
+	Status  string          `json:"status"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// do sends a request to backend i using method, the path and query string of r
+// and body, returning the decoded response.
+func (rt *router) do(i int, method string, r *http.Request, body []byte) (backendResponse, error) {
+	var x backendResponse
+	u := *rt.backends[i]
+	u.Path = strings.TrimSuffix(u.Path, "/") + r.URL.Path
+	u.RawQuery = r.URL.RawQuery
+	req, err := http.NewRequestWithContext(r.Context(), method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return x, err
+	}
+	req.Header.Set(federatedHeader, "1")
+	forwardRequestID(req, r)
+	if v := r.Header.Get("Authorization"); v != "" {
+		req.Header.Set("Authorization", v)
+	}
+	resp, err := rt.client.Do(req)
+	if err != nil {
+		return x, err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&x); err != nil {
+		return x, err
+	}
+	return x, nil
+}
+
+// fanout sends the request r to every backend, returning their responses and an
+// error naming the backends that cannot be reached, whose responses are omitted.
+func (rt *router) fanout(r *http.Request) ([]backendResponse, error) {
+	responses := make([]*backendResponse, len(rt.backends))
+	var wg sync.WaitGroup
+	for i := range rt.backends {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			x, err := rt.do(i, r.Method, r, nil)
+			if err != nil {
+				logf(r, "error forwarding request to %s: %s", rt.backends[i], err)
+				return
+			}
+			responses[i] = &x
+		}(i)
+	}
+	wg.Wait()
+	var result []backendResponse
+	var unreachable []string
+	for i, v := range responses {
+		if v == nil {
+			unreachable = append(unreachable, rt.backends[i].String())
+			continue
+		}
+		result = append(result, *v)
+	}
+	if unreachable != nil {
+		return result, fmt.Errorf("error forwarding request to %s", strings.Join(unreachable, ", "))
+	}
+	return result, nil
+}
+
+// handlerStatements splits line-based statements by owner, each line starting with
+// a key, and forwards them to the backends. Backends are asked for their rejected
+// statements, which are counted and reported using the lines of the request.
+func (rt *router) handlerStatements(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, statusError, "error reading request body", nil)
+		logf(r, "error reading request body: %s", err)
+		return
+	}
+
+	lines := bytes.Split(body, []byte("\n"))
+	rejected := newRejections(r, lines)
+
+	// lines of the statements of each backend
+	groups := make([][]int, len(rt.backends))
+	for i, line := range lines {
+		key := line
+		if p := bytes.IndexByte(line, ' '); p != -1 {
+			key = line[:p]
+		}
+		if !validKey.Match(key) {
+			logf(r, "error parsing statement %d: key is not valid", i+1)
+			rejected.add(i, "key is not valid")
+			continue
+		}
+		j := rt.owner(string(key))
+		groups[j] = append(groups[j], i)
+	}
+
+	q := r.URL.Query()
+	q.Set("verbose", "1")
+	fr := r.Clone(r.Context())
+	fr.URL.RawQuery = q.Encode()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i, v := range groups {
+		if len(v) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, v []int) {
+			defer wg.Done()
+			statements := make([][]byte, len(v))
+			for j, k := range v {
+				statements[j] = lines[k]
+			}
+			x, err := rt.do(i, http.MethodPost, fr, bytes.Join(statements, []byte("\n")))
+			var list []rejection
+			if err == nil && x.Code == http.StatusOK {
+				err = json.Unmarshal(x.Data, &list)
+			} else if err == nil {
+				err = errors.New(x.Message)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				logf(r, "error forwarding statements to %s: %s", rt.backends[i], err)
+				for _, k := range v {
+					rejected.add(k, "error forwarding statement to backend")
+				}
+				return
+			}
+			for _, y := range list {
+				if y.Line >= 1 && y.Line <= len(v) {
+					rejected.add(v[y.Line-1], y.Reason)
+				}
+			}
+		}(i, v)
+	}
+	wg.Wait()
+
+	n := len(rejected.accepted())
+	status := statusOK
+	if n != len(lines) {
+		status = statusWarning
+	}
+
+	writeResponse(w, http.StatusOK, status, fmt.Sprintf("processed %d/%d statement(s)", n, len(lines)), rejected.data())
+}
+
+// handlerKey forwards the request to the backend owning the key parameter of the
+// query string, the body being forwarded unread.
+func (rt *router) handlerKey(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		writeResponse(w, http.StatusBadRequest, statusError, "missing key", nil)
+		return
+	}
+	rt.proxies[rt.owner(key)].ServeHTTP(w, r)
+}
+
+// handlerMaintenance forwards maintenance windows, one statement per line, to the
+// backends owning their key, and lists the windows of a key.
+func (rt *router) handlerMaintenance(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		rt.handlerStatements(w, r)
+		return
+	}
+	rt.handlerKey(w, r)
+}
+
+func (rt *router) handlerQuery(w http.ResponseWriter, r *http.Request) {
+	if !isSubtree(r.URL.Query().Get("key")) {
+		rt.handlerKey(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	if r.FormValue("group") != "" {
+		writeError(w, http.StatusBadRequest, errorInvalidRequest, errGroupNotSupported.Error())
+		return
+	}
+	// results of backends are merged as JSON objects
+	if format, err := queryFormat(r); err != nil || format != formatJSON {
+		writeError(w, http.StatusBadRequest, errorInvalidRequest, "subtree queries spanning multiple backends only support the json format")
+		return
+	}
+	responses, err := rt.fanout(r)
+	if err != nil {
+		writeResponse(w, http.StatusBadGateway, statusError, err.Error(), nil)
+		return
+	}
+	merged := make(map[string]json.RawMessage)
+	for _, x := range responses {
+		if x.Code != http.StatusOK {
+			writeResponse(w, x.Code, x.Status, x.Message, nil)
+			return
+		}
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal(x.Data, &m); err != nil {
+			writeResponse(w, http.StatusBadGateway, statusError, "error merging backend responses", nil)
+			logf(r, "error merging backend responses: %s", err)
+			return
+		}
+		for k, v := range m {
+			merged[k] = v
+		}
+	}
+	data, err := json.Marshal(merged)
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+		logf(r, "error serializing query results: %s", err)
+		return
+	}
+	writeResponse(w, http.StatusOK, statusOK, fmt.Sprintf("%d key(s) returned", len(merged)), data)
+}
+
+// handlerExport forwards the request to the backend owning the requested keys.
+// Exports spanning multiple backends are not supported.
+func (rt *router) handlerExport(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeResponse(w, http.StatusBadRequest, statusError, "error parsing request", nil)
+		return
+	}
+	owner := -1
+	for _, k := range r.Form["key"] {
+		i := rt.owner(k)
+		if isSubtree(k) || (owner != -1 && i != owner) {
+			writeResponse(w, http.StatusBadRequest, statusError, "keys span multiple backends", nil)
+			return
+		}
+		owner = i
+	}
+	if owner == -1 {
+		writeResponse(w, http.StatusBadRequest, statusError, "missing key", nil)
+		return
+	}
+	rt.proxies[owner].ServeHTTP(w, r)
+}
+
+func (rt *router) handlerKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+		return
+	}
+	responses, err := rt.fanout(r)
+	if err != nil {
+		writeResponse(w, http.StatusBadGateway, statusError, err.Error(), nil)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		rt.mergeDeletions(w, r, responses)
+		return
+	}
+	var keys []string
+	for _, x := range responses {
+		if x.Code != http.StatusOK {
+			writeResponse(w, x.Code, x.Status, x.Message, nil)
+			return
+		}
+		var v []string
+		if err := json.Unmarshal(x.Data, &v); err != nil {
+			writeResponse(w, http.StatusBadGateway, statusError, "error merging backend responses", nil)
+			logf(r, "error merging backend responses: %s", err)
+			return
+		}
+		keys = append(keys, v...)
+	}
+	sort.Strings(keys)
+	if keys == nil {
+		keys = []string{}
+	}
+	data, err := json.Marshal(keys)
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+		logf(r, "error serializing keys: %s", err)
+		return
+	}
+	writeResponse(w, http.StatusOK, statusOK, fmt.Sprintf("%d key(s) returned", len(keys)), data)
+}
+
+// mergeDeletions writes the sum of the deletions of responses, the responses of the
+// backends to the delete request r.
+func (rt *router) mergeDeletions(w http.ResponseWriter, r *http.Request, responses []backendResponse) {
+	var total deletion
+	for _, x := range responses {
+		if x.Code != http.StatusOK {
+			writeResponse(w, x.Code, x.Status, x.Message, nil)
+			return
+		}
+		var v deletion
+		if err := json.Unmarshal(x.Data, &v); err != nil {
+			writeResponse(w, http.StatusBadGateway, statusError, "error merging backend responses", nil)
+			logf(r, "error merging backend responses: %s", err)
+			return
+		}
+		total.Keys += v.Keys
+		total.Values += v.Values
+	}
+	message := fmt.Sprintf("%d key(s) deleted", total.Keys)
+	if r.URL.Query().Get("start") != "" || r.URL.Query().Get("end") != "" {
+		message = fmt.Sprintf("%d value(s) deleted from %d key(s)", total.Values, total.Keys)
+	}
+	data, _ := json.Marshal(total)
+	writeResponse(w, http.StatusOK, statusOK, message, data)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Scopes granting read and write access to the tokens of the OpenID Connect
+// provider, set by -oidc-read-scope and -oidc-write-scope, and claim restricting
+// tokens to key prefixes, set by -oidc-prefix-claim. Access is not restricted by
+// scopes if they are not set, and the write scope grants read access.
+var (
+	oidcReadScope   string
+	oidcWriteScope  string
+	oidcPrefixClaim string
+)
+
+// scopes is the space separated list of scopes of a token, or an array of scopes
+// as used by some providers.
+type scopes []string
+
+func (x *scopes) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		*x = strings.Fields(s)
+		return nil
+	}
+	var v []string
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*x = v
+	return nil
+}
+
+// has reports whether x holds scope.
+func (x scopes) has(scope string) bool {
+	for _, v := range x {
+		if v == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// readPrefixes sets the key prefixes of c from the claim of payload named
+// oidcPrefixClaim, a string of comma separated prefixes or an array of prefixes.
+// A token holding the claim without prefixes cannot access any key.
+func (c *claims) readPrefixes(payload []byte) error {
+	if oidcPrefixClaim == "" {
+		return nil
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &m); err != nil {
+		return err
+	}
+	v, ok := m[oidcPrefixClaim]
+	if !ok {
+		return nil
+	}
+	var s string
+	if json.Unmarshal(v, &s) == nil {
+		c.Prefixes = splitList(s)
+	} else if err := json.Unmarshal(v, &c.Prefixes); err != nil {
+		return fmt.Errorf("claim %s is not valid", oidcPrefixClaim)
+	}
+	if c.Prefixes == nil {
+		c.Prefixes = []string{}
+	}
+	return nil
+}
+
+// canWrite reports whether c grants write access.
+func (c claims) canWrite() bool {
+	return oidcWriteScope == "" || c.Scope.has(oidcWriteScope) || c.Scp.has(oidcWriteScope)
+}
+
+// canRead reports whether c grants read access, granted to UI sessions as ID tokens
+// do not usually hold scopes.
+func (c claims) canRead() bool {
+	return oidcReadScope == "" || c.Session || c.Scope.has(oidcReadScope) || c.Scp.has(oidcReadScope) || (oidcWriteScope != "" && c.canWrite())
+}
+
+// allowsKey reports whether c grants access to key, or to the keys matching key if
+// key is a pattern, i.e. whether key starts with one of the prefixes of c.
+func (c claims) allowsKey(key []byte) bool {
+	if c.Prefixes == nil {
+		return true
+	}
+	for _, v := range c.Prefixes {
+		if bytes.HasPrefix(key, []byte(v)) {
+			return true
+		}
+	}
+	return false
+}
+
+type claimsKey struct{}
+
+// withClaims returns a copy of r holding c, the claims of the token authenticating
+// r.
+func withClaims(r *http.Request, c claims) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), claimsKey{}, c))
+}
+
+// tokenClaims returns the claims of the token authenticating r, if issued by the
+// OpenID Connect provider.
+func tokenClaims(r *http.Request) (claims, bool) {
+	c, ok := r.Context().Value(claimsKey{}).(claims)
+	return c, ok
+}
+
+// checkTokenKey returns the reason of the rejection of key, a key of the body of r,
+// if the token of r does not grant access to it, or an empty string.
+func checkTokenKey(r *http.Request, key []byte) string {
+	if c, ok := tokenClaims(r); ok && !c.allowsKey(key) {
+		return "key is not allowed by the token"
+	}
+	return ""
+}
+
+// keyEndpoints are the endpoints tokens restricted to key prefixes can use: the
+// endpoints selecting keys using the key parameter, and the endpoints holding keys
+// in their body (bodyKeys), whose statements are checked one by one.
+var keyEndpoints = map[string]bool{
+	"/insert/": true, "/create/": true, "/gauge/insert/": true, "/counter/insert/": true,
+	"/overwrite/": true, "/intervals/": true, "/import/": true, "/maintenance/": true,
+	"/query/": true, "/export/": true, "/sequence/": true, "/longest/": true, "/sla/": true,
+	"/gauge/query/": true, "/counter/query/": true, "/annotations/": true,
+	"/keys/": true, "/undelete/": true, "/stats/": true, "/memory/": true, "/top/": true,
+}
+
+// bodyKeys are the endpoints whose write requests hold keys in their body.
+var bodyKeys = map[string]bool{
+	"/insert/": true, "/create/": true, "/gauge/insert/": true, "/counter/insert/": true,
+	"/overwrite/": true, "/intervals/": true, "/import/": true, "/maintenance/": true,
+	"/annotations/": true,
+}
+
+// writes reports whether r, a request to the endpoint registered for path, requires
+// write access: requests other than GET and HEAD requests, except GraphQL and gRPC
+// queries, and requests to admin endpoints.
+func writes(path string, r *http.Request) bool {
+	switch {
+	case strings.HasPrefix(path, "/admin/"):
+		return true
+	case path == grpcService:
+		return strings.TrimPrefix(r.URL.Path, grpcService) == "Insert"
+	case path == "/graphql/":
+		return false
+	}
+	return r.Method != http.MethodGet && r.Method != http.MethodHead
+}
+
+// authorize is the hook rejecting the requests authenticated by a token of the
+// OpenID Connect provider that does not grant the access they require, or access
+// to the keys they select. Requests authenticated otherwise are not restricted.
+func authorize(path string) middleware {
+	if oidcAuth == nil || (oidcReadScope == "" && oidcWriteScope == "" && oidcPrefixClaim == "") {
+		return nil
+	}
+	return func(h http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			c, ok := tokenClaims(r)
+			if !ok {
+				h(w, r)
+				return
+			}
+			if writes(path, r) {
+				if !c.canWrite() {
+					writeError(w, http.StatusForbidden, errorForbidden, "token does not grant write access")
+					return
+				}
+			} else if !c.canRead() {
+				writeError(w, http.StatusForbidden, errorForbidden, "token does not grant read access")
+				return
+			}
+			if c.Prefixes != nil {
+				if reason := checkKeyParameters(path, r, c); reason != "" {
+					writeError(w, http.StatusForbidden, errorForbidden, reason)
+					return
+				}
+			}
+			h(w, r)
+		}
+	}
+}
+
+// checkKeyParameters returns the reason of the rejection of r, a request to the
+// endpoint registered for path authenticated by a token restricted to key prefixes,
+// if the endpoint cannot be restricted to keys or if r selects keys the token does
+// not grant access to, or an empty string. Requests holding keys in their body are
+// checked statement by statement instead, query expressions being rejected.
+func checkKeyParameters(path string, r *http.Request, c claims) string {
+	if !keyEndpoints[path] {
+		return "token restricted to key prefixes cannot use this endpoint"
+	}
+	// the body of insert requests is not parsed, keys being read from the query string
+	q := r.URL.Query()
+	if !bodyKeys[path] {
+		r.ParseForm()
+		q = r.Form
+	}
+	if q.Get("q") != "" {
+		return "token restricted to key prefixes cannot use query expressions"
+	}
+	keys := q["key"]
+	if len(keys) == 0 {
+		if bodyKeys[path] && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			return ""
+		}
+		return "token restricted to key prefixes requires a key"
+	}
+	for _, k := range keys {
+		if !c.allowsKey([]byte(k)) {
+			return "key is not allowed by the token"
+		}
+	}
+	return ""
+}
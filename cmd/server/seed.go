@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+var (
+	seedRegions  = []string{"eu", "us", "ap"}
+	seedServices = []string{"web", "api", "db", "cache"}
+)
+
+// seed populates the store with days of synthetic values for n demo keys, ending
+// at the current time, so that the UI can be evaluated without inserting data.
+// Values are generated using a fixed source, so that seeded stores are identical.
+func (s *server) seed(n, days int) {
+	rnd := rand.New(rand.NewSource(1))
+	end := time.Now().Truncate(sequenceFrequency * time.Second)
+	start := end.AddDate(0, 0, -days)
+	length := int(end.Sub(start)/(sequenceFrequency*time.Second)) + 1
+	for i := 0; i < n; i++ {
+		region := seedRegions[i%len(seedRegions)]
+		service := seedServices[i/len(seedRegions)%len(seedServices)]
+		key := fmt.Sprintf("demo.%s.%s.%02d", region, service, i/(len(seedRegions)*len(seedServices))+1)
+		s.store.Add(key, sequence.NewWithValues(start, sequenceFrequency, seedValues(rnd, length)))
+	}
+	log.Printf("seeding store with %d demo key(s) over %d day(s)", n, days)
+}
+
+// seedValues returns n values alternating between active periods and outages,
+// mostly inactive values and sometimes unknown values (agent not reporting). Keys
+// fail every one to seven days on average, one key out of ten flapping every few
+// hours.
+func seedValues(rnd *rand.Rand, n int) []uint8 {
+	mtbf := float64(86400*(1+rnd.Intn(7))) / sequenceFrequency
+	if rnd.Intn(10) == 0 {
+		mtbf = 3 * 3600 / sequenceFrequency
+	}
+	values := make([]uint8, n)
+	for i := 0; i < n; {
+		for up := int(rnd.ExpFloat64()*mtbf) + 1; up > 0 && i < n; up-- {
+			values[i] = sequence.StateActive
+			i++
+		}
+		state := uint8(sequence.StateInactive)
+		if rnd.Intn(4) == 0 {
+			state = sequence.StateUnknown
+		}
+		// outages last 20 minutes on average
+		for down := int(rnd.ExpFloat64()*1200/sequenceFrequency) + 1; down > 0 && i < n; down-- {
+			values[i] = state
+			i++
+		}
+	}
+	return values
+}
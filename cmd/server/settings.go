@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// settings represents the settings that can be changed at runtime by reloading
+// the configuration file.
+type settings struct {
+	dumpInterval int
+	retention    int
+	overrides    retentionOverrides
+	tokens       []string
+	quota        quota
+}
+
+// withConfig returns a copy of st overridden by the settings defined in c, except
+// for the settings whose flag is in set.
+func (st settings) withConfig(c *config, set map[string]bool) settings {
+	if c.DumpInterval != nil && !set["i"] {
+		st.dumpInterval = *c.DumpInterval
+	}
+	if c.Retention != nil && !set["r"] {
+		st.retention = *c.Retention
+	}
+	if c.RetentionOverrides != nil && !set["R"] {
+		st.overrides = nil
+		for k, v := range c.RetentionOverrides {
+			st.overrides = append(st.overrides, retentionOverride{prefix: k, days: v})
+		}
+		sort.Slice(st.overrides, func(i, j int) bool { return st.overrides[i].prefix < st.overrides[j].prefix })
+	}
+	if c.Tokens != nil {
+		st.tokens = c.Tokens
+	}
+	return st
+}
+
+// settings returns the current settings of s.
+func (s *server) settings() settings {
+	s.settingsMu.RLock()
+	defer s.settingsMu.RUnlock()
+	return s.current
+}
+
+// reload reads the configuration file f, if any, and applies the runtime settings
+// it defines on top of base, except for the flags in set, as well as alerting rules,
+// to s and its tenants.
+// The current configuration is kept if the file cannot be loaded.
+func (s *server) reload(f string, base settings, set map[string]bool) {
+	conf := &config{}
+	if f != "" {
+		var err error
+		if conf, err = loadConfig(f); err != nil {
+			log.Printf("error reloading configuration: %s", err)
+			return
+		}
+	}
+	s.settingsMu.Lock()
+	s.current = base.withConfig(conf, set)
+	s.settingsMu.Unlock()
+	s.alerts.setRules(conf.Rules)
+	for name, t := range s.tenants {
+		t.settingsMu.Lock()
+		t.current = base.withConfig(conf, set).withTenant(conf.Tenants[name])
+		t.settingsMu.Unlock()
+		t.alerts.setRules(conf.Rules)
+	}
+	log.Printf("reloading configuration (%d rule(s))", len(conf.Rules))
+}
+
+// auth returns a handler requiring a valid bearer token when tokens or an OpenID
+// Connect provider are configured, tokens issued by the provider being accepted as
+// well as the UI session of users logged in using the provider. The UI page only
+// requires a session if users log in using the provider, and static files and
+// login endpoints are always served.
+func (s *server) auth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tokens := s.settings().tokens
+		// raft RPCs are authenticated by the raft token
+		if (len(tokens) == 0 && oidcAuth == nil) || strings.HasPrefix(r.URL.Path, "/static/") || strings.HasPrefix(r.URL.Path, "/auth/") || (s.raft != nil && raftRPCs[r.URL.Path]) {
+			h(w, r)
+			return
+		}
+		if r.URL.Path == "/" {
+			if oidcAuth == nil || !oidcAuth.login() {
+				h(w, r)
+				return
+			}
+			if _, err := oidcAuth.authenticate(r); err != nil {
+				http.Redirect(w, r, "/auth/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+				return
+			}
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if ok {
+			for _, v := range tokens {
+				if subtle.ConstantTimeCompare([]byte(token), []byte(v)) == 1 {
+					h(w, r)
+					return
+				}
+			}
+		}
+		if oidcAuth != nil {
+			c, err := oidcAuth.authenticate(r)
+			if err == nil {
+				h(w, withClaims(r, c))
+				return
+			}
+			if ok {
+				logf(r, "error authenticating request: %s", err)
+			}
+		}
+		writeResponse(w, http.StatusUnauthorized, statusError, "unauthorized", nil)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// A shardedStore distributes keys across independent stores using a hash of their
+// name, so that batches on keys of different shards do not contend on a single
+// lock. Internal keys of a series (gauge, counter and rollup bit sequences) belong
+// to the shard of the series.
+type shardedStore struct {
+	shards []*sequence.Store
+	locks  []sync.Mutex // serialize batches of a shard with the changes they induce
+}
+
+func newShardedStore(n int) *shardedStore {
+	if n < 1 {
+		n = 1
+	}
+	s := &shardedStore{shards: make([]*sequence.Store, n), locks: make([]sync.Mutex, n)}
+	for i := range s.shards {
+		s.shards[i] = sequence.NewStore()
+	}
+	return s
+}
+
+// shard returns the index of the shard holding key.
+func (s *shardedStore) shard(key string) int {
+	if i := strings.Index(key, internalKeySeparator); i != -1 {
+		key = key[:i]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(s.shards)))
+}
+
+// Create creates a sequence using key as its identifier unless key exists,
+// reporting whether it was created. The shard is locked so that a concurrent
+// batch creating key is not replaced.
+func (s *shardedStore) Create(t time.Time, f uint16, key string) bool {
+	n := s.shard(key)
+	s.locks[n].Lock()
+	defer s.locks[n].Unlock()
+	if _, ok := s.shards[n].Get(key); ok {
+		return false
+	}
+	s.shards[n].New(t, f, key)
+	return true
+}
+
+// Add adds a copy of x using key as its identifier, replacing the existing one.
+func (s *shardedStore) Add(key string, x *sequence.Sequence) {
+	s.shards[s.shard(key)].Add(key, x)
+}
+
+// Delete removes key.
+func (s *shardedStore) Delete(key string) {
+	s.shards[s.shard(key)].Delete(key)
+}
+
+// Get returns a copy of the sequence of key.
+func (s *shardedStore) Get(key string) (*sequence.Sequence, bool) {
+	return s.shards[s.shard(key)].Get(key)
+}
+
+// GetAll returns copies of the sequences of keys, internal keys of a single series,
+// read while holding the lock of their shard so that a batch on these keys is not
+// observed half applied. It returns false if one of the keys does not exist.
+func (s *shardedStore) GetAll(keys []string) ([]*sequence.Sequence, bool) {
+	n := s.shard(keys[0])
+	s.locks[n].Lock()
+	defer s.locks[n].Unlock()
+	sequences := make([]*sequence.Sequence, len(keys))
+	for i, k := range keys {
+		x, ok := s.shards[n].Get(k)
+		if !ok {
+			return nil, false
+		}
+		sequences[i] = x
+	}
+	return sequences, true
+}
+
+// Query executes a query on the sequence of key.
+func (s *shardedStore) Query(key string, start, end time.Time, d time.Duration) (sequence.QuerySet, error) {
+	return s.shards[s.shard(key)].Query(key, start, end, d)
+}
+
+// Batch executes statements shard by shard. If apply is not nil, it is called with
+// the statements of each shard and their result while the shard is locked, so that
+// batches on a key are observed in the order they are executed.
+func (s *shardedStore) Batch(statements []sequence.Statement, apply func([]sequence.Statement, sequence.BatchResult)) sequence.BatchResult {
+	groups := make(map[int][]int)
+	for i, v := range statements {
+		n := s.shard(v.Key)
+		groups[n] = append(groups[n], i)
+	}
+	errs := make(batchErrors, len(statements))
+	for n, indexes := range groups {
+		x := statements
+		if len(groups) > 1 {
+			x = make([]sequence.Statement, len(indexes))
+			for i, j := range indexes {
+				x[i] = statements[j]
+			}
+		}
+		s.locks[n].Lock()
+		result := s.shards[n].Batch(x)
+		if apply != nil {
+			apply(x, result)
+		}
+		s.locks[n].Unlock()
+		if result.HasErrors() {
+			for i, err := range result.ErrorVars() {
+				errs[indexes[i]] = err
+			}
+		}
+	}
+	return errs
+}
+
+// Keys returns the identifiers of the sequences of every shard.
+func (s *shardedStore) Keys() []string {
+	var keys []string
+	for _, v := range s.shards {
+		keys = append(keys, v.Keys()...)
+	}
+	return keys
+}
+
+// Dump returns the sequences of every shard using the dump format of sequence.Store.
+func (s *shardedStore) Dump() ([]byte, error) {
+	var buf bytes.Buffer
+	err := s.DumpShards(func(data []byte) error {
+		buf.Write(data)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DumpShards calls f with the dump of each shard in turn, stopping at the first
+// error. Dumps of shards concatenated in order form a dump of the store.
+func (s *shardedStore) DumpShards(f func(data []byte) error) error {
+	for _, v := range s.shards {
+		data, err := v.Dump()
+		if err != nil {
+			return err
+		}
+		if err := f(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load replaces the content of the store using data, a dump. The store is left
+// unchanged if data cannot be loaded.
+func (s *shardedStore) Load(data []byte) error {
+	x := sequence.NewStore()
+	if err := loadDump(x, data); err != nil {
+		return err
+	}
+	for _, v := range s.shards {
+		v.Load(nil)
+	}
+	for _, k := range x.Keys() {
+		v, _ := x.Get(k)
+		s.Add(k, v)
+	}
+	return nil
+}
+
+// TrimLeft drops the values of every sequence older than t.
+func (s *shardedStore) TrimLeft(t time.Time) {
+	for _, v := range s.shards {
+		v.TrimLeft(t)
+	}
+}
+
+// batchErrors holds the error of each statement of a batch and implements the
+// sequence.BatchResult interface.
+type batchErrors []error
+
+func (b batchErrors) ErrorVars() []error {
+	return append([]error(nil), b...)
+}
+
+func (b batchErrors) HasErrors() bool {
+	for _, err := range b {
+		if err != nil {
+			return true
+		}
+	}
+	return false
+}
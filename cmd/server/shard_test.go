@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+func TestShardedStoreCreate(t *testing.T) {
+	s := newShardedStore(4)
+	now := time.Now().Truncate(time.Minute)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var created int
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				// inserts create missing keys using the default frequency
+				s.Batch([]sequence.Statement{{
+					Key:                 "eu.web",
+					Timestamp:           now,
+					Value:               sequence.StateActive,
+					Type:                sequence.StatementAdd,
+					CreateIfNotExists:   true,
+					CreateWithTimestamp: now,
+					CreateWithFrequency: sequenceFrequency,
+				}}, nil)
+				return
+			}
+			if s.Create(now, 60, "eu.web") {
+				mu.Lock()
+				created++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	x, ok := s.Get("eu.web")
+	if !ok {
+		t.Fatal("expected key eu.web")
+	}
+	if created > 1 {
+		t.Fatalf("expected key to be created at most once, created %d times", created)
+	}
+	if created == 1 && x.Frequency() != 60 {
+		t.Fatalf("expected frequency 60 of the created key, got %d", x.Frequency())
+	}
+	if s.Create(now, 60, "eu.web") {
+		t.Fatal("expected existing key not to be created")
+	}
+}
+
+func TestShardedStoreGetAll(t *testing.T) {
+	s := newShardedStore(4)
+	now := time.Now().Truncate(time.Minute)
+	keys := []string{"eu.web#g0", "eu.web#g1"}
+	if _, ok := s.GetAll(keys); ok {
+		t.Fatal("expected missing keys not to be found")
+	}
+	s.Create(now, 60, keys[0])
+	if _, ok := s.GetAll(keys); ok {
+		t.Fatal("expected partially missing keys not to be found")
+	}
+	s.Create(now, 60, keys[1])
+	x, ok := s.GetAll(keys)
+	if !ok || len(x) != 2 {
+		t.Fatalf("expected 2 sequences, got %d", len(x))
+	}
+}
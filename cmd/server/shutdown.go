@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// loops runs the auxiliary loops of the server (dumps, retention, expiry,
+// replication listener...) until shutdown, so that the final dump does not run
+// concurrently with them.
+type loops struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newLoops() *loops {
+	l := &loops{}
+	l.ctx, l.cancel = context.WithCancel(context.Background())
+	return l
+}
+
+// every calls fn every d until l is stopped.
+func (l *loops) every(d time.Duration, fn func()) {
+	l.run(func(ctx context.Context) {
+		t := time.NewTicker(d)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				fn()
+			}
+		}
+	})
+}
+
+// run calls fn in a goroutine, fn returning once ctx is done.
+func (l *loops) run(fn func(ctx context.Context)) {
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		fn(l.ctx)
+	}()
+}
+
+// stop stops the loops and waits for them to return, calls in progress (e.g. a
+// dump) completing first.
+func (l *loops) stop() {
+	l.cancel()
+	l.wg.Wait()
+}
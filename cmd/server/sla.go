@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// slaTotalKey is the key of the aggregate row of SLA reports encoded as CSV.
+const slaTotalKey = "*"
+
+// slaCSVHeader is the header of SLA reports encoded as CSV.
+var slaCSVHeader = []string{"key", "active", "inactive", "unknown", "availability", "downtime_minutes", "incidents"}
+
+// slaCounts holds the values of a key, or of a group of keys, counted over the
+// range of an SLA report.
+type slaCounts struct {
+	active, known, total int64
+	downtime             int64 // seconds of inactive values
+	incidents            int64 // runs of inactive values
+}
+
+// add adds the values of values, a sequence of frequency seconds, to c. Unknown
+// values do not end runs of inactive values, so that gaps of data during an outage
+// do not count as separate incidents.
+func (c *slaCounts) add(values []uint8, frequency int64) {
+	last := sequence.StateUnknown
+	for _, v := range values {
+		switch v {
+		case sequence.StateActive:
+			c.active++
+			c.known++
+		case sequence.StateInactive:
+			c.known++
+			c.downtime += frequency
+			if last != sequence.StateInactive {
+				c.incidents++
+			}
+		default:
+			continue
+		}
+		last = v
+	}
+	c.total += int64(len(values))
+}
+
+// merge adds the counts of x to c.
+func (c *slaCounts) merge(x slaCounts) {
+	c.active += x.active
+	c.known += x.known
+	c.total += x.total
+	c.downtime += x.downtime
+	c.incidents += x.incidents
+}
+
+// slaRow represents the availability, downtime and incidents of a key over the
+// range of an SLA report.
+type slaRow struct {
+	Key string `json:"key,omitempty"`
+	availability
+	DowntimeMinutes float64 `json:"downtime_minutes"`
+	Incidents       int64   `json:"incidents"`
+}
+
+func newSLARow(key string, c slaCounts) slaRow {
+	return slaRow{
+		Key:             key,
+		availability:    newAvailability(c.active, c.known, c.total),
+		DowntimeMinutes: math.Round(float64(c.downtime)/60*100) / 100,
+		Incidents:       c.incidents,
+	}
+}
+
+// slaReport represents an SLA report: a row per key and the aggregate of the keys,
+// computed from the values of all keys.
+type slaReport struct {
+	Start     int64    `json:"start"`
+	End       int64    `json:"end"`
+	Keys      []slaRow `json:"keys"`
+	Aggregate slaRow   `json:"aggregate"`
+}
+
+// handlerSLA returns the availability, the downtime and the number of incidents of
+// keys and subtree patterns over a range, for each key and in aggregate.
+func (s *server) handlerSLA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	format, err := queryFormat(r)
+	if err == nil && format == formatMsgpack {
+		err = errors.New("format is not supported")
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorInvalidRequest, err.Error())
+		return
+	}
+	selectors := r.Form["key"]
+	if len(selectors) == 0 {
+		writeError(w, http.StatusBadRequest, errorInvalidRequest, "key is required")
+		return
+	}
+	start, end, err := parseRange(r.FormValue("start"), r.FormValue("end"), 1)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorInvalidRange, err.Error())
+		return
+	}
+	hours, err := queryHours(r.FormValue("hours"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorInvalidRequest, err.Error())
+		return
+	}
+	exclude := r.FormValue("maintenance") == "exclude"
+
+	// keys selected by several selectors are reported once, in the order of the
+	// selectors
+	var keys []string
+	seen := make(map[string]bool)
+	named := make(map[string]bool)
+	for _, v := range selectors {
+		matches := []string{v}
+		if isSubtree(v) {
+			matches = s.keys(v)
+		} else {
+			named[v] = true
+		}
+		for _, k := range matches {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+
+	report := slaReport{Start: start.Unix(), End: end.Unix(), Keys: make([]slaRow, 0, len(keys))}
+	var total slaCounts
+	for _, k := range keys {
+		if err := r.Context().Err(); err != nil {
+			writeContextError(w, err)
+			return
+		}
+		x, ok := s.get(k)
+		if !ok {
+			// keys of subtree patterns may be deleted since listed
+			if !named[k] {
+				continue
+			}
+			writeError(w, http.StatusNotFound, errorKeyNotFound, fmt.Sprintf("key %s does not exist", k))
+			return
+		}
+		frequency := int64(x.Frequency())
+		args := queryArgs{start: time.Unix(ceilInt64(start.Unix(), frequency), 0), end: end, hours: hours}
+		values, _ := s.values(k, x, args, exclude)
+		var c slaCounts
+		c.add(values, frequency)
+		total.merge(c)
+		report.Keys = append(report.Keys, newSLARow(k, c))
+	}
+	report.Aggregate = newSLARow("", total)
+
+	message := fmt.Sprintf("%d key(s) returned", len(report.Keys))
+	if format == formatCSV {
+		writeSLACSV(w, r, report)
+		return
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+		logf(r, "error serializing SLA report: %s", err)
+		return
+	}
+	writeResponse(w, http.StatusOK, statusOK, message, data)
+}
+
+// writeSLACSV writes a successful response holding report encoded as CSV, a line
+// per key followed by the aggregate line, whose key is slaTotalKey.
+func writeSLACSV(w http.ResponseWriter, r *http.Request, report slaReport) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	c := csv.NewWriter(buf)
+	c.Write(slaCSVHeader)
+	for _, v := range append(report.Keys, report.Aggregate) {
+		key := v.Key
+		if key == "" {
+			key = slaTotalKey
+		}
+		var a string
+		if v.Availability != nil {
+			a = strconv.FormatFloat(*v.Availability, 'f', -1, 64)
+		}
+		c.Write([]string{
+			key,
+			strconv.FormatFloat(v.Active, 'f', -1, 64),
+			strconv.FormatFloat(v.Inactive, 'f', -1, 64),
+			strconv.FormatFloat(v.Unknown, 'f', -1, 64),
+			a,
+			strconv.FormatFloat(v.DowntimeMinutes, 'f', -1, 64),
+			strconv.FormatInt(v.Incidents, 10),
+		})
+	}
+	c.Flush()
+	if err := c.Error(); err != nil {
+		writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+		logf(r, "error serializing SLA report: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
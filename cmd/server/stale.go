@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+var (
+	staleAfter     time.Duration
+	staleOverrides staleTimeouts
+)
+
+// A staleTimeout defines the heartbeat timeout of the keys starting with prefix.
+type staleTimeout struct {
+	prefix  string
+	timeout time.Duration
+}
+
+// staleTimeouts implements the flag.Value interface, parsing values formatted as
+// prefix=duration.
+type staleTimeouts []staleTimeout
+
+func (t *staleTimeouts) String() string {
+	s := make([]string, len(*t))
+	for i, v := range *t {
+		s[i] = fmt.Sprintf("%s=%s", v.prefix, v.timeout)
+	}
+	return strings.Join(s, ",")
+}
+
+func (t *staleTimeouts) Set(value string) error {
+	p := strings.LastIndexByte(value, '=')
+	if p < 1 {
+		return errors.New("expected prefix=duration")
+	}
+	d, err := time.ParseDuration(value[p+1:])
+	if err != nil || d < 0 {
+		return errors.New("expected prefix=duration")
+	}
+	*t = append(*t, staleTimeout{prefix: value[:p], timeout: d})
+	return nil
+}
+
+// lookup returns the heartbeat timeout of key, using the longest matching prefix
+// or fallback if no override matches.
+func (t staleTimeouts) lookup(key string, fallback time.Duration) time.Duration {
+	d, n := fallback, -1
+	for _, v := range t {
+		if strings.HasPrefix(key, v.prefix) && len(v.prefix) > n {
+			d, n = v.timeout, len(v.prefix)
+		}
+	}
+	return d
+}
+
+// markStale records an unknown value in the previous interval for the keys that
+// did not receive inserts for at least their heartbeat timeout, so that the values
+// of keys whose agent stopped sending values become unknown instead of ending on
+// their last state. Timeouts of 0 disable staleness marking. Keys without recorded
+// activity, e.g. loaded from a dump, are considered active.
+func (s *server) markStale() {
+	now := time.Now()
+	var stale []string
+	s.activityMu.Lock()
+	for _, k := range s.keys("*") {
+		last, ok := s.activity[k]
+		if !ok {
+			s.activity[k] = now
+			continue
+		}
+		if d := staleOverrides.lookup(k, staleAfter); d > 0 && now.Sub(last) >= d {
+			stale = append(stale, k)
+		}
+	}
+	s.activityMu.Unlock()
+	if len(stale) == 0 {
+		return
+	}
+
+	// gauge and counter planes are marked without notifying watchers and alerts,
+	// which only handle state sequences
+	var statements, planes []sequence.Statement
+	for _, k := range stale {
+		for _, x := range sequenceKeys(k) {
+			if strings.Contains(x, rollupKeyInfix) {
+				continue
+			}
+			seq, ok := s.store.Get(x)
+			if !ok {
+				continue
+			}
+			// the current interval is left to the agent, values being append only
+			t := now.Add(-time.Duration(seq.Frequency()) * time.Second)
+			v := sequence.Statement{Key: x, Timestamp: t, Value: sequence.StateUnknown, Type: sequence.StatementAdd}
+			if x == k {
+				statements = append(statements, v)
+			} else {
+				planes = append(planes, v)
+			}
+		}
+	}
+	s.mu.RLock()
+	result := s.store.Batch(statements, s.replicator.statements)
+	s.store.Batch(planes, s.replicator.statements)
+	s.cache.invalidateStatements(statements)
+	s.cache.invalidateStatements(planes)
+	s.mu.RUnlock()
+	// activity is left untouched so that keys stay stale until inserts resume
+	s.notify(nil, statements, result)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// keyStats represents the storage statistics of a series, summed over its
+// sequences (e.g. gauge planes). Ratio is the number of raw values, stored as one
+// byte each, divided by the encoded size of the sequences. End is exclusive.
+type keyStats struct {
+	Key       string  `json:"key"`
+	Sequences int     `json:"sequences"`
+	Bytes     int     `json:"bytes"`
+	Runs      int     `json:"runs"`
+	Values    int     `json:"values"`
+	Ratio     float64 `json:"ratio"`
+	Start     int64   `json:"start"`
+	End       int64   `json:"end"`
+	Span      int64   `json:"span"`
+}
+
+// countRuns returns the number of runs of values sharing the same state.
+func countRuns(values []uint8) int {
+	var n int
+	for i, v := range values {
+		if i == 0 || v != values[i-1] {
+			n++
+		}
+	}
+	return n
+}
+
+// stats returns the storage statistics of the series key. The second return value
+// is false if no sequence belongs to key.
+func (s *server) stats(key string) (keyStats, bool) {
+	st := keyStats{Key: key}
+	for _, k := range sequenceKeys(key) {
+		x, ok := s.store.Get(k)
+		if !ok {
+			continue
+		}
+		values := x.All()
+		end := x.Timestamp() + int64(len(values))*int64(x.Frequency())
+		if st.Sequences == 0 || x.Timestamp() < st.Start {
+			st.Start = x.Timestamp()
+		}
+		if end > st.End {
+			st.End = end
+		}
+		st.Sequences++
+		st.Bytes += len(x.Bytes())
+		st.Runs += countRuns(values)
+		st.Values += len(values)
+	}
+	if st.Sequences == 0 {
+		return keyStats{}, false
+	}
+	if st.Bytes > 0 {
+		st.Ratio = float64(st.Values) / float64(st.Bytes)
+	}
+	st.Span = st.End - st.Start
+	return st, true
+}
+
+func (s *server) handlerStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	pattern := r.FormValue("key")
+	if pattern == "" {
+		pattern = "*"
+	}
+
+	rows := []keyStats{}
+	for _, k := range s.keys(pattern) {
+		if st, ok := s.stats(k); ok {
+			rows = append(rows, st)
+		}
+	}
+
+	switch r.FormValue("sort") {
+	case "", "key":
+	case "ratio":
+		// least compressed keys first
+		sort.SliceStable(rows, func(i, j int) bool { return rows[i].Ratio < rows[j].Ratio })
+	case "bytes":
+		sort.SliceStable(rows, func(i, j int) bool { return rows[i].Bytes > rows[j].Bytes })
+	default:
+		writeResponse(w, http.StatusBadRequest, statusError, "sort is not valid", nil)
+		return
+	}
+
+	data, err := json.Marshal(rows)
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+		logf(r, "error serializing key statistics: %s", err)
+		return
+	}
+	writeResponse(w, http.StatusOK, statusOK, fmt.Sprintf("%d key(s) returned", len(rows)), data)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+)
+
+// systemdFirstFD is the first file descriptor passed by systemd.
+const systemdFirstFD = 3
+
+// systemdListeners returns the listeners passed by systemd using socket activation,
+// if any. Environment variables are unset so they are not inherited.
+func systemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	listeners := make([]net.Listener, n)
+	for i := range listeners {
+		f := os.NewFile(uintptr(systemdFirstFD+i), "LISTEN_FD_"+strconv.Itoa(systemdFirstFD+i))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		listeners[i] = l
+	}
+	return listeners, nil
+}
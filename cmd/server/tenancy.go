@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultTenant is the name of the tenant serving requests without tenant, using
+// the dump and metadata files set by -f and -m.
+const defaultTenant = "default"
+
+// Requests select a tenant using tenantHeader or by prefixing the path of the
+// endpoint with tenantPrefix and the name of the tenant.
+const (
+	tenantHeader = "X-Tenant"
+	tenantPrefix = "/tenants/"
+)
+
+var validTenant = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// tenantNames holds the names of the tenants other than the default tenant.
+type tenantNames []string
+
+func (t *tenantNames) String() string {
+	return strings.Join(*t, ",")
+}
+
+func (t *tenantNames) Set(value string) error {
+	switch {
+	case !validTenant.MatchString(value):
+		return errors.New("tenant names must match " + validTenant.String())
+	case value == defaultTenant:
+		return errors.New("tenant name " + defaultTenant + " is reserved")
+	}
+	for _, v := range *t {
+		if v == value {
+			return errors.New("tenant is already declared")
+		}
+	}
+	*t = append(*t, value)
+	return nil
+}
+
+// A tenantConfig holds the settings of a tenant defined in the configuration file.
+type tenantConfig struct {
+	Retention          *int           `json:"retention"`
+	RetentionOverrides map[string]int `json:"retention_overrides"`
+	Tokens             []string       `json:"tokens"`
+	MaxKeys            int            `json:"max_keys"`
+	IngestRate         float64        `json:"ingest_rate"`
+	MaxQueryRange      int64          `json:"max_query_range"`
+}
+
+// withTenant returns a copy of st, the settings of the default tenant, overridden
+// by the settings and the quota of a tenant defined in c. Tokens of the default
+// tenant grant access to every tenant, the tokens of c being added to them.
+func (st settings) withTenant(c tenantConfig) settings {
+	if c.Retention != nil {
+		st.retention = *c.Retention
+	}
+	if c.RetentionOverrides != nil {
+		st.overrides = nil
+		for k, v := range c.RetentionOverrides {
+			st.overrides = append(st.overrides, retentionOverride{prefix: k, days: v})
+		}
+		sort.Slice(st.overrides, func(i, j int) bool { return st.overrides[i].prefix < st.overrides[j].prefix })
+	}
+	if len(c.Tokens) > 0 {
+		st.tokens = append(append([]string(nil), st.tokens...), c.Tokens...)
+	}
+	st.quota = quota{maxKeys: c.MaxKeys, ingestRate: c.IngestRate, maxRange: c.MaxQueryRange}
+	return st
+}
+
+// A tenant is the server holding the keys of a tenant other than the default
+// tenant, and the handler of its requests.
+type tenant struct {
+	*server
+	handler http.Handler
+}
+
+// newTenant returns the tenant name of s, the server of the default tenant, using
+// its own store, metadata, query results cache and files, named after the files of
+// s (e.g. store.name.dump). Replication, read replicas, peers, reports and seeding
+// only apply to the default tenant.
+func (s *server) newTenant(name string, shards, cacheSize int, conf *config, base settings, set map[string]bool) (*tenant, error) {
+	t := &server{
+		store:      newShardedStore(shards),
+		meta:       newMetadata(),
+		dumpFile:   tenantFile(s.dumpFile, name),
+		metaFile:   tenantFile(s.metaFile, name),
+		counters:   make(map[string]uint64),
+		activity:   make(map[string]time.Time),
+		queried:    make(map[string]time.Time),
+		alerts:     newAlerter(conf.Rules),
+		dispatcher: s.dispatcher,
+		cache:      newQueryCache(cacheSize << 20),
+		readOnly:   s.readOnly,
+		name:       name,
+		auditLog:   s.auditLog,
+	}
+	t.queryWorkers = s.queryWorkers
+	t.backfillWindow = s.backfillWindow
+	t.undeleteWindow = s.undeleteWindow
+	t.futurePolicy, t.futureSkew = s.futurePolicy, s.futureSkew
+	t.current = base.withConfig(conf, set).withTenant(conf.Tenants[name])
+
+	if err := t.loadStore(); err != nil {
+		return nil, err
+	}
+	if err := t.loadMeta(); err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	t.routes(mux)
+	return &tenant{server: t, handler: t.auth(mux.ServeHTTP)}, nil
+}
+
+// tenantFile returns the path of the file of tenant name corresponding to path, a
+// file of the default tenant.
+func tenantFile(path, name string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + name + ext
+}
+
+// servers returns s, the server of the default tenant, followed by the servers of
+// the other tenants sorted by name.
+func (s *server) servers() []*server {
+	names := make([]string, 0, len(s.tenants))
+	for k := range s.tenants {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	servers := []*server{s}
+	for _, v := range names {
+		servers = append(servers, s.tenants[v].server)
+	}
+	return servers
+}
+
+// tenancy returns a handler serving requests selecting a tenant using the tenant
+// header or the tenant path prefix with the handler of the tenant, the prefix
+// being removed, and other requests with h.
+func (s *server) tenancy(h http.HandlerFunc) http.HandlerFunc {
+	if len(s.tenants) == 0 {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.Header.Get(tenantHeader)
+		if rest, ok := strings.CutPrefix(r.URL.Path, tenantPrefix); ok {
+			prefixed, path, _ := strings.Cut(rest, "/")
+			if name != "" && name != prefixed {
+				writeError(w, http.StatusBadRequest, errorInvalidRequest, fmt.Sprintf("%s header does not match the tenant of the path", tenantHeader))
+				return
+			}
+			name = prefixed
+			u := *r.URL
+			u.Path, u.RawPath = "/"+path, ""
+			x := *r
+			x.URL = &u
+			r = &x
+		}
+		if name == "" || name == defaultTenant {
+			h(w, r)
+			return
+		}
+		t, ok := s.tenants[name]
+		if !ok {
+			writeError(w, http.StatusNotFound, errorTenantNotFound, "tenant does not exist")
+			return
+		}
+		t.handler.ServeHTTP(w, r)
+	}
+}
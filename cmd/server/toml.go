@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseTOML parses the subset of TOML used by configuration files: key / value
+// pairs, tables ([name]) and arrays of tables ([[name]]) with a single level of
+// nesting, tables nested in a table ([name.name]), strings, integers, floats, booleans and arrays (possibly spanning
+// multiple lines).
+func parseTOML(data []byte) (map[string]any, error) {
+	root := make(map[string]any)
+	current := root
+	lines := strings.Split(string(data), "\n")
+	for i := 0; i < len(lines); i++ {
+		n := i + 1
+		line := strings.TrimSpace(stripComment(lines[i]))
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "[["):
+			name := strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(line, "[["), "]]"))
+			if !strings.HasSuffix(line, "]]") || !validTOMLKey(name) {
+				return nil, fmt.Errorf("line %d: table name is not valid", n)
+			}
+			table := make(map[string]any)
+			switch x := root[name].(type) {
+			case nil:
+				root[name] = []any{table}
+			case []any:
+				if len(x) > 0 {
+					if _, ok := x[0].(map[string]any); !ok {
+						return nil, fmt.Errorf("line %d: key %s is already defined", n, name)
+					}
+				}
+				root[name] = append(x, table)
+			default:
+				return nil, fmt.Errorf("line %d: key %s is already defined", n, name)
+			}
+			current = table
+		case strings.HasPrefix(line, "["):
+			name := strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(line, "["), "]"))
+			parent, child, dotted := strings.Cut(name, ".")
+			if !strings.HasSuffix(line, "]") || !validTOMLKey(parent) || dotted && !validTOMLKey(child) {
+				return nil, fmt.Errorf("line %d: table name is not valid", n)
+			}
+			tables := root
+			if dotted {
+				// dotted names define tables nested in a parent table, created if needed
+				x, ok := root[parent].(map[string]any)
+				if _, defined := root[parent]; defined && !ok {
+					return nil, fmt.Errorf("line %d: key %s is already defined", n, parent)
+				}
+				if !ok {
+					x = make(map[string]any)
+					root[parent] = x
+				}
+				tables, name = x, child
+			}
+			if _, ok := tables[name]; ok {
+				return nil, fmt.Errorf("line %d: key %s is already defined", n, name)
+			}
+			table := make(map[string]any)
+			tables[name] = table
+			current = table
+		default:
+			key, rest, err := parseTOMLKey(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", n, err)
+			}
+			// arrays may span multiple lines
+			for strings.HasPrefix(rest, "[") && !balancedTOML(rest) && i+1 < len(lines) {
+				i++
+				rest += " " + strings.TrimSpace(stripComment(lines[i]))
+			}
+			value, rest, err := parseTOMLValue(rest)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", n, err)
+			}
+			if strings.TrimSpace(rest) != "" {
+				return nil, fmt.Errorf("line %d: unexpected %q", n, rest)
+			}
+			if _, ok := current[key]; ok {
+				return nil, fmt.Errorf("line %d: key %s is already defined", n, key)
+			}
+			current[key] = value
+		}
+	}
+	return root, nil
+}
+
+func validTOMLKey(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '_' && c != '-' && (c < '0' || c > '9') && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// stripComment removes the comment ending line, if any.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// balancedTOML reports whether the brackets of s, outside strings, are balanced.
+func balancedTOML(s string) bool {
+	var depth int
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		}
+	}
+	return depth <= 0
+}
+
+// parseTOMLKey parses a bare or quoted key followed by an equal sign, returning
+// the key and the remaining of the line.
+func parseTOMLKey(line string) (string, string, error) {
+	var key string
+	if strings.HasPrefix(line, `"`) || strings.HasPrefix(line, "'") {
+		v, rest, err := parseTOMLString(line)
+		if err != nil {
+			return "", "", err
+		}
+		key, line = v, rest
+	} else {
+		p := strings.IndexByte(line, '=')
+		if p == -1 {
+			return "", "", errors.New("expected key = value")
+		}
+		key, line = strings.TrimSpace(line[:p]), line[p:]
+		if !validTOMLKey(key) {
+			return "", "", errors.New("key is not valid")
+		}
+	}
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "=") {
+		return "", "", errors.New("expected key = value")
+	}
+	return key, strings.TrimSpace(line[1:]), nil
+}
+
+// parseTOMLValue parses the value starting s, returning the value and the remaining
+// of s.
+func parseTOMLValue(s string) (any, string, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "":
+		return nil, "", errors.New("missing value")
+	case s[0] == '"' || s[0] == '\'':
+		return parseTOMLString(s)
+	case s[0] == '[':
+		values := []any{}
+		s = strings.TrimSpace(s[1:])
+		for {
+			if strings.HasPrefix(s, "]") {
+				return values, s[1:], nil
+			}
+			v, rest, err := parseTOMLValue(s)
+			if err != nil {
+				return nil, "", err
+			}
+			values = append(values, v)
+			s = strings.TrimSpace(rest)
+			if strings.HasPrefix(s, ",") {
+				s = strings.TrimSpace(s[1:])
+			} else if !strings.HasPrefix(s, "]") {
+				return nil, "", errors.New("expected , or ]")
+			}
+		}
+	}
+	end := strings.IndexAny(s, ",] \t")
+	if end == -1 {
+		end = len(s)
+	}
+	token, rest := s[:end], s[end:]
+	switch token {
+	case "true":
+		return true, rest, nil
+	case "false":
+		return false, rest, nil
+	}
+	clean := strings.ReplaceAll(token, "_", "")
+	if v, err := strconv.ParseInt(clean, 10, 64); err == nil {
+		return v, rest, nil
+	}
+	if v, err := strconv.ParseFloat(clean, 64); err == nil {
+		return v, rest, nil
+	}
+	return nil, "", fmt.Errorf("value %q is not supported", token)
+}
+
+// parseTOMLString parses the basic or literal string starting s, returning the
+// string and the remaining of s.
+func parseTOMLString(s string) (string, string, error) {
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == quote:
+			return b.String(), s[i+1:], nil
+		case c == '\\' && quote == '"':
+			if i+1 == len(s) {
+				return "", "", errors.New("unterminated string")
+			}
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '"', '\\':
+				b.WriteByte(s[i])
+			default:
+				return "", "", fmt.Errorf("escape sequence \\%c is not supported", s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", "", errors.New("unterminated string")
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  map[string]any
+	}{
+		{"empty", "", map[string]any{}},
+		{"comments", "# comment\n\nretention = 30 # days\n", map[string]any{"retention": int64(30)}},
+		{"scalars", "a = \"x\"\nb = 'y'\nc = 1_000\nd = 0.5\ne = true\nf = false\ng = -3\n", map[string]any{
+			"a": "x", "b": "y", "c": int64(1000), "d": 0.5, "e": true, "f": false, "g": int64(-3),
+		}},
+		{"escapes", `a = "tab\tnew\nquote\"back\\"` + "\nb = 'C:\\path # not a comment'\n", map[string]any{
+			"a": "tab\tnew\nquote\"back\\", "b": `C:\path # not a comment`,
+		}},
+		{"quoted key", `"eu.web" = 30`, map[string]any{"eu.web": int64(30)}},
+		{"arrays", "a = []\nb = [1, 2, 3,]\nc = [[\"x\"], [\"y\", \"z\"]]\n", map[string]any{
+			"a": []any{}, "b": []any{int64(1), int64(2), int64(3)}, "c": []any{[]any{"x"}, []any{"y", "z"}},
+		}},
+		{"multiline array", "a = [\n  \"x\", # first\n  \"]\",\n]\nb = 1\n", map[string]any{
+			"a": []any{"x", "]"}, "b": int64(1),
+		}},
+		{"table", "a = 1\n[tokens]\nadmin = \"secret\"\n", map[string]any{
+			"a": int64(1), "tokens": map[string]any{"admin": "secret"},
+		}},
+		{"nested tables", "[tenants.acme]\nretention = 30\n[tenants.globex]\nretention = 60\n", map[string]any{
+			"tenants": map[string]any{
+				"acme":   map[string]any{"retention": int64(30)},
+				"globex": map[string]any{"retention": int64(60)},
+			},
+		}},
+		{"array of tables", "[[rules]]\nkey = \"a\"\n[[rules]]\nkey = \"b\"\n", map[string]any{
+			"rules": []any{map[string]any{"key": "a"}, map[string]any{"key": "b"}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTOML([]byte(tt.input))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected %#v, got %#v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		err   string
+	}{
+		{"missing equal sign", "a 1", "line 1: expected key = value"},
+		{"invalid key", "a.b = 1", "line 1: key is not valid"},
+		{"missing value", "a =", "line 1: missing value"},
+		{"unsupported value", "a = 1979-05-27", `line 1: value "1979-05-27" is not supported`},
+		{"trailing characters", "a = \"x\" y", `line 1: unexpected " y"`},
+		{"unterminated string", "a = \"x", "line 1: unterminated string"},
+		{"unsupported escape", `a = "\u0041"`, `line 1: escape sequence \u is not supported`},
+		{"unterminated array", "a = [1, 2", "line 1: expected , or ]"},
+		{"array separator", "a = [1 2]", "line 1: expected , or ]"},
+		{"duplicate key", "a = 1\na = 2", "line 2: key a is already defined"},
+		{"duplicate table", "[a]\n[a]", "line 2: key a is already defined"},
+		{"table over key", "a = 1\n[a]", "line 2: key a is already defined"},
+		{"nested table over key", "a = 1\n[a.b]", "line 2: key a is already defined"},
+		{"array of tables over table", "[a]\n[[a]]", "line 2: key a is already defined"},
+		{"array of tables over array", "a = [1]\n[[a]]", "line 2: key a is already defined"},
+		{"unclosed table", "[a", "line 1: table name is not valid"},
+		{"deep table", "[a.b.c]", "line 1: table name is not valid"},
+		{"unclosed array of tables", "[[a]", "line 1: table name is not valid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseTOML([]byte(tt.input))
+			if err == nil {
+				t.Fatalf("expected error %q, got none", tt.err)
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected error %q, got %q", tt.err, err)
+			}
+		})
+	}
+}
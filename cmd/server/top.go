@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+const (
+	defaultTopKeys   = 10
+	maxTopKeys       = 1000
+	defaultTopWindow = 24 * time.Hour
+)
+
+// topKey represents a key ranked by /top/ and its value for the requested
+// criterion: a size in bytes, a number of transitions or a Unix time.
+type topKey struct {
+	Key   string `json:"key"`
+	Value int64  `json:"value"`
+}
+
+// countTransitions returns the number of transitions between consecutive known
+// values, ignoring values before offset, unknown values being skipped.
+func countTransitions(values []uint8, offset int) int64 {
+	var n int64
+	last := sequence.StateUnknown
+	for i := offset; i < len(values); i++ {
+		v := values[i]
+		if v == sequence.StateUnknown {
+			continue
+		}
+		if last != sequence.StateUnknown && v != last {
+			n++
+		}
+		last = v
+	}
+	return n
+}
+
+// churn returns the number of transitions of the states of key recorded at or
+// after Unix time since. The second return value is false if key has no states.
+func (s *server) churn(key string, since int64) (int64, bool) {
+	x, ok := s.store.Get(key)
+	if !ok {
+		return 0, false
+	}
+	var offset int
+	if since > x.Timestamp() {
+		offset = int(ceilInt64(since-x.Timestamp(), int64(x.Frequency())) / int64(x.Frequency()))
+	}
+	values := x.All()
+	if offset > len(values) {
+		offset = len(values)
+	}
+	return countTransitions(values, offset), true
+}
+
+// handlerTop returns the n keys matching a pattern with the largest storage, the
+// most state transitions over a recent window or the most recent inserts.
+func (s *server) handlerTop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	pattern := r.FormValue("key")
+	if pattern == "" {
+		pattern = "*"
+	}
+	n := defaultTopKeys
+	if v := r.FormValue("n"); v != "" {
+		x, err := strconv.Atoi(v)
+		if err != nil || x < 1 || x > maxTopKeys {
+			writeResponse(w, http.StatusBadRequest, statusError, fmt.Sprintf("n must be between 1 and %d", maxTopKeys), nil)
+			return
+		}
+		n = x
+	}
+	window := defaultTopWindow
+	if v := r.FormValue("window"); v != "" {
+		x, err := time.ParseDuration(v)
+		if err != nil || x <= 0 {
+			writeResponse(w, http.StatusBadRequest, statusError, "window is not valid", nil)
+			return
+		}
+		window = x
+	}
+
+	rows := []topKey{}
+	keys := s.keys(pattern)
+	switch r.FormValue("by") {
+	case "", "bytes":
+		for _, k := range keys {
+			if st, ok := s.stats(k); ok {
+				rows = append(rows, topKey{Key: k, Value: int64(st.Bytes)})
+			}
+		}
+	case "transitions":
+		since := time.Now().Add(-window).Unix()
+		for _, k := range keys {
+			if x, ok := s.churn(k, since); ok {
+				rows = append(rows, topKey{Key: k, Value: x})
+			}
+		}
+	case "activity":
+		// keys without recorded inserts, e.g. loaded from a dump, are not ranked
+		s.activityMu.Lock()
+		for _, k := range keys {
+			if t, ok := s.activity[k]; ok {
+				rows = append(rows, topKey{Key: k, Value: t.Unix()})
+			}
+		}
+		s.activityMu.Unlock()
+	default:
+		writeResponse(w, http.StatusBadRequest, statusError, "by is not valid", nil)
+		return
+	}
+
+	// keys are listed in lexical order, ties being kept in that order
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].Value > rows[j].Value })
+	if len(rows) > n {
+		rows = rows[:n]
+	}
+
+	data, err := json.Marshal(rows)
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+		logf(r, "error serializing top keys: %s", err)
+		return
+	}
+	writeResponse(w, http.StatusOK, statusOK, fmt.Sprintf("%d key(s) returned", len(rows)), data)
+}
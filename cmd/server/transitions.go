@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// transitionsRow represents the number of known values and state transitions
+// of a group.
+type transitionsRow struct {
+	Date        int64 `json:"date"`
+	Count       int64 `json:"count"`
+	Transitions int64 `json:"transitions"`
+}
+
+// transitions counts the transitions between consecutive known values, starting at
+// Unix time ts and spaced by frequency seconds, grouped using args. Unknown values
+// are ignored and transitions are attributed to the group of the latest value.
+func transitions(values []uint8, ts, frequency int64, args queryArgs) []transitionsRow {
+	start, interval := args.start.Unix(), int64(args.interval.Seconds())
+	rows := make([]transitionsRow, (args.end.Unix()-start)/interval+1)
+	for i := range rows {
+		rows[i].Date = start + int64(i)*interval
+	}
+	last := sequence.StateUnknown
+	for i, v := range values {
+		if v == sequence.StateUnknown {
+			continue
+		}
+		j := (ts + int64(i)*frequency - start) / interval
+		if last != sequence.StateUnknown && v != last {
+			rows[j].Transitions++
+		}
+		rows[j].Count++
+		last = v
+	}
+	return rows
+}
+
+func (s *server) handlerQueryTransitions(w http.ResponseWriter, r *http.Request, key string) {
+	x, ok := s.get(key)
+	if !ok {
+		writeError(w, http.StatusNotFound, errorKeyNotFound, "key does not exist")
+		return
+	}
+
+	args, err := newQueryArgs(r.FormValue("start"), r.FormValue("end"), int64(x.Frequency()))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorInvalidRange, err.Error())
+		return
+	}
+	args.hours, err = queryHours(r.FormValue("hours"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errorInvalidRequest, err.Error())
+		return
+	}
+
+	values, ts := s.values(key, x, args, r.FormValue("maintenance") == "exclude")
+	rows := transitions(values, ts, int64(x.Frequency()), args)
+
+	data, err := json.Marshal(rows)
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+		logf(r, "error serializing rows: %s", err)
+		return
+	}
+
+	message := fmt.Sprintf("%d row(s) returned (interval %ds)", len(rows), int(args.interval.Seconds()))
+	writeResponse(w, http.StatusOK, statusOK, message, data)
+}
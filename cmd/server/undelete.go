@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// errKeyExists is returned when undeleting a key that was created again.
+var errKeyExists = errors.New("key already exists")
+
+// A tombstone holds a key deleted less than the undelete window ago, persisted with
+// metadata until it is purged or undeleted.
+type tombstone struct {
+	Deleted     int64        `json:"deleted"`
+	Sequences   []byte       `json:"sequences"` // dump of a store holding the sequences of the key
+	Maintenance []window     `json:"maintenance,omitempty"`
+	Annotations []annotation `json:"annotations,omitempty"`
+}
+
+// bury records the tombstone of key, replacing any previous tombstone.
+func (m *metadata) bury(key string, t tombstone) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Tombstones[key] = t
+}
+
+// exhume removes the tombstone of key and returns it.
+func (m *metadata) exhume(key string) (tombstone, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.Tombstones[key]
+	delete(m.Tombstones, key)
+	return t, ok
+}
+
+// tombstones returns the sorted keys of tombstones matching pattern and the time
+// they were deleted.
+func (m *metadata) tombstones(pattern string) ([]string, map[string]int64) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var keys []string
+	deleted := make(map[string]int64)
+	for k, v := range m.Tombstones {
+		if matchKey(k, pattern) {
+			keys = append(keys, k)
+			deleted[k] = v.Deleted
+		}
+	}
+	sort.Strings(keys)
+	return keys, deleted
+}
+
+// purgeTombstones removes the tombstones of the keys deleted at or before Unix time
+// t, returning their sorted keys.
+func (m *metadata) purgeTombstones(t int64) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var keys []string
+	for k, v := range m.Tombstones {
+		if v.Deleted <= t {
+			delete(m.Tombstones, k)
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// keyMetadata returns the maintenance windows and the annotations of key, global
+// annotations excluded.
+func (m *metadata) keyMetadata(key string) ([]window, []annotation) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var annotations []annotation
+	for _, v := range m.Annotations {
+		if v.Key == key {
+			annotations = append(annotations, v)
+		}
+	}
+	return append([]window(nil), m.Maintenance[key]...), annotations
+}
+
+// sequenceKeys returns the keys of the sequences that can belong to the series key.
+func sequenceKeys(key string) []string {
+	keys := []string{key}
+	for i := 0; i < gaugeBits; i++ {
+		keys = append(keys, planeKey(key, gaugeKeyInfix, i))
+	}
+	for i := 0; i < counterBits; i++ {
+		keys = append(keys, planeKey(key, counterKeyInfix, i))
+	}
+	for i := 0; i < rollupBits; i++ {
+		keys = append(keys, planeKey(key, rollupKeyInfix, i))
+	}
+	return keys
+}
+
+// softDeleteKey deletes the series key, keeping it in a tombstone for the undelete
+// window of s if it is enabled.
+func (s *server) softDeleteKey(key string) error {
+	if s.undeleteWindow <= 0 {
+		s.deleteKey(key)
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	store := sequence.NewStore()
+	for _, k := range sequenceKeys(key) {
+		if x, ok := s.store.Get(k); ok {
+			store.Add(k, x)
+		}
+	}
+	data, err := store.Dump()
+	if err != nil {
+		return err
+	}
+	t := tombstone{Deleted: time.Now().Unix(), Sequences: data}
+	t.Maintenance, t.Annotations = s.meta.keyMetadata(key)
+	s.meta.bury(key, t)
+	s.deleteKey(key)
+	return nil
+}
+
+// undeleteKey restores the series key from its tombstone.
+func (s *server) undeleteKey(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range sequenceKeys(key) {
+		if _, ok := s.store.Get(k); ok {
+			return errKeyExists
+		}
+	}
+	t, ok := s.meta.exhume(key)
+	if !ok {
+		return errKeyNotFound
+	}
+	store := sequence.NewStore()
+	if err := loadDump(store, t.Sequences); err != nil {
+		s.meta.bury(key, t)
+		return err
+	}
+	for _, k := range store.Keys() {
+		x, _ := store.Get(k)
+		s.store.Add(k, x)
+	}
+	for _, v := range t.Maintenance {
+		s.meta.addMaintenanceWindow(key, v)
+	}
+	s.meta.addAnnotations(t.Annotations...)
+	s.cache.invalidate(key)
+	return nil
+}
+
+// purge removes the tombstones older than the undelete window of s.
+func (s *server) purge() {
+	purged := s.meta.purgeTombstones(time.Now().Add(-s.undeleteWindow).Unix())
+	if len(purged) > 0 {
+		log.Printf("purging %d deleted key(s)", len(purged))
+		s.audit(nil, auditPurge, purged, fmt.Sprintf("%d deleted key(s) purged", len(purged)))
+	}
+}
+
+// deletedKey represents a deleted key that can be undeleted until purge.
+type deletedKey struct {
+	Key     string `json:"key"`
+	Deleted int64  `json:"deleted"`
+	Purge   int64  `json:"purge"`
+}
+
+func (s *server) handlerUndelete(w http.ResponseWriter, r *http.Request) {
+	pattern := r.FormValue("key")
+	if pattern == "" {
+		pattern = "*"
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		keys, deleted := s.meta.tombstones(pattern)
+		rows := make([]deletedKey, len(keys))
+		for i, k := range keys {
+			rows[i] = deletedKey{Key: k, Deleted: deleted[k], Purge: deleted[k] + int64(s.undeleteWindow.Seconds())}
+		}
+		data, err := json.Marshal(rows)
+		if err != nil {
+			writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+			logf(r, "error serializing deleted keys: %s", err)
+			return
+		}
+		writeResponse(w, http.StatusOK, statusOK, fmt.Sprintf("%d deleted key(s) returned", len(rows)), data)
+	case http.MethodPost:
+		if r.FormValue("key") == "" {
+			writeResponse(w, http.StatusBadRequest, statusError, "missing key", nil)
+			return
+		}
+		keys, _ := s.meta.tombstones(pattern)
+		if len(keys) == 0 {
+			writeError(w, http.StatusNotFound, errorKeyNotFound, "no deleted key matches key")
+			return
+		}
+		var undeleted []string
+		for _, k := range keys {
+			switch err := s.undeleteKey(k); err {
+			case nil:
+				undeleted = append(undeleted, k)
+			case errKeyExists, errKeyNotFound:
+				logf(r, "error undeleting key %s: %s", k, err)
+			default:
+				writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+				logf(r, "error undeleting key %s: %s", k, err)
+				return
+			}
+		}
+		if len(undeleted) == 0 {
+			writeError(w, http.StatusConflict, errorKeyExists, "deleted keys were created again")
+			return
+		}
+		if m, err := s.snapshot(); err != nil {
+			logf(r, "error replicating undeleted keys: %s", err)
+		} else {
+			s.replicator.send(m)
+		}
+		message := fmt.Sprintf("%d/%d key(s) undeleted", len(undeleted), len(keys))
+		s.audit(r, auditUndelete, undeleted, message)
+		status := statusOK
+		if len(undeleted) != len(keys) {
+			status = statusWarning
+		}
+		writeResponse(w, http.StatusOK, status, message, nil)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	upstreamTimeout         = 30 * time.Second
+	upstreamMaxCacheEntries = 4096
+	upstreamMaxCacheBody    = 1 << 20
+)
+
+// An upstreamResponse represents a response of the upstream server.
+type upstreamResponse struct {
+	code        int
+	contentType string
+	body        []byte
+	expires     time.Time
+}
+
+// An upstream forwards reads of keys missing from the store to another server
+// (e.g. the server holding the history of keys during a migration), caching
+// successful responses for ttl if it is positive.
+type upstream struct {
+	base   *url.URL
+	ttl    time.Duration
+	client *http.Client
+	mu     sync.Mutex
+	cache  map[string]upstreamResponse
+}
+
+func newUpstream(base *url.URL, ttl time.Duration) *upstream {
+	return &upstream{base: base, ttl: ttl, client: &http.Client{Timeout: upstreamTimeout}, cache: make(map[string]upstreamResponse)}
+}
+
+// get returns the cached response to the request identified by k, if any.
+func (u *upstream) get(k string) (upstreamResponse, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	x, ok := u.cache[k]
+	if ok && time.Now().After(x.expires) {
+		delete(u.cache, k)
+		return upstreamResponse{}, false
+	}
+	return x, ok
+}
+
+// put caches x as the response to the request identified by k. Expired responses
+// are dropped when the cache is full, x not being cached if it is still full.
+func (u *upstream) put(k string, x upstreamResponse) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.cache) >= upstreamMaxCacheEntries {
+		now := time.Now()
+		for k, v := range u.cache {
+			if now.After(v.expires) {
+				delete(u.cache, k)
+			}
+		}
+		if len(u.cache) >= upstreamMaxCacheEntries {
+			return
+		}
+	}
+	x.expires = time.Now().Add(u.ttl)
+	u.cache[k] = x
+}
+
+// fetch forwards r to the upstream server, forwarding its Authorization header.
+func (u *upstream) fetch(r *http.Request) (upstreamResponse, error) {
+	target := *u.base
+	target.Path = strings.TrimSuffix(target.Path, "/") + r.URL.Path
+	target.RawQuery = r.URL.RawQuery
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, target.String(), nil)
+	if err != nil {
+		return upstreamResponse{}, err
+	}
+	if v := r.Header.Get("Authorization"); v != "" {
+		req.Header.Set("Authorization", v)
+	}
+	if v := r.Header.Get("Accept"); v != "" {
+		req.Header.Set("Accept", v)
+	}
+	forwardRequestID(req, r)
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return upstreamResponse{}, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return upstreamResponse{}, err
+	}
+	return upstreamResponse{code: resp.StatusCode, contentType: resp.Header.Get("Content-Type"), body: body}, nil
+}
+
+// hasKey reports whether key, a series or a composite key, exists in the store.
+func (s *server) hasKey(key string) bool {
+	if _, ok := s.get(key); ok {
+		return true
+	}
+	for _, k := range sequenceKeys(key)[1:] {
+		if _, ok := s.store.Get(k); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// readThrough returns a handler forwarding GET requests on a single key missing
+// from the store to the upstream server.
+func (s *server) readThrough(h http.HandlerFunc) http.HandlerFunc {
+	if s.upstream == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || len(r.URL.Query()["key"]) != 1 {
+			h(w, r)
+			return
+		}
+		key := r.URL.Query().Get("key")
+		if key == "" || isSubtree(key) || s.hasKey(key) {
+			h(w, r)
+			return
+		}
+
+		k := r.URL.Path + "?" + r.URL.RawQuery + "\n" + r.Header.Get("Accept")
+		x, ok := s.upstream.get(k)
+		if !ok {
+			var err error
+			if x, err = s.upstream.fetch(r); err != nil {
+				writeError(w, http.StatusBadGateway, errorBadGateway, "error forwarding request to upstream server")
+				log.Printf("error forwarding request to upstream server: %s", err)
+				return
+			}
+			if x.code == http.StatusOK && s.upstream.ttl > 0 && len(x.body) <= upstreamMaxCacheBody {
+				s.upstream.put(k, x)
+			}
+		}
+		if x.contentType != "" {
+			w.Header().Set("Content-Type", x.contentType)
+		}
+		w.WriteHeader(x.code)
+		w.Write(x.body)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime/debug"
+	"strings"
+)
+
+// Build information set at link time, e.g. using
+//
+//	go build -ldflags "-X main.version=v1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Values that are not set are read from the build information embedded by the Go
+// toolchain, if available.
+var (
+	version   string
+	commit    string
+	buildDate string
+)
+
+// dumpFormatVersion is the version of the format of dump files, incremented when
+// dumps written by a release cannot be loaded by previous releases.
+const dumpFormatVersion = 1
+
+// A buildInfo describes the binary of the server. Sequence is the version of the
+// sequence package encoding the values of keys.
+type buildInfo struct {
+	Version    string `json:"version"`
+	Commit     string `json:"commit"`
+	BuildDate  string `json:"build_date"`
+	Modified   bool   `json:"modified"`
+	GoVersion  string `json:"go_version"`
+	Sequence   string `json:"sequence"`
+	DumpFormat int    `json:"dump_format"`
+}
+
+// readBuildInfo returns the build information of the binary, values set at link
+// time taking precedence.
+func readBuildInfo() buildInfo {
+	b := buildInfo{Version: version, Commit: commit, BuildDate: buildDate, DumpFormat: dumpFormatVersion}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return b
+	}
+	b.GoVersion = info.GoVersion
+	if b.Version == "" {
+		b.Version = info.Main.Version
+	}
+	for _, v := range info.Settings {
+		switch {
+		case v.Key == "vcs.revision" && b.Commit == "":
+			b.Commit = v.Value
+		case v.Key == "vcs.time" && b.BuildDate == "":
+			b.BuildDate = v.Value
+		case v.Key == "vcs.modified":
+			b.Modified = v.Value == "true"
+		}
+	}
+	for _, v := range info.Deps {
+		if strings.HasPrefix(v.Path, "github.com/geofduf/run-length") {
+			b.Sequence = v.Version
+		}
+	}
+	return b
+}
+
+func handlerVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	b := readBuildInfo()
+	data, err := json.Marshal(b)
+	if err != nil {
+		writeResponse(w, http.StatusInternalServerError, statusError, "an unexpected error occurred", nil)
+		logf(r, "error serializing build information: %s", err)
+		return
+	}
+	writeResponse(w, http.StatusOK, statusOK, "version "+b.Version, data)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// watchBufferSize is the number of values a watcher can lag behind before being
+// dropped.
+const watchBufferSize = 1024
+
+// A watchEvent represents a value applied to a key.
+type watchEvent struct {
+	key   string
+	time  int64
+	state uint8
+}
+
+// A watcher receives the values applied to the keys matching its pattern. Its
+// channel is closed if it falls behind by more than watchBufferSize values.
+type watcher struct {
+	pattern string
+	events  chan watchEvent
+}
+
+// A watchHub dispatches the values applied by insert requests to watchers.
+type watchHub struct {
+	mu       sync.Mutex
+	watchers map[*watcher]bool
+}
+
+// watch registers a watcher of the keys matching pattern, a key or a subtree.
+func (h *watchHub) watch(pattern string) *watcher {
+	x := &watcher{pattern: pattern, events: make(chan watchEvent, watchBufferSize)}
+	h.mu.Lock()
+	if h.watchers == nil {
+		h.watchers = make(map[*watcher]bool)
+	}
+	h.watchers[x] = true
+	h.mu.Unlock()
+	return x
+}
+
+// stop unregisters x.
+func (h *watchHub) stop(x *watcher) {
+	h.mu.Lock()
+	if h.watchers[x] {
+		delete(h.watchers, x)
+		close(x.events)
+	}
+	h.mu.Unlock()
+}
+
+// publish sends the statements applied by a batch to the watchers of their key,
+// errs holding the error of each statement or being nil if none failed.
+func (h *watchHub) publish(statements []sequence.Statement, errs []error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.watchers) == 0 {
+		return
+	}
+	for i, v := range statements {
+		if errs != nil && errs[i] != nil {
+			continue
+		}
+		for x := range h.watchers {
+			if !matchKey(v.Key, x.pattern) {
+				continue
+			}
+			select {
+			case x.events <- watchEvent{key: v.Key, time: v.Timestamp.Unix(), state: v.Value}:
+			default:
+				delete(h.watchers, x)
+				close(x.events)
+			}
+		}
+	}
+}
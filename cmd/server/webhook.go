@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/geofduf/run-length/sequence"
+)
+
+// Notification types.
+const (
+	notificationTransition = "transition"
+	notificationAlert      = "alert"
+)
+
+const (
+	notificationQueueSize   = 1024
+	notificationMaxAttempts = 5
+	webhookTimeout          = 10 * time.Second
+)
+
+// A webhook defines a URL receiving notifications as JSON payloads. Events lists
+// the types of notifications sent to the URL, all types being sent if empty.
+type webhook struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+func (h webhook) validate() error {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url is not valid")
+	}
+	for _, v := range h.Events {
+		if v != notificationTransition && v != notificationAlert {
+			return fmt.Errorf("event %q is not valid", v)
+		}
+	}
+	return nil
+}
+
+// accepts reports whether notifications of type t are sent to h.
+func (h webhook) accepts(t string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, v := range h.Events {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+// A transition represents a change of state of a key.
+type transition struct {
+	Key  string `json:"key"`
+	Time int64  `json:"time"`
+	From uint8  `json:"from"`
+	To   uint8  `json:"to"`
+}
+
+// A notification represents the payload sent to webhooks.
+type notification struct {
+	Type       string      `json:"type"`
+	Transition *transition `json:"transition,omitempty"`
+	Alert      *alertEvent `json:"alert,omitempty"`
+}
+
+// lastValue represents the most recent value of a key.
+type lastValue struct {
+	ts    int64
+	value uint8
+}
+
+// A dispatcher detects state transitions and delivers notifications to webhooks.
+// Each webhook has its own queue, notifications being dropped when it is full.
+type dispatcher struct {
+	webhooks    []webhook
+	queues      []chan []byte
+	client      *http.Client
+	transitions bool // whether any webhook accepts transitions
+	notifiers   map[string]*notifier
+	mu          sync.Mutex
+	last        map[string]lastValue
+}
+
+func newDispatcher(webhooks []webhook, notifiers []notifierConfig) *dispatcher {
+	d := &dispatcher{
+		webhooks:  webhooks,
+		queues:    make([]chan []byte, len(webhooks)),
+		client:    &http.Client{Timeout: webhookTimeout},
+		notifiers: make(map[string]*notifier),
+		last:      make(map[string]lastValue),
+	}
+	for _, v := range notifiers {
+		d.notifiers[v.Name] = newNotifier(v, d)
+	}
+	for i, h := range webhooks {
+		d.queues[i] = make(chan []byte, notificationQueueSize)
+		d.transitions = d.transitions || h.accepts(notificationTransition)
+		u := h.URL
+		go deliver(u, d.queues[i], func(payload []byte) error {
+			return d.post(u, "application/json", payload)
+		})
+	}
+	return d
+}
+
+// observe records value as the value of key at Unix time ts, returning the
+// resulting transition if any. Values older than the most recent value of key are
+// ignored.
+func (d *dispatcher) observe(key string, ts int64, value uint8) *transition {
+	if !d.transitions {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	x, ok := d.last[key]
+	if ok && ts < x.ts {
+		return nil
+	}
+	d.last[key] = lastValue{ts: ts, value: value}
+	if !ok || x.value == value {
+		return nil
+	}
+	return &transition{Key: key, Time: ts, From: x.value, To: value}
+}
+
+// forget drops the most recent value of key.
+func (d *dispatcher) forget(key string) {
+	d.mu.Lock()
+	delete(d.last, key)
+	d.mu.Unlock()
+}
+
+// send queues n for delivery to the webhooks accepting its type.
+func (d *dispatcher) send(n notification) {
+	var payload []byte
+	for i, h := range d.webhooks {
+		if !h.accepts(n.Type) {
+			continue
+		}
+		if payload == nil {
+			var err error
+			if payload, err = json.Marshal(n); err != nil {
+				log.Printf("error serializing notification: %s", err)
+				return
+			}
+		}
+		select {
+		case d.queues[i] <- payload:
+		default:
+			log.Printf("error queuing notification: queue of webhook %s is full", h.URL)
+		}
+	}
+}
+
+// alert sends e to the webhooks accepting alerts and to the notifiers selected by
+// its rule.
+func (d *dispatcher) alert(e alertEvent) {
+	d.send(notification{Type: notificationAlert, Alert: &e})
+	for _, v := range e.notify {
+		if n, ok := d.notifiers[v]; ok {
+			n.alert(e)
+		}
+	}
+}
+
+// deliver sends the payloads received from queue to target using send, retrying
+// failed attempts with exponential backoff.
+func deliver(target string, queue chan []byte, send func([]byte) error) {
+	for payload := range queue {
+		backoff := time.Second
+		for attempt := 1; ; attempt++ {
+			err := send(payload)
+			if err == nil {
+				break
+			}
+			if attempt == notificationMaxAttempts {
+				log.Printf("error delivering notification to %s, giving up after %d attempt(s): %s", target, attempt, err)
+				break
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+func (d *dispatcher) post(u, contentType string, payload []byte) error {
+	resp, err := d.client.Post(u, contentType, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// notify detects transitions and evaluates alerting rules using the values of
+// statements successfully executed in batch by r, sending the resulting
+// notifications and the values to the watchers of their key. Values of raft
+// entries replayed at startup are not notified, and only the leader proposing an
+// entry detects transitions and evaluates alerting rules.
+func (s *server) notify(r *http.Request, statements []sequence.Statement, result sequence.BatchResult) {
+	if raftReplayed(r) {
+		return
+	}
+	var errs []error
+	if result.HasErrors() {
+		errs = result.ErrorVars()
+	}
+	s.watchers.publish(statements, errs)
+	if !raftEffects(r) {
+		return
+	}
+	for i, v := range statements {
+		if errs != nil && errs[i] != nil {
+			continue
+		}
+		ts := v.Timestamp.Unix()
+		if t := s.dispatcher.observe(v.Key, ts, v.Value); t != nil {
+			s.dispatcher.send(notification{Type: notificationTransition, Transition: t})
+		}
+		for _, e := range s.alerts.observe(v.Key, ts, v.Value) {
+			log.Printf("alert %s: rule %s, key %s", e.Status, e.Rule, e.Key)
+			s.dispatcher.alert(e)
+		}
+	}
+}